@@ -0,0 +1,187 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-7 16:52:08
+@Description: Stability checks of the exported API
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var updateAPI = flag.Bool("update-api", false, "rewrite testdata/api.txt with the current stable API")
+
+// stableAPI lists the exported declarations of the package, one per line,
+// as compiled for linux/amd64 without build tags. Declarations documented as
+// experimental are listed separately.
+func stableAPI(t *testing.T) (stable, experimental []string) {
+	ctx := build.Default
+	ctx.GOOS, ctx.GOARCH, ctx.BuildTags = "linux", "amd64", nil
+	pkg, err := ctx.ImportDir(".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fset := token.NewFileSet()
+	render := func(node any) string {
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, node); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(strings.Fields(buf.String()), " ")
+	}
+	add := func(doc *ast.CommentGroup, line string) {
+		if doc != nil && strings.HasPrefix(doc.Text(), "Experimental:") {
+			experimental = append(experimental, line)
+		} else {
+			stable = append(stable, line)
+		}
+	}
+
+	for _, name := range pkg.GoFiles {
+		f, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, name), nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if !d.Name.IsExported() {
+					continue
+				}
+				recv := ""
+				if d.Recv != nil {
+					typ := d.Recv.List[0].Type
+					base := typ
+					if star, ok := base.(*ast.StarExpr); ok {
+						base = star.X
+					}
+					if id, ok := base.(*ast.Ident); !ok || !id.IsExported() {
+						continue
+					}
+					recv = "(" + render(typ) + ") "
+				}
+				add(d.Doc, "func "+recv+d.Name.Name+strings.TrimPrefix(render(d.Type), "func"))
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					doc := d.Doc
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if !s.Name.IsExported() {
+							continue
+						}
+						if s.Doc != nil {
+							doc = s.Doc
+						}
+						addType(s, doc, render, add)
+					case *ast.ValueSpec:
+						if s.Doc != nil {
+							doc = s.Doc
+						}
+						for _, n := range s.Names {
+							if !n.IsExported() {
+								continue
+							}
+							line := d.Tok.String() + " " + n.Name
+							if s.Type != nil {
+								line += " " + render(s.Type)
+							}
+							add(doc, line)
+						}
+					}
+				}
+			}
+		}
+	}
+	slices.Sort(stable)
+	slices.Sort(experimental)
+	return slices.Compact(stable), slices.Compact(experimental)
+}
+
+// addType lists a type, and the exported fields and methods of structs and interfaces
+func addType(s *ast.TypeSpec, doc *ast.CommentGroup, render func(any) string, add func(*ast.CommentGroup, string)) {
+	name := s.Name.Name
+	switch typ := s.Type.(type) {
+	case *ast.StructType:
+		add(doc, "type "+name+" struct")
+		for _, field := range typ.Fields.List {
+			for _, n := range field.Names {
+				if n.IsExported() {
+					add(field.Doc, "field "+name+"."+n.Name+" "+render(field.Type))
+				}
+			}
+			if len(field.Names) == 0 {
+				add(field.Doc, "embedded "+name+" "+render(field.Type))
+			}
+		}
+	case *ast.InterfaceType:
+		add(doc, "type "+name+" interface")
+		for _, m := range typ.Methods.List {
+			for _, n := range m.Names {
+				add(m.Doc, "method "+name+"."+n.Name+strings.TrimPrefix(render(m.Type), "func"))
+			}
+			if len(m.Names) == 0 {
+				add(m.Doc, "embedded "+name+" "+render(m.Type))
+			}
+		}
+	default:
+		assign := " "
+		if s.Assign.IsValid() {
+			assign = " = "
+		}
+		add(doc, "type "+name+assign+render(s.Type))
+	}
+}
+
+// TestAPIStability 测试稳定的导出接口没有被意外修改，实验性的接口不受限制。
+// 有意修改稳定接口时使用 go test -run TestAPIStability -update-api 更新 testdata/api.txt
+func TestAPIStability(t *testing.T) {
+	stable, experimental := stableAPI(t)
+	golden := filepath.Join("testdata", "api.txt")
+	current := strings.Join(stable, "\n") + "\n"
+	if *updateAPI {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, []byte(current), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for _, line := range want {
+		if _, found := slices.BinarySearch(stable, line); !found {
+			t.Errorf("stable API removed or changed: %s", line)
+		}
+	}
+	for _, line := range stable {
+		if _, found := slices.BinarySearch(want, line); !found {
+			t.Errorf("stable API added, update testdata/api.txt or document it as experimental: %s", line)
+		}
+	}
+
+	// 实验性的声明不能进入稳定接口列表
+	for _, line := range experimental {
+		if _, found := slices.BinarySearch(want, line); found {
+			t.Errorf("experimental declaration listed as stable: %s", line)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-13 21:26:50
+@Description: Asynchronous write completion notifications
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "context"
+
+// writeWaiter is an asynchronous write waiting for all its segments to be acknowledged
+type writeWaiter struct {
+	sn   uint32 // the sequence number following the last segment of the write
+	done func(error)
+}
+
+// WriteAsync writes 'b' like Write, and invokes 'done' once all the bytes have been
+// acknowledged by remote, or with an error if the session has died before that.
+//
+// 'done' is called on the receiving goroutine and must not block, it is called
+// immediately with the error if the write itself fails.
+func (s *UDPSession) WriteAsync(b []byte, done func(err error)) (n int, err error) {
+	n, err = s.writeBuffers(context.Background(), [][]byte{b}, done, false)
+	if err != nil {
+		done(err)
+	}
+	return n, err
+}
+
+// addWriteWaiter registers 'done' for the data queued so far, the caller must hold the session lock
+func (s *UDPSession) addWriteWaiter(done func(error)) {
+	// segments are numbered in the order they leave snd_queue
+	sn := s.kcp.snd_nxt + uint32(s.kcp.snd_queue.Len())
+	s.writeWaiters = append(s.writeWaiters, writeWaiter{sn, done})
+}
+
+// ackedWriteWaiters removes and returns the waiters whose data has been fully
+// acknowledged, the caller must hold the session lock
+func (s *UDPSession) ackedWriteWaiters() (acked []writeWaiter) {
+	n := 0
+	for _, w := range s.writeWaiters {
+		if _itimediff(s.kcp.snd_una, w.sn) < 0 {
+			break
+		}
+		n++
+	}
+
+	if n > 0 {
+		acked = make([]writeWaiter, n)
+		copy(acked, s.writeWaiters)
+		s.writeWaiters = append(s.writeWaiters[:0], s.writeWaiters[n:]...)
+	}
+	return
+}
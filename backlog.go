@@ -0,0 +1,85 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-11 10:26:37
+@Description: Accept backlog overflow of listeners
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// maxBacklog is the largest accept backlog of a listener
+const maxBacklog = 1 << 16
+
+// BacklogPolicy selects what a listener does with a new conversation while
+// its accept backlog is full
+type BacklogPolicy int
+
+const (
+	// BacklogDrop drops the packets of the conversation, the client sends
+	// them again until the application accepts sessions again. This is the
+	// default.
+	BacklogDrop BacklogPolicy = iota
+
+	// BacklogReset answers the packets of the conversation with a reset, the
+	// reads and writes of the client fail with ErrReset at once, so it can
+	// back off or try another server.
+	BacklogReset
+)
+
+func (p BacklogPolicy) String() string {
+	switch p {
+	case BacklogDrop:
+		return "drop"
+	case BacklogReset:
+		return "reset"
+	default:
+		return "invalid"
+	}
+}
+
+// MarshalText and UnmarshalText encode the policy by name in config files
+func (p BacklogPolicy) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *BacklogPolicy) UnmarshalText(text []byte) error {
+	return unmarshalName(p, text, "backlog policy", BacklogDrop, BacklogReset)
+}
+
+// valid reports whether 'p' is a known policy
+func (p BacklogPolicy) valid() bool {
+	return p == BacklogDrop || p == BacklogReset
+}
+
+// SetBacklogPolicy selects what becomes of new conversations while the accept
+// backlog is full, they are counted in BacklogDrops either way. 'overflow', if
+// not nil, is called on the read loop with the source of each packet refused,
+// and must be fast. The size of the backlog is set by Config.Backlog.
+func (l *Listener) SetBacklogPolicy(policy BacklogPolicy, overflow func(addr net.Addr)) error {
+	if !policy.valid() {
+		return errors.Errorf("invalid backlog policy %d", policy)
+	}
+	l.backlogPolicy.Store(int32(policy))
+	if overflow == nil {
+		l.backlogOverflow.Store(nil)
+	} else {
+		l.backlogOverflow.Store(&overflow)
+	}
+	return nil
+}
+
+// overflow refuses a new conversation from 'addr' as the backlog is full
+func (l *Listener) overflow(addr net.Addr, dst pktinfo, conv uint32) {
+	atomic.AddUint64(&l.Snmp().BacklogDrops, 1)
+	if BacklogPolicy(l.backlogPolicy.Load()) == BacklogReset {
+		l.reset(addr, dst, conv)
+	}
+	if f := l.backlogOverflow.Load(); f != nil {
+		(*f)(addr)
+	}
+}
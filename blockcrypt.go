@@ -0,0 +1,46 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-19 11:34:06
+@Description: BlockCrypt interface shared by full and minimal builds
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+// BlockCrypt defines encryption/decryption methods for a given byte slice.
+// Notes on implementing: the data to be encrypted contains a builtin
+// nonce at the first 16 bytes
+type BlockCrypt interface {
+	// Encrypt encrypts the whole block in src into dst.
+	// Dst and src may point at the same memory.
+	Encrypt(dst, src []byte)
+
+	// Decrypt decrypts the whole block in src into dst.
+	// Dst and src may point at the same memory.
+	Decrypt(dst, src []byte)
+}
+
+type noneBlockCrypt struct{}
+
+// NewNoneBlockCrypt does nothing but copying
+func NewNoneBlockCrypt(key []byte) (BlockCrypt, error) {
+	return new(noneBlockCrypt), nil
+}
+
+func (c *noneBlockCrypt) Encrypt(dst, src []byte) { copy(dst, src) }
+func (c *noneBlockCrypt) Decrypt(dst, src []byte) { copy(dst, src) }
+
+// blockCloner is implemented by the ciphers which keep scratch buffers, and so
+// are not safe for concurrent use, clone returns one with buffers of its own
+type blockCloner interface {
+	clone() BlockCrypt
+}
+
+// cloneBlock returns a cipher for use by another goroutine, 'b' itself if it
+// has no scratch state
+func cloneBlock(b BlockCrypt) BlockCrypt {
+	if c, ok := b.(blockCloner); ok {
+		return c.clone()
+	}
+	return b
+}
@@ -0,0 +1,154 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 10:02:35
+@Description: Optional end-to-end checksum over application data
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// digestSize is the size of the digest segment payload: | length 8B | sha256 32B |
+	digestSize = 8 + sha256.Size
+
+	// digestCopies is the number of times the digest is sent on Close, it is not retransmitted
+	digestCopies = 3
+)
+
+// e2eChecksum keeps running hashes over the application data sent and received by a session.
+//
+// The state is protected by the session lock.
+type e2eChecksum struct {
+	tx, rx           hash.Hash
+	txBytes, rxBytes uint64
+
+	remoteLen uint64
+	remoteSum []byte // digest announced by the remote, nil until received
+
+	verified bool
+	err      error
+}
+
+// SetChecksum enables an end-to-end SHA-256 checksum over the application data,
+// it must be enabled on both ends before the first Write and Read.
+//
+// Every byte written is hashed, and on Close the total length and digest are sent
+// to the remote, which compares them with the hash of the bytes it has read. This
+// detects corruption above the per-packet integrity checks, such as reassembly or
+// buffer handling bugs. A mismatch fails Read and Close with errChecksumMismatch
+// once all data has been read, see also VerifyChecksum.
+//
+// The digest is sent unreliably a few times, a session closed before it arrives
+// stays unverified. It is refused on sessions of Config.KCPCompat.
+func (s *UDPSession) SetChecksum(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !enable {
+		s.e2e = nil
+		return
+	}
+	if s.refusedByKCPCompat("end-to-end checksum") {
+		return
+	}
+	s.e2e = &e2eChecksum{tx: sha256.New(), rx: sha256.New()}
+}
+
+// VerifyChecksum returns nil if the data read matches the digest sent by the
+// remote, errChecksumPending if the digest has not arrived or data is still unread,
+// and errChecksumMismatch on corruption.
+func (s *UDPSession) VerifyChecksum() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.e2e == nil {
+		return errors.WithStack(errInvalidOperation)
+	}
+	if s.e2e.err != nil {
+		return s.e2e.err
+	}
+	if !s.e2e.verified {
+		return errors.WithStack(errChecksumPending)
+	}
+	return nil
+}
+
+// e2eWrite hashes the data accepted by Write, the caller must hold the session lock
+func (s *UDPSession) e2eWrite(v [][]byte) {
+	if s.e2e == nil {
+		return
+	}
+	for _, b := range v {
+		s.e2e.tx.Write(b)
+		s.e2e.txBytes += uint64(len(b))
+	}
+}
+
+// e2eRead hashes the data returned by Read, the caller must hold the session lock
+func (s *UDPSession) e2eRead(b []byte) {
+	if s.e2e == nil {
+		return
+	}
+	s.e2e.rx.Write(b)
+	s.e2e.rxBytes += uint64(len(b))
+	s.e2eVerify()
+}
+
+// e2eVerify compares the digests once all the announced data has been read
+func (s *UDPSession) e2eVerify() {
+	c := s.e2e
+	if c.remoteSum == nil || c.verified || c.err != nil {
+		return
+	}
+
+	if c.rxBytes < c.remoteLen {
+		return
+	}
+
+	if c.rxBytes == c.remoteLen && bytes.Equal(c.rx.Sum(nil), c.remoteSum) {
+		c.verified = true
+	} else {
+		c.err = errors.WithStack(errChecksumMismatch)
+	}
+}
+
+// sendDigest announces the length and digest of the data written, the caller must hold the session lock
+func (s *UDPSession) sendDigest() {
+	if s.e2e == nil {
+		return
+	}
+
+	var seg segment
+	seg.conv = s.kcp.conv
+	seg.cmd = IKCP_CMD_DIGEST
+	seg.wnd = s.kcp.wnd_unused()
+	seg.una = s.kcp.rcv_nxt
+	seg.data = make([]byte, digestSize)
+	binary.LittleEndian.PutUint64(seg.data, s.e2e.txBytes)
+	copy(seg.data[8:], s.e2e.tx.Sum(nil))
+
+	for i := 0; i < digestCopies; i++ {
+		s.writeControl(&seg, s.remoteAddr())
+	}
+}
+
+// onDigest is invoked by KCP with the session lock held
+func (s *UDPSession) onDigest(data []byte) {
+	if s.e2e == nil || len(data) != digestSize || s.e2e.remoteSum != nil {
+		return
+	}
+
+	s.e2e.remoteLen = binary.LittleEndian.Uint64(data)
+	s.e2e.remoteSum = append([]byte(nil), data[8:]...)
+	s.e2eVerify()
+	s.notifyReadEvent()
+}
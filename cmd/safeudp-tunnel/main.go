@@ -0,0 +1,89 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 13:21:36
+@Description: Command forwarding TCP connections over safe-udp
+@Language: Go 1.23.4
+*/
+
+// Command safeudp-tunnel forwards TCP connections over safe-udp. The client
+// listens for TCP connections and carries them to the server, which connects
+// them to the target:
+//
+//	safeudp-tunnel server -listen :4000 -target 127.0.0.1:22 -config tunnel.yaml
+//	safeudp-tunnel client -listen 127.0.0.1:2222 -remote server:4000 -config tunnel.yaml
+//
+// Both ends load the same config file, see configfile.Load, without one
+// the defaults apply and a key is agreed for each session.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	safeudp "safe-udp"
+	"safe-udp/configfile"
+	"safe-udp/tunnel"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	listen := flags.String("listen", "", "address to listen on, TCP for the client and UDP for the server")
+	configPath := flags.String("config", "", "JSON or YAML config file")
+	remote := flags.String("remote", "", "address of the server (client)")
+	sessions := flags.Int("sessions", 1, "sessions to the server (client)")
+	target := flags.String("target", "", "TCP address to forward to (server)")
+	flags.Parse(os.Args[2:])
+
+	config := new(safeudp.Config)
+	if *configPath != "" {
+		var err error
+		if config, err = configfile.Load(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch os.Args[1] {
+	case "client":
+		if *listen == "" || *remote == "" {
+			usage()
+		}
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		c, err := tunnel.NewClient(ctx, *remote, config, *sessions)
+		cancel()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("forwarding %v to %s", l.Addr(), *remote)
+		log.Fatal(c.Serve(l))
+	case "server":
+		if *listen == "" || *target == "" {
+			usage()
+		}
+		l, err := safeudp.ListenStream(*listen, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("forwarding %v to %s", l.Addr(), *target)
+		log.Fatal(tunnel.NewServer(*target).Serve(l))
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: safeudp-tunnel client -listen addr -remote addr [-sessions n] [-config file]")
+	fmt.Fprintln(os.Stderr, "       safeudp-tunnel server -listen addr -target addr [-config file]")
+	os.Exit(2)
+}
@@ -0,0 +1,162 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 10:52:30
+@Description: Payload compression
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CompressHeaderSize is the flag byte after the KCP header of each packet with compression
+	CompressHeaderSize = 1
+
+	compressRaw    = 0 // the payload follows as is
+	compressSnappy = 1 // the payload follows compressed with snappy
+
+	compressMinSize = 128 // smaller payloads are sent as is
+	compressBackoff = 16  // packets sent as is after one which did not compress
+)
+
+var errCompressed = errors.New("invalid compressed packet")
+
+// compressBuf holds the payload of a packet compressed by snappy, before it is
+// copied over the payload
+var compressBuf = sync.Pool{
+	New: func() any {
+		buf := make([]byte, snappy.MaxEncodedLen(mtuLimit))
+		return &buf
+	},
+}
+
+// Compressor is a PacketProcessor which compresses the payload of packets
+// with snappy, as kcptun does with its streams, it helps text heavy traffic
+// on constrained links. Payloads which do not shrink are sent as is, and
+// compression is skipped for the next few packets after such a payload, so
+// incompressible traffic costs little.
+//
+// Both ends of a session must use it, and each session needs its own. Packets
+// led by a version offer or choice pass unchanged, so that sessions which
+// negotiate versions, see UDPSession.SetVersions, also agree on compression
+// and fail with ErrVersion if only one end compresses.
+type Compressor struct {
+	negotiate bool         // of Config.Compression, a listener drops the packets of clients which did not negotiate
+	skip      atomic.Int32 // packets to send as is before trying again
+}
+
+// NewCompressor returns a Compressor
+func NewCompressor() *Compressor {
+	return new(Compressor)
+}
+
+// Overhead returns the bytes added to each packet
+func (c *Compressor) Overhead() int { return CompressHeaderSize }
+
+// Outgoing compresses the payload after the KCP header, path probes are sent
+// as is to keep their size
+func (c *Compressor) Outgoing(pkt []byte) ([]byte, error) {
+	if pkt[4] == IKCP_CMD_VERSION {
+		return pkt, nil
+	}
+	payload := pkt[IKCP_OVERHEAD:]
+	if len(payload) >= compressMinSize && pkt[4] != IKCP_CMD_PROBE {
+		if c.skip.Load() > 0 {
+			c.skip.Add(-1)
+		} else if out, ok := c.compress(pkt[:IKCP_OVERHEAD], payload); ok {
+			return out, nil
+		} else {
+			c.skip.Store(compressBackoff)
+		}
+	}
+
+	pkt = append(pkt, 0)
+	copy(pkt[IKCP_OVERHEAD+CompressHeaderSize:], payload)
+	pkt[IKCP_OVERHEAD] = compressRaw
+	return pkt, nil
+}
+
+// compress appends the flag and the compressed payload to 'dst', it returns
+// false if the payload does not shrink
+func (c *Compressor) compress(dst, payload []byte) ([]byte, bool) {
+	buf := compressBuf.Get().(*[]byte)
+	defer compressBuf.Put(buf)
+
+	out := snappy.Encode(*buf, payload)
+	if len(out) >= len(payload) {
+		return nil, false
+	}
+	// 'dst' may share the memory of 'payload', which is fully read by now
+	dst = append(dst, compressSnappy)
+	return append(dst, out...), true
+}
+
+// compression returns the Compressor among the processors of the session, nil
+// if none
+func (s *UDPSession) compression() *Compressor {
+	chain := s.processors.Load()
+	if chain == nil {
+		return nil
+	}
+	for _, p := range *chain {
+		if c, ok := p.(*Compressor); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// unnegotiated reports whether a packet reaches a listener session of
+// Config.Compression before the client negotiated, it is dropped as the
+// client may not compress
+func (s *UDPSession) unnegotiated(pkt []byte) bool {
+	if s.l == nil || s.version != 0 || len(pkt) < IKCP_OVERHEAD || pkt[4] == IKCP_CMD_VERSION {
+		return false
+	}
+	c := s.compression()
+	return c != nil && c.negotiate
+}
+
+// Incoming restores the payload after the KCP header
+func (c *Compressor) Incoming(pkt []byte) ([]byte, error) {
+	if len(pkt) >= IKCP_OVERHEAD && pkt[4] == IKCP_CMD_VERSION {
+		return pkt, nil
+	}
+	if len(pkt) < IKCP_OVERHEAD+CompressHeaderSize {
+		return nil, errors.WithStack(errCompressed)
+	}
+
+	switch pkt[IKCP_OVERHEAD] {
+	case compressRaw:
+		copy(pkt[IKCP_OVERHEAD:], pkt[IKCP_OVERHEAD+CompressHeaderSize:])
+		return pkt[:len(pkt)-CompressHeaderSize], nil
+	case compressSnappy:
+		return c.decompress(pkt)
+	default:
+		return nil, errors.WithStack(errCompressed)
+	}
+}
+
+// decompress restores a packet into a new buffer of its size, the result is
+// limited to the size of a packet
+func (c *Compressor) decompress(pkt []byte) ([]byte, error) {
+	src := pkt[IKCP_OVERHEAD+CompressHeaderSize:]
+	n, err := snappy.DecodedLen(src)
+	if err != nil || IKCP_OVERHEAD+n > mtuLimit {
+		return nil, errors.WithStack(errCompressed)
+	}
+
+	out := make([]byte, IKCP_OVERHEAD+n)
+	copy(out, pkt[:IKCP_OVERHEAD])
+	if _, err := snappy.Decode(out[IKCP_OVERHEAD:], src); err != nil {
+		return nil, errors.WithStack(errCompressed)
+	}
+	return out, nil
+}
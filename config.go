@@ -0,0 +1,578 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 10:52:30
+@Description: Config validation
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"cmp"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+var (
+	errFECDisabled    = errors.New("FEC is not available in builds with the safeudp_nofec tag")
+	errCryptoDisabled = errors.New("encryption is not available in builds with the safeudp_nocrypto tag")
+	errXDPDisabled    = errors.New("AF_XDP is only available on linux in builds with the safeudp_xdp tag")
+)
+
+// checkFEC returns an error if the FEC shards are invalid, or FEC is
+// requested but compiled out
+func checkFEC(dataShards, parityShards int) error {
+	if dataShards < 0 || parityShards < 0 {
+		return errors.New("FEC shards must not be negative")
+	}
+	if dataShards > 0 && parityShards > 0 {
+		if !fecEnabled {
+			return errors.WithStack(errFECDisabled)
+		}
+		if dataShards+parityShards > 256 {
+			return errors.New("FEC data and parity shards must not exceed 256 in total")
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration, and returns an error describing the
+// first invalid setting, including features compiled out by build tags.
+func (c *Config) Validate() error {
+	if len(c.Key) > 0 {
+		if !cryptoEnabled {
+			return errors.WithStack(errCryptoDisabled)
+		}
+		if c.Cipher == "" || c.Cipher == "aes" {
+			if n := len(c.Key); n != 16 && n != 24 && n != 32 {
+				return errors.Errorf("invalid key length %d, must be 16, 24 or 32 bytes", n)
+			}
+		} else if _, err := namedBlockCrypt(c.Cipher, c.Key); err != nil {
+			return errors.Wrapf(err, "Cipher %s", c.Cipher)
+		}
+		if c.Plaintext {
+			return errors.New("Plaintext set with a Key")
+		}
+	} else if c.Cipher != "" {
+		return errors.Errorf("Cipher %s set without a Key", c.Cipher)
+	}
+	if c.Handshake != nil && (len(c.Key) > 0 || c.Plaintext) {
+		return errors.New("Handshake set with a Key or Plaintext")
+	}
+
+	if err := checkFEC(c.FECData, c.FECParity); err != nil {
+		return err
+	}
+	if (c.FECData > 0) != (c.FECParity > 0) {
+		return errors.Errorf("FECData %d and FECParity %d must both be set, or both be 0 without FEC", c.FECData, c.FECParity)
+	}
+	if !c.FECBackend.valid() {
+		return errors.Errorf("invalid FEC backend %d", c.FECBackend)
+	}
+
+	if c.NoDelay < 0 || c.NoDelay > 1 {
+		return errors.New("NoDelay must be 0 or 1")
+	}
+	if c.Interval < 0 || c.Interval > 5000 {
+		return errors.New("Interval must be between 0 and 5000 ms")
+	}
+	if c.Resend < 0 {
+		return errors.New("Resend must not be negative")
+	}
+	if c.NoCongestion < 0 || c.NoCongestion > 1 {
+		return errors.New("NoCongestion must be 0 or 1")
+	}
+	if err := checkProfile(c.Profile); err != nil {
+		return err
+	}
+	if c.InitialRTO < 0 || c.MinRTO < 0 || c.MaxRTO < 0 {
+		return errors.New("RTO settings must not be negative")
+	}
+	if maxRTO := cmp.Or(c.MaxRTO, IKCP_RTO_MAX); c.MinRTO > maxRTO || c.InitialRTO > maxRTO {
+		return errors.Errorf("MinRTO and InitialRTO must not exceed MaxRTO of %d", maxRTO)
+	}
+	if c.MaxRetransmit < 0 || c.ProgressTimeout < 0 {
+		return errors.New("dead link settings must not be negative")
+	}
+	if c.SendWindow < 0 || c.RecvWindow < 0 {
+		return errors.New("window sizes must not be negative")
+	}
+	if c.RateLimit < 0 || c.ReceiveRateLimit < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if c.SendBuffer < 0 || c.RecvBuffer < 0 {
+		return errors.New("socket buffers must not be negative")
+	}
+	if c.DSCP < 0 || c.DSCP > 63 {
+		return errors.New("DSCP must be between 0 and 63")
+	}
+	if c.MaxSessions < 0 {
+		return errors.New("MaxSessions must not be negative")
+	}
+	if !c.Eviction.valid() {
+		return errors.Errorf("invalid eviction policy %d", c.Eviction)
+	}
+	if c.ReadWorkers < 0 {
+		return errors.New("ReadWorkers must not be negative")
+	}
+	if c.SourceLimits.PacketsPerSec < 0 || c.SourceLimits.NewSessionsPerSec < 0 {
+		return errors.New("source limits must not be negative")
+	}
+	if c.Backlog < 0 || c.Backlog > maxBacklog {
+		return errors.Errorf("Backlog must be between 0 and %d", maxBacklog)
+	}
+	if !c.BacklogPolicy.valid() {
+		return errors.Errorf("invalid backlog policy %d", c.BacklogPolicy)
+	}
+	if n := len(c.ResetKey); n > 0 && n < minResetKeySize {
+		return errors.Errorf("ResetKey of %d bytes, must be at least %d", n, minResetKeySize)
+	}
+	if err := checkVersions(c.Versions); err != nil {
+		return err
+	}
+	if c.XDPInterface != "" || c.XDPQueues != 0 {
+		if !xdpEnabled {
+			return errors.WithStack(errXDPDisabled)
+		}
+		if c.XDPInterface == "" || c.XDPQueues < 0 {
+			return errors.New("XDPQueues must not be negative, and needs an XDPInterface")
+		}
+		if c.HopPorts != "" {
+			return errors.New("XDPInterface with HopPorts, the program redirects a single port")
+		}
+	}
+	if c.Smux != nil {
+		if c.NoMux {
+			return errors.New("Smux set with NoMux")
+		}
+		if err := smux.VerifyConfig(c.Smux); err != nil {
+			return errors.Wrap(err, "Smux")
+		}
+	}
+	if err := c.Experimental.validate(); err != nil {
+		return err
+	}
+	if _, err := c.hopSchedule(); err != nil {
+		return err
+	}
+	if c.Plugin != "" {
+		if err := checkPlugin(c.Plugin); err != nil {
+			return err
+		}
+		if c.HopPorts != "" || c.XDPInterface != "" {
+			return errors.New("Plugin with HopPorts or XDPInterface, the plugin owns the sockets")
+		}
+	} else if c.PluginOptions != "" {
+		return errors.New("PluginOptions set without a Plugin")
+	}
+	if c.KCPCompat {
+		return c.checkKCPCompat()
+	}
+	return nil
+}
+
+// ApplyDefaults fills the zero values of the KCP settings, from the profile
+// first, and of the accept backlog with the defaults they stand for, so the
+// config shows the settings in effect. Zero values which disable a feature,
+// such as FEC, the key, or the socket settings, are left alone, and Validate
+// still applies afterwards.
+func (c *Config) ApplyDefaults() {
+	*c = *c.withProfile()
+	if c.Interval == 0 {
+		c.Interval = IKCP_INTERVAL
+	}
+	if c.InitialRTO == 0 {
+		c.InitialRTO = IKCP_RTO_DEF
+	}
+	if c.MinRTO == 0 {
+		c.MinRTO = IKCP_RTO_MIN
+		if c.NoDelay != 0 {
+			c.MinRTO = IKCP_RTO_NDL
+		}
+	}
+	if c.MaxRTO == 0 {
+		c.MaxRTO = IKCP_RTO_MAX
+	}
+	if c.MaxRetransmit == 0 {
+		c.MaxRetransmit = IKCP_DEADLINK - 1
+	}
+	if c.SendWindow == 0 {
+		c.SendWindow = IKCP_WND_SND
+	}
+	if c.RecvWindow == 0 {
+		c.RecvWindow = IKCP_WND_RCV
+	}
+	if c.Backlog == 0 {
+		c.Backlog = acceptBacklog
+	}
+}
+
+// agreesKey reports whether stream connections agree on an ephemeral key
+func (c *Config) agreesKey() bool {
+	return len(c.Key) == 0 && !c.Plaintext && c.Handshake == nil
+}
+
+// blockCrypt returns the cipher for the key, nil without a key
+func (c *Config) blockCrypt() (BlockCrypt, error) {
+	if len(c.Key) == 0 {
+		return nil, nil
+	}
+	return namedBlockCrypt(c.Cipher, c.Key)
+}
+
+// socketTuner is the socket tuning of a session or a listener
+type socketTuner interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+	SetDSCP(dscp int) error
+}
+
+// tuneSocket applies the socket settings of the config which are set
+func (c *Config) tuneSocket(t socketTuner) error {
+	if c.RecvBuffer > 0 {
+		if err := t.SetReadBuffer(c.RecvBuffer); err != nil {
+			return errors.Wrap(err, "set receive buffer")
+		}
+	}
+	if c.SendBuffer > 0 {
+		if err := t.SetWriteBuffer(c.SendBuffer); err != nil {
+			return errors.Wrap(err, "set send buffer")
+		}
+	}
+	if c.DSCP > 0 {
+		if err := t.SetDSCP(c.DSCP); err != nil {
+			return errors.Wrap(err, "set DSCP")
+		}
+	}
+	return nil
+}
+
+// kcpTuned reports whether the config sets any of the KCP settings
+func (c *Config) kcpTuned() bool {
+	return c.NoDelay != 0 || c.Interval != 0 || c.Resend != 0 || c.NoCongestion != 0 || c.Profile != "" ||
+		c.InitialRTO != 0 || c.MinRTO != 0 || c.MaxRTO != 0 || c.RACK || c.FRTO || c.SACK ||
+		c.MaxRetransmit != 0 || c.ProgressTimeout != 0 || c.SendWindow != 0 || c.RecvWindow != 0 ||
+		c.RateLimit != 0 || c.ReceiveRateLimit != 0
+}
+
+// tuneKCP applies the KCP settings of the config which are set
+func (c *Config) tuneKCP(s *UDPSession) {
+	c = c.withProfile()
+	if c.NoDelay != 0 || c.Interval != 0 || c.Resend != 0 || c.NoCongestion != 0 {
+		s.SetNoDelay(keep(c.NoDelay), keep(c.Interval), keep(c.Resend), keep(c.NoCongestion))
+	}
+	if c.InitialRTO != 0 || c.MinRTO != 0 || c.MaxRTO != 0 {
+		s.SetRTO(c.InitialRTO, c.MinRTO, c.MaxRTO)
+	}
+	if c.RACK {
+		s.SetRACK(true)
+	}
+	if c.FRTO {
+		s.SetFRTO(true)
+	}
+	if c.SACK {
+		s.SetSACK(true)
+	}
+	if c.MaxRetransmit != 0 || c.ProgressTimeout != 0 {
+		s.SetMaxRetransmit(c.MaxRetransmit, time.Duration(c.ProgressTimeout)*time.Millisecond)
+	}
+	if c.SendWindow != 0 || c.RecvWindow != 0 {
+		s.SetWindowSize(c.SendWindow, c.RecvWindow)
+	}
+	if c.RateLimit != 0 {
+		s.SetRateLimit(c.RateLimit)
+	}
+	if c.ReceiveRateLimit != 0 {
+		s.SetReceiveRateLimit(c.ReceiveRateLimit)
+	}
+}
+
+// processors returns the packet processors of a session, nil without any
+func (c *Config) processors() []PacketProcessor {
+	if !c.Compression {
+		return nil
+	}
+	compressor := NewCompressor()
+	compressor.negotiate = true
+	return []PacketProcessor{compressor}
+}
+
+// unmarshalName sets 'v' to the one of 'values' named 'text'
+func unmarshalName[T fmt.Stringer](v *T, text []byte, what string, values ...T) error {
+	for _, value := range values {
+		if value.String() == string(text) {
+			*v = value
+			return nil
+		}
+	}
+	return errors.Errorf("unknown %s %q", what, text)
+}
+
+// keep returns 'v', or -1 for 0 which keeps the current setting of NoDelay
+func keep(v int) int {
+	if v == 0 {
+		return -1
+	}
+	return v
+}
+
+// DialWithConfig connects to the remote address "raddr" with the encryption,
+// FEC, compression, KCP and socket settings of 'config', the key selects AES.
+func DialWithConfig(raddr string, config *Config) (*UDPSession, error) {
+	return dialWithConfig(context.Background(), raddr, config)
+}
+
+// dialWithConfig is DialWithConfig with the context of the dial, for the Tracer
+func dialWithConfig(ctx context.Context, raddr string, config *Config) (*UDPSession, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	block, err := config.blockCrypt()
+	if err != nil {
+		return nil, err
+	}
+	return dialConfig(ctx, raddr, config, block, nil)
+}
+
+// dialConfig dials "raddr" with the validated 'config' and 'block', from the
+// local address of 'bind' unless nil, over port hopping, a plugin or a socket
+// of its own
+func dialConfig(ctx context.Context, raddr string, config *Config, block BlockCrypt, bind *LocalBinding) (*UDPSession, error) {
+	schedule, _ := config.hopSchedule()
+	if bind != nil && (schedule != nil || config.Plugin != "") {
+		return nil, errors.New("a local binding with HopPorts or Plugin, which own the sockets")
+	}
+
+	var s *UDPSession
+	var err error
+	if schedule != nil {
+		s, err = dialHopping(ctx, raddr, config, block, schedule)
+	} else if config.Plugin != "" {
+		s, err = dialPlugin(ctx, raddr, config, block)
+	} else {
+		s, err = dialWithBinding(ctx, raddr, bind, block, config.FECData, config.FECParity)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := config.tuneDialed(s); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// DialWithConn connects to 'raddr' with the settings of 'config' like
+// DialWithConfig over a packet connection of the caller, such as a socket
+// punched through a NAT. A connected *net.UDPConn, from net.DialUDP, is sent
+// on with Write, and 'raddr' may be nil to use its remote address. The session
+// reads all the packets of 'conn', and Close leaves 'conn' open. Socket
+// settings of the config fail on conns without the corresponding methods of
+// *net.UDPConn, and port hopping and plugins, which need sockets of their
+// own, fail.
+func DialWithConn(conn net.PacketConn, raddr net.Addr, config *Config) (*UDPSession, error) {
+	var convid uint32
+	binary.Read(crand.Reader, binary.LittleEndian, &convid)
+	return dialWithConn(conn, raddr, config, convid)
+}
+
+// dialWithConn is DialWithConn with the conversation 'convid'
+func dialWithConn(conn net.PacketConn, raddr net.Addr, config *Config, convid uint32) (*UDPSession, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Plugin != "" {
+		return nil, errors.WithStack(errPluginConn)
+	}
+	if config.HopPorts != "" || config.HopInterval != 0 {
+		return nil, errors.WithStack(errHopConn)
+	}
+	block, err := config.blockCrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	if uc, ok := conn.(*net.UDPConn); ok && uc.RemoteAddr() != nil {
+		if raddr == nil {
+			raddr = uc.RemoteAddr()
+		} else if addrKey(raddr) != addrKey(uc.RemoteAddr()) {
+			return nil, errors.Errorf("socket connected to %v, not %v", uc.RemoteAddr(), raddr)
+		}
+		conn = connectedConn{uc}
+	}
+	if raddr == nil {
+		return nil, errors.New("remote address required on an unconnected socket")
+	}
+
+	s, err := NewConn3(convid, raddr, block, config.FECData, config.FECParity, conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.tuneDialed(s); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// tuneDialed applies the settings of the config to a dialed session
+func (c *Config) tuneDialed(s *UDPSession) error {
+	if c.KCPCompat {
+		s.setKCPCompat()
+	}
+	c.tuneKCP(s)
+	if processors := c.processors(); processors != nil {
+		s.SetPacketProcessors(processors...)
+	}
+	s.SetFECBackend(c.FECBackend)
+	versions := c.Versions
+	if c.Compression && len(versions) == 0 {
+		versions = supportedVersions // compression is agreed on with the version
+	}
+	s.SetVersions(versions...)
+	if c.IOUring {
+		s.SetIOUring(true)
+	}
+	return c.tuneSocket(s)
+}
+
+// connectedConn sends on a connected UDP socket, which refuses WriteTo, to
+// the address it is connected to
+type connectedConn struct {
+	*net.UDPConn
+}
+
+func (c connectedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// ListenWithConfig listens on "laddr" with the encryption, FEC and socket
+// settings of 'config', the compression and KCP settings are applied to
+// accepted sessions.
+func ListenWithConfig(laddr string, config *Config) (*Listener, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	block, err := config.blockCrypt()
+	if err != nil {
+		return nil, err
+	}
+	l, err := listenUDP(laddr, config, block)
+	if err != nil {
+		return nil, err
+	}
+	go l.monitor()
+	return l, nil
+}
+
+// listenUDP opens a socket on "laddr" for a listener configured by 'config',
+// without starting its read loop
+func listenUDP(laddr string, config *Config, block BlockCrypt) (*Listener, error) {
+	if schedule, _ := config.hopSchedule(); schedule != nil || config.Plugin != "" {
+		var conn net.PacketConn
+		var err error
+		if schedule != nil {
+			conn, err = listenHopping(laddr, schedule)
+		} else {
+			conn, err = listenPlugin(laddr, config)
+		}
+		if err != nil {
+			return nil, err
+		}
+		l, err := newConfigListener(conn, config, block, true)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	l, err := newConfigListener(conn, config, block, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListenWithConn serves 'config' like ListenWithConfig over a packet
+// connection of the caller, such as a socket punched through a NAT or a
+// wrapped conn. The listener reads all the packets of 'conn', and Close leaves
+// 'conn' open. Socket settings of the config fail on conns without the
+// corresponding methods of *net.UDPConn, and port hopping and plugins fail.
+func ListenWithConn(conn net.PacketConn, config *Config) (*Listener, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Plugin != "" {
+		return nil, errors.WithStack(errPluginConn)
+	}
+	if config.HopPorts != "" || config.HopInterval != 0 {
+		return nil, errors.WithStack(errHopConn)
+	}
+	block, err := config.blockCrypt()
+	if err != nil {
+		return nil, err
+	}
+	l, err := newConfigListener(conn, config, block, false)
+	if err != nil {
+		return nil, err
+	}
+	go l.monitor()
+	return l, nil
+}
+
+// newConfigListener creates a listener on 'conn' configured by 'config',
+// without starting its read loop
+func newConfigListener(conn net.PacketConn, config *Config, block BlockCrypt, ownConn bool) (*Listener, error) {
+	l := newListener(block, config.FECData, config.FECParity, conn, ownConn)
+	if config.Backlog > 0 {
+		l.chAccepts = make(chan *UDPSession, config.Backlog)
+	}
+	if err := config.tuneSocket(l); err != nil {
+		return nil, err
+	}
+	l.SetFECBackend(config.FECBackend)
+	if config.IOUring {
+		l.SetIOUring(true)
+	}
+	l.SetStatelessCookies(config.StatelessCookies)
+	l.SetVersions(config.Versions...)
+	l.SetMaxSessions(config.MaxSessions, config.Eviction)
+	l.SetSourceLimits(config.SourceLimits)
+	l.SetReadWorkers(config.ReadWorkers)
+	l.SetBacklogPolicy(config.BacklogPolicy, nil)
+	if len(config.ResetKey) > 0 {
+		l.SetStatelessReset(config.ResetKey)
+	}
+	cfg := *config
+	if cfg.kcpTuned() || cfg.KCPCompat {
+		l.sessionConfig = &cfg
+	}
+	if cfg.Compression {
+		l.SetPacketProcessors(cfg.processors)
+	}
+	if config.XDPInterface != "" {
+		if err := l.startXDP(config.XDPInterface, cmp.Or(config.XDPQueues, 1)); err != nil {
+			releaseIORing(&l.uring)
+			return nil, err
+		}
+	}
+	return l, nil
+}
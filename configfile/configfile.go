@@ -0,0 +1,307 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 23:16:05
+@Description: Loading of configs from JSON and YAML files
+@Language: Go 1.23.4
+*/
+
+// Package configfile loads the safeudp.Config of a daemon from a JSON or YAML
+// file, with overrides from the environment. It is apart from safeudp so that
+// programs configured in code do not carry the parsers.
+package configfile
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+
+	safeudp "safe-udp"
+)
+
+// EnvPrefix leads the names of the environment variables overriding the
+// settings of a config file, SAFEUDP_INTERVAL overrides "interval"
+const EnvPrefix = "SAFEUDP_"
+
+// Load reads a config from a JSON file, or a YAML file if the name ends in
+// .yaml or .yml, and validates it. The settings have the names of the json
+// tags of safeudp.Config, ciphers, profiles, FEC backends and policies are
+// named, versions are written "v1", and the keys are base64.
+//
+// Environment variables named EnvPrefix and the upper case name of a setting
+// override the file, SAFEUDP_SOURCE_LIMITS_PACKETS_PER_SEC for the field of
+// "source_limits", and take YAML values. Unknown settings in the file are
+// errors, variables naming no setting are ignored, as the environment is
+// shared with other programs.
+//
+// YAML files are read without a YAML library: mappings, lists and scalars are
+// understood, anchors, tags and multi-line strings are not.
+func Load(path string) (*safeudp.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		settings, err = parseYAML(data)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&settings)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", path)
+	}
+	if settings == nil {
+		settings = make(map[string]any)
+	}
+	overrideFromEnv(settings, os.Environ())
+
+	data, err = json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	config := new(safeudp.Config)
+	if _, ok := settings["smux"]; ok {
+		config.Smux = smux.DefaultConfig() // the settings of the file replace the defaults
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return nil, errors.Wrapf(err, "load %s", path)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// overrideFromEnv sets the settings named by the variables of 'environ' with
+// EnvPrefix, the others are left to whoever set them
+func overrideFromEnv(settings map[string]any, environ []string) {
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(name, EnvPrefix)
+		if !ok {
+			continue
+		}
+		setSetting(settings, reflect.TypeFor[safeudp.Config](), strings.ToLower(name), value)
+	}
+}
+
+// setSetting sets 'name' of the settings of the struct type 't', or the field
+// of a struct setting it is prefixed with, and reports whether it exists.
+// Fields without a json tag are named in lower case, as in smux.Config.
+func setSetting(settings map[string]any, t reflect.Type, name, value string) bool {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == "" {
+			tag = strings.ToLower(f.Name)
+		}
+		if tag == name {
+			settings[tag] = settingValue(f.Type, value)
+			return true
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if rest, ok := strings.CutPrefix(name, tag+"_"); ok && ft.Kind() == reflect.Struct {
+			nested, _ := settings[tag].(map[string]any)
+			if nested == nil {
+				nested = make(map[string]any)
+			}
+			if setSetting(nested, ft, rest, value) {
+				settings[tag] = nested
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// settingValue returns the value of a variable for a setting of type 't',
+// strings and named values are taken as they are, so keys are never numbers
+func settingValue(t reflect.Type, value string) any {
+	if t.Kind() == reflect.String || t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 && t.Elem().Name() == "uint8" ||
+		reflect.PointerTo(t).Implements(reflect.TypeFor[encoding.TextUnmarshaler]()) {
+		return value
+	}
+	return yamlScalar(value)
+}
+
+// yamlLine is a line of a YAML document without indentation and comment
+type yamlLine struct {
+	indent int
+	text   string
+	n      int // line number
+}
+
+// yamlParser reads the block structure of a YAML document
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML parses a YAML document of nested mappings, lists and scalars
+// into the values json.Unmarshal produces
+func parseYAML(data []byte) (map[string]any, error) {
+	p := new(yamlParser)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(yamlStripComment(line), " \t\r")
+		text := strings.TrimLeft(line, " ")
+		if text == "" || text == "---" {
+			continue
+		}
+		if text[0] == '\t' {
+			return nil, errors.Errorf("line %d: tabs in indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{indent: len(line) - len(text), text: text, n: i + 1})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, errors.Errorf("line %d: unexpected indentation", p.lines[p.pos].n)
+	}
+	settings, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("document is not a mapping")
+	}
+	return settings, nil
+}
+
+// block parses the mapping or list at 'indent'
+func (p *yamlParser) block(indent int) (any, error) {
+	if isYAMLItem(p.lines[p.pos].text) {
+		var list []any
+		for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text) {
+			item := strings.TrimSpace(p.lines[p.pos].text[1:])
+			p.pos++
+			v, err := p.value(indent, item, false)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.checkIndent(indent)
+	}
+
+	mapping := make(map[string]any)
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && !isYAMLItem(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		key, value, ok := strings.Cut(line.text, ":")
+		if !ok || (value != "" && value[0] != ' ') {
+			return nil, errors.Errorf("line %d: expected key: value", line.n)
+		}
+		key = strings.TrimSpace(key)
+		if unquoted, ok := yamlScalar(key).(string); ok {
+			key = unquoted
+		}
+		if _, dup := mapping[key]; dup {
+			return nil, errors.Errorf("line %d: duplicate key %q", line.n, key)
+		}
+		p.pos++
+		v, err := p.value(indent, strings.TrimSpace(value), true)
+		if err != nil {
+			return nil, err
+		}
+		mapping[key] = v
+	}
+	return mapping, p.checkIndent(indent)
+}
+
+// value parses the value after a key or a list item at 'indent', a nested
+// block if it is empty, which may be a list at the indentation of a key
+func (p *yamlParser) value(indent int, text string, key bool) (any, error) {
+	if text != "" {
+		return yamlScalar(text), nil
+	}
+	if p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		if next.indent > indent || key && next.indent == indent && isYAMLItem(next.text) {
+			return p.block(next.indent)
+		}
+	}
+	return nil, nil
+}
+
+// checkIndent fails if the line after a block is indented deeper than it
+func (p *yamlParser) checkIndent(indent int) error {
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return errors.Errorf("line %d: unexpected indentation", p.lines[p.pos].n)
+	}
+	return nil
+}
+
+// isYAMLItem reports whether a line is a list item
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlStripComment removes a comment outside of quotes from a line
+func yamlStripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// yamlScalar returns the value of a scalar or a flow list of scalars
+func yamlScalar(text string) any {
+	switch {
+	case len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"':
+		if s, err := strconv.Unquote(text); err == nil {
+			return s
+		}
+		return text
+	case len(text) >= 2 && text[0] == '\'' && text[len(text)-1] == '\'':
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'")
+	case len(text) >= 2 && text[0] == '[' && text[len(text)-1] == ']':
+		list := []any{}
+		if inner := strings.TrimSpace(text[1 : len(text)-1]); inner != "" {
+			for _, item := range strings.Split(inner, ",") {
+				list = append(list, yamlScalar(strings.TrimSpace(item)))
+			}
+		}
+		return list
+	}
+
+	switch text {
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	case "null", "Null", "NULL", "~":
+		return nil
+	}
+	if _, err := strconv.ParseFloat(text, 64); err == nil && json.Valid([]byte(text)) {
+		return json.Number(text)
+	}
+	return text
+}
@@ -0,0 +1,111 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 13:21:36
+@Description: Config file tests
+@Language: Go 1.23.4
+*/
+
+package configfile
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xtaci/smux"
+
+	safeudp "safe-udp"
+)
+
+// TestLoad 测试从YAML和JSON文件加载配置以及环境变量覆盖
+func TestLoad(t *testing.T) {
+	// 以safeudp_nocrypto标签构建时密钥无效
+	crypto := (&safeudp.Config{Key: make([]byte, 16)}).Validate() == nil
+	dir := t.TempDir()
+	yaml := `# 隧道服务端
+profile: fast2
+resend: 3   # 覆盖配置档
+fec_backend: leopard
+eviction: lru
+max_sessions: 100
+backlog_policy: "reset"
+source_limits:
+  packets_per_sec: 1000
+versions:
+- v1
+`
+	if crypto {
+		yaml += "key: " + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\ncipher: sm4\n"
+	}
+	path := dir + "/server.yaml"
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SAFEUDP_INTERVAL", "15")
+	t.Setenv("SAFEUDP_SOURCE_LIMITS_NEW_SESSIONS_PER_SEC", "5")
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := safeudp.Config{Profile: "fast2", Resend: 3, Interval: 15, FECBackend: safeudp.FECBackendLeopard, Eviction: safeudp.EvictionLRU,
+		MaxSessions: 100, BacklogPolicy: safeudp.BacklogReset, SourceLimits: safeudp.SourceLimits{PacketsPerSec: 1000, NewSessionsPerSec: 5},
+		Versions: []safeudp.Version{safeudp.Version1}}
+	if crypto {
+		want.Key, want.Cipher = make([]byte, 16), "sm4"
+	}
+	if !reflect.DeepEqual(*config, want) {
+		t.Fatalf("loaded %+v", *config)
+	}
+
+	// JSON往返得到相同的配置
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"fec_backend":"leopard"`) {
+		t.Fatalf("backend not named: %s", data)
+	}
+	os.Unsetenv("SAFEUDP_INTERVAL")
+	os.Unsetenv("SAFEUDP_SOURCE_LIMITS_NEW_SESSIONS_PER_SEC")
+	path = dir + "/server.json"
+	os.WriteFile(path, data, 0o600)
+	if loaded, err := Load(path); err != nil || !reflect.DeepEqual(loaded, config) {
+		t.Fatalf("round trip %+v: %v", loaded, err)
+	}
+
+	for name, content := range map[string]string{
+		"unknown.yaml": "intervall: 10\n",
+		"invalid.json": `{"no_delay": 2}`,
+		"cipher.yaml":  "cipher: rot13\n",
+		"indent.yaml":  "interval: 10\n  resend: 2\n",
+	} {
+		os.WriteFile(dir+"/"+name, []byte(content), 0o600)
+		if _, err := Load(dir + "/" + name); err == nil {
+			t.Errorf("%s loaded", name)
+		}
+	}
+
+	// 不对应任何设置的变量属于其他程序，被忽略
+	t.Setenv("SAFEUDP_BOGUS", "1")
+	if _, err := Load(path); err != nil {
+		t.Error("unknown variable rejected:", err)
+	}
+}
+
+// TestLoadSmux 测试文件中未设置的smux参数取默认值
+func TestLoadSmux(t *testing.T) {
+	path := t.TempDir() + "/smux.json"
+	os.WriteFile(path, []byte(`{"smux": {"version": 2}}`), 0o600)
+	t.Setenv("SAFEUDP_SMUX_MAXFRAMESIZE", "8192")
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Smux.Version != 2 || loaded.Smux.MaxFrameSize != 8192 || loaded.Smux.KeepAliveInterval != smux.DefaultConfig().KeepAliveInterval {
+		t.Fatalf("smux config loaded as %+v", *loaded.Smux)
+	}
+}
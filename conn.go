@@ -1,6 +1,6 @@
 /*
 @Author: Lzww
-@LastEditTime: 2025-8-25 22:08:25
+@LastEditTime: 2025-10-17 17:42:09
 @Description: Conn
 @Language: Go 1.23.4
 */
@@ -8,17 +8,73 @@
 package safeudp
 
 import (
+	"context"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/xtaci/smux"
 )
 
 type Conn struct {
-	// point to the underlying smux stream
-	stream *smux.Stream
-	// point to the parent session
+	// point to the underlying smux stream, or the session itself with NoMux
+	stream net.Conn
+	// point to the parent session, nil with NoMux
 	sess *smux.Session
+	// encrypted with an ephemeral key agreed without authentication
+	unauthenticated bool
+	// the connection of the Config.Handshake backend, nil without one
+	secured net.Conn
+	// closing the connection closes its session and socket, as it was dialed
+	owner bool
+
+	// deadlines set by the application, restored after a context cancellation
+	rd, wd time.Time
+	mu     sync.Mutex
+}
+
+// aLongTimeAgo is a deadline in the past, used to abort blocked calls
+var aLongTimeAgo = time.Unix(1, 0)
+
+// errNoMux is the error of stream operations on a connection without smux
+var errNoMux = errors.New("connection without a multiplexer, see Config.NoMux")
+
+// OpenStream opens another stream over the session of the connection, which
+// the remote takes with AcceptStream. The streams share the session and its
+// encryption, and fail once the session closes.
+func (c *Conn) OpenStream() (*Conn, error) {
+	if c.sess == nil {
+		return nil, errors.WithStack(errNoMux)
+	}
+	stream, err := c.sess.OpenStream()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Conn{stream: stream, sess: c.sess, unauthenticated: c.unauthenticated, secured: c.secured}, nil
+}
+
+// AcceptStream waits for the next stream the remote opens over the session of
+// the connection with OpenStream. The first stream of a session is returned
+// by StreamListener.Accept and DialContext, not by AcceptStream.
+func (c *Conn) AcceptStream() (*Conn, error) {
+	if c.sess == nil {
+		return nil, errors.WithStack(errNoMux)
+	}
+	stream, err := c.sess.AcceptStream()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Conn{stream: stream, sess: c.sess, unauthenticated: c.unauthenticated, secured: c.secured}, nil
+}
+
+// CloseSession closes the session of the connection with all its streams,
+// Close closes only the stream unless the connection was dialed.
+func (c *Conn) CloseSession() error {
+	if c.sess == nil {
+		return c.stream.Close()
+	}
+	return c.sess.Close()
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
@@ -29,26 +85,99 @@ func (c *Conn) Write(b []byte) (int, error) {
 	return c.stream.Write(b)
 }
 
+// ReadContext reads like Read, and returns ctx.Err() if the context is done
+// while blocked, the read deadline still applies.
+func (c *Conn) ReadContext(ctx context.Context, b []byte) (int, error) {
+	return c.withContext(ctx, c.stream.Read, b, c.stream.SetReadDeadline, &c.rd)
+}
+
+// WriteContext writes like Write, and returns ctx.Err() if the context is done
+// while blocked, a part of 'b' may have been written in that case.
+func (c *Conn) WriteContext(ctx context.Context, b []byte) (int, error) {
+	return c.withContext(ctx, c.stream.Write, b, c.stream.SetWriteDeadline, &c.wd)
+}
+
+// withContext runs 'op', and aborts it by moving its deadline to the past once
+// ctx is done, the deadline of the application is restored afterwards.
+func (c *Conn) withContext(ctx context.Context, op func([]byte) (int, error), b []byte,
+	setDeadline func(time.Time) error, deadline *time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	aborted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		setDeadline(aLongTimeAgo)
+		c.mu.Unlock()
+		close(aborted)
+	})
+
+	n, err := op(b)
+	if !stop() {
+		<-aborted
+		c.mu.Lock()
+		setDeadline(*deadline)
+		c.mu.Unlock()
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// Unauthenticated reports whether the connection is encrypted with an
+// ephemeral key agreed without authentication, as the config had no Key. It
+// is safe from eavesdroppers, not from a man in the middle, who can agree on
+// keys with both ends; use a pre-shared Key or a Config.Handshake backend
+// to authenticate the peer.
+func (c *Conn) Unauthenticated() bool {
+	return c.unauthenticated
+}
+
+// Secured returns the connection of the Config.Handshake backend the session
+// runs over, such as a *tls.Conn of package tlshandshake for its ConnectionState with
+// the peer certificates and the ALPN protocol, nil without a backend. Reads
+// and writes go through the Conn.
+func (c *Conn) Secured() net.Conn {
+	return c.secured
+}
+
+// Close closes the stream. The connection of DialContext and DialStream owns
+// its session: closing it closes the session, with the other streams, and
+// its socket.
 func (c *Conn) Close() error {
+	if c.owner {
+		return c.CloseSession()
+	}
 	return c.stream.Close()
 }
 
 func (c *Conn) LocalAddr() net.Addr {
-	return c.sess.LocalAddr()
+	return c.stream.LocalAddr()
 }
 
 func (c *Conn) RemoteAddr() net.Addr {
-	return c.sess.RemoteAddr()
+	return c.stream.RemoteAddr()
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rd, c.wd = t, t
 	return c.stream.SetDeadline(t)
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rd = t
 	return c.stream.SetReadDeadline(t)
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wd = t
 	return c.stream.SetWriteDeadline(t)
 }
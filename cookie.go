@@ -0,0 +1,161 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-8 14:37:25
+@Description: Stateless cookies against spoofed session floods
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cookieSize is the MAC carried in the ts, sn and una fields of an
+	// IKCP_CMD_COOKIE segment without data, so packet processors, which keep
+	// the first segment header, never change it
+	cookieSize = 12
+
+	// cookiePeriod is the time bucket of cookies, a cookie is accepted in its
+	// bucket and the next
+	cookiePeriod = 10 * time.Second
+)
+
+// cookieKey issues and checks the cookies of a listener
+type cookieKey struct {
+	macs sync.Pool // hash.Hash, HMAC-SHA256 with the secret of the listener
+}
+
+func newCookieKey() *cookieKey {
+	secret := make([]byte, 32)
+	crand.Read(secret)
+	return &cookieKey{macs: sync.Pool{New: func() any { return hmac.New(sha256.New, secret) }}}
+}
+
+// cookie returns the cookie of conversation 'conv' from 'addr' in a time bucket
+func (k *cookieKey) cookie(addr netip.AddrPort, conv uint32, bucket int64) []byte {
+	var msg [8 + 16 + 2 + 4]byte
+	binary.LittleEndian.PutUint64(msg[:], uint64(bucket))
+	ip := addr.Addr().As16()
+	copy(msg[8:], ip[:])
+	binary.LittleEndian.PutUint16(msg[24:], addr.Port())
+	binary.LittleEndian.PutUint32(msg[26:], conv)
+
+	mac := k.macs.Get().(hash.Hash)
+	defer k.macs.Put(mac)
+	mac.Reset()
+	mac.Write(msg[:])
+	return mac.Sum(nil)[:cookieSize]
+}
+
+// verify reports whether the KCP packet starts with a valid cookie for
+// conversation 'conv' from 'addr', invalid cookies are counted in 'snmp'
+func (k *cookieKey) verify(kcpPacket []byte, addr netip.AddrPort, conv uint32, snmp *Snmp) bool {
+	if len(kcpPacket) < IKCP_OVERHEAD || kcpPacket[4] != IKCP_CMD_COOKIE {
+		return false // the first packet of the client, no cookie yet
+	}
+	presented := kcpPacket[8 : 8+cookieSize]
+	bucket := time.Now().Unix() / int64(cookiePeriod/time.Second)
+	for _, b := range []int64{bucket, bucket - 1} {
+		if hmac.Equal(presented, k.cookie(addr, conv, b)) {
+			return true
+		}
+	}
+	atomic.AddUint64(&snmp.CookieRejects, 1)
+	return false
+}
+
+// SetStatelessCookies makes the listener answer the first packet of an unknown
+// conversation with a cookie instead of creating a session, and create it only
+// once the client echoes the cookie from the same address. Floods from spoofed
+// addresses then cost the server no memory, and the answer is never larger
+// than the packet it answers. The handshake costs new sessions a round trip.
+//
+// Clients of this version echo cookies without any setting.
+func (l *Listener) SetStatelessCookies(enable bool) {
+	if !enable {
+		l.cookies.Store(nil)
+	} else if l.cookies.Load() == nil {
+		l.cookies.Store(newCookieKey())
+	}
+}
+
+// challenge answers the first packet of a conversation with a cookie
+func (l *Listener) challenge(k *cookieKey, addr net.Addr, dst pktinfo, key netip.AddrPort, conv uint32) {
+	bucket := time.Now().Unix() / int64(cookiePeriod/time.Second)
+	c := k.cookie(key, conv, bucket)
+
+	seg := segment{conv: conv, cmd: IKCP_CMD_COOKIE}
+	seg.ts = binary.LittleEndian.Uint32(c)
+	seg.sn = binary.LittleEndian.Uint32(c[4:])
+	seg.una = binary.LittleEndian.Uint32(c[8:])
+	if l.writeBare(&seg, addr, dst) == nil {
+		atomic.AddUint64(&l.Snmp().CookieChallenges, 1)
+	}
+}
+
+// writeBare sends a segment without data to 'addr' from 'dst' outside of any
+// session, encrypted with the cipher of the listener but without FEC or packet
+// processors
+func (l *Listener) writeBare(seg *segment, addr net.Addr, dst pktinfo) error {
+	headerSize := 0
+	if l.block != nil {
+		headerSize = cryptHeaderSize
+	}
+	buf := make([]byte, headerSize+IKCP_OVERHEAD)
+	seg.encode(buf[headerSize:])
+	atomic.AddUint64(&l.Snmp().OutSegs, 1)
+
+	if l.block != nil {
+		crand.Read(buf[:nonceSize])
+		checksum := crc32.ChecksumIEEE(buf[cryptHeaderSize:])
+		binary.LittleEndian.PutUint32(buf[nonceSize:], checksum)
+		l.block.Encrypt(buf, buf)
+	}
+	if dst.addr.IsValid() {
+		if uc, ok := l.conn.(*net.UDPConn); ok {
+			if ua, ok := addr.(*net.UDPAddr); ok {
+				_, _, err := uc.WriteMsgUDP(buf, pktinfoControl(dst), ua)
+				return err
+			}
+		}
+	}
+	_, err := l.conn.WriteTo(buf, addr)
+	return err
+}
+
+// isBare reports whether a packet is a bare IKCP_CMD_COOKIE or IKCP_CMD_RESET
+// segment, which listeners send without the packet processors of the session
+func isBare(data []byte) bool {
+	return len(data) == IKCP_OVERHEAD && (data[4] == IKCP_CMD_COOKIE || data[4] == IKCP_CMD_RESET)
+}
+
+// onCookie is invoked by KCP with the session lock held, with the cookie
+// demanded by the listener on the client
+func (s *UDPSession) onCookie(cookie []byte) {
+	if s.l != nil || bytes.Equal(s.kcp.cookie, cookie) {
+		return
+	}
+	s.kcp.cookie = append(s.kcp.cookie[:0], cookie...)
+	s.traceEvent(TraceHandshake, "cookie demanded by %v", s.remoteAddr())
+
+	// the listener dropped the segments sent so far, send them again with
+	// the cookie in front as if they were new
+	for seg := range s.kcp.snd_buf.ForEach {
+		if seg.acked == 0 {
+			seg.xmit = 0
+		}
+	}
+}
@@ -1,3 +1,5 @@
+//go:build !safeudp_nocrypto
+
 /*
 @Author: Lzww
 @LastEditTime: 2025-9-2 16:22:58
@@ -13,8 +15,12 @@ import (
 	"crypto/des"
 	"crypto/sha1"
 	"crypto/subtle"
+	"maps"
+	"slices"
 	"unsafe"
 
+	"github.com/pkg/errors"
+
 	"github.com/tjfoc/gmsm/sm4"
 
 	"golang.org/x/crypto/blowfish"
@@ -26,6 +32,46 @@ import (
 	"golang.org/x/crypto/xtea"
 )
 
+// cryptoEnabled is false in builds with the safeudp_nocrypto tag
+const cryptoEnabled = true
+
+// keyBlockCrypt returns the cipher for Config.Key, AES of the key length
+func keyBlockCrypt(key []byte) (BlockCrypt, error) { return NewAESBlockCrypt(key) }
+
+// ciphers are the ciphers of Config.Cipher by name, the names of kcptun
+var ciphers = map[string]func(key []byte) (BlockCrypt, error){
+	"aes":      NewAESBlockCrypt,
+	"aes-128":  func(key []byte) (BlockCrypt, error) { return NewAESBlockCrypt(key[:min(len(key), 16)]) },
+	"aes-192":  func(key []byte) (BlockCrypt, error) { return NewAESBlockCrypt(key[:min(len(key), 24)]) },
+	"none":     NewNoneBlockCrypt,
+	"sm4":      NewSM4BlockCrypt,
+	"twofish":  NewTwofishBlockCrypt,
+	"3des":     NewTripleDESBlockCrypt,
+	"cast5":    NewCast5BlockCrypt,
+	"blowfish": NewBlowfishBlockCrypt,
+	"tea":      NewTEABlockCrypt,
+	"xtea":     NewXTEABlockCrypt,
+	"salsa20":  NewSalsa20BlockCrypt,
+	"xor":      NewSimpleXORBlockCrypt,
+}
+
+// CipherNames returns the names of the ciphers Config.Cipher selects, sorted.
+func CipherNames() []string {
+	return slices.Sorted(maps.Keys(ciphers))
+}
+
+// namedBlockCrypt returns the cipher 'name' of the key, AES if empty
+func namedBlockCrypt(name string, key []byte) (BlockCrypt, error) {
+	if name == "" {
+		return keyBlockCrypt(key)
+	}
+	newCrypt, ok := ciphers[name]
+	if !ok {
+		return nil, errors.Errorf("unknown cipher %q", name)
+	}
+	return newCrypt(key)
+}
+
 var (
 	// a defined initial vector
 	// https://en.wikipedia.org/wiki/Block_cipher_mode_of_operation#Initialization_vector_.28IV.29
@@ -36,19 +82,6 @@ var (
 	saltxor       = `sH3CIVoF#rWLtJo6`
 )
 
-// BlockCrypt defines encryption/decryption methods for a given byte slice.
-// Notes on implementing: the data to be encrypted contains a builtin
-// nonce at the first 16 bytes
-type BlockCrypt interface {
-	// Encrypt encrypts the whole block in src into dst.
-	// Dst and src may point at the same memory.
-	Encrypt(dst, src []byte)
-
-	// Decrypt decrypts the whole block in src into dst.
-	// Dst and src may point at the same memory.
-	Decrypt(dst, src []byte)
-}
-
 type salsa20BlockCrypt struct {
 	key [32]byte
 }
@@ -88,6 +121,7 @@ func NewSM4BlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *sm4BlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
 func (c *sm4BlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *sm4BlockCrypt) clone() BlockCrypt       { return &sm4BlockCrypt{block: c.block} }
 
 type twofishBlockCrypt struct {
 	encbuf [twofish.BlockSize]byte
@@ -108,6 +142,7 @@ func NewTwofishBlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *twofishBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
 func (c *twofishBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *twofishBlockCrypt) clone() BlockCrypt       { return &twofishBlockCrypt{block: c.block} }
 
 type tripleDESBlockCrypt struct {
 	encbuf [des.BlockSize]byte
@@ -128,6 +163,7 @@ func NewTripleDESBlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *tripleDESBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
 func (c *tripleDESBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *tripleDESBlockCrypt) clone() BlockCrypt       { return &tripleDESBlockCrypt{block: c.block} }
 
 type cast5BlockCrypt struct {
 	encbuf [cast5.BlockSize]byte
@@ -148,6 +184,7 @@ func NewCast5BlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *cast5BlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
 func (c *cast5BlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *cast5BlockCrypt) clone() BlockCrypt       { return &cast5BlockCrypt{block: c.block} }
 
 type blowfishBlockCrypt struct {
 	encbuf [blowfish.BlockSize]byte
@@ -168,6 +205,7 @@ func NewBlowfishBlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *blowfishBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
 func (c *blowfishBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *blowfishBlockCrypt) clone() BlockCrypt       { return &blowfishBlockCrypt{block: c.block} }
 
 type aesBlockCrypt struct {
 	encbuf [aes.BlockSize]byte
@@ -188,6 +226,7 @@ func NewAESBlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *aesBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
 func (c *aesBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *aesBlockCrypt) clone() BlockCrypt       { return &aesBlockCrypt{block: c.block} }
 
 type teaBlockCrypt struct {
 	encbuf [tea.BlockSize]byte
@@ -208,6 +247,7 @@ func NewTEABlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *teaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
 func (c *teaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *teaBlockCrypt) clone() BlockCrypt       { return &teaBlockCrypt{block: c.block} }
 
 type xteaBlockCrypt struct {
 	encbuf [xtea.BlockSize]byte
@@ -228,6 +268,7 @@ func NewXTEABlockCrypt(key []byte) (BlockCrypt, error) {
 
 func (c *xteaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf[:]) }
 func (c *xteaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf[:]) }
+func (c *xteaBlockCrypt) clone() BlockCrypt       { return &xteaBlockCrypt{block: c.block} }
 
 type simpleXORBlockCrypt struct {
 	xortbl []byte
@@ -243,16 +284,6 @@ func NewSimpleXORBlockCrypt(key []byte) (BlockCrypt, error) {
 func (c *simpleXORBlockCrypt) Encrypt(dst, src []byte) { subtle.XORBytes(dst, src, c.xortbl) }
 func (c *simpleXORBlockCrypt) Decrypt(dst, src []byte) { subtle.XORBytes(dst, src, c.xortbl) }
 
-type noneBlockCrypt struct{}
-
-// NewNoneBlockCrypt does nothing but copying
-func NewNoneBlockCrypt(key []byte) (BlockCrypt, error) {
-	return new(noneBlockCrypt), nil
-}
-
-func (c *noneBlockCrypt) Encrypt(dst, src []byte) { copy(dst, src) }
-func (c *noneBlockCrypt) Decrypt(dst, src []byte) { copy(dst, src) }
-
 // packet encryption with local CFB mode
 func encrypt(block cipher.Block, dst, src, buf []byte) {
 	switch block.BlockSize() {
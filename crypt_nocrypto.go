@@ -0,0 +1,28 @@
+//go:build safeudp_nocrypto
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-19 11:41:52
+@Description: Builds without the bundled ciphers
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "github.com/pkg/errors"
+
+// cryptoEnabled is false in builds with the safeudp_nocrypto tag, only
+// NewNoneBlockCrypt and application provided BlockCrypt implementations
+// are available.
+const cryptoEnabled = false
+
+// keyBlockCrypt fails, Config.Key needs the bundled ciphers
+func keyBlockCrypt(key []byte) (BlockCrypt, error) { return nil, errors.WithStack(errCryptoDisabled) }
+
+// CipherNames returns no names, Config.Cipher needs the bundled ciphers
+func CipherNames() []string { return nil }
+
+// namedBlockCrypt fails, Config.Cipher needs the bundled ciphers
+func namedBlockCrypt(name string, key []byte) (BlockCrypt, error) {
+	return nil, errors.WithStack(errCryptoDisabled)
+}
@@ -0,0 +1,249 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:12:40
+@Description: Dialing multiplexed streams with a context
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// happyEyeballsDelay is the head start of a dial attempt before the next
+// address is tried, as recommended by RFC 8305
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// DialContext connects to "raddr" with the settings of 'config' and opens a
+// stream multiplexed with smux over the session, the client side of
+// StreamListener. It returns once the server has acknowledged the stream.
+//
+// When the host resolves to several addresses, they are tried in the order of
+// RFC 8305, alternating IPv6 and IPv4 from the first IPv6 address: each attempt
+// gets a head start of 250ms, or until it fails, before the next one starts,
+// and the first to complete its handshake wins, the others are closed.
+//
+// The name resolution and the handshake stop when the context is done, with
+// ctx.Err(), and a session failing before the server answers, for instance
+// with ErrReset or ErrVersion, fails with ErrHandshake wrapping its error, the
+// error of the first address if all fail. The sockets are closed on any
+// failure. Once established, the connection is not affected by the context.
+// It owns the session and its socket, which Close closes with any other
+// streams of the session.
+//
+// Without Config.Key an ephemeral key is agreed with the server first, see
+// Conn.Unauthenticated, unless Config.Plaintext is set. With
+// Config.Handshake the backend secures the session instead.
+//
+// With Config.NoMux the connection is the session itself, without smux
+// framing, and it returns without a handshake: the server accepts the session
+// once the first write arrives. Unless a key is agreed, the first address
+// then wins at once.
+func DialContext(ctx context.Context, raddr string, config *Config) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	addrs, err := resolveUDPAddrs(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 1 {
+		return dialAttempt(ctx, addrs[0], config)
+	}
+	return dialRace(ctx, addrs, config, happyEyeballsDelay)
+}
+
+// dialAttempt dials a single address and completes the handshake of
+// DialContext on it
+func dialAttempt(ctx context.Context, addr *net.UDPAddr, config *Config) (*Conn, error) {
+	s, err := dialWithConfig(ctx, addr.String(), config)
+	if err != nil {
+		return nil, err
+	}
+	var stream, secured net.Conn = s, nil
+	if config.agreesKey() {
+		if stream, err = agreeKey(ctx, s, true); err != nil {
+			s.Close()
+			return nil, err
+		}
+	} else if config.Handshake != nil {
+		if secured, err = runHandshake(ctx, config.Handshake, s, true); err != nil {
+			s.Close()
+			return nil, err
+		}
+		stream = secured
+	}
+	if config.NoMux {
+		return &Conn{stream: stream, unauthenticated: config.agreesKey(), secured: secured, owner: true}, nil
+	}
+	conn, err := clientStream(ctx, s, stream, config.Smux)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	conn.unauthenticated, conn.secured, conn.owner = config.agreesKey(), secured, true
+	return conn, nil
+}
+
+// dialResult is the outcome of an attempt of dialRace
+type dialResult struct {
+	conn *Conn
+	err  error
+}
+
+// dialRace dials 'addrs' in order, starting the next attempt after 'delay' or
+// as soon as the running ones have failed, and returns the first connection
+// established. The attempts still running are canceled and the connections
+// they establish anyway are closed.
+func dialRace(ctx context.Context, addrs []*net.UDPAddr, config *Config, delay time.Duration) (*Conn, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	next, running := 0, 0
+	start := func() {
+		go func(addr *net.UDPAddr) {
+			conn, err := dialAttempt(raceCtx, addr, config)
+			results <- dialResult{conn, err}
+		}(addrs[next])
+		next++
+		running++
+		timer.Reset(delay)
+	}
+
+	var firstErr error
+	for start(); running > 0; {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+			}
+		case r := <-results:
+			running--
+			if r.err == nil {
+				cancel()
+				go closeLosers(results, running)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) { // no need to wait for the head start
+				start()
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, firstErr
+}
+
+// closeLosers closes the connections of the 'running' attempts a race has not
+// waited for
+func closeLosers(results <-chan dialResult, running int) {
+	for range running {
+		if r := <-results; r.err == nil {
+			r.conn.CloseSession()
+		}
+	}
+}
+
+// resolveUDPAddrs resolves "raddr" like net.ResolveUDPAddr until the context is
+// done, to all the addresses of the host, alternating IPv6 and IPv4 addresses
+// from the first IPv6 one
+func resolveUDPAddrs(ctx context.Context, raddr string) ([]*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", service)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if host == "" {
+		return []*net.UDPAddr{{Port: port}}, nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for _, ip := range interleaveFamilies(ips) {
+		addrs = append(addrs, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))))
+	}
+	return addrs, nil
+}
+
+// interleaveFamilies orders addresses by alternating families, IPv6 first if
+// there is any, keeping the order of the resolver within a family
+func interleaveFamilies(ips []netip.Addr) []netip.Addr {
+	var v6, v4 []netip.Addr
+	for _, ip := range ips {
+		if ip = ip.Unmap(); ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	ordered := make([]netip.Addr, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
+
+// clientStream opens a smux stream over 'conn', the session or the agreed
+// encryption or handshake of it, and waits until the server acknowledges it, nil 'config'
+// for the smux defaults
+func clientStream(ctx context.Context, s *UDPSession, conn net.Conn, config *smux.Config) (*Conn, error) {
+	session, err := smux.Client(conn, config)
+	if err != nil {
+		return nil, handshakeFailed(err)
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, handshakeFailed(err)
+	}
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for !s.acknowledged() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			session.Close()
+			return nil, ctx.Err()
+		case <-s.chSocketReadError:
+			session.Close()
+			return nil, handshakeFailed(s.socketReadError.Load().(error))
+		case <-s.die:
+			session.Close()
+			return nil, errors.WithStack(ErrClosed)
+		}
+	}
+	return &Conn{stream: stream, sess: session}, nil
+}
+
+// acknowledged reports whether the remote has acknowledged any data of the session
+func (s *UDPSession) acknowledged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.snd_una != 0
+}
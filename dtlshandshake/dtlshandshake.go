@@ -0,0 +1,196 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 11:48:19
+@Description: DTLS handshake backend
+@Language: Go 1.23.4
+*/
+
+// Package dtlshandshake secures the stream connections of safe-udp with DTLS
+// of github.com/pion/dtls, see safeudp.Config.Handshake. The library
+// implements DTLS 1.2, DTLS 1.3 is not available in Go yet. It is apart from
+// safeudp so that programs with a pre-shared key do not carry the library.
+package dtlshandshake
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+
+	"github.com/pion/dtls/v3"
+	dtlsnet "github.com/pion/dtls/v3/pkg/net"
+
+	safeudp "safe-udp"
+)
+
+const (
+	// recordSize is the most data written in a record, its datagram stays
+	// within the 8192 bytes pion/dtls reads at once
+	recordSize = 4096
+
+	// recordOverhead bounds the header, explicit IV, MAC and padding of a record
+	recordOverhead = 128
+)
+
+// New returns a safeudp.HandshakeBackend running DTLS with 'config' over the
+// sessions, which carry its records as datagrams under safeudp.WriteMessage,
+// the backend sets it. Servers set Certificates
+// and SupportedProtocols for ALPN, clients ServerName, RootCAs and
+// SupportedProtocols; both set a SessionStore, see NewSessionStore, to resume
+// sessions. The connections are *Conn, see safeudp.Conn.Secured.
+func New(config *dtls.Config) safeudp.HandshakeBackend {
+	c := *config
+	return dtlsHandshake{&c}
+}
+
+type dtlsHandshake struct {
+	config *dtls.Config
+}
+
+func (h dtlsHandshake) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	size := messages(conn)
+	c, err := dtls.Client(dtlsnet.PacketConnFromConn(conn), conn.RemoteAddr(), h.config)
+	if err != nil {
+		return nil, err
+	}
+	return handshake(ctx, c, size)
+}
+
+func (h dtlsHandshake) Server(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	size := messages(conn)
+	c, err := dtls.Server(dtlsnet.PacketConnFromConn(conn), conn.RemoteAddr(), h.config)
+	if err != nil {
+		return nil, err
+	}
+	return handshake(ctx, c, size)
+}
+
+// messages sends each write of a session as one message, so that a record
+// arrives as a datagram instead of split into segments, and returns the most
+// data of a record the session carries
+func messages(conn net.Conn) int {
+	s, ok := conn.(*safeudp.UDPSession)
+	if !ok {
+		return recordSize
+	}
+	s.SetWritePolicy(safeudp.WriteMessage)
+	return max(min(recordSize, s.MaxMessageSize()-recordOverhead), 1)
+}
+
+// handshake runs the handshake of 'c', which is closed if it fails, and
+// writes records of at most 'size' bytes of data
+func handshake(ctx context.Context, c *dtls.Conn, size int) (net.Conn, error) {
+	if err := c.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &Conn{Conn: c, size: size}, nil
+}
+
+// Conn is a DTLS connection read and written as a stream: writes are split
+// into records and the rest of a record too large for a read is kept for the
+// next ones. The embedded *dtls.Conn gives its ConnectionState.
+type Conn struct {
+	*dtls.Conn
+	size int // most data of a record written
+
+	rmu  sync.Mutex
+	buf  []byte // record read
+	rest []byte // unread rest of buf
+
+	wmu sync.Mutex
+}
+
+// Read reads the data of the records in order
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.rest) == 0 {
+		if len(b) >= recordSize {
+			return c.Conn.Read(b)
+		}
+		if c.buf == nil {
+			c.buf = make([]byte, recordSize)
+		}
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.rest = c.buf[:n]
+	}
+	n := copy(b, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// Write writes 'b' in records small enough for a message of the session
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for len(b) > 0 {
+		size := min(len(b), c.size)
+		if _, err = c.Conn.Write(b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// NewSessionStore returns a dtls.SessionStore in memory keeping the last
+// 'capacity' sessions, for clients and servers to resume sessions
+func NewSessionStore(capacity int) dtls.SessionStore {
+	return &sessionStore{capacity: capacity, sessions: make(map[string]*list.Element), order: list.New()}
+}
+
+// sessionStore is a least recently used cache of sessions
+type sessionStore struct {
+	mu       sync.Mutex
+	capacity int
+	sessions map[string]*list.Element
+	order    *list.List // of *storedSession, most recent first
+}
+
+type storedSession struct {
+	key     string
+	session dtls.Session
+}
+
+func (s *sessionStore) Set(key []byte, session dtls.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.sessions[string(key)]; ok {
+		e.Value.(*storedSession).session = session
+		s.order.MoveToFront(e)
+		return nil
+	}
+	s.sessions[string(key)] = s.order.PushFront(&storedSession{string(key), session})
+	for s.order.Len() > s.capacity {
+		e := s.order.Back()
+		s.order.Remove(e)
+		delete(s.sessions, e.Value.(*storedSession).key)
+	}
+	return nil
+}
+
+// Get returns an empty session for an unknown key, as pion/dtls expects
+func (s *sessionStore) Get(key []byte) (dtls.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.sessions[string(key)]; ok {
+		s.order.MoveToFront(e)
+		return e.Value.(*storedSession).session, nil
+	}
+	return dtls.Session{}, nil
+}
+
+func (s *sessionStore) Del(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.sessions[string(key)]; ok {
+		s.order.Remove(e)
+		delete(s.sessions, string(key))
+	}
+	return nil
+}
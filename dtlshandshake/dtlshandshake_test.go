@@ -0,0 +1,148 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 11:48:19
+@Description: DTLS handshake backend tests
+@Language: Go 1.23.4
+*/
+
+package dtlshandshake
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+
+	safeudp "safe-udp"
+)
+
+// TestNew 测试DTLS握手后端：证书校验、ALPN、会话恢复、大于记录的读写以及失败的握手
+func TestNew(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"safe-udp.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	for _, noMux := range []bool{false, true} {
+		server := &safeudp.Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, NoMux: noMux,
+			Handshake: New(&dtls.Config{
+				Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+				SupportedProtocols: []string{"echo"},
+				SessionStore:       NewSessionStore(4),
+			})}
+		if err := server.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		sl, err := safeudp.ListenStream("127.0.0.1:0", server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := sl.Accept()
+				if err != nil {
+					if errors.Is(err, safeudp.ErrHandshake) {
+						continue
+					}
+					return
+				}
+				go io.Copy(conn, conn)
+			}
+		}()
+
+		client := *server
+		client.Handshake = New(&dtls.Config{ServerName: "safe-udp.test", RootCAs: roots,
+			SupportedProtocols: []string{"echo"}, SessionStore: NewSessionStore(4)})
+		var sessionID []byte
+		for i := 0; i < 2; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			conn, err := safeudp.DialContext(ctx, sl.Addr().String(), &client)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn.Unauthenticated() {
+				t.Fatal("handshake flagged unauthenticated")
+			}
+			dc, ok := conn.Secured().(*Conn)
+			if !ok {
+				t.Fatal("no dtlshandshake.Conn", conn.Secured())
+			}
+			state, _ := dc.ConnectionState()
+			if i == 0 {
+				if len(state.PeerCertificates) != 1 || !bytes.Equal(state.PeerCertificates[0], der) {
+					t.Fatal("peer certificates", len(state.PeerCertificates))
+				}
+				if state.NegotiatedProtocol != "echo" {
+					t.Fatal("negotiated protocol", state.NegotiatedProtocol)
+				}
+				sessionID = state.SessionID
+			} else if !bytes.Equal(state.SessionID, sessionID) {
+				// 第二次连接恢复第一次的会话
+				t.Fatal("session not resumed", noMux)
+			}
+
+			// 大于一个记录的写入被分成多个记录，读取时拼回
+			msg := bytes.Repeat([]byte("certified "), 2000)
+			go conn.Write(msg)
+			got := make([]byte, len(msg))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+				t.Fatal(err, noMux)
+			}
+			conn.Close()
+		}
+
+		// 不信任服务器证书的客户端握手失败
+		client.Handshake = New(&dtls.Config{ServerName: "safe-udp.test"})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = safeudp.DialContext(ctx, sl.Addr().String(), &client)
+		cancel()
+		if !errors.Is(err, safeudp.ErrHandshake) {
+			t.Fatal("untrusted certificate accepted:", err)
+		}
+		sl.Close()
+	}
+}
+
+// TestSessionStore 测试会话缓存按最近使用淘汰
+func TestSessionStore(t *testing.T) {
+	store := NewSessionStore(2)
+	for _, key := range []string{"a", "b"} {
+		store.Set([]byte(key), dtls.Session{ID: []byte(key)})
+	}
+	store.Get([]byte("a"))
+	store.Set([]byte("c"), dtls.Session{ID: []byte("c")})
+	for key, kept := range map[string]bool{"a": true, "b": false, "c": true} {
+		if s, _ := store.Get([]byte(key)); (s.ID != nil) != kept {
+			t.Fatal("session", key, "kept", s.ID != nil)
+		}
+	}
+	store.Del([]byte("a"))
+	if s, _ := store.Get([]byte("a")); s.ID != nil {
+		t.Fatal("deleted session kept")
+	}
+}
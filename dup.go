@@ -0,0 +1,131 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-16 19:27:03
+@Description: Adaptive packet duplication
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dupInterval is the interval the loss rate is measured over
+	dupInterval = time.Second
+
+	// dupMinSegs is the minimum number of segments sent in an interval for the loss rate to be meaningful
+	dupMinSegs = 32
+)
+
+// dupPolicy enables packet duplication when the measured loss rate exceeds
+// a threshold and the RTT is still within budget.
+//
+// The state is protected by the session lock.
+type dupPolicy struct {
+	maxDup    int
+	threshold float64       // loss rate enabling duplication
+	rttBudget time.Duration // duplication is disabled if the smoothed RTT exceeds this
+
+	lastCheck   time.Time
+	lastOut     uint64
+	lastRetrans uint64
+}
+
+// next returns the number of duplicated copies for the measured loss and RTT
+func (p *dupPolicy) next(current int, loss float64, srtt time.Duration) int {
+	if p.rttBudget > 0 && srtt > p.rttBudget {
+		// the path is congested, more traffic would make it worse
+		return 0
+	}
+
+	if loss < p.threshold {
+		// hysteresis, keep duplicating until the loss has dropped clearly below the threshold
+		if current > 0 && loss >= p.threshold/2 {
+			return current
+		}
+		return 0
+	}
+
+	n := int(loss / p.threshold)
+	if n > p.maxDup {
+		n = p.maxDup
+	}
+	return n
+}
+
+// SetDup sets the number of extra copies sent of each packet, trading bandwidth
+// for lower latency on lossy paths. Adaptive duplication is disabled.
+func (s *UDPSession) SetDup(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adaptDup = nil
+	atomic.StoreInt32(&s.dup, int32(n))
+}
+
+// GetDup returns the number of extra copies currently sent of each packet
+func (s *UDPSession) GetDup() int { return int(atomic.LoadInt32(&s.dup)) }
+
+// SetAdaptiveDup enables duplication on demand: the loss rate of the session is
+// measured every second, and when it exceeds 'lossThreshold' (0 < lossThreshold < 1)
+// each packet is sent up to 'maxDup' extra times, one more copy per multiple of the
+// threshold. Duplication is turned off while the smoothed RTT is above 'rttBudget',
+// 0 means no budget.
+//
+// A 'maxDup' of 0 disables duplication.
+func (s *UDPSession) SetAdaptiveDup(maxDup int, lossThreshold float64, rttBudget time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	atomic.StoreInt32(&s.dup, 0)
+	if maxDup <= 0 || lossThreshold <= 0 || lossThreshold >= 1 {
+		s.adaptDup = nil
+		return
+	}
+
+	s.adaptDup = &dupPolicy{
+		maxDup:      maxDup,
+		threshold:   lossThreshold,
+		rttBudget:   rttBudget,
+		lastCheck:   time.Now(),
+		lastOut:     s.kcp.out_segs,
+		lastRetrans: s.kcp.retrans_segs,
+	}
+}
+
+// adjustDup re-evaluates adaptive duplication, the caller must hold the session lock
+func (s *UDPSession) adjustDup() {
+	p := s.adaptDup
+	if p == nil {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(p.lastCheck) < dupInterval {
+		return
+	}
+
+	out := s.kcp.out_segs - p.lastOut
+	if out < dupMinSegs {
+		return
+	}
+
+	loss := float64(s.kcp.retrans_segs-p.lastRetrans) / float64(out)
+	srtt := time.Duration(s.kcp.rx_srtt) * time.Millisecond
+	current := int(atomic.LoadInt32(&s.dup))
+	n := p.next(current, loss, srtt)
+	if n != current {
+		s.logEvent("duplication %d -> %d, loss %.3f", current, n, loss)
+	}
+	atomic.StoreInt32(&s.dup, int32(n))
+
+	p.lastCheck = now
+	p.lastOut = s.kcp.out_segs
+	p.lastRetrans = s.kcp.retrans_segs
+}
@@ -0,0 +1,57 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-16 21:48:30
+@Description: Bounded buffering of data arriving before a session is accepted
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "sync/atomic"
+
+// defaultEarlyDataLimit is the number of bytes buffered by a session before it is accepted
+const defaultEarlyDataLimit = 64 * 1024
+
+// SetEarlyDataLimit sets the number of bytes a new session buffers between its
+// first packet and the application's Accept, at least two segments are buffered.
+//
+// Data beyond the limit is not dropped, the session advertises a receive window
+// of the limit until it is accepted, so the remote holds the rest back and the
+// full window is restored by Accept.
+func (l *Listener) SetEarlyDataLimit(bytes int) {
+	atomic.StoreInt64(&l.earlyDataLimit, int64(bytes))
+}
+
+// EarlyDataLimit returns the number of bytes a new session buffers before it is accepted
+func (l *Listener) EarlyDataLimit() int {
+	return int(atomic.LoadInt64(&l.earlyDataLimit))
+}
+
+// holdEarlyData limits the receive window of a session waiting to be accepted
+func (s *UDPSession) holdEarlyData(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the window bounds both the receive queue and the reordering buffer
+	wnd := uint32(limit) / s.kcp.mss / 2
+	if limit <= 0 || wnd == 0 {
+		wnd = 1
+	}
+
+	if wnd < s.kcp.rcv_wnd {
+		s.earlyWnd = s.kcp.rcv_wnd
+		s.kcp.rcv_wnd = wnd
+	}
+}
+
+// releaseEarlyData restores the receive window once the session is accepted
+func (s *UDPSession) releaseEarlyData() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.earlyWnd != 0 {
+		s.kcp.rcv_wnd = s.earlyWnd
+		s.earlyWnd = 0
+		s.kcp.probe |= IKCP_ASK_TELL // announce the larger window with the next flush
+	}
+}
@@ -0,0 +1,247 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:12:40
+@Description: Client sessions sharing a local socket
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// endpointInboxSize is the number of packets queued for a session of an endpoint
+const endpointInboxSize = 1024
+
+// Endpoint is a local UDP socket shared by client sessions to any number of
+// servers, incoming packets are demultiplexed by remote address.
+//
+// A server sees the sessions of an endpoint coming from the same address, and
+// a Listener takes a new conversation from a known address for a reconnect,
+// so an endpoint holds at most one session per remote address.
+type Endpoint struct {
+	conn    net.PacketConn
+	ownConn bool
+
+	routes map[netip.AddrPort]*endpointConn
+	mu     sync.RWMutex
+
+	die     chan struct{}
+	dieOnce sync.Once
+
+	readErr     atomic.Value // error which stopped the read loop
+	chReadError chan struct{}
+}
+
+// NewEndpoint opens a UDP socket on "laddr" to be shared by client sessions,
+// an empty "laddr" picks an ephemeral port.
+func NewEndpoint(laddr string) (*Endpoint, error) {
+	var udpaddr *net.UDPAddr
+	if laddr != "" {
+		var err error
+		if udpaddr, err = net.ResolveUDPAddr("udp", laddr); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newEndpoint(conn, true), nil
+}
+
+// NewEndpointWithConn shares an existing packet connection between client
+// sessions, 'conn' is not closed by the endpoint.
+func NewEndpointWithConn(conn net.PacketConn) *Endpoint {
+	return newEndpoint(conn, false)
+}
+
+func newEndpoint(conn net.PacketConn, ownConn bool) *Endpoint {
+	e := new(Endpoint)
+	e.conn = conn
+	e.ownConn = ownConn
+	e.routes = make(map[netip.AddrPort]*endpointConn)
+	e.die = make(chan struct{})
+	e.chReadError = make(chan struct{})
+	go e.monitor()
+	return e
+}
+
+// Dial connects to the remote address "raddr" like DialWithOptions, over the
+// socket of the endpoint. Closing the session releases its route only.
+//
+// It fails if a session of the endpoint is already connected to "raddr".
+func (e *Endpoint) Dial(raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	if err := checkFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	select {
+	case <-e.die:
+		return nil, errors.WithStack(ErrClosed)
+	default:
+	}
+
+	conn, ok := e.register(udpaddr)
+	if !ok {
+		return nil, errors.Errorf("endpoint already has a session to %v", udpaddr)
+	}
+
+	var convid uint32
+	binary.Read(crand.Reader, binary.LittleEndian, &convid)
+	return newUDPSession(context.Background(), convid, dataShards, parityShards, nil, conn, true, udpaddr, block), nil
+}
+
+// LocalAddr returns the local address of the shared socket
+func (e *Endpoint) LocalAddr() net.Addr { return e.conn.LocalAddr() }
+
+// Close stops the endpoint and closes its socket if owned, sessions still
+// using it fail their reads.
+func (e *Endpoint) Close() error {
+	var once bool
+	e.dieOnce.Do(func() {
+		close(e.die)
+		once = true
+	})
+
+	if !once {
+		return errors.WithStack(ErrClosed)
+	}
+	if e.ownConn {
+		return e.conn.Close()
+	}
+	return nil
+}
+
+// register adds the route of a new session, it returns false if the remote address is taken
+func (e *Endpoint) register(remote net.Addr) (*endpointConn, bool) {
+	c := &endpointConn{
+		e:      e,
+		key:    addrKey(remote),
+		inbox:  make(chan endpointPacket, endpointInboxSize),
+		closed: make(chan struct{}),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.routes[c.key]; ok {
+		return nil, false
+	}
+	e.routes[c.key] = c
+	return c, true
+}
+
+// unregister removes the route of a closed session
+func (e *Endpoint) unregister(c *endpointConn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.routes[c.key] == c {
+		delete(e.routes, c.key)
+	}
+}
+
+// monitor reads packets from the shared socket and routes them to the sessions
+func (e *Endpoint) monitor() {
+	buf := make([]byte, mtuLimit)
+	for {
+		select {
+		case <-e.die:
+			return
+		default:
+		}
+
+		n, addr, err := e.conn.ReadFrom(buf)
+		if err != nil {
+			e.readErr.Store(errors.WithStack(err))
+			close(e.chReadError)
+			return
+		}
+
+		e.mu.RLock()
+		c := e.routes[addrKey(addr)]
+		e.mu.RUnlock()
+		if c != nil {
+			c.deliver(buf[:n], addr)
+		}
+	}
+}
+
+// endpointPacket is a packet queued for a session
+type endpointPacket struct {
+	data []byte // from xmitBuf
+	addr net.Addr
+}
+
+// endpointConn is the packet connection of a session on an endpoint, it reads
+// the packets routed to the session, and writes to the shared socket.
+type endpointConn struct {
+	e   *Endpoint
+	key netip.AddrPort
+
+	inbox     chan endpointPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// deliver queues a copy of the packet, it is dropped if the session does not keep up
+func (c *endpointConn) deliver(data []byte, addr net.Addr) {
+	pkt := endpointPacket{xmitBuf.Get().([]byte)[:len(data)], addr}
+	copy(pkt.data, data)
+	select {
+	case c.inbox <- pkt:
+	default:
+		xmitBuf.Put(pkt.data)
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+	}
+}
+
+func (c *endpointConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.inbox:
+		n := copy(p, pkt.data)
+		xmitBuf.Put(pkt.data)
+		return n, pkt.addr, nil
+	case <-c.closed:
+		return 0, nil, errors.WithStack(ErrClosed)
+	case <-c.e.chReadError:
+		return 0, nil, c.e.readErr.Load().(error)
+	case <-c.e.die:
+		return 0, nil, errors.WithStack(ErrClosed)
+	}
+}
+
+func (c *endpointConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.e.conn.WriteTo(p, addr)
+}
+
+// Close releases the route of the session, the shared socket stays open
+func (c *endpointConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.e.unregister(c)
+	})
+	return nil
+}
+
+func (c *endpointConn) LocalAddr() net.Addr { return c.e.conn.LocalAddr() }
+
+// deadlines are not used by sessions on their packet connection
+func (c *endpointConn) SetDeadline(t time.Time) error      { return nil }
+func (c *endpointConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *endpointConn) SetWriteDeadline(t time.Time) error { return nil }
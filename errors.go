@@ -0,0 +1,116 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 22:31:16
+@Description: Exported errors
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by sessions and listeners, the returned errors may carry a
+// stack trace, use errors.Is to compare them.
+var (
+	// ErrClosed is returned by operations on a closed session or listener, it
+	// also matches io.ErrClosedPipe and net.ErrClosed.
+	ErrClosed error = closedError{}
+
+	// ErrTimeout is returned when a deadline expires, it implements net.Error
+	// with Timeout() true and also matches os.ErrDeadlineExceeded.
+	ErrTimeout error = timeoutError{}
+
+	// ErrHandshake is returned when a session cannot be established with the remote.
+	ErrHandshake = errors.New("handshake failed")
+
+	// ErrMaxRetransmit is returned once a segment has been retransmitted too many
+	// times, or nothing has been acknowledged for the progress timeout, the
+	// remote is considered unreachable. See SetMaxRetransmit.
+	ErrMaxRetransmit = errors.New("maximum retransmissions exceeded")
+
+	// ErrMsgTooLarge is returned when a write can never fit in the send window
+	// as a whole, see WriteAtomic and WriteMessage.
+	ErrMsgTooLarge = errors.New("message too large")
+
+	// ErrDecrypt is returned when a session is terminated by its decryption failure policy.
+	ErrDecrypt = errors.New("too many decryption failures")
+
+	// ErrVersion is returned when the peers support no common protocol version,
+	// or the remote answers the version negotiation with an unknown format.
+	ErrVersion = errors.New("no common protocol version")
+
+	// ErrReset is returned when the remote listener refuses the conversation,
+	// see BacklogReset.
+	ErrReset = errors.New("conversation reset by remote")
+
+	// ErrTicket is returned when a session ticket is invalid, expired or replayed.
+	ErrTicket = errors.New("session ticket rejected")
+
+	// ErrSTUN is returned when a STUN server does not answer a binding
+	// request, see STUNBinding.
+	ErrSTUN = errors.New("no STUN response")
+)
+
+// closedError is returned on closed sessions and listeners, like the errors of the io and net packages.
+type closedError struct{}
+
+func (closedError) Error() string {
+	return io.ErrClosedPipe.Error()
+}
+
+func (closedError) Is(target error) bool {
+	return target == io.ErrClosedPipe || target == net.ErrClosed
+}
+
+// timeoutError is returned when a deadline expires, it implements net.Error
+// and matches os.ErrDeadlineExceeded, like the errors of the net package.
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "timeout"
+}
+
+func (timeoutError) Timeout() bool {
+	return true
+}
+
+func (timeoutError) Temporary() bool {
+	return true
+}
+
+func (timeoutError) Is(target error) bool {
+	return target == os.ErrDeadlineExceeded
+}
+
+// handshakeFailed returns 'err' of a failed handshake as matching ErrHandshake
+// and wrapping 'err', with a stack trace, unless it matches ErrHandshake already.
+func handshakeFailed(err error) error {
+	if errors.Is(err, ErrHandshake) {
+		return err
+	}
+	return errors.WithStack(handshakeFailure{err})
+}
+
+// handshakeFailure is the error of a failed handshake, it matches ErrHandshake
+// and unwraps to the cause.
+type handshakeFailure struct {
+	err error
+}
+
+func (e handshakeFailure) Error() string {
+	return ErrHandshake.Error() + ": " + e.err.Error()
+}
+
+func (e handshakeFailure) Unwrap() error {
+	return e.err
+}
+
+func (handshakeFailure) Is(target error) bool {
+	return target == ErrHandshake
+}
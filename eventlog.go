@@ -0,0 +1,136 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-15 19:02:37
+@Description: Session event log and debug state
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventLogSize is the number of recent events kept per session
+const eventLogSize = 64
+
+// Event is a significant change in the life of a session
+type Event struct {
+	Time    time.Time
+	Message string
+}
+
+func (e Event) String() string {
+	return e.Time.Format("15:04:05.000000") + " " + e.Message
+}
+
+// eventLog is a bounded ring of the most recent events, safe for concurrent use
+type eventLog struct {
+	mu   sync.Mutex
+	ring [eventLogSize]Event
+	next int  // slot of the next event
+	full bool // the ring has wrapped around
+}
+
+func (l *eventLog) add(msg string) {
+	l.mu.Lock()
+	l.ring[l.next] = Event{time.Now(), msg}
+	l.next++
+	if l.next == eventLogSize {
+		l.next = 0
+		l.full = true
+	}
+	l.mu.Unlock()
+}
+
+// events returns the events in the ring, oldest first
+func (l *eventLog) events() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Event(nil), l.ring[:l.next]...)
+	}
+	return append(append([]Event(nil), l.ring[l.next:]...), l.ring[:l.next]...)
+}
+
+// logEvent records an event of the session, it does not take the session lock
+func (s *UDPSession) logEvent(format string, args ...any) {
+	s.traceEvent(TraceEvent, format, args...)
+}
+
+// traceEvent records an event of the session and passes it to its
+// SessionTracer under 'name'
+func (s *UDPSession) traceEvent(name, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	s.events.add(msg)
+	if s.trace != nil {
+		s.trace.Event(name, msg)
+	}
+}
+
+// DebugInfo is a snapshot of a session for bug reports
+type DebugInfo struct {
+	Conv       uint32
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	MTU                    int
+	RTO, SRTT, RTTVar      int
+	SndWnd, RcvWnd, RmtWnd int
+	Cwnd                   int
+	WaitSnd                int // segments waiting to be sent or acknowledged
+	RcvQueue, RcvBuf       int // segments ready for the application, and out of order
+	Dup                    int
+	DeadLink               bool       // a segment has reached the dead link limit
+	FECBackend             FECBackend // Reed-Solomon implementation in use
+
+	Events []Event // the most recent events, oldest first
+}
+
+// String formats the snapshot as text suitable for bug reports
+func (d DebugInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "conv %d, local %v, remote %v\n", d.Conv, d.LocalAddr, d.RemoteAddr)
+	fmt.Fprintf(&b, "mtu %d, rto %d, srtt %d, rttvar %d\n", d.MTU, d.RTO, d.SRTT, d.RTTVar)
+	fmt.Fprintf(&b, "snd_wnd %d, rcv_wnd %d, rmt_wnd %d, cwnd %d\n", d.SndWnd, d.RcvWnd, d.RmtWnd, d.Cwnd)
+	fmt.Fprintf(&b, "waitsnd %d, rcv_queue %d, rcv_buf %d, dup %d, dead link %v, fec %v\n",
+		d.WaitSnd, d.RcvQueue, d.RcvBuf, d.Dup, d.DeadLink, d.FECBackend)
+	for _, e := range d.Events {
+		b.WriteString(e.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// DebugState captures the protocol state of the session and its recent events,
+// such as path changes, MTU changes, RTO spikes and errors, for bug reports.
+func (s *UDPSession) DebugState() DebugInfo {
+	s.mu.Lock()
+	d := DebugInfo{
+		Conv:     s.kcp.conv,
+		MTU:      int(s.kcp.mtu) + s.packetOverhead(),
+		RTO:      int(s.kcp.rx_rto),
+		SRTT:     int(s.kcp.rx_srtt),
+		RTTVar:   int(s.kcp.rx_rttvar),
+		SndWnd:   int(s.kcp.snd_wnd),
+		RcvWnd:   int(s.kcp.rcv_wnd),
+		RmtWnd:   int(s.kcp.rmt_wnd),
+		Cwnd:     int(s.kcp.cwnd),
+		WaitSnd:  s.kcp.WaitSnd(),
+		RcvQueue: s.kcp.rcv_queue.Len(),
+		RcvBuf:   s.kcp.rcv_buf.Len(),
+		DeadLink: s.kcp.state == 0xFFFFFFFF,
+	}
+	s.mu.Unlock()
+
+	d.LocalAddr = s.LocalAddr()
+	d.RemoteAddr = s.RemoteAddr()
+	d.Dup = s.GetDup()
+	d.FECBackend = s.FECBackend()
+	d.Events = s.events.events()
+	return d
+}
@@ -0,0 +1,60 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-7 16:52:08
+@Description: Opt-in gate of experimental subsystems
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"math/bits"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Experiment is a set of experimental subsystems, selected in
+// Config.Experimental.
+//
+// The package API has two stability tiers. Everything exported is stable and
+// only changes compatibly, except declarations whose doc comment starts with
+// "Experimental:". Those belong to a subsystem which is still iterating: its
+// API, behaviour and wire format may change in any release, and it stays off
+// unless its Experiment is set, so nothing experimental runs by accident.
+type Experiment uint64
+
+// experiments names the known experiments, a subsystem adds its flag here
+// when it lands and removes it when it becomes stable or is dropped
+var experiments = map[Experiment]string{}
+
+func (x Experiment) String() string {
+	if x == 0 {
+		return "none"
+	}
+	var names []string
+	for rest := x; rest != 0; rest &= rest - 1 {
+		bit := Experiment(1) << bits.TrailingZeros64(uint64(rest))
+		if name, ok := experiments[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, "unknown")
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// validate fails on flags of unknown experiments, which may have been removed
+// or promoted to stable in this release
+func (x Experiment) validate() error {
+	for rest := x; rest != 0; rest &= rest - 1 {
+		bit := Experiment(1) << bits.TrailingZeros64(uint64(rest))
+		if _, ok := experiments[bit]; !ok {
+			return errors.Errorf("unknown experiment %#x", uint64(bit))
+		}
+	}
+	return nil
+}
+
+// Has reports whether all the experiments of 'y' are selected in 'x'
+func (x Experiment) Has(y Experiment) bool { return x&y == y }
@@ -0,0 +1,153 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-16 19:14:50
+@Description: Round-robin receive processing between the sessions of a listener
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// fairInboxLimit is the number of packets queued for a session before new packets are dropped
+const fairInboxLimit = 1024
+
+// fairInput distributes the receive processing of a listener between its sessions,
+// every session processes at most 'quota' packets per round and the excess is
+// deferred to the next round, so a chatty session cannot delay the others.
+type fairInput struct {
+	quota  int
+	inbox  map[*UDPSession][][]byte // packets waiting to be processed
+	ready  []*UDPSession            // sessions with queued packets, in round-robin order
+	notify chan struct{}
+	mu     sync.Mutex
+}
+
+// SetReceiveQuota enables fair receive processing: packets of established sessions
+// are handed from the socket reader to a processing goroutine, which serves sessions
+// in rounds of at most 'packets' packets each. 0 processes the packets inline in
+// the socket reader, which is the default.
+//
+// Each session queues at most 1024 packets, packets beyond are dropped and counted
+// as input errors.
+func (l *Listener) SetReceiveQuota(packets int) {
+	if packets < 0 {
+		packets = 0
+	}
+
+	l.fairLock.Lock()
+	defer l.fairLock.Unlock()
+
+	if l.fair != nil {
+		l.fair.setQuota(packets) // the queued packets are drained when disabled
+		return
+	}
+	if packets == 0 {
+		return
+	}
+
+	l.fair = &fairInput{
+		quota:  packets,
+		inbox:  make(map[*UDPSession][][]byte),
+		notify: make(chan struct{}, 1),
+	}
+	go l.fair.run(l.die)
+}
+
+// dispatch hands a packet of an established session to KCP, directly or through the fair queue
+func (l *Listener) dispatch(s *UDPSession, data []byte) {
+	l.fairLock.RLock()
+	fair := l.fair
+	l.fairLock.RUnlock()
+
+	if fair == nil || !fair.enqueue(s, data) {
+		s.kcpInput(data)
+	}
+}
+
+func (f *fairInput) setQuota(packets int) {
+	f.mu.Lock()
+	f.quota = packets
+	f.mu.Unlock()
+	f.wakeup()
+}
+
+func (f *fairInput) wakeup() {
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue copies the packet into the inbox of the session, it returns false if fair processing is off
+func (f *fairInput) enqueue(s *UDPSession, data []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.quota == 0 {
+		return false
+	}
+
+	pkts, ok := f.inbox[s]
+	if len(pkts) >= fairInboxLimit {
+		atomic.AddUint64(&s.Snmp().InErrs, 1)
+		atomic.AddUint64(&s.stats.InErrs, 1)
+		return true
+	}
+
+	pkt := xmitBuf.Get().([]byte)[:len(data)]
+	copy(pkt, data)
+	f.inbox[s] = append(pkts, pkt)
+	if !ok {
+		f.ready = append(f.ready, s)
+	}
+	f.wakeup()
+	return true
+}
+
+// run processes the queued packets in rounds until the listener is closed
+func (f *fairInput) run(die <-chan struct{}) {
+	var round []*UDPSession
+	for {
+		select {
+		case <-f.notify:
+		case <-die:
+			return
+		}
+
+		for {
+			f.mu.Lock()
+			quota := f.quota
+			round, f.ready = f.ready, round[:0]
+			f.mu.Unlock()
+			if len(round) == 0 {
+				break
+			}
+
+			for _, s := range round {
+				f.mu.Lock()
+				pkts := f.inbox[s]
+				n := len(pkts)
+				if quota > 0 && n > quota {
+					n = quota
+				}
+				batch := pkts[:n:n]
+				if n == len(pkts) {
+					delete(f.inbox, s)
+				} else {
+					f.inbox[s] = pkts[n:]
+					f.ready = append(f.ready, s) // defer the excess to the next round
+				}
+				f.mu.Unlock()
+
+				for _, pkt := range batch {
+					s.kcpInput(pkt)
+					xmitBuf.Put(pkt)
+				}
+			}
+		}
+	}
+}
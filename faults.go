@@ -0,0 +1,98 @@
+//go:build safeudp_faults
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-7 10:21:36
+@Description: Fault injection for resilience testing
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Faults configures the failures injected into all sessions and listeners,
+// each is drawn independently with its probability from 0 to 1. It is only
+// available in builds with the safeudp_faults tag, for testing how an
+// application copes with failing sockets, corrupted packets and stalls.
+type Faults struct {
+	// Probability that a send on the socket fails, a failed batch send falls
+	// back to single sends, and a failed single send kills the session
+	WriteError float64
+	// Error returned by the failed sends, syscall.ENETUNREACH if nil
+	WriteErr error
+
+	// Probability that a received packet fails decryption, it is handled by
+	// the decryption failure policy of the session
+	DecryptError float64
+
+	// Probability that a session update runs late, by up to TimerDelayMax
+	TimerDelay    float64
+	TimerDelayMax time.Duration
+
+	// Seed of the random draws, so a failing run can be replayed
+	Seed uint64
+}
+
+// faultInjector draws the failures of a Faults
+type faultInjector struct {
+	Faults
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+var faults atomic.Pointer[faultInjector]
+
+// SetFaults starts injecting the failures of 'f', nil stops injecting
+func SetFaults(f *Faults) {
+	if f == nil {
+		faults.Store(nil)
+		return
+	}
+	fi := &faultInjector{Faults: *f, rng: rand.New(rand.NewPCG(f.Seed, f.Seed))}
+	if fi.WriteErr == nil {
+		fi.WriteErr = syscall.ENETUNREACH
+	}
+	faults.Store(fi)
+}
+
+// draw reports whether a failure of probability 'p' happens
+func (fi *faultInjector) draw(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.rng.Float64() < p
+}
+
+// faultWrite returns the error to fail a send with, nil to send
+func faultWrite() error {
+	if fi := faults.Load(); fi != nil && fi.draw(fi.WriteError) {
+		return fi.WriteErr
+	}
+	return nil
+}
+
+// faultDecrypt reports whether a received packet is treated as corrupted
+func faultDecrypt() bool {
+	fi := faults.Load()
+	return fi != nil && fi.draw(fi.DecryptError)
+}
+
+// faultTimerDelay returns the extra delay of a session update
+func faultTimerDelay() time.Duration {
+	fi := faults.Load()
+	if fi == nil || fi.TimerDelayMax <= 0 || !fi.draw(fi.TimerDelay) {
+		return 0
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return time.Duration(fi.rng.Int64N(int64(fi.TimerDelayMax))) + 1
+}
@@ -0,0 +1,20 @@
+//go:build !safeudp_faults
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-7 10:21:36
+@Description: Fault injection stubs for regular builds
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "time"
+
+// the hooks of faults.go are inlined away in regular builds
+
+func faultWrite() error { return nil }
+
+func faultDecrypt() bool { return false }
+
+func faultTimerDelay() time.Duration { return 0 }
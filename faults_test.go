@@ -0,0 +1,71 @@
+//go:build safeudp_faults
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-7 10:21:36
+@Description: Fault injection tests
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestFaults 测试注入的发送失败、解密失败和定时器延迟
+func TestFaults(t *testing.T) {
+	defer SetFaults(nil)
+
+	// 解密失败按会话的策略处理
+	block, _ := NewNoneBlockCrypt(nil)
+	l, cli := newSimPair(t, newSimNetwork(0), block, 0, 0)
+	cli.SetDecryptFailurePolicy(DecryptTerminate, 3, nil)
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	SetFaults(&Faults{DecryptError: 1})
+	s.Write([]byte("lost"))
+	buf := make([]byte, 16)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Read(buf); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("read returned %v with injected decryption failures", err)
+	}
+
+	// 定时器延迟在上限以内
+	SetFaults(&Faults{TimerDelay: 1, TimerDelayMax: 50 * time.Millisecond, Seed: 1})
+	for i := 0; i < 100; i++ {
+		if d := faultTimerDelay(); d <= 0 || d > 50*time.Millisecond {
+			t.Fatalf("timer delay %v", d)
+		}
+	}
+
+	// 发送失败使会话的写入返回注入的错误
+	_, cli = newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	SetFaults(&Faults{WriteError: 1})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := cli.Write([]byte("hello"))
+		if errors.Is(err, syscall.ENETUNREACH) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("write returned %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	SetFaults(nil)
+	if faultWrite() != nil || faultDecrypt() || faultTimerDelay() != 0 {
+		t.Fatal("faults injected after SetFaults(nil)")
+	}
+}
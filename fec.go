@@ -1,6 +1,8 @@
+//go:build !safeudp_nofec
+
 /*
 @Author: Lzww
-@LastEditTime: 2025-8-29 21:15:32
+@LastEditTime: 2025-10-16 19:14:50
 @Description: FEC (Forward Error Correction) implementation for SafeUDP protocol
 @Language: Go 1.23.4
 */
@@ -10,32 +12,44 @@ package safeudp
 import (
 	"container/heap"
 	"encoding/binary"
+	"runtime"
 	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/reedsolomon"
 )
 
-const (
-	fecHeaderSize     = 6
-	fecHeaderSizePlus = fecHeaderSize + 2
-	typeData          = 0xf1
-	typeParity        = 0xf2
-	maxShardSets      = 3
-)
-
-type fecPacket []byte
-
-func (fec fecPacket) seqid() uint32 {
-	return binary.LittleEndian.Uint32(fec)
-}
-
-func (fec fecPacket) flag() uint16 {
-	return binary.LittleEndian.Uint16(fec[4:])
-}
-
-func (fec fecPacket) data() []byte {
-	return fec[6:]
+// fecEnabled is false in builds with the safeudp_nofec tag
+const fecEnabled = true
+
+// fecSplitWork is the bytes of Galois field multiplications worth a goroutine,
+// smaller groups are coded on the calling goroutine
+const fecSplitWork = 256 << 10
+
+// leopardShardAlign is the multiple of the shard sizes of the Leopard codec
+const leopardShardAlign = 64
+
+// newRSCodec returns the Reed-Solomon codec of a FEC group. Shards are no larger
+// than a packet, so a group is only split across goroutines when it has enough
+// data and parity shards for the coding to outweigh the fan out.
+//
+// Leopard is only used if selected, it produces other parity bytes than the
+// matrix codecs, which the remote would fail to decode with.
+func newRSCodec(dataShards, parityShards int, backend FECBackend) (reedsolomon.Encoder, error) {
+	split := max(fecSplitWork/(dataShards*parityShards), 64)
+	opts := []reedsolomon.Option{
+		reedsolomon.WithMaxGoroutines(runtime.GOMAXPROCS(0)),
+		reedsolomon.WithMinSplitSize(split),
+	}
+	switch backend.resolve(dataShards, parityShards) {
+	case FECBackendLeopard:
+		opts = append(opts, reedsolomon.WithLeopardGF(true))
+	case FECBackendPureGo:
+		opts = append(opts, reedsolomon.WithSSE2(false), reedsolomon.WithSSSE3(false),
+			reedsolomon.WithAVX2(false), reedsolomon.WithAVX512(false),
+			reedsolomon.WithGFNI(false), reedsolomon.WithAVXGFNI(false))
+	}
+	return reedsolomon.New(dataShards, parityShards, opts...)
 }
 
 type shardHeap struct {
@@ -94,13 +108,17 @@ type fecDecoder struct {
 	decodeCache [][]byte
 	flagCache   []bool
 
-	codec reedsolomon.Encoder
+	codec   reedsolomon.Encoder
+	backend FECBackend
 
 	autoTune   autoTune
 	shouldTune bool
+
+	snmp  *Snmp // counters of the session, shared
+	stats *Snmp // counters of the session alone
 }
 
-func newFECDecoder(dataShards, parityShards int) *fecDecoder {
+func newFECDecoder(dataShards, parityShards int, backend FECBackend) *fecDecoder {
 	if dataShards <= 0 || parityShards <= 0 {
 		return nil
 	}
@@ -110,12 +128,14 @@ func newFECDecoder(dataShards, parityShards int) *fecDecoder {
 	dec.parityShards = parityShards
 	dec.shardSize = dataShards + parityShards
 	dec.shardSet = make(map[uint32]*shardHeap)
-	codec, err := reedsolomon.New(dataShards, parityShards)
+	codec, err := newRSCodec(dataShards, parityShards, backend)
 	if err != nil {
 		return nil
 	}
 
 	dec.codec = codec
+	dec.backend = backend
+	dec.snmp, dec.stats = DefaultSnmp, new(Snmp)
 	dec.decodeCache = make([][]byte, dec.shardSize)
 	dec.flagCache = make([]bool, dec.shardSize)
 	return dec
@@ -147,19 +167,29 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 			dec.parityShards = autoPS
 			dec.shardSize = dec.dataShards + dec.parityShards
 			dec.shardSet = make(map[uint32]*shardHeap)
-			codec, err := reedsolomon.New(dec.dataShards, dec.parityShards)
+			codec, err := newRSCodec(dec.dataShards, dec.parityShards, dec.backend)
 			if err != nil {
 				return nil
 			}
 			dec.codec = codec
 			dec.decodeCache = make([][]byte, dec.shardSize)
 			dec.flagCache = make([]bool, dec.shardSize)
+			dec.minShardId = dec.getShardId(in.seqid())
 			dec.shouldTune = false
 		}
 
 		return nil
 	}
 
+	// stop caching shards under memory pressure, data shards are still
+	// delivered by the caller, only the recovery is lost
+	if memoryPressure.Load() {
+		if len(dec.shardSet) > 0 {
+			dec.release()
+		}
+		return nil
+	}
+
 	shardId := dec.getShardId(in.seqid())
 	if timediff(shardId, dec.minShardId) < 0 {
 		return nil
@@ -169,7 +199,7 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 	if !ok {
 		shard = newShardHeap()
 		dec.shardSet[shardId] = shard
-		atomic.AddUint64(&DefaultSnmp.FECShardSet, 1)
+		atomic.AddUint64(&dec.snmp.FECShardSet, 1)
 	}
 
 	if shard.Contains(in.seqid()) {
@@ -177,7 +207,8 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 	}
 
 	if in.flag() == typeParity {
-		atomic.AddUint64(&DefaultSnmp.FECParityShards, 1)
+		atomic.AddUint64(&dec.snmp.FECParityShards, 1)
+		atomic.AddUint64(&dec.stats.FECParityShards, 1)
 	}
 
 	pkt := fecPacket(xmitBuf.Get().([]byte)[:len(in)])
@@ -206,44 +237,47 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 			if len(pkt.data()) > maxLen {
 				maxLen = len(pkt.data())
 			}
-			if numDataShard == dec.dataShards {
-				// do nothing if all shards are present
-				atomic.AddUint64(&DefaultSnmp.FECFullShardSet, 1)
-			} else { // case 2: loss on data shards, but it's recoverable from parity shards
-				// make the bytes length of each shard equal
-				for k := range shards {
-					if shards[k] != nil {
-						dlen := len(shards[k])
-						shards[k] = shards[k][:maxLen]
-						clear(shards[k][dlen:])
-					} else if k < dec.dataShards {
-						// prepare memory for the data recovery
-						shards[k] = xmitBuf.Get().([]byte)[:0]
-					}
+		}
+
+		if numDataShard == dec.dataShards {
+			// do nothing if all shards are present
+			atomic.AddUint64(&dec.snmp.FECFullShardSet, 1)
+			atomic.AddUint64(&dec.stats.FECFullShardSet, 1)
+		} else { // case 2: loss on data shards, but it's recoverable from parity shards
+			// make the bytes length of each shard equal
+			for k := range shards {
+				if shards[k] != nil {
+					dlen := len(shards[k])
+					shards[k] = shards[k][:maxLen]
+					clear(shards[k][dlen:])
+				} else if k < dec.dataShards {
+					// prepare memory for the data recovery
+					shards[k] = xmitBuf.Get().([]byte)[:0]
 				}
+			}
 
-				// Reed-Solomon recovery
-				if err := dec.codec.ReconstructData(shards); err == nil {
-					for k := range shards[:dec.dataShards] {
-						if !shardsFlag[k] {
-							// recovered data should be recycled
-							recovered = append(recovered, shards[k])
-						}
+			// Reed-Solomon recovery
+			if err := dec.codec.ReconstructData(shards); err == nil {
+				for k := range shards[:dec.dataShards] {
+					if !shardsFlag[k] {
+						// recovered data should be recycled
+						recovered = append(recovered, shards[k])
 					}
-				} else {
-					// record the error, and still keep the seqid monotonic increasing
-					atomic.AddUint64(&DefaultSnmp.FECErrs, 1)
 				}
-
-				atomic.AddUint64(&DefaultSnmp.FECRecovered, uint64(len(recovered)))
+			} else {
+				// record the error, and still keep the seqid monotonic increasing
+				atomic.AddUint64(&dec.snmp.FECErrs, 1)
+				atomic.AddUint64(&dec.stats.FECErrs, 1)
 			}
 
+			atomic.AddUint64(&dec.snmp.FECRecovered, uint64(len(recovered)))
+			atomic.AddUint64(&dec.stats.FECRecovered, uint64(len(recovered)))
 		}
 	}
 
 	if timediff(shardId, dec.minShardId) > 0 {
 		dec.minShardId = shardId
-		atomic.StoreUint64(&DefaultSnmp.FECShardMin, uint64(dec.minShardId))
+		atomic.StoreUint64(&dec.snmp.FECShardMin, uint64(dec.minShardId))
 	}
 
 	dec.flushShards()
@@ -264,7 +298,40 @@ func (dec *fecDecoder) flushShards() {
 		}
 	}
 
-	atomic.StoreUint64(&DefaultSnmp.FECShardSet, uint64(len(dec.shardSet)))
+	atomic.StoreUint64(&dec.snmp.FECShardSet, uint64(len(dec.shardSet)))
+}
+
+// shards returns the data and parity shards of a group, tuned to the remote
+func (dec *fecDecoder) shards() (dataShards, parityShards int) {
+	return dec.dataShards, dec.parityShards
+}
+
+// setSnmp selects the shared counters of the decoder and those of its session
+func (dec *fecDecoder) setSnmp(snmp, stats *Snmp) { dec.snmp, dec.stats = snmp, stats }
+
+// setBackend switches the codec, the cached shards are dropped
+func (dec *fecDecoder) setBackend(backend FECBackend) {
+	if backend == dec.backend {
+		return
+	}
+	codec, err := newRSCodec(dec.dataShards, dec.parityShards, backend)
+	if err != nil {
+		return
+	}
+	dec.codec = codec
+	dec.backend = backend
+	dec.release()
+}
+
+// release drops all the cached shards and recycles their buffers
+func (dec *fecDecoder) release() {
+	for shardId, shard := range dec.shardSet {
+		for _, pkt := range shard.elements {
+			xmitBuf.Put([]byte(pkt))
+		}
+		delete(dec.shardSet, shardId)
+	}
+	atomic.StoreUint64(&dec.snmp.FECShardSet, 0)
 }
 
 type (
@@ -288,11 +355,15 @@ type (
 		tsLatestPacket int64
 
 		// RS encoder
-		codec reedsolomon.Encoder
+		codec   reedsolomon.Encoder
+		backend FECBackend
+
+		snmp  *Snmp // counters of the session, shared
+		stats *Snmp // counters of the session alone
 	}
 )
 
-func newFECEncoder(dataShards, parityShards, offset int) *fecEncoder {
+func newFECEncoder(dataShards, parityShards, offset int, backend FECBackend) *fecEncoder {
 	if dataShards <= 0 || parityShards <= 0 {
 		return nil
 	}
@@ -304,19 +375,72 @@ func newFECEncoder(dataShards, parityShards, offset int) *fecEncoder {
 	enc.headerOffset = offset
 	enc.payloadOffset = enc.headerOffset + fecHeaderSize
 
-	codec, err := reedsolomon.New(dataShards, parityShards)
+	codec, err := newRSCodec(dataShards, parityShards, backend)
 	if err != nil {
 		return nil
 	}
 	enc.codec = codec
+	enc.backend = backend
+	enc.snmp, enc.stats = DefaultSnmp, new(Snmp)
 
 	// caches
 	enc.encodeCache = make([][]byte, enc.shardSize)
+	enc.allocShards()
+	return enc
+}
+
+// allocShards allocates the shard caches
+func (enc *fecEncoder) allocShards() {
 	enc.shardCache = make([][]byte, enc.shardSize)
 	for k := range enc.shardCache {
 		enc.shardCache[k] = make([]byte, mtuLimit)
 	}
-	return enc
+}
+
+// setSnmp selects the shared counters of the encoder and those of its session
+func (enc *fecEncoder) setSnmp(snmp, stats *Snmp) { enc.snmp, enc.stats = snmp, stats }
+
+// setBackend switches the codec, it is deferred while a group is collected
+// and called again with the next packet
+func (enc *fecEncoder) setBackend(backend FECBackend) {
+	if backend == enc.backend || enc.shardCount != 0 {
+		return
+	}
+	if codec, err := newRSCodec(enc.dataShards, enc.parityShards, backend); err == nil {
+		enc.codec = codec
+		enc.backend = backend
+	}
+}
+
+// setShards changes the shards of a group, it is deferred while a group is
+// collected like setBackend. The seqid moves on to a multiple of the new group
+// size, so the remote decoder notices the new ratio and tunes to it.
+func (enc *fecEncoder) setShards(dataShards, parityShards int) {
+	if (dataShards == enc.dataShards && parityShards == enc.parityShards) || enc.shardCount != 0 {
+		return
+	}
+	codec, err := newRSCodec(dataShards, parityShards, enc.backend)
+	if err != nil {
+		return
+	}
+	enc.codec = codec
+	enc.dataShards = dataShards
+	enc.parityShards = parityShards
+	enc.shardSize = dataShards + parityShards
+	enc.paws = 0xffffffff / uint32(enc.shardSize) * uint32(enc.shardSize)
+	enc.next = (enc.next + uint32(enc.shardSize) - 1) / uint32(enc.shardSize) * uint32(enc.shardSize)
+	if enc.next >= enc.paws {
+		enc.next = 0
+	}
+	enc.encodeCache = make([][]byte, enc.shardSize)
+	if enc.shardCache != nil {
+		enc.allocShards()
+	}
+}
+
+// shards returns the data and parity shards of a group
+func (enc *fecEncoder) shards() (dataShards, parityShards int) {
+	return enc.dataShards, enc.parityShards
 }
 
 // encodes the packet, outputs parity shards if we have collected quorum datashards
@@ -328,6 +452,23 @@ func (enc *fecEncoder) encode(b []byte, rto uint32) (ps [][]byte) {
 	enc.sealData(b[enc.headerOffset:])
 	binary.LittleEndian.PutUint16(b[enc.payloadOffset:], uint16(len(b[enc.payloadOffset:])))
 
+	// skip the parity shards under memory pressure, an interrupted group
+	// is completed without parity before the caches are restored, so the
+	// seqid stays aligned for the remote decoder
+	if memoryPressure.Load() || enc.shardCache == nil {
+		enc.shardCache = nil
+		enc.shardCount++
+		if enc.shardCount == enc.dataShards {
+			enc.skipParity()
+			enc.shardCount = 0
+			enc.maxSize = 0
+			if !memoryPressure.Load() {
+				enc.allocShards()
+			}
+		}
+		return nil
+	}
+
 	// copy data from payloadOffset to fec shard cache
 	sz := len(b)
 	enc.shardCache[enc.shardCount] = enc.shardCache[enc.shardCount][:sz]
@@ -342,19 +483,27 @@ func (enc *fecEncoder) encode(b []byte, rto uint32) (ps [][]byte) {
 	// Generation of Reed-Solomon Erasure Code when we have enough datashards
 	now := time.Now().UnixMilli()
 	if enc.shardCount == enc.dataShards {
-		// generate the rs-code only if the data is continuous.
-		if now-enc.tsLatestPacket < int64(rto) {
+		// Leopard takes shards in multiples of 64 bytes
+		size := enc.maxSize
+		if enc.backend.resolve(enc.dataShards, enc.parityShards) == FECBackendLeopard {
+			payload := size - enc.payloadOffset
+			size = enc.payloadOffset + (payload+leopardShardAlign-1)/leopardShardAlign*leopardShardAlign
+		}
+
+		// generate the rs-code only if the data is continuous, and the padded
+		// shards fit in the buffers
+		if now-enc.tsLatestPacket < int64(rto) && size <= mtuLimit {
 			// fill '0' into the tail of each datashard
 			for i := 0; i < enc.dataShards; i++ {
 				shard := enc.shardCache[i]
 				slen := len(shard)
-				clear(shard[slen:enc.maxSize])
+				clear(shard[slen:size])
 			}
 
 			// construct equal-sized slice with stripped header
 			cache := enc.encodeCache
 			for k := range cache {
-				cache[k] = enc.shardCache[k][enc.payloadOffset:enc.maxSize]
+				cache[k] = enc.shardCache[k][enc.payloadOffset:size]
 			}
 
 			// encoding
@@ -362,11 +511,12 @@ func (enc *fecEncoder) encode(b []byte, rto uint32) (ps [][]byte) {
 				ps = enc.shardCache[enc.dataShards:]
 				for k := range ps {
 					enc.sealParity(ps[k][enc.headerOffset:]) // NOTE(x): seal parity will increase the seqid by 1
-					ps[k] = ps[k][:enc.maxSize]
+					ps[k] = ps[k][:size]
 				}
 			} else {
 				// record the error, and still keep the seqid monotonic increasing
-				atomic.AddUint64(&DefaultSnmp.FECErrs, 1)
+				atomic.AddUint64(&enc.snmp.FECErrs, 1)
+				atomic.AddUint64(&enc.stats.FECErrs, 1)
 				enc.skipParity()
 			}
 		} else {
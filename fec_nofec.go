@@ -0,0 +1,44 @@
+//go:build safeudp_nofec
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-16 19:14:50
+@Description: FEC stubs for builds without Reed-Solomon
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+// fecEnabled is false in builds with the safeudp_nofec tag
+const fecEnabled = false
+
+// fecDecoder is never instantiated without FEC, packets with FEC headers from
+// the remote are still accepted, data shards are delivered and parity ignored.
+type fecDecoder struct{}
+
+func newFECDecoder(dataShards, parityShards int, backend FECBackend) *fecDecoder { return nil }
+
+func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) { return nil }
+
+func (dec *fecDecoder) setBackend(backend FECBackend) {}
+
+func (dec *fecDecoder) setSnmp(snmp, stats *Snmp) {}
+
+func (dec *fecDecoder) shards() (dataShards, parityShards int) { return 0, 0 }
+
+// fecEncoder is never instantiated without FEC
+type fecEncoder struct{}
+
+func newFECEncoder(dataShards, parityShards, offset int, backend FECBackend) *fecEncoder {
+	return nil
+}
+
+func (enc *fecEncoder) encode(b []byte, rto uint32) (ps [][]byte) { return nil }
+
+func (enc *fecEncoder) setBackend(backend FECBackend) {}
+
+func (enc *fecEncoder) setSnmp(snmp, stats *Snmp) {}
+
+func (enc *fecEncoder) setShards(dataShards, parityShards int) {}
+
+func (enc *fecEncoder) shards() (dataShards, parityShards int) { return 0, 0 }
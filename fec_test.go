@@ -0,0 +1,183 @@
+//go:build !safeudp_nofec
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-4 16:08:25
+@Description: FEC encoding benchmarks
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// TestRSCodecCompatible 测试并行编码与默认编码的校验分片一致
+func TestRSCodecCompatible(t *testing.T) {
+	for _, shards := range [][2]int{{10, 3}, {50, 20}, {128, 64}} {
+		ds, ps := shards[0], shards[1]
+		parallel, err := newRSCodec(ds, ps, FECBackendAuto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial, err := reedsolomon.New(ds, ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, b := make([][]byte, ds+ps), make([][]byte, ds+ps)
+		for k := range a {
+			a[k], b[k] = make([]byte, 1400), make([]byte, 1400)
+			if k < ds {
+				for i := range a[k] {
+					a[k][i] = byte(k*31 + i)
+				}
+				copy(b[k], a[k])
+			}
+		}
+		if err := parallel.Encode(a); err != nil {
+			t.Fatal(err)
+		}
+		if err := serial.Encode(b); err != nil {
+			t.Fatal(err)
+		}
+		for k := ds; k < ds+ps; k++ {
+			if string(a[k]) != string(b[k]) {
+				t.Fatalf("%d/%d: parity shard %d differs", ds, ps, k)
+			}
+		}
+	}
+}
+
+// TestFECBackend 测试各个FEC后端的编码和丢包恢复
+func TestFECBackend(t *testing.T) {
+	if b := FECBackendAuto.resolve(200, 100); b != FECBackendLeopard {
+		t.Fatalf("auto backend %v for 300 shards", b)
+	}
+	if b := FECBackendPureGo.resolve(10, 3); b != FECBackendPureGo {
+		t.Fatalf("explicit backend resolved to %v", b)
+	}
+
+	const ds, ps = 4, 2
+	var parity [][]byte // 每个后端的第一个校验分片
+	for _, backend := range []FECBackend{FECBackendMatrix, FECBackendLeopard, FECBackendPureGo} {
+		enc := newFECEncoder(ds, ps, 0, backend)
+		dec := newFECDecoder(ds, ps, backend)
+
+		// 长度不同的数据包，Leopard 需要把分片补齐到64字节
+		var data, shards [][]byte
+		for i := 0; i < ds; i++ {
+			pkt := make([]byte, fecHeaderSizePlus+100+i*37)
+			for k := fecHeaderSizePlus; k < len(pkt); k++ {
+				pkt[k] = byte(i + k)
+			}
+			for _, p := range enc.encode(pkt, math.MaxUint32) {
+				shards = append(shards, append([]byte(nil), p...))
+			}
+			data = append(data, pkt)
+		}
+		if len(shards) != ps {
+			t.Fatalf("%v: %d parity shards", backend, len(shards))
+		}
+		if backend == FECBackendLeopard && (len(shards[0])-fecHeaderSize)%leopardShardAlign != 0 {
+			t.Fatalf("leopard shard of %d bytes not aligned", len(shards[0]))
+		}
+		parity = append(parity, shards[0])
+
+		// 丢失第一个数据包，由其余数据包和校验分片恢复
+		var recovered [][]byte
+		for _, pkt := range append(data[1:], shards...) {
+			recovered = append(recovered, dec.decode(fecPacket(pkt))...)
+		}
+		if len(recovered) != 1 {
+			t.Fatalf("%v: %d packets recovered", backend, len(recovered))
+		}
+		r := recovered[0]
+		if sz := binary.LittleEndian.Uint16(r); string(r[2:sz]) != string(data[0][fecHeaderSize+2:]) {
+			t.Fatalf("%v: recovered data mismatch", backend)
+		}
+	}
+
+	// 纯Go实现与矩阵实现的校验分片一致，Leopard 不同
+	if string(parity[0]) != string(parity[2]) {
+		t.Fatal("purego parity differs from matrix")
+	}
+	if string(parity[0]) == string(parity[1]) {
+		t.Fatal("leopard parity equals matrix")
+	}
+
+	// 两端都选择 Leopard 时会话在丢包下正常传输
+	l, cli := newSimPair(t, newSimNetwork(0.1), nil, 10, 3)
+	if err := l.SetFECBackend(FECBackendLeopard); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.SetFECBackend(FECBackendLeopard); err != nil {
+		t.Fatal(err)
+	}
+	if cli.SetFECBackend(FECBackend(9)) == nil {
+		t.Fatal("invalid backend accepted")
+	}
+	if b := cli.DebugState().FECBackend; b != FECBackendLeopard {
+		t.Fatalf("backend %v reported", b)
+	}
+
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	msg := bytes.Repeat([]byte("leopard"), 8192)
+	go cli.Write(msg)
+	echo := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, echo) {
+		t.Fatal("echoed data mismatch")
+	}
+}
+
+// BenchmarkFECEncode 对比单协程与并行的FEC编码吞吐，并行在多核机器上分片数较多时才有收益
+func BenchmarkFECEncode(b *testing.B) {
+	for _, shards := range [][2]int{{10, 3}, {50, 20}, {128, 64}} {
+		ds, ps := shards[0], shards[1]
+		serial, err := reedsolomon.New(ds, ps, reedsolomon.WithMaxGoroutines(1))
+		if err != nil {
+			b.Fatal(err)
+		}
+		parallel, err := newRSCodec(ds, ps, FECBackendAuto)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, c := range []struct {
+			name  string
+			codec reedsolomon.Encoder
+		}{{"serial", serial}, {"parallel", parallel}} {
+			b.Run(fmt.Sprintf("%d-%d/%s", ds, ps, c.name), func(b *testing.B) {
+				enc := newFECEncoder(ds, ps, 0, FECBackendAuto)
+				enc.codec = c.codec
+				pkt := make([]byte, mtuLimit)
+				b.SetBytes(int64(len(pkt)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					enc.encode(pkt, math.MaxUint32)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-5 11:42:17
+@Description: Selection of the Reed-Solomon backend
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// FECBackend selects the Reed-Solomon implementation of the FEC codec
+type FECBackend int
+
+const (
+	// FECBackendAuto picks FECBackendMatrix, or FECBackendLeopard for more
+	// than 256 shards, and FECBackendPureGo where there is no assembly
+	FECBackendAuto FECBackend = iota
+
+	// FECBackendMatrix is the Vandermonde matrix codec with the SIMD kernels
+	// generated for the CPU, the default
+	FECBackendMatrix
+
+	// FECBackendLeopard is the FFT based Leopard codec, faster beyond a few
+	// dozen shards. Its parity differs from the matrix codecs so both ends
+	// must select it, and shards are padded to 64 bytes, making parity
+	// packets up to 63 bytes larger than data packets.
+	FECBackendLeopard
+
+	// FECBackendPureGo is the matrix codec without the x86 SIMD extensions,
+	// its parity is the same as FECBackendMatrix. Build with the noasm tag
+	// to drop the assembly on all platforms.
+	FECBackendPureGo
+)
+
+func (b FECBackend) String() string {
+	switch b {
+	case FECBackendAuto:
+		return "auto"
+	case FECBackendMatrix:
+		return "matrix"
+	case FECBackendLeopard:
+		return "leopard"
+	case FECBackendPureGo:
+		return "purego"
+	default:
+		return "invalid"
+	}
+}
+
+// MarshalText and UnmarshalText encode the backend by name in config files
+func (b FECBackend) MarshalText() ([]byte, error) { return []byte(b.String()), nil }
+
+func (b *FECBackend) UnmarshalText(text []byte) error {
+	return unmarshalName(b, text, "FEC backend", FECBackendAuto, FECBackendMatrix, FECBackendLeopard, FECBackendPureGo)
+}
+
+// valid reports whether 'b' is a known backend
+func (b FECBackend) valid() bool {
+	return b >= FECBackendAuto && b <= FECBackendPureGo
+}
+
+// resolve returns the backend used for a group of the shards
+func (b FECBackend) resolve(dataShards, parityShards int) FECBackend {
+	if b != FECBackendAuto {
+		return b
+	}
+	if dataShards+parityShards > 256 {
+		return FECBackendLeopard
+	}
+	switch runtime.GOARCH {
+	case "amd64", "arm64", "ppc64le":
+		return FECBackendMatrix
+	default:
+		return FECBackendPureGo
+	}
+}
+
+// SetFECBackend selects the Reed-Solomon implementation, both ends must use
+// FECBackendLeopard or neither. The encoder switches at the start of the next
+// FEC group, shards cached for recovery are dropped.
+func (s *UDPSession) SetFECBackend(b FECBackend) error {
+	if !b.valid() {
+		return errors.Errorf("invalid FEC backend %d", b)
+	}
+	s.fecBackend.Store(int32(b))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fecDecoder != nil {
+		s.fecDecoder.setBackend(b)
+	}
+	return nil
+}
+
+// FECBackend returns the Reed-Solomon implementation in use, FECBackendAuto
+// resolved for the shards of the session
+func (s *UDPSession) FECBackend() FECBackend {
+	b := FECBackend(s.fecBackend.Load())
+	if shards := s.fecShards.Load(); shards != 0 {
+		return b.resolve(int(shards>>16), int(shards&0xffff))
+	}
+	if s.fecEncoder != nil {
+		return b.resolve(s.fecEncoder.shards())
+	}
+	return b.resolve(0, 0)
+}
+
+// SetFECBackend selects the Reed-Solomon implementation of the sessions
+// accepted afterwards, see UDPSession.SetFECBackend.
+func (l *Listener) SetFECBackend(b FECBackend) error {
+	if !b.valid() {
+		return errors.Errorf("invalid FEC backend %d", b)
+	}
+	l.fecBackend.Store(int32(b))
+	return nil
+}
@@ -0,0 +1,32 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-19 11:02:17
+@Description: FEC packet header shared by full and minimal builds
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "encoding/binary"
+
+const (
+	fecHeaderSize     = 6
+	fecHeaderSizePlus = fecHeaderSize + 2
+	typeData          = 0xf1
+	typeParity        = 0xf2
+	maxShardSets      = 3
+)
+
+type fecPacket []byte
+
+func (fec fecPacket) seqid() uint32 {
+	return binary.LittleEndian.Uint32(fec)
+}
+
+func (fec fecPacket) flag() uint16 {
+	return binary.LittleEndian.Uint16(fec[4:])
+}
+
+func (fec fecPacket) data() []byte {
+	return fec[6:]
+}
@@ -0,0 +1,105 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-6 15:18:53
+@Description: Flush and Sync of the queued data
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// flushWaiter is a Flush waiting for the packets queued before it to be sent
+type flushWaiter struct {
+	seq uint64 // packets delivered to post processing when it was queued
+	ch  chan struct{}
+}
+
+// Flush segments the queued data and sends it at once, bypassing the write
+// delay and the update interval, and returns when the packets have been handed
+// to the socket. Data beyond the send and congestion windows stays queued and
+// follows as acknowledgements open the windows.
+//
+// It returns ctx.Err() if the context is done before the packets are sent.
+func (s *UDPSession) Flush(ctx context.Context) error {
+	if s.isClosed() {
+		return errors.WithStack(ErrClosed)
+	}
+
+	s.mu.Lock()
+	s.kcp.flush(false)
+	w := flushWaiter{s.txQueued.Load(), make(chan struct{})}
+	s.flushMu.Lock()
+	if s.txDone.Load() >= w.seq {
+		close(w.ch)
+	} else {
+		s.flushWaiters = append(s.flushWaiters, w)
+	}
+	s.flushMu.Unlock()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.chSocketWriteError:
+		return s.socketWriteError.Load().(error)
+	case <-s.die:
+		return errors.WithStack(ErrClosed)
+	}
+}
+
+// Sync flushes the queued data like Flush, and returns when all the data
+// written before the call has been acknowledged by remote, which makes it a
+// commit point for the application.
+//
+// It returns ctx.Err() if the context is done before that, the data is still
+// delivered afterwards.
+func (s *UDPSession) Sync(ctx context.Context) error {
+	chAcked := make(chan error, 1)
+	s.mu.Lock()
+	if s.kcp.snd_queue.Len() == 0 && s.kcp.snd_buf.Len() == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	s.addWriteWaiter(func(err error) { chAcked <- err })
+	s.mu.Unlock()
+
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-chAcked:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.chSocketWriteError:
+		return s.socketWriteError.Load().(error)
+	case <-s.die:
+		return errors.WithStack(ErrClosed)
+	}
+}
+
+// flushed records the packets handed to the socket by post processing, and
+// releases the Flush calls waiting for them
+func (s *UDPSession) flushed(done uint64) {
+	s.txDone.Store(done)
+
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	waiters := s.flushWaiters[:0]
+	for _, w := range s.flushWaiters {
+		if w.seq > done {
+			waiters = append(waiters, w)
+		} else {
+			close(w.ch)
+		}
+	}
+	s.flushWaiters = waiters
+}
@@ -0,0 +1,145 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-26 16:52:09
+@Description: Hooks for unparseable packets
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// GarbageReason tells why a packet could not be processed
+type GarbageReason int
+
+const (
+	GarbageChecksum  GarbageReason = iota // failed decryption or the integrity check
+	GarbageMalformed                      // too short, or rejected by the FEC or KCP parser
+	GarbageUnknown                        // valid, but for no session, such as parity of an unknown session
+)
+
+func (r GarbageReason) String() string {
+	switch r {
+	case GarbageChecksum:
+		return "checksum"
+	case GarbageMalformed:
+		return "malformed"
+	case GarbageUnknown:
+		return "unknown"
+	default:
+		return "invalid"
+	}
+}
+
+// GarbagePacket is a packet dropped because it could not be processed
+type GarbagePacket struct {
+	Time   time.Time
+	Addr   net.Addr
+	Reason GarbageReason
+
+	// Data is a copy of the packet as received for GarbageChecksum, and after
+	// decryption otherwise, the handler may keep it.
+	Data []byte
+}
+
+// garbageHook passes dropped packets to a handler, up to a number per second
+type garbageHook struct {
+	handler   func(GarbagePacket)
+	perSecond int
+
+	window time.Time // start of the current second
+	count  int       // packets reported in the current second
+	mu     sync.Mutex
+}
+
+func newGarbageHook(handler func(GarbagePacket), perSecond int) *garbageHook {
+	if handler == nil || perSecond <= 0 {
+		return nil
+	}
+	return &garbageHook{handler: handler, perSecond: perSecond}
+}
+
+// armed reports whether a packet would be reported now, it is used to skip
+// copying packets before decryption while the budget is exhausted.
+func (h *garbageHook) armed() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.window) >= time.Second || h.count < h.perSecond
+}
+
+// report passes a copy of 'data' to the handler if the budget allows
+func (h *garbageHook) report(data []byte, addr net.Addr, reason GarbageReason) {
+	if h == nil || data == nil {
+		return
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	if now.Sub(h.window) >= time.Second {
+		h.window, h.count = now, 0
+	}
+	if h.count >= h.perSecond {
+		h.mu.Unlock()
+		return
+	}
+	h.count++
+	h.mu.Unlock()
+
+	h.handler(GarbagePacket{
+		Time:   now,
+		Addr:   addr,
+		Reason: reason,
+		Data:   append([]byte(nil), data...),
+	})
+}
+
+// rawCopy copies a packet before decryption if the hook may report it, the
+// copy is from xmitBuf, or nil
+func (h *garbageHook) rawCopy(data []byte) []byte {
+	if !h.armed() {
+		return nil
+	}
+	raw := xmitBuf.Get().([]byte)[:len(data)]
+	copy(raw, data)
+	return raw
+}
+
+// releaseRaw recycles a copy from rawCopy
+func releaseRaw(raw []byte) {
+	if raw != nil {
+		xmitBuf.Put(raw)
+	}
+}
+
+// SetGarbageHandler installs a handler for packets which the listener or its
+// sessions drop because they cannot be processed, so that scanners and attack
+// traffic can be fed into detection systems. At most 'perSecond' packets are
+// reported, a nil handler removes it.
+//
+// The handler is called on the receiving goroutine and must not block. While
+// installed, packets are copied before decryption to report them as received.
+func (l *Listener) SetGarbageHandler(handler func(p GarbagePacket), perSecond int) {
+	l.garbage.Store(newGarbageHook(handler, perSecond))
+}
+
+// SetGarbageHandler installs a handler for packets which the session drops,
+// see Listener.SetGarbageHandler. Sessions accepted from a Listener report
+// to the handler of the Listener.
+func (s *UDPSession) SetGarbageHandler(handler func(p GarbagePacket), perSecond int) {
+	s.garbage.Store(newGarbageHook(handler, perSecond))
+}
+
+// garbageHook returns the hook of the session, or of its listener
+func (s *UDPSession) garbageHook() *garbageHook {
+	if s.l != nil {
+		return s.l.garbage.Load()
+	}
+	return s.garbage.Load()
+}
@@ -3,15 +3,20 @@ module safe-udp
 go 1.23.4
 
 require (
+	github.com/golang/snappy v1.0.0
 	github.com/klauspost/reedsolomon v1.12.5
+	github.com/pion/dtls/v3 v3.0.7
 	github.com/pkg/errors v0.9.1
 	github.com/tjfoc/gmsm v1.4.1
+	github.com/xtaci/kcp-go/v5 v5.6.24
 	github.com/xtaci/smux v1.5.35
 	golang.org/x/crypto v0.41.0
 	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.35.0
 )
 
 require (
 	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
-	golang.org/x/sys v0.35.0 // indirect
+	github.com/pion/logging v0.2.4 // indirect
+	github.com/pion/transport/v3 v3.0.7 // indirect
 )
@@ -0,0 +1,59 @@
+//go:build linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-25 20:37:44
+@Description: UDP generic receive offload
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// groControlSize is the room for the control message carrying the segment size
+var groControlSize = unix.CmsgSpace(4)
+
+// setGRO turns UDP_GRO on or off on 'conn'
+func setGRO(conn net.PacketConn, enable bool) bool {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return false
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	value := 0
+	if enable {
+		value = 1
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, value)
+	}); err != nil {
+		return false
+	}
+	return sockErr == nil
+}
+
+// groSegmentSize returns the size of the packets coalesced in a buffer, or 0
+// if the buffer holds a single packet
+func groSegmentSize(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == unix.IPPROTO_UDP && m.Header.Type == unix.UDP_GRO && len(m.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(m.Data))
+		}
+	}
+	return 0
+}
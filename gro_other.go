@@ -0,0 +1,21 @@
+//go:build !linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-25 20:37:44
+@Description: UDP generic receive offload, unsupported
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "net"
+
+// groControlSize is the room for the control message carrying the segment size
+var groControlSize = 0
+
+// setGRO turns UDP_GRO on or off on 'conn'
+func setGRO(conn net.PacketConn, enable bool) bool { return false }
+
+// groSegmentSize returns the size of the packets coalesced in a buffer
+func groSegmentSize(oob []byte) int { return 0 }
@@ -0,0 +1,34 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-13 22:48:05
+@Description: gRPC clients and servers over stream connections
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"net"
+)
+
+// GRPCDialer returns a function for grpc.WithContextDialer which dials the
+// addresses gRPC resolves with DialContext and the settings of 'config', and
+// closes the session with the connection, so gRPC channels run over stream
+// connections instead of TCP:
+//
+//	cc, err := grpc.NewClient("example.com:4000",
+//		grpc.WithContextDialer(safeudp.GRPCDialer(config)),
+//		grpc.WithTransportCredentials(insecure.NewCredentials()))
+//
+// The server serves a StreamListener, a net.Listener, with grpc.Server.Serve.
+// The connections keep their deadlines and addresses like TCP connections,
+// and Accept fails temporarily on bad clients, so Serve goes on. Without
+// Config.Key the streams are encrypted with an agreed key, TLS credentials
+// are needed to authenticate the server.
+func GRPCDialer(config *Config) func(ctx context.Context, addr string) (net.Conn, error) {
+	dial := HTTPDialer(config)
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return dial(ctx, "tcp", addr)
+	}
+}
@@ -0,0 +1,127 @@
+//go:build linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-16 19:14:50
+@Description: UDP generic segmentation offload
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// gsoMaxSegments is the largest number of segments in a super packet, UDP_MAX_SEGMENTS
+	gsoMaxSegments = 64
+
+	// gsoMaxBytes keeps a super packet within the 64KB limit of an IP packet
+	gsoMaxBytes = 65000
+)
+
+// gsoSupported reports whether the kernel accepts UDP_SEGMENT on 'conn'
+func gsoSupported(conn *net.UDPConn) bool {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		_, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+	}); err != nil {
+		return false
+	}
+	return sockErr == nil
+}
+
+// gsoControl builds the control message carrying the segment size
+func gsoControl(size int) []byte {
+	oob := make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(size))
+	return oob
+}
+
+// gsoTx sends runs of packets to the same address as super packets which the
+// kernel splits at the size of their first packet, only the last packet of a
+// run may be shorter. It returns the number of packets sent, and turns GSO off
+// on the first failure so the caller sends the rest by other means.
+func (s *UDPSession) gsoTx(txqueue []ipv4.Message) (sent int) {
+	conn, ok := s.conn.(*net.UDPConn)
+	if !ok {
+		s.gso.Store(false)
+		return 0
+	}
+
+	nbytes := 0
+	buf := s.gsoBuffer[:0]
+	for sent < len(txqueue) {
+		addr, ok := txqueue[sent].Addr.(*net.UDPAddr)
+		if !ok {
+			s.gso.Store(false)
+			break
+		}
+
+		// collect a run of packets of the same size to the same address, from
+		// the same source
+		oob := txqueue[sent].OOB
+		size := len(txqueue[sent].Buffers[0])
+		buf = append(buf[:0], txqueue[sent].Buffers[0]...)
+		end := sent + 1
+		for end < len(txqueue) && end-sent < gsoMaxSegments {
+			b := txqueue[end].Buffers[0]
+			if len(b) > size || len(buf)+len(b) > gsoMaxBytes || !sameUDPAddr(txqueue[end].Addr, addr) ||
+				!bytes.Equal(txqueue[end].OOB, oob) {
+				break
+			}
+			buf = append(buf, b...)
+			end++
+			if len(b) < size {
+				break
+			}
+		}
+
+		var err error
+		switch {
+		case end-sent == 1 && len(oob) == 0:
+			_, err = conn.WriteToUDP(buf, addr)
+		case end-sent == 1:
+			_, _, err = conn.WriteMsgUDP(buf, oob, addr)
+		default:
+			_, _, err = conn.WriteMsgUDP(buf, append(gsoControl(size), oob...), addr)
+		}
+		if err != nil {
+			// no offload on this path, such as a device without checksum offload
+			s.gso.Store(false)
+			break
+		}
+		nbytes += len(buf)
+		sent = end
+	}
+	s.gsoBuffer = buf
+
+	atomic.AddUint64(&s.Snmp().OutPkts, uint64(sent))
+	atomic.AddUint64(&s.stats.OutPkts, uint64(sent))
+	atomic.AddUint64(&s.Snmp().OutBytes, uint64(nbytes))
+	atomic.AddUint64(&s.stats.OutBytes, uint64(nbytes))
+	return sent
+}
+
+// sameUDPAddr reports whether 'a' is the UDP address 'b'
+func sameUDPAddr(a net.Addr, b *net.UDPAddr) bool {
+	ua, ok := a.(*net.UDPAddr)
+	return ok && ua.Port == b.Port && ua.IP.Equal(b.IP) && ua.Zone == b.Zone
+}
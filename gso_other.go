@@ -0,0 +1,22 @@
+//go:build !linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-23 21:48:05
+@Description: UDP generic segmentation offload, unsupported
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// gsoSupported reports whether the kernel accepts UDP_SEGMENT on 'conn'
+func gsoSupported(conn *net.UDPConn) bool { return false }
+
+// gsoTx is never called without kernel support
+func (s *UDPSession) gsoTx(txqueue []ipv4.Message) int { return 0 }
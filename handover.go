@@ -0,0 +1,411 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:31:26
+@Description: Handover of listeners to a new process for hot restarts
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// handoverMagic leads the encoded state of a handover
+const handoverMagic = "SUDPH2"
+
+// Handover is what a listener hands over to its successor in another process
+// on a hot restart: the sockets, which keep the port and the NAT bindings of
+// the clients, and the state of the sessions.
+type Handover struct {
+	Files []*os.File // the sockets, one per shard, to be inherited by the successor
+	State []byte     // the sessions, encoded
+}
+
+// Handover stops the listener and hands its socket and sessions over to a
+// successor, which resumes them with ListenHandover. Pass the files to the new
+// process, with exec.Cmd.ExtraFiles or over a unix socket, and the state on
+// any channel; the state holds the unacknowledged data of the sessions and the
+// running hashes of their end-to-end checksums, but no keys.
+//
+// New conversations are ignored from the call on, and the sessions are closed
+// once their state is taken, so the application must stop reading and writing
+// them first. Packets the listener receives afterwards are not acknowledged,
+// and the clients send them again to the successor.
+//
+// Sockets which are not *net.UDPConn, and windows, cannot be handed over.
+func (l *Listener) Handover() (*Handover, error) {
+	return handover([]*Listener{l})
+}
+
+// Handover stops all the shards and hands their sockets and sessions over, see
+// Listener.Handover. The successor resumes them with ListenReusePortHandover.
+func (sl *ShardedListener) Handover() (*Handover, error) {
+	return handover(sl.group.shards)
+}
+
+// handover takes the sockets and the sessions of the shards and closes them
+func handover(shards []*Listener) (*Handover, error) {
+	h := new(Handover)
+	for _, l := range shards {
+		sc, ok := l.conn.(interface{ File() (*os.File, error) })
+		if !ok {
+			h.Close()
+			return nil, errors.New("socket cannot be handed over")
+		}
+		f, err := sc.File()
+		if err != nil {
+			h.Close()
+			return nil, errors.WithStack(err)
+		}
+		h.Files = append(h.Files, f)
+	}
+
+	var sessions []*UDPSession
+	for _, l := range shards {
+		l.drainOnce.Do(func() { close(l.draining) })
+		for _, s := range l.sessionList() {
+			if !s.isClosed() {
+				sessions = append(sessions, s)
+			}
+		}
+	}
+	h.State = binary.LittleEndian.AppendUint32([]byte(handoverMagic), uint32(len(sessions)))
+	for _, s := range sessions {
+		h.State = s.freeze(h.State)
+	}
+
+	for _, l := range shards {
+		l.closeSessions()
+		l.Close()
+	}
+	return h, nil
+}
+
+// Close closes the files of the handover, the successor's listener holds its
+// own copies of the sockets.
+func (h *Handover) Close() error {
+	var err error
+	for _, f := range h.Files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ListenHandover resumes the listener and the sessions handed over by a
+// predecessor with Listener.Handover, with the settings of 'config', which
+// must use the key and the FEC settings of the predecessor. The sessions are
+// returned to the caller instead of being queued for Accept.
+func ListenHandover(h *Handover, config *Config) (*Listener, []*UDPSession, error) {
+	if len(h.Files) != 1 {
+		return nil, nil, errors.Errorf("handover of %d sockets, resumed by ListenReusePortHandover", len(h.Files))
+	}
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	block, err := config.blockCrypt()
+	if err != nil {
+		return nil, nil, err
+	}
+	states, err := parseHandover(h.State)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := net.FilePacketConn(h.Files[0])
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	l, err := newConfigListener(conn, config, block, true)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	sessions := make([]*UDPSession, 0, len(states))
+	for _, st := range states {
+		sessions = append(sessions, l.resume(st))
+	}
+	go l.monitor()
+	return l, sessions, nil
+}
+
+// ListenReusePortHandover resumes the shards and the sessions handed over by a
+// predecessor with ShardedListener.Handover, the other parameters are those of
+// ListenReusePort. The sessions are returned to the caller instead of being
+// queued for Accept.
+func ListenReusePortHandover(h *Handover, block BlockCrypt, dataShards, parityShards int) (*ShardedListener, []*UDPSession, error) {
+	if err := checkFEC(dataShards, parityShards); err != nil {
+		return nil, nil, err
+	}
+	if len(h.Files) == 0 {
+		return nil, nil, errors.New("handover without sockets")
+	}
+	states, err := parseHandover(h.State)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conns []net.PacketConn
+	for _, f := range h.Files {
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, nil, errors.WithStack(err)
+		}
+		conns = append(conns, conn)
+	}
+	sl := newShardedListener(conns, block, dataShards, parityShards)
+	sessions := make([]*UDPSession, 0, len(states))
+	for _, st := range states {
+		sessions = append(sessions, sl.group.owner(st.conv).resume(st))
+	}
+	sl.start()
+	return sl, sessions, nil
+}
+
+// sessionState is the handed over state of a session
+type sessionState struct {
+	conv                   uint32
+	remote                 netip.AddrPort
+	version                Version
+	sndUna, sndNxt, rcvNxt uint32
+	sndBuf, sndQueue       []segment
+	rcvQueue, rcvBuf       []segment
+	e2e                    *e2eChecksum // nil if disabled
+}
+
+// freeze appends the state of the session to 'b' and silences the session,
+// the packets it receives afterwards are neither acknowledged nor answered
+func (s *UDPSession) freeze(b []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.output = func([]byte, int) {}
+
+	remote, _ := addrKey(s.remoteAddr()).MarshalBinary()
+	b = binary.LittleEndian.AppendUint32(b, s.kcp.conv)
+	b = append(b, byte(len(remote)))
+	b = append(b, remote...)
+	b = append(b, byte(s.version))
+	b = binary.LittleEndian.AppendUint32(b, s.kcp.snd_una)
+	b = binary.LittleEndian.AppendUint32(b, s.kcp.snd_nxt)
+	b = binary.LittleEndian.AppendUint32(b, s.kcp.rcv_nxt)
+	b = appendSegments(b, s.kcp.snd_buf.ForEach)
+	b = appendSegments(b, s.kcp.snd_queue.ForEach)
+	b = appendSegments(b, s.kcp.rcv_queue.ForEach)
+	b = appendSegments(b, func(yield func(*segment) bool) {
+		for i := range s.kcp.rcv_buf.segments {
+			if !yield(&s.kcp.rcv_buf.segments[i]) {
+				return
+			}
+		}
+	})
+	b = appendChecksum(b, s.e2e)
+	// the successor's session sends the digest, not the Close of this one
+	s.e2e = nil
+	return b
+}
+
+// flags of the end-to-end checksum in a handover state
+const (
+	checksumEnabled  = 1 << iota
+	checksumDigest   // the digest of the remote has arrived
+	checksumVerified // the data read matched it
+	checksumMismatch // the data read did not match it
+)
+
+// appendChecksum appends the flags of the end-to-end checksum, then if enabled
+// the states of the running hashes, the byte counts and the remote digest
+func appendChecksum(b []byte, c *e2eChecksum) []byte {
+	if c == nil {
+		return append(b, 0)
+	}
+	flags := byte(checksumEnabled)
+	if c.remoteSum != nil {
+		flags |= checksumDigest
+	}
+	if c.verified {
+		flags |= checksumVerified
+	}
+	if c.err != nil {
+		flags |= checksumMismatch
+	}
+	b = append(b, flags)
+	for _, h := range []any{c.tx, c.rx} {
+		state, _ := h.(encoding.BinaryMarshaler).MarshalBinary()
+		b = append(b, byte(len(state)))
+		b = append(b, state...)
+	}
+	b = binary.LittleEndian.AppendUint64(b, c.txBytes)
+	b = binary.LittleEndian.AppendUint64(b, c.rxBytes)
+	b = binary.LittleEndian.AppendUint64(b, c.remoteLen)
+	if c.remoteSum != nil {
+		b = append(b, c.remoteSum...)
+	}
+	return b
+}
+
+// appendSegments appends the count of the segments, then their sn, frg, ack
+// mark and data
+func appendSegments(b []byte, segments func(yield func(*segment) bool)) []byte {
+	at := len(b)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	var n uint32
+	for seg := range segments {
+		b = binary.LittleEndian.AppendUint32(b, seg.sn)
+		b = append(b, seg.frg, byte(seg.acked))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(seg.data)))
+		b = append(b, seg.data...)
+		n++
+	}
+	binary.LittleEndian.PutUint32(b[at:], n)
+	return b
+}
+
+// handoverReader decodes a handover state, the first error sticks
+type handoverReader struct {
+	b   []byte
+	err error
+}
+
+func (r *handoverReader) next(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		if r.err == nil {
+			r.err = errors.New("truncated handover state")
+		}
+		return make([]byte, n)
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *handoverReader) u8() uint8   { return r.next(1)[0] }
+func (r *handoverReader) u32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *handoverReader) u64() uint64 { return binary.LittleEndian.Uint64(r.next(8)) }
+
+func (r *handoverReader) checksum() *e2eChecksum {
+	flags := r.u8()
+	if flags&checksumEnabled == 0 {
+		return nil
+	}
+	c := &e2eChecksum{tx: sha256.New(), rx: sha256.New()}
+	for _, h := range []any{c.tx, c.rx} {
+		state := r.next(int(r.u8()))
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil && r.err == nil {
+			r.err = errors.WithStack(err)
+		}
+	}
+	c.txBytes, c.rxBytes, c.remoteLen = r.u64(), r.u64(), r.u64()
+	if flags&checksumDigest != 0 {
+		c.remoteSum = append([]byte(nil), r.next(sha256.Size)...)
+	}
+	c.verified = flags&checksumVerified != 0
+	if flags&checksumMismatch != 0 {
+		c.err = errors.WithStack(errChecksumMismatch)
+	}
+	return c
+}
+
+func (r *handoverReader) segments() []segment {
+	n := r.u32()
+	var segments []segment
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		seg := segment{sn: r.u32(), frg: r.u8(), acked: uint32(r.u8())}
+		size := int(r.u32())
+		if size > mtuLimit {
+			r.err = errors.New("segment of handover state too large")
+			break
+		}
+		seg.data = r.next(size) // copied into the segment pool by resume
+		segments = append(segments, seg)
+	}
+	return segments
+}
+
+// parseHandover decodes the sessions of a handover state
+func parseHandover(b []byte) ([]sessionState, error) {
+	if len(b) < len(handoverMagic) || string(b[:len(handoverMagic)]) != handoverMagic {
+		return nil, errors.New("invalid handover state")
+	}
+	r := &handoverReader{b: b[len(handoverMagic):]}
+	n := r.u32()
+	var states []sessionState
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		var st sessionState
+		st.conv = r.u32()
+		if err := st.remote.UnmarshalBinary(r.next(int(r.u8()))); err != nil && r.err == nil {
+			r.err = errors.WithStack(err)
+		}
+		st.version = Version(r.u8())
+		st.sndUna, st.sndNxt, st.rcvNxt = r.u32(), r.u32(), r.u32()
+		st.sndBuf = r.segments()
+		st.sndQueue = r.segments()
+		st.rcvQueue = r.segments()
+		st.rcvBuf = r.segments()
+		st.e2e = r.checksum()
+		states = append(states, st)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return states, nil
+}
+
+// resume recreates a handed over session in the listener
+func (l *Listener) resume(st sessionState) *UDPSession {
+	s := l.newSession(st.conv, net.UDPAddrFromAddrPort(st.remote))
+	s.mu.Lock()
+	kcp := s.kcp
+	kcp.snd_una, kcp.snd_nxt, kcp.rcv_nxt = st.sndUna, st.sndNxt, st.rcvNxt
+	s.version = st.version
+	s.e2e = st.e2e
+	for _, seg := range st.sndBuf {
+		seg.conv, seg.cmd = kcp.conv, IKCP_CMD_PUSH // sent as new segments
+		kcp.snd_buf.Push(kcp.copySegment(seg))
+	}
+	for _, seg := range st.sndQueue {
+		kcp.snd_queue.Push(kcp.copySegment(seg))
+	}
+	for _, seg := range st.rcvQueue {
+		kcp.rcv_queue.Push(kcp.copySegment(seg))
+		kcp.rcv_mem += len(seg.data)
+	}
+	for _, seg := range st.rcvBuf {
+		heap.Push(kcp.rcv_buf, kcp.copySegment(seg))
+		kcp.rcv_mem += len(seg.data)
+	}
+	readable := kcp.PeekSize() > 0
+	s.mu.Unlock()
+	if readable {
+		s.notifyReadEvent()
+	}
+
+	l.sessionLock.Lock()
+	if l.sessions[st.conv] == nil {
+		l.sessions[st.conv] = s
+	}
+	l.sessionAddrs[st.remote] = s
+	l.sessionLock.Unlock()
+	s.logEvent("resumed from a handover")
+	return s
+}
+
+// copySegment copies 'seg' with its data in a buffer of the segment pool
+func (kcp *KCP) copySegment(seg segment) segment {
+	data := seg.data
+	seg.data = kcp.newSegment(len(data)).data
+	copy(seg.data, data)
+	return seg
+}
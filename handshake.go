@@ -0,0 +1,55 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 11:48:19
+@Description: Pluggable handshakes securing stream connections
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"net"
+)
+
+// HandshakeBackend secures the sessions of stream connections with a
+// standard handshake, instead of the pre-shared key of Config.Key or the
+// unauthenticated ephemeral key: certificates, ALPN and session tickets are
+// those of the backend, while KCP and FEC below it keep the session reliable.
+// See Config.Handshake.
+//
+// A backend runs over the session as a net.Conn, a reliable ordered stream,
+// which keeps the boundaries of writes under WriteMessage. Package
+// tlshandshake runs TLS 1.3 over the stream, package dtlshandshake DTLS of
+// pion/dtls over the messages; DTLS 1.2, as DTLS 1.3 is not implemented in
+// Go yet.
+type HandshakeBackend interface {
+	// Client runs the handshake of a dialed session and returns the secured
+	// connection, it stops when the context is done
+	Client(ctx context.Context, conn net.Conn) (net.Conn, error)
+
+	// Server runs the handshake of an accepted session and returns the
+	// secured connection, it stops when the context is done
+	Server(ctx context.Context, conn net.Conn) (net.Conn, error)
+}
+
+// runHandshake secures 'conn' with the backend as the client or the server.
+// It fails with ctx.Err() once the context is done, and with ErrHandshake
+// wrapping the error of the backend otherwise.
+func runHandshake(ctx context.Context, h HandshakeBackend, conn net.Conn, client bool) (net.Conn, error) {
+	handshake := h.Server
+	if client {
+		handshake = h.Client
+	}
+	secured, err := handshake(ctx, conn)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, handshakeFailed(err)
+	}
+	if s, ok := conn.(*UDPSession); ok {
+		s.traceEvent(TraceHandshake, "handshake of the backend completed")
+	}
+	return secured, nil
+}
@@ -0,0 +1,407 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:12:40
+@Description: Synchronized port hopping on a schedule derived from the key
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// defaultHopInterval is the interval between hops when Config.HopInterval is 0
+const defaultHopInterval = 30 * time.Second
+
+// errHopConn is the error of port hopping with a socket of the caller
+var errHopConn = errors.New("HopPorts and HopInterval apply to the sockets of the library, which hop between ports")
+
+// hopSchedule is the port of each epoch of the interval, the same for both
+// ends with the same key and synchronized clocks
+type hopSchedule struct {
+	key      []byte
+	min, max int
+	interval time.Duration
+}
+
+// hopSchedule returns the schedule of the config, nil if it does not hop
+func (c *Config) hopSchedule() (*hopSchedule, error) {
+	if c.HopPorts == "" {
+		return nil, nil
+	}
+	lo, hi, ok := strings.Cut(c.HopPorts, "-")
+	min, err1 := strconv.Atoi(lo)
+	max, err2 := strconv.Atoi(hi)
+	if !ok || err1 != nil || err2 != nil || min < 1 || min > max || max > 65535 {
+		return nil, errors.Errorf("HopPorts %q, want a range of ports min-max", c.HopPorts)
+	}
+	if len(c.Key) == 0 {
+		return nil, errors.New("HopPorts needs a Key to derive the schedule from")
+	}
+	if c.HopInterval < 0 {
+		return nil, errors.New("HopInterval must not be negative")
+	}
+	interval := defaultHopInterval
+	if c.HopInterval > 0 {
+		interval = time.Duration(c.HopInterval) * time.Second
+	}
+	return &hopSchedule{key: c.Key, min: min, max: max, interval: interval}, nil
+}
+
+// epoch returns the epoch at time 't'
+func (h *hopSchedule) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(h.interval)
+}
+
+// port returns the port of an epoch
+func (h *hopSchedule) port(epoch int64) int {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte("safe-udp port hopping"))
+	binary.Write(mac, binary.BigEndian, epoch)
+	return h.min + int(binary.BigEndian.Uint64(mac.Sum(nil))%uint64(h.max-h.min+1))
+}
+
+// inRange reports whether 'port' is in the range of the schedule
+func (h *hopSchedule) inRange(port uint16) bool {
+	return int(port) >= h.min && int(port) <= h.max
+}
+
+// hopClientConn is the socket of a client session hopping the destination
+// port of the packets to its remote, and passing the packets from the ports
+// of the range as from the remote
+type hopClientConn struct {
+	*net.UDPConn
+	remote   netip.AddrPort
+	schedule *hopSchedule
+}
+
+func (c *hopClientConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addrKey(addr) == c.remote {
+		port := c.schedule.port(c.schedule.epoch(time.Now()))
+		addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(c.remote.Addr(), uint16(port)))
+	}
+	return c.UDPConn.WriteTo(b, addr)
+}
+
+func (c *hopClientConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	if err == nil {
+		if from := addrKey(addr); from.Addr() == c.remote.Addr() && c.schedule.inRange(from.Port()) {
+			addr = net.UDPAddrFromAddrPort(c.remote)
+		}
+	}
+	return n, addr, err
+}
+
+// dialHopping dials 'raddr' like DialWithConfig with the port hopping of
+// 'schedule', 'raddr' names the remote, its port is not used
+func dialHopping(ctx context.Context, raddr string, config *Config, block BlockCrypt, schedule *hopSchedule) (*UDPSession, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	network := "udp4"
+	if udpaddr.IP.To4() == nil {
+		network = "udp"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	hc := &hopClientConn{UDPConn: conn, remote: addrKey(udpaddr), schedule: schedule}
+	var convid uint32
+	binary.Read(crand.Reader, binary.LittleEndian, &convid)
+	return newUDPSession(ctx, convid, config.FECData, config.FECParity, nil, hc, true, udpaddr, block), nil
+}
+
+// hopPacket is a packet read by one of the sockets of a hopListenConn
+type hopPacket struct {
+	buf  []byte // from xmitBuf
+	n    int
+	addr net.Addr
+	port int // local port it was read on
+}
+
+// hopListenConn is the socket of a listener hopping ports: it holds a socket
+// on the port of the previous, current and next epochs, so clients a hop
+// ahead or behind still reach it, and replies to each client from the port it
+// last sent to, which its NAT expects.
+type hopListenConn struct {
+	ip       net.IP
+	schedule *hopSchedule
+	packets  chan hopPacket
+	die      chan struct{}
+	dieOnce  sync.Once
+
+	mu        sync.Mutex
+	socks     map[int]*net.UDPConn   // by port
+	replyPort map[netip.AddrPort]int // last port of each client
+	readBuf   int                    // socket settings of new sockets, 0 for the system defaults
+	writeBuf  int
+	dscp      int
+	rd        time.Time     // read deadline
+	rdChanged chan struct{} // closed when the deadline changes
+	lastErr   error         // failure to bind a port of the schedule
+	local     *net.UDPAddr  // address of the socket on the current port
+	epoch     int64         // epoch of the sockets
+}
+
+// listenHopping opens the sockets of the schedule on the IP of 'laddr'
+func listenHopping(laddr string, schedule *hopSchedule) (*hopListenConn, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := &hopListenConn{
+		ip:        udpaddr.IP,
+		schedule:  schedule,
+		packets:   make(chan hopPacket, 256),
+		die:       make(chan struct{}),
+		socks:     make(map[int]*net.UDPConn),
+		replyPort: make(map[netip.AddrPort]int),
+		rdChanged: make(chan struct{}),
+	}
+	c.rotate(time.Now())
+	c.mu.Lock()
+	bound := len(c.socks)
+	err = c.lastErr
+	c.mu.Unlock()
+	if bound == 0 {
+		return nil, errors.WithStack(err)
+	}
+	go c.hop()
+	return c, nil
+}
+
+// hop rotates the sockets at the start of each epoch until closed
+func (c *hopListenConn) hop() {
+	for {
+		now := time.Now()
+		next := time.Unix(0, (c.schedule.epoch(now)+1)*int64(c.schedule.interval))
+		select {
+		case <-time.After(next.Sub(now)):
+			c.rotate(time.Now())
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// rotate opens the sockets of the epochs around 't' and closes the others
+func (c *hopListenConn) rotate(t time.Time) {
+	epoch := c.schedule.epoch(t)
+	want := make(map[int]bool)
+	for e := epoch - 1; e <= epoch+1; e++ {
+		want[c.schedule.port(e)] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.die:
+		return
+	default:
+	}
+	for port, sock := range c.socks {
+		if !want[port] {
+			sock.Close()
+			delete(c.socks, port)
+		}
+	}
+	for port := range want {
+		if _, ok := c.socks[port]; ok {
+			continue
+		}
+		sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: c.ip, Port: port})
+		if err != nil {
+			c.lastErr = err // the port is taken, clients reach the others
+			continue
+		}
+		c.tune(sock)
+		c.socks[port] = sock
+		go c.readLoop(sock, port)
+	}
+	for addr, port := range c.replyPort {
+		if _, ok := c.socks[port]; !ok {
+			delete(c.replyPort, addr)
+		}
+	}
+	c.epoch = epoch
+	if sock, ok := c.socks[c.schedule.port(epoch)]; ok {
+		c.local = sock.LocalAddr().(*net.UDPAddr)
+	}
+}
+
+// tune applies the socket settings to a new socket, the caller must hold the lock
+func (c *hopListenConn) tune(sock *net.UDPConn) {
+	if c.readBuf > 0 {
+		sock.SetReadBuffer(c.readBuf)
+	}
+	if c.writeBuf > 0 {
+		sock.SetWriteBuffer(c.writeBuf)
+	}
+	if c.dscp > 0 {
+		ipv4.NewConn(sock).SetTOS(c.dscp << 2)
+		ipv6.NewConn(sock).SetTrafficClass(c.dscp)
+	}
+}
+
+// readLoop passes the packets of a socket to ReadFrom until it is closed
+func (c *hopListenConn) readLoop(sock *net.UDPConn, port int) {
+	for {
+		buf := xmitBuf.Get().([]byte)[:mtuLimit]
+		n, addr, err := sock.ReadFrom(buf)
+		if err != nil {
+			xmitBuf.Put(buf)
+			return
+		}
+		select {
+		case c.packets <- hopPacket{buf, n, addr, port}:
+		case <-c.die:
+			xmitBuf.Put(buf)
+			return
+		}
+	}
+}
+
+func (c *hopListenConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		rd, changed := c.rd, c.rdChanged
+		c.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !rd.IsZero() {
+			if !rd.After(time.Now()) {
+				return 0, nil, errors.WithStack(ErrTimeout)
+			}
+			timer = time.NewTimer(time.Until(rd))
+			timeout = timer.C
+		}
+		select {
+		case p := <-c.packets:
+			if timer != nil {
+				timer.Stop()
+			}
+			n := copy(b, p.buf[:p.n])
+			xmitBuf.Put(p.buf)
+			c.mu.Lock()
+			c.replyPort[addrKey(p.addr)] = p.port
+			c.mu.Unlock()
+			return n, p.addr, nil
+		case <-c.die:
+			return 0, nil, errors.WithStack(net.ErrClosed)
+		case <-timeout:
+			return 0, nil, errors.WithStack(ErrTimeout)
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (c *hopListenConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	sock, ok := c.socks[c.replyPort[addrKey(addr)]]
+	if !ok {
+		sock, ok = c.socks[c.schedule.port(c.epoch)]
+	}
+	if !ok {
+		for _, sock = range c.socks {
+			break
+		}
+	}
+	c.mu.Unlock()
+	if sock == nil {
+		return 0, errors.WithStack(net.ErrClosed)
+	}
+	return sock.WriteTo(b, addr)
+}
+
+func (c *hopListenConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		c.mu.Lock()
+		for port, sock := range c.socks {
+			sock.Close()
+			delete(c.socks, port)
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+// LocalAddr returns the address of the socket on the port of the current epoch
+func (c *hopListenConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.local == nil {
+		return &net.UDPAddr{IP: c.ip}
+	}
+	return c.local
+}
+
+func (c *hopListenConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *hopListenConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rd = t
+	close(c.rdChanged)
+	c.rdChanged = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *hopListenConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *hopListenConn) SetReadBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readBuf = bytes
+	for _, sock := range c.socks {
+		if err := sock.SetReadBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *hopListenConn) SetWriteBuffer(bytes int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeBuf = bytes
+	for _, sock := range c.socks {
+		if err := sock.SetWriteBuffer(bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *hopListenConn) SetDSCP(dscp int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dscp = dscp
+	for _, sock := range c.socks {
+		c.tune(sock)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 15:52:10
+@Description: HTTP clients over stream connections
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPDialer returns a function for http.Transport.DialContext which dials
+// the address of each HTTP connection with DialContext and the settings of
+// 'config', so HTTP clients run over stream connections instead of TCP, and
+// closes the session with the connection. The server serves them with
+// http.Serve on a StreamListener, and package safehttp has a transport with
+// this dialer.
+//
+// HTTPS requests run TLS over the streams and negotiate HTTP/2 as usual. For
+// HTTP/2 without TLS, h2c, hand the function to the DialTLSContext of a
+// golang.org/x/net/http2.Transport with AllowHTTP, and serve with its h2c
+// handler.
+func HTTPDialer(config *Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, errors.Errorf("network %s cannot be dialed over streams", network)
+		}
+		conn, err := DialContext(ctx, addr, config)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,412 @@
+//go:build !safeudp_nocrypto
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 10:34:12
+@Description: Wire-level compatibility tests pinned to the kcp-go reference layout
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// 参考实现 (xtaci/kcp-go v5) 的线上格式:
+//
+//	| nonce(16B) | crc32(4B) | fec seqid(4B) | fec type(2B) | size(2B) | kcp segment(24B + data) |
+//
+// 下面的解码器独立于本包的编码逻辑实现，任何一方的格式漂移都会导致测试失败。
+type refFrame struct {
+	fecSeqID uint32
+	fecType  uint16
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	data     []byte
+}
+
+func refDecode(t *testing.T, pkt []byte, crypt, fec bool) refFrame {
+	t.Helper()
+	var f refFrame
+	if crypt {
+		if len(pkt) < 20 {
+			t.Fatalf("packet too short for crypt header: %d", len(pkt))
+		}
+		if crc32.ChecksumIEEE(pkt[20:]) != binary.LittleEndian.Uint32(pkt[16:]) {
+			t.Fatal("crc32 mismatch in reference decoding")
+		}
+		pkt = pkt[20:]
+	}
+	if fec {
+		f.fecSeqID = binary.LittleEndian.Uint32(pkt)
+		f.fecType = binary.LittleEndian.Uint16(pkt[4:])
+		size := binary.LittleEndian.Uint16(pkt[6:])
+		if int(size) != len(pkt)-6 {
+			t.Fatalf("fec size field %d does not match payload %d", size, len(pkt)-6)
+		}
+		pkt = pkt[8:]
+	}
+	f.conv = binary.LittleEndian.Uint32(pkt)
+	f.cmd = pkt[4]
+	f.frg = pkt[5]
+	f.wnd = binary.LittleEndian.Uint16(pkt[6:])
+	f.ts = binary.LittleEndian.Uint32(pkt[8:])
+	f.sn = binary.LittleEndian.Uint32(pkt[12:])
+	f.una = binary.LittleEndian.Uint32(pkt[16:])
+	length := binary.LittleEndian.Uint32(pkt[20:])
+	f.data = pkt[24 : 24+length]
+	return f
+}
+
+// TestWireCompatSegmentLayout 固定 KCP 段头的字节布局
+func TestWireCompatSegmentLayout(t *testing.T) {
+	seg := segment{conv: 0x11223344, cmd: IKCP_CMD_PUSH, frg: 0, wnd: 32, ts: 1000, sn: 7, una: 3, data: []byte("hello")}
+	buf := make([]byte, IKCP_OVERHEAD)
+	seg.encode(buf)
+
+	golden := []byte{
+		0x44, 0x33, 0x22, 0x11, // conv
+		0x51,       // cmd
+		0x00,       // frg
+		0x20, 0x00, // wnd
+		0xe8, 0x03, 0x00, 0x00, // ts
+		0x07, 0x00, 0x00, 0x00, // sn
+		0x03, 0x00, 0x00, 0x00, // una
+		0x05, 0x00, 0x00, 0x00, // len
+	}
+	if !bytes.Equal(buf, golden) {
+		t.Fatalf("segment header drifted:\n got %x\nwant %x", buf, golden)
+	}
+}
+
+// TestWireCompatFrame 抓取会话实际发出的数据报，并用参考解码器校验
+func TestWireCompatFrame(t *testing.T) {
+	if !fecEnabled {
+		t.Skip("built without FEC")
+	}
+	network := newSimNetwork(0)
+	peer := network.listen()
+	defer peer.Close()
+
+	block, _ := NewNoneBlockCrypt(nil)
+	sess, err := NewConn4(0xdeadbeef, peer.LocalAddr(), block, 10, 3, true, network.listen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	if _, err := sess.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, mtuLimit)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := refDecode(t, buf[:n], true, true)
+	if f.fecType != typeData || f.fecSeqID != 0 {
+		t.Errorf("unexpected fec header: type=%#x seqid=%d", f.fecType, f.fecSeqID)
+	}
+	if f.conv != 0xdeadbeef || f.cmd != IKCP_CMD_PUSH || f.sn != 0 {
+		t.Errorf("unexpected kcp header: conv=%#x cmd=%d sn=%d", f.conv, f.cmd, f.sn)
+	}
+	if string(f.data) != "hello" {
+		t.Errorf("unexpected payload: %q", f.data)
+	}
+}
+
+// TestInteropOverSimNetwork 在有丢包的模拟网络上进行端到端回显
+func TestInteropOverSimNetwork(t *testing.T) {
+	cases := []struct {
+		name         string
+		crypt        bool
+		dataShards   int
+		parityShards int
+		loss         float64
+	}{
+		{"Plain", false, 0, 0, 0},
+		{"AES", true, 0, 0, 0},
+		{"AES+FEC+Loss", true, 10, 3, 0.1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.dataShards > 0 && !fecEnabled {
+				t.Skip("built without FEC")
+			}
+			network := newSimNetwork(tc.loss)
+
+			var block BlockCrypt
+			if tc.crypt {
+				key := pbkdf2.Key([]byte("interop"), []byte("safe-udp"), 1024, 32, sha1.New)
+				block, _ = NewAESBlockCrypt(key)
+			}
+
+			serverConn := network.listen()
+			l, err := ServeConn(block, tc.dataShards, tc.parityShards, serverConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			defer serverConn.Close()
+
+			go func() {
+				s, err := l.AcceptKCP()
+				if err != nil {
+					return
+				}
+				defer s.Close()
+				s.SetNoDelay(1, 10, 2, 1)
+				io.Copy(s, s)
+			}()
+
+			cli, err := NewConn4(1234, serverConn.LocalAddr(), block, tc.dataShards, tc.parityShards, true, network.listen())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cli.Close()
+			cli.SetNoDelay(1, 10, 2, 1)
+
+			msg := bytes.Repeat([]byte("0123456789abcdef"), 512)
+			go cli.Write(msg)
+
+			echo := make([]byte, len(msg))
+			cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(cli, echo); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(msg, echo) {
+				t.Fatal("echoed data mismatch")
+			}
+		})
+	}
+}
+
+// TestKCPGoInterop 在有丢包的模拟网络上与 xtaci/kcp-go 双向回显
+func TestKCPGoInterop(t *testing.T) {
+	cases := []struct {
+		name         string
+		crypt        bool
+		dataShards   int
+		parityShards int
+		loss         float64
+	}{
+		{"Plain", false, 0, 0, 0},
+		{"AES", true, 0, 0, 0},
+		{"AES+FEC+Loss", true, 10, 3, 0.1},
+	}
+
+	key := KCPTunKey("interop")
+	for _, tc := range cases {
+		for _, server := range []string{"SafeUDPServer", "KCPGoServer"} {
+			t.Run(tc.name+"/"+server, func(t *testing.T) {
+				if tc.dataShards > 0 && !fecEnabled {
+					t.Skip("built without FEC")
+				}
+				network := newSimNetwork(tc.loss)
+
+				var block BlockCrypt
+				var refBlock kcp.BlockCrypt
+				if tc.crypt {
+					block, _ = NewAESBlockCrypt(key)
+					refBlock, _ = kcp.NewAESBlockCrypt(key)
+				}
+
+				serverConn := network.listen()
+				defer serverConn.Close()
+				var cli net.Conn
+				if server == "KCPGoServer" {
+					l, err := kcp.ServeConn(refBlock, tc.dataShards, tc.parityShards, serverConn)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer l.Close()
+					go func() {
+						s, err := l.AcceptKCP()
+						if err != nil {
+							return
+						}
+						defer s.Close()
+						s.SetNoDelay(1, 10, 2, 1)
+						io.Copy(s, s)
+					}()
+
+					sess, err := NewConn4(1234, serverConn.LocalAddr(), block, tc.dataShards, tc.parityShards, true, network.listen())
+					if err != nil {
+						t.Fatal(err)
+					}
+					sess.SetNoDelay(1, 10, 2, 1)
+					cli = sess
+				} else {
+					l, err := ServeConn(block, tc.dataShards, tc.parityShards, serverConn)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer l.Close()
+					go func() {
+						s, err := l.AcceptKCP()
+						if err != nil {
+							return
+						}
+						defer s.Close()
+						s.SetNoDelay(1, 10, 2, 1)
+						io.Copy(s, s)
+					}()
+
+					sess, err := kcp.NewConn4(1234, serverConn.LocalAddr(), refBlock, tc.dataShards, tc.parityShards, true, network.listen())
+					if err != nil {
+						t.Fatal(err)
+					}
+					sess.SetNoDelay(1, 10, 2, 1)
+					cli = sess
+				}
+				defer cli.Close()
+
+				msg := bytes.Repeat([]byte("0123456789abcdef"), 512)
+				go cli.Write(msg)
+
+				echo := make([]byte, len(msg))
+				cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+				if _, err := io.ReadFull(cli, echo); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(msg, echo) {
+					t.Fatal("echoed data mismatch")
+				}
+			})
+		}
+	}
+}
+
+// TestKCPCompat 测试kcptun的密钥派生、加密名称，以及兼容模式拒绝改变线上格式的设置
+func TestKCPCompat(t *testing.T) {
+	// kcptun 的默认口令
+	key := KCPTunKey("it's a secrect")
+	if got := hex.EncodeToString(key); got != "25d7d7bd51050742d8d791f2b653c6c8b2366b7e25a124cf7a2e12eaf4ffa444" {
+		t.Fatalf("key %s", got)
+	}
+
+	base := Config{Key: key, Cipher: "aes-128", KCPCompat: true}
+	if fecEnabled {
+		base.FECData, base.FECParity = 10, 3
+	}
+	if err := base.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range map[string]func(c *Config){
+		"no key":          func(c *Config) { c.Key, c.Cipher = nil, "" },
+		"compression":     func(c *Config) { c.Compression = true },
+		"sack":            func(c *Config) { c.SACK = true },
+		"leopard":         func(c *Config) { c.FECBackend = FECBackendLeopard },
+		"versions":        func(c *Config) { c.Versions = []Version{Version1} },
+		"cookies":         func(c *Config) { c.StatelessCookies = true },
+		"stateless reset": func(c *Config) { c.ResetKey = make([]byte, minResetKeySize) },
+	} {
+		c := base
+		change(&c)
+		if c.Validate() == nil {
+			t.Errorf("%s accepted in compatibility mode", name)
+		}
+	}
+	plain := Config{KCPCompat: true, Plaintext: true}
+	if err := plain.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// 兼容模式的会话与 kcp-go 的 AES-128 服务端回显
+	network := newSimNetwork(0)
+	peer := network.listen()
+	defer peer.Close()
+	refBlock, _ := kcp.NewAESBlockCrypt(key[:16])
+	ref, err := kcp.ServeConn(refBlock, base.FECData, base.FECParity, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Close()
+	go func() {
+		s, err := ref.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+	block, err := namedBlockCrypt("aes-128", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := NewConn4(0xcafe, peer.LocalAddr(), block, base.FECData, base.FECParity, true, network.listen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// 兼容模式的会话拒绝改变线上格式的功能
+	if err := base.tuneDialed(sess); err != nil {
+		t.Fatal(err)
+	}
+	sess.SetSACK(true)
+	sess.SetChecksum(true)
+	sess.SetPMTUD(true)
+	if sess.kcp.sack || sess.e2e != nil || sess.pmtud != nil {
+		t.Errorf("compatibility mode session enabled SACK %v, checksum %v, PMTUD %v", sess.kcp.sack, sess.e2e != nil, sess.pmtud != nil)
+	}
+	sess.Write([]byte("kcptun"))
+	buf := make([]byte, mtuLimit)
+	sess.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := sess.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "kcptun" {
+		t.Errorf("kcp-go echoed %q", buf[:n])
+	}
+
+	// 兼容模式的监听器不应答会话票据
+	l, cli := newSimPair(t, network, nil, 0, 0)
+	l.sessionConfig = &plain
+	ticketKey, err := NewTicketKey(make([]byte, 16), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetTicketKey(ticketKey)
+	ticket, err := ticketKey.Seal([]byte("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.mu.Lock()
+	cli.kcp.ticket, cli.kcp.ticket_repeat, cli.ticketStatus = ticket, true, TicketPending
+	cli.mu.Unlock()
+	cli.Write([]byte("resume"))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := s.Resumption(); status != TicketNone {
+		t.Errorf("compatibility mode listener took the ticket: %v", status)
+	}
+}
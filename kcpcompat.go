@@ -0,0 +1,72 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 10:02:35
+@Description: Wire compatibility with kcp-go and kcptun
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"crypto/sha1"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// kcptunSalt is the salt of the key derivation of kcptun
+const kcptunSalt = "kcp-go"
+
+// KCPTunKey derives the key of a kcptun passphrase, its -key flag, with
+// PBKDF2-SHA1 as kcptun does. Set it as Config.Key with the Cipher of its
+// -crypt flag to talk to a kcptun deployment.
+func KCPTunKey(passphrase string) []byte {
+	return pbkdf2.Key([]byte(passphrase), []byte(kcptunSalt), 4096, 32, sha1.New)
+}
+
+// setKCPCompat keeps the packets of the session those of kcp-go, it turns off
+// and refuses from then on the features changing them
+func (s *UDPSession) setKCPCompat() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcpCompat = true
+	s.kcp.SetSACK(false)
+	s.e2e = nil
+	s.pmtud = nil
+	s.kcp.ticket, s.kcp.ticket_repeat = nil, false
+}
+
+// refusedByKCPCompat tells whether 'feature' cannot be enabled as the session
+// keeps the packets of kcp-go, the caller must hold the session lock
+func (s *UDPSession) refusedByKCPCompat(feature string) bool {
+	if s.kcpCompat {
+		s.logEvent("%s refused in KCPCompat mode", feature)
+	}
+	return s.kcpCompat
+}
+
+// checkKCPCompat fails on the settings of Config.KCPCompat which change the
+// packets from those of kcp-go
+func (c *Config) checkKCPCompat() error {
+	switch {
+	case len(c.Key) == 0 && !c.Plaintext:
+		return errors.New("KCPCompat needs a Key or Plaintext, kcp-go does not agree on keys")
+	case c.Compression:
+		return errors.New("KCPCompat with Compression, kcp-go does not decompress payloads")
+	case c.SACK:
+		return errors.New("KCPCompat with SACK, kcp-go does not understand the ranges")
+	case c.FECBackend == FECBackendLeopard:
+		return errors.New("KCPCompat with FECBackendLeopard, kcp-go decodes the parity of the matrix backends only")
+	case len(c.Versions) > 0:
+		return errors.New("KCPCompat with Versions, kcp-go does not negotiate versions")
+	case c.StatelessCookies:
+		return errors.New("KCPCompat with StatelessCookies, kcp-go clients do not echo cookies")
+	case len(c.ResetKey) > 0:
+		return errors.New("KCPCompat with a ResetKey, kcp-go clients do not understand resets")
+	case c.Experimental != 0:
+		return errors.New("KCPCompat with experiments, their wire formats are not those of kcp-go")
+	case c.HopPorts != "":
+		return errors.New("KCPCompat with HopPorts, kcp-go does not hop ports")
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 22:31:16
+@Description: Ephemeral key agreement of stream connections without a key
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// agreeMagic leads the hello of each end, followed by its X25519 public key
+	agreeMagic = "SUDPKX1\x00"
+	agreeHello = len(agreeMagic) + 32
+
+	// agreeRecordSize is the plaintext bytes of a record at most, a record is
+	// the 2 byte length of the sealed bytes, then the sealed bytes
+	agreeRecordSize = 16 << 10
+)
+
+// errNotAgreed is the error of a record failing authentication
+var errNotAgreed = errors.New("record of the agreed key failed authentication")
+
+// agreedConn encrypts a connection with AES-256-GCM under keys agreed by an
+// ephemeral X25519 exchange. The exchange is not authenticated: it protects
+// against eavesdroppers, not against a man in the middle.
+type agreedConn struct {
+	net.Conn
+
+	seal, open     cipher.AEAD
+	sealSeq        uint64
+	openSeq        uint64
+	werr, rerr     error  // sticky, the stream is out of step after them, timeouts are not
+	record         []byte // the record being read, 'have' bytes of it so far
+	have           int
+	plain, pending []byte // decrypted data of the last record, 'pending' not yet read
+	rmu, wmu       sync.Mutex
+}
+
+// agreeKey runs the exchange on 'conn' as the client or the server, until the
+// context is done. A peer which does not agree, such as a plaintext peer, fails
+// the handshake.
+func agreeKey(ctx context.Context, conn net.Conn, client bool) (*agreedConn, error) {
+	priv, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	hello := append([]byte(agreeMagic), priv.PublicKey().Bytes()...)
+
+	aborted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+		close(aborted)
+	})
+	peer := make([]byte, agreeHello)
+	if client {
+		if _, err = conn.Write(hello); err == nil {
+			_, err = io.ReadFull(conn, peer)
+		}
+	} else if _, err = io.ReadFull(conn, peer); err == nil {
+		_, err = conn.Write(hello)
+	}
+	if !stop() {
+		<-aborted
+		conn.SetDeadline(time.Time{})
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, handshakeFailed(err)
+	}
+	if !bytes.HasPrefix(peer, []byte(agreeMagic)) {
+		return nil, errors.Wrap(ErrHandshake, "peer does not agree on a key")
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(peer[len(agreeMagic):])
+	if err != nil {
+		return nil, handshakeFailed(err)
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, handshakeFailed(err)
+	}
+
+	if s, ok := conn.(*UDPSession); ok {
+		s.traceEvent(TraceHandshake, "ephemeral key agreed, the peer is NOT authenticated")
+	}
+
+	// a key per direction, bound to both public keys
+	clientHello, serverHello := hello, peer
+	if !client {
+		clientHello, serverHello = peer, hello
+	}
+	c2s := agreedAEAD(shared, "client", clientHello, serverHello)
+	s2c := agreedAEAD(shared, "server", clientHello, serverHello)
+	if client {
+		return &agreedConn{Conn: conn, seal: c2s, open: s2c}, nil
+	}
+	return &agreedConn{Conn: conn, seal: s2c, open: c2s}, nil
+}
+
+// agreedAEAD derives the cipher of a direction from the shared secret
+func agreedAEAD(shared []byte, direction string, clientHello, serverHello []byte) cipher.AEAD {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(direction))
+	mac.Write(clientHello)
+	mac.Write(serverHello)
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// agreedNonce returns the nonce of record 'seq'
+func agreedNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce, seq)
+	return nonce
+}
+
+func (c *agreedConn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.werr != nil {
+		return 0, c.werr
+	}
+	for len(b) > 0 {
+		chunk := b[:min(len(b), agreeRecordSize)]
+		record := make([]byte, 2, 2+len(chunk)+c.seal.Overhead())
+		record = c.seal.Seal(record, agreedNonce(c.sealSeq), chunk, nil)
+		binary.BigEndian.PutUint16(record, uint16(len(record)-2))
+		if m, err := c.Conn.Write(record); err != nil {
+			if m > 0 { // a part of the record is out, the stream is out of step
+				c.werr = err
+			}
+			return n, err
+		}
+		c.sealSeq++
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *agreedConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.pending) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readRecord reads and opens the next record, a read interrupted by a
+// deadline resumes where it stopped
+func (c *agreedConn) readRecord() error {
+	if c.record == nil {
+		c.record = make([]byte, 2+agreeRecordSize+c.open.Overhead())
+	}
+	size := 2
+	for {
+		if c.have >= 2 {
+			size = 2 + int(binary.BigEndian.Uint16(c.record))
+			if size > len(c.record) || size < 2+c.open.Overhead() {
+				c.rerr = errors.WithStack(errNotAgreed)
+				return c.rerr
+			}
+		}
+		if c.have == size {
+			break
+		}
+		n, err := c.Conn.Read(c.record[c.have:size])
+		c.have += n
+		if err != nil {
+			if ne := net.Error(nil); !errors.As(err, &ne) || !ne.Timeout() {
+				c.rerr = err
+			}
+			return err
+		}
+	}
+
+	plain, err := c.open.Open(c.plain[:0], agreedNonce(c.openSeq), c.record[2:size], nil)
+	if err != nil {
+		c.rerr = errors.WithStack(errNotAgreed)
+		return c.rerr
+	}
+	c.openSeq++
+	c.have = 0
+	c.plain, c.pending = plain, plain
+	return nil
+}
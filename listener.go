@@ -1,6 +1,6 @@
 /*
 @Author: Lzww
-@LastEditTime: 2025-8-25 22:08:25
+@LastEditTime: 2025-10-17 22:31:16
 @Description: Listener
 @Language: Go 1.23.4
 */
@@ -8,38 +8,201 @@
 package safeudp
 
 import (
+	"context"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/xtaci/smux"
 )
 
+// streamHandshakeTimeout bounds the key agreement and the first stream of a
+// session accepted by a StreamListener
+const streamHandshakeTimeout = 10 * time.Second
+
+// StreamListener accepts streams multiplexed with smux over the sessions of
+// a listener, a stream per session
 type StreamListener struct {
 	listener net.Listener
+	config   *smux.Config     // nil for the smux defaults
+	noMux    bool             // the sessions are returned as they are
+	agree    bool             // an ephemeral key is agreed with each session
+	secure   HandshakeBackend // secures each session, nil for none
+
+	// the handshakes of the sessions run concurrently from the first Accept
+	start      sync.Once
+	results    chan acceptResult // completed handshakes
+	die        chan struct{}     // closed once the listener fails, with 'err'
+	err        error
+	handshakes chan struct{} // a slot per session in handshake or waiting for Accept
+	closeOnce  sync.Once
+	closed     chan struct{} // closed by Close
 }
 
-func (l *StreamListener) Accept() (net.Conn, error) {
-	conn, err := l.listener.Accept()
+// acceptResult is the outcome of the handshake of a session
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// ListenStream listens on "laddr" with the settings of 'config' like
+// ListenWithConfig, so the streams run over KCP with the encryption and FEC
+// of the config, and accepts the first stream of each session, the server side
+// of DialStream and DialContext. With Config.NoMux it accepts the sessions
+// themselves. Without Config.Key an ephemeral key is agreed with each client
+// unless Config.Plaintext is set, see Conn.Unauthenticated, or the
+// Config.Handshake backend secures each session.
+func ListenStream(laddr string, config *Config) (*StreamListener, error) {
+	l, err := ListenWithConfig(laddr, config)
 	if err != nil {
 		return nil, err
 	}
+	return newStreamListener(l, config), nil
+}
+
+// newStreamListener accepts the streams of 'config' over the sessions of 'l'
+func newStreamListener(l net.Listener, config *Config) *StreamListener {
+	backlog := config.Backlog
+	if backlog == 0 {
+		backlog = acceptBacklog
+	}
+	return &StreamListener{
+		listener:   l,
+		config:     config.Smux,
+		noMux:      config.NoMux,
+		agree:      config.agreesKey(),
+		secure:     config.Handshake,
+		handshakes: make(chan struct{}, backlog),
+		closed:     make(chan struct{}),
+	}
+}
+
+// DialStream connects to "raddr" with the settings of 'config' and opens a
+// stream over the session, like DialContext without a context. Closing the
+// connection closes the session and its socket.
+func DialStream(raddr string, config *Config) (*Conn, error) {
+	return DialContext(context.Background(), raddr, config)
+}
+
+// Accept waits for the next session and its first stream. The handshakes of
+// the sessions run concurrently, a session failing the key agreement, the
+// handshake of the backend or the smux handshake, or not opening a stream in 10s, is closed and fails Accept
+// with a temporary net.Error wrapping ErrHandshake, which servers such as
+// http.Serve and grpc.Server.Serve retry, so bad clients neither stop them nor
+// hold them up. At most Config.Backlog sessions, 128 by default, are in
+// handshake or waiting for Accept at once; further sessions wait in the
+// backlog of the listener, under Config.BacklogPolicy.
+func (l *StreamListener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		l.results = make(chan acceptResult)
+		l.die = make(chan struct{})
+		go l.acceptLoop()
+	})
+	select {
+	case r := <-l.results:
+		return r.conn, r.err
+	case <-l.die:
+		return nil, l.err
+	}
+}
+
+// acceptLoop accepts the sessions of the listener and starts their handshakes
+// until it fails
+func (l *StreamListener) acceptLoop() {
+	for {
+		acquired := false
+		select {
+		case l.handshakes <- struct{}{}:
+			acquired = true
+		case <-l.closed: // the listener fails Accept
+		}
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.die)
+			return
+		}
+		if !acquired {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-l.handshakes }()
+			c, err := l.handshake(conn)
+			select {
+			case l.results <- acceptResult{c, err}:
+			case <-l.die:
+				if c != nil {
+					c.Close()
+				}
+			}
+		}()
+	}
+}
+
+// handshake agrees on a key with a new session, or runs the handshake of the
+// backend, and accepts its first stream
+func (l *StreamListener) handshake(conn net.Conn) (net.Conn, error) {
+	var secured net.Conn
+	if l.secure != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), streamHandshakeTimeout)
+		c, err := runHandshake(ctx, l.secure, conn, false)
+		cancel()
+		if err != nil {
+			conn.Close()
+			return nil, handshakeError{handshakeFailed(err)}
+		}
+		conn, secured = c, c
+	}
+	if l.agree {
+		ctx, cancel := context.WithTimeout(context.Background(), streamHandshakeTimeout)
+		agreed, err := agreeKey(ctx, conn, false)
+		cancel()
+		if err != nil {
+			conn.Close()
+			return nil, handshakeError{handshakeFailed(err)}
+		}
+		conn = agreed
+	}
+	if l.noMux {
+		return &Conn{stream: conn, unauthenticated: l.agree, secured: secured}, nil
+	}
 
-	session, err := smux.Server(conn, nil)
+	session, err := smux.Server(conn, l.config)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, handshakeError{handshakeFailed(err)}
 	}
 
+	session.SetDeadline(time.Now().Add(streamHandshakeTimeout))
 	stream, err := session.AcceptStream()
 	if err != nil {
-		return nil, err
+		session.Close()
+		return nil, handshakeError{handshakeFailed(err)}
 	}
+	session.SetDeadline(time.Time{})
 
 	return &Conn{
-		stream: stream,
-		sess:   session,
+		stream:          stream,
+		sess:            session,
+		unauthenticated: l.agree,
+		secured:         secured,
 	}, nil
 }
 
+// handshakeError is the error of a session failing on Accept, temporary as
+// the listener goes on
+type handshakeError struct {
+	err error
+}
+
+func (e handshakeError) Error() string   { return e.err.Error() }
+func (e handshakeError) Unwrap() error   { return e.err }
+func (e handshakeError) Timeout() bool   { return false }
+func (e handshakeError) Temporary() bool { return true }
+
 func (l *StreamListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
 	return l.listener.Close()
 }
 
@@ -0,0 +1,119 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:12:40
+@Description: Local address selection for dialing
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// defaultBindAttempts is the number of random ports tried in a port range
+const defaultBindAttempts = 16
+
+// LocalBinding selects the local address of a dialing session.
+//
+// With a zero Port and no range the system picks an ephemeral port. A range
+// [PortMin, PortMax] picks ports at random from it, retrying on EADDRINUSE; if
+// both Port and a range are set, the range is the fallback when Port is in use.
+type LocalBinding struct {
+	IP       net.IP // local IP, nil for the unspecified address
+	Port     int    // fixed local port, 0 for none
+	PortMin  int    // lowest port of the random range
+	PortMax  int    // highest port of the random range
+	Attempts int    // random ports tried before giving up, 0 for the default of 16
+}
+
+// validate checks the port numbers of the binding
+func (b *LocalBinding) validate() error {
+	if b.Port < 0 || b.Port > 65535 {
+		return errors.Errorf("invalid local port %d", b.Port)
+	}
+	if b.PortMin != 0 || b.PortMax != 0 {
+		if b.PortMin <= 0 || b.PortMax > 65535 || b.PortMin > b.PortMax {
+			return errors.Errorf("invalid local port range %d-%d", b.PortMin, b.PortMax)
+		}
+	}
+	if b.Attempts < 0 {
+		return errors.New("bind attempts must not be negative")
+	}
+	return nil
+}
+
+// listen opens the local socket on 'network' according to the binding, a nil
+// binding lets the system choose.
+func (b *LocalBinding) listen(network string) (*net.UDPConn, error) {
+	if b == nil {
+		return net.ListenUDP(network, nil)
+	}
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	hasRange := b.PortMin != 0
+	if b.Port != 0 || !hasRange {
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: b.IP, Port: b.Port})
+		if err == nil || !hasRange || !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+
+	attempts := b.Attempts
+	if attempts == 0 {
+		attempts = defaultBindAttempts
+	}
+	span := b.PortMax - b.PortMin + 1
+	var err error
+	for i := 0; i < attempts; i++ {
+		port := b.PortMin + rand.IntN(span)
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP(network, &net.UDPAddr{IP: b.IP, Port: port}); err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// DialWithBinding connects to the remote address "raddr" like DialWithOptions,
+// with the local address selected by 'bind', a nil 'bind' is the same as DialWithOptions.
+func DialWithBinding(raddr string, bind *LocalBinding, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	return dialWithBinding(context.Background(), raddr, bind, block, dataShards, parityShards)
+}
+
+// dialWithBinding is DialWithBinding with the context of the dial, for the Tracer
+func dialWithBinding(ctx context.Context, raddr string, bind *LocalBinding, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	if err := checkFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+
+	// network type detection
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	network := "udp4"
+	if udpaddr.IP.To4() == nil {
+		network = "udp"
+	}
+
+	conn, err := bind.listen(network)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var convid uint32
+	binary.Read(crand.Reader, binary.LittleEndian, &convid)
+	return newUDPSession(ctx, convid, dataShards, parityShards, nil, conn, true, udpaddr, block), nil
+}
@@ -0,0 +1,93 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 19:31:04
+@Description: Memory pressure handling for the FEC layer
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryPressure is set while the FEC layer is suspended, FEC decoders stop
+// caching shards and FEC encoders stop generating parity shards.
+var memoryPressure atomic.Bool
+
+// SetMemoryPressure suspends or resumes FEC shard caching and parity generation
+// for all sessions. Data packets keep their FEC headers, so peers are not affected
+// except for the missing recovery, and sessions resume FEC on their own once the
+// pressure is released. Each suspension is counted in Snmp.FECSuspended of
+// DefaultSnmp, MemoryPressure reports the state.
+func SetMemoryPressure(on bool) {
+	if memoryPressure.Swap(on) == on {
+		return
+	}
+
+	if on {
+		atomic.AddUint64(&DefaultSnmp.FECSuspended, 1)
+	}
+}
+
+// MemoryPressure reports whether the FEC layer is suspended under memory pressure
+func MemoryPressure() bool { return memoryPressure.Load() }
+
+var watermark struct {
+	sync.Mutex
+	high, low uint64
+	die       chan struct{}
+}
+
+// watermarkInterval is the sampling interval of heap usage
+const watermarkInterval = time.Second
+
+// SetMemoryWatermark watches the heap usage of the process, the memory pressure is
+// signaled when it grows above 'high' bytes, and released when it drops below 'low'.
+// Setting 'high' to 0 stops watching.
+func SetMemoryWatermark(high, low uint64) {
+	watermark.Lock()
+	defer watermark.Unlock()
+
+	if watermark.die != nil {
+		close(watermark.die)
+		watermark.die = nil
+	}
+
+	watermark.high, watermark.low = high, low
+	if high == 0 {
+		return
+	}
+
+	watermark.die = make(chan struct{})
+	go watchMemory(high, low, watermark.die)
+}
+
+// watchMemory samples the heap usage periodically with hysteresis between 'low' and 'high'
+func watchMemory(high, low uint64, die chan struct{}) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	ticker := time.NewTicker(watermarkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			metrics.Read(sample)
+			if sample[0].Value.Kind() != metrics.KindUint64 {
+				return
+			}
+
+			inuse := sample[0].Value.Uint64()
+			if inuse > high {
+				SetMemoryPressure(true)
+			} else if inuse < low {
+				SetMemoryPressure(false)
+			}
+		case <-die:
+			return
+		}
+	}
+}
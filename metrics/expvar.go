@@ -0,0 +1,48 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 23:31:52
+@Description: Publishing of the counters with expvar
+@Language: Go 1.23.4
+*/
+
+package metrics
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	safeudp "safe-udp"
+)
+
+// publishMu serializes Publish, expvar.Publish panics on a name taken meanwhile
+var publishMu sync.Mutex
+
+// Publish registers the counters of 'snmp' with expvar as a map named 'name',
+// read on each request of /debug/vars, so that safeudp.DefaultSnmp or the
+// counters of a listener are scraped with the rest of the process. expvar
+// names are global and cannot be removed, publishing a name twice is an error.
+//
+// It lives here rather than in safeudp because importing expvar registers
+// /debug/vars on http.DefaultServeMux.
+func Publish(name string, snmp *safeudp.Snmp) error {
+	if name == "" {
+		return errors.New("expvar name is empty")
+	}
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	if expvar.Get(name) != nil {
+		return errors.Errorf("expvar %q already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() any {
+		m := make(map[string]uint64)
+		values := snmp.ToSlice()
+		for i, h := range snmp.Header() {
+			m[h], _ = strconv.ParseUint(values[i], 10, 64)
+		}
+		return m
+	}))
+	return nil
+}
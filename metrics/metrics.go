@@ -0,0 +1,195 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 10:26:45
+@Description: Prometheus exposition of the counters and sessions of listeners
+@Language: Go 1.23.4
+*/
+
+// Package metrics exports the Snmp counters of safe-udp and gauges of the
+// sessions of listeners in the Prometheus text exposition format. A Collector
+// is an http.Handler a Prometheus server scrapes directly, so the library
+// needs no Prometheus client as a dependency. Publish registers the counters
+// with expvar instead.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	safeudp "safe-udp"
+)
+
+// prefix of the names of the metrics
+const prefix = "safeudp_"
+
+// Source is what a Collector scrapes, a *safeudp.Listener or a
+// *safeudp.ShardedListener
+type Source interface {
+	Snmp() *safeudp.Snmp
+	Sessions() []safeudp.SessionInfo
+}
+
+// gauges are the Snmp fields which go up and down, the others are counters
+var gauges = map[string]bool{
+	"MaxConn":             true,
+	"CurrEstab":           true,
+	"RingBufferSndQueue":  true,
+	"RingBufferRcvQueue":  true,
+	"RingBufferSndBuffer": true,
+}
+
+// sessionGauges are the metrics of each session, labeled with its listener
+// and remote address
+var sessionGauges = []struct {
+	name, help string
+	value      func(info *safeudp.SessionInfo) float64
+}{
+	{"session_srtt_seconds", "Smoothed round trip time of the session.", func(i *safeudp.SessionInfo) float64 { return float64(i.SRTT) / 1000 }},
+	{"session_rto_seconds", "Retransmission timeout of the session.", func(i *safeudp.SessionInfo) float64 { return float64(i.RTO) / 1000 }},
+	{"session_cwnd_segments", "Congestion window of the session.", func(i *safeudp.SessionInfo) float64 { return float64(i.Cwnd) }},
+	{"session_wait_snd_segments", "Segments of the session waiting to be sent or acknowledged.", func(i *safeudp.SessionInfo) float64 { return float64(i.WaitSnd) }},
+	{"session_rcv_queue_segments", "Segments of the session received and not yet read.", func(i *safeudp.SessionInfo) float64 { return float64(i.RcvQueue) }},
+	{"session_idle_seconds", "Time since the last packet from the remote of the session.", func(i *safeudp.SessionInfo) float64 { return i.Idle.Seconds() }},
+	{"session_uptime_seconds", "Time since the first packet of the session.", func(i *safeudp.SessionInfo) float64 { return i.Uptime.Seconds() }},
+}
+
+// Collector serves the metrics of the counters and listeners added to it.
+// Each is labeled with the name it was added under as "listener"; sources
+// sharing one Snmp, such as DefaultSnmp, report the same counters under
+// each of their names.
+type Collector struct {
+	mu       sync.Mutex
+	counters []named[*safeudp.Snmp]
+	sources  []named[Source]
+}
+
+// named is a source of metrics with its label
+type named[T any] struct {
+	name string
+	v    T
+}
+
+// New returns an empty Collector
+func New() *Collector {
+	return new(Collector)
+}
+
+// AddSnmp exports the counters of 'snmp', such as DefaultSnmp for the
+// client sessions of a process, labeled with 'name'
+func (c *Collector) AddSnmp(name string, snmp *safeudp.Snmp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters = append(c.counters, named[*safeudp.Snmp]{name, snmp})
+}
+
+// AddListener exports the counters of the listener and the gauges of each
+// of its sessions, labeled with 'name'. The counters are those of
+// l.Snmp() at the time of each scrape.
+func (c *Collector) AddListener(name string, l Source) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sources = append(c.sources, named[Source]{name, l})
+}
+
+// ServeHTTP writes the metrics for a scrape
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the text exposition format
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	counters := append([]named[*safeudp.Snmp](nil), c.counters...)
+	sources := append([]named[Source](nil), c.sources...)
+	c.mu.Unlock()
+
+	// one snapshot per source, all families are written from the same one
+	type snapshot struct {
+		name   string
+		values []string
+	}
+	var snaps []snapshot
+	for _, n := range counters {
+		snaps = append(snaps, snapshot{n.name, n.v.ToSlice()})
+	}
+	sessions := make([][]safeudp.SessionInfo, len(sources))
+	for i, n := range sources {
+		snaps = append(snaps, snapshot{n.name, n.v.Snmp().ToSlice()})
+		sessions[i] = n.v.Sessions()
+	}
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for i, field := range safeudp.DefaultSnmp.Header() {
+		name, kind := prefix+snakeCase(field), "gauge"
+		if !gauges[field] {
+			name, kind = name+"_total", "counter"
+		}
+		fmt.Fprintf(cw, "# HELP %s Snmp.%s of safe-udp.\n# TYPE %s %s\n", name, field, name, kind)
+		for _, s := range snaps {
+			fmt.Fprintf(cw, "%s{listener=\"%s\"} %s\n", name, escape(s.name), s.values[i])
+		}
+	}
+	for _, g := range sessionGauges {
+		fmt.Fprintf(cw, "# HELP %s%s %s\n# TYPE %s%s gauge\n", prefix, g.name, g.help, prefix, g.name)
+		for i, n := range sources {
+			for j := range sessions[i] {
+				info := &sessions[i][j]
+				fmt.Fprintf(cw, "%s%s{listener=\"%s\",remote=\"%s\"} %s\n", prefix, g.name, escape(n.name),
+					escape(info.RemoteAddr.String()), strconv.FormatFloat(g.value(info), 'g', -1, 64))
+			}
+		}
+	}
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// countWriter counts the bytes written and keeps the first error
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// snakeCase converts a field name to the style of metric names,
+// "FECFullShardSet" to "fec_full_shard_set" and "SpuriousRTOs" to
+// "spurious_rtos"
+func snakeCase(s string) string {
+	r := []rune(s)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			prevLower := unicode.IsLower(r[i-1])
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			plural := i+1 < len(r) && r[i+1] == 's' && (i+2 == len(r) || unicode.IsUpper(r[i+2]))
+			if prevLower || (nextLower && !plural) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
+
+// escape escapes a label value
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
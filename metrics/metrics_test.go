@@ -0,0 +1,110 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 10:26:45
+@Description: Metrics tests
+@Language: Go 1.23.4
+*/
+
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+// TestCollector 测试抓取监听器的计数器与会话指标
+func TestCollector(t *testing.T) {
+	l, err := safeudp.ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetSnmp(safeudp.NewSnmp())
+	cli, err := safeudp.DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c := New()
+	c.AddListener(`public "a"`, l)
+	c.AddSnmp("clients", safeudp.DefaultSnmp)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	text := string(body)
+
+	for _, want := range []string{
+		"# TYPE safeudp_passive_opens_total counter\n",
+		"safeudp_passive_opens_total{listener=\"public \\\"a\\\"\"} 1\n",
+		"safeudp_curr_estab{listener=\"clients\"} ",
+		"# TYPE safeudp_spurious_rtos_total counter\n",
+		"# TYPE safeudp_fec_full_shards_total counter\n",
+		"safeudp_session_rto_seconds{listener=\"public \\\"a\\\"\",remote=\"127.0.0.1:" + strconv.Itoa(cli.LocalAddr().(*net.UDPAddr).Port) + "\"} ",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("missing %q in\n%s", want, text)
+		}
+	}
+}
+
+// TestSnakeCase 测试字段名到指标名的转换
+func TestSnakeCase(t *testing.T) {
+	for in, want := range map[string]string{
+		"BytesSent":       "bytes_sent",
+		"KCPInErrors":     "kcp_in_errors",
+		"FECFullShardSet": "fec_full_shard_set",
+		"SACKSegs":        "sack_segs",
+		"SpuriousRTOs":    "spurious_rtos",
+	} {
+		if got := snakeCase(in); got != want {
+			t.Errorf("%s: got %s, want %s", in, got, want)
+		}
+	}
+}
+
+// TestPublish 测试统计计数器以expvar发布
+func TestPublish(t *testing.T) {
+	snmp := safeudp.NewSnmp()
+	if err := Publish("safeudp_test", snmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := Publish("safeudp_test", safeudp.NewSnmp()); err == nil {
+		t.Fatal("name published twice")
+	}
+	if err := Publish("", snmp); err == nil {
+		t.Fatal("empty name accepted")
+	}
+
+	// 每次读取时取计数器的当前值
+	atomic.AddUint64(&snmp.InPkts, 3)
+	var counters map[string]uint64
+	if err := json.Unmarshal([]byte(expvar.Get("safeudp_test").String()), &counters); err != nil {
+		t.Fatal(err)
+	}
+	if counters["InPkts"] != 3 || len(counters) != len(snmp.Header()) {
+		t.Fatal("published counters", counters)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:44:08
+@Description: Connection migration on peer address change
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// pathTokenFlag marks probe tokens used for path validation, so they never
+	// collide with the packet sizes used as tokens by path MTU discovery
+	pathTokenFlag = 0x80000000
+
+	// pathChallengeInterval is the minimum interval between two path challenges
+	pathChallengeInterval = time.Second
+
+	// pathHoldLimit is the maximum number of packets from a new path held until
+	// the path is validated, the peer retransmits those dropped beyond it
+	pathHoldLimit = 16
+)
+
+// addrKey converts a network address into a comparable map key, it does not
+// allocate for UDP addresses, IPv4-mapped IPv6 addresses are unmapped.
+func addrKey(addr net.Addr) netip.AddrPort {
+	if udpaddr, ok := addr.(*net.UDPAddr); ok {
+		ap := udpaddr.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
+
+// remoteAddr returns the current address of the peer, which may have changed
+// after the session was created if the peer has migrated.
+func (s *UDPSession) remoteAddr() net.Addr {
+	if addr, ok := s.peer.Load().(net.Addr); ok {
+		return addr
+	}
+	return s.remote
+}
+
+// samePeer tells whether 'kcpPacket' of the conversation of 's', arriving from
+// a new address, may come from the peer of 's' rebound by NAT rather than from
+// another client which picked the same conversation id. The peer acknowledges
+// what 's' has sent, and does not open the conversation again while it is in
+// progress.
+func (s *UDPSession) samePeer(kcpPacket []byte) bool {
+	sn := binary.LittleEndian.Uint32(kcpPacket[IKCP_SN_OFFSET:])
+	una := binary.LittleEndian.Uint32(kcpPacket[IKCP_SN_OFFSET+4:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _itimediff(una, s.kcp.snd_una) < 0 || _itimediff(una, s.kcp.snd_nxt) > 0 {
+		return false
+	}
+	if sn == 0 && una == 0 {
+		idle := _itimediff(currentMs(), s.lastInput.Load())
+		return s.kcp.rcv_nxt == 0 && idle >= int32(pathChallengeInterval/time.Millisecond)
+	}
+	return true
+}
+
+// migratePath is called with every authenticated packet 'data' of this
+// conversation arriving from 'addr' which is not the current peer address.
+// Nothing of such packets is processed before the new path is validated: they
+// are held while 'addr' is challenged, and once a packet from 'addr' echoes the
+// challenge, 'addr' becomes the peer address of the session and the packets
+// held are returned, to be fed into the session before 'data'.
+func (s *UDPSession) migratePath(data []byte, addr net.Addr) (held [][]byte, migrated bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pathCandidate == nil || s.pathCandidate.String() != addr.String() {
+		s.pathCandidate = addr
+		s.pathHeld = nil
+		s.pathChallenged = time.Time{}
+	} else if s.answersPath(data) {
+		s.logEvent("migrated to %v", addr)
+		s.peer.Store(addr)
+		held = s.pathHeld
+		s.pathCandidate = nil
+		s.pathHeld = nil
+		return held, true
+	}
+
+	if len(s.pathHeld) < pathHoldLimit {
+		s.pathHeld = append(s.pathHeld, append([]byte(nil), data...))
+	}
+	if time.Since(s.pathChallenged) < pathChallengeInterval {
+		return nil, false
+	}
+
+	// challenge the new path with a random token, which the peer echoes
+	// back from the new path
+	var token uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &token)
+	s.pathToken = token | pathTokenFlag
+	s.pathChallenged = time.Now()
+	s.logEvent("challenging new path %v", addr)
+
+	var seg segment
+	seg.conv = s.kcp.conv
+	seg.cmd = IKCP_CMD_PROBE
+	seg.wnd = s.kcp.wnd_unused()
+	seg.una = s.kcp.rcv_nxt
+	seg.sn = s.pathToken
+	s.writeControl(&seg, addr)
+	return nil, false
+}
+
+// answersPath tells whether the decrypted packet 'data' echoes the outstanding
+// path challenge, the caller must hold the session lock. The packet is not fed
+// into KCP, its copy is only restored by the packet processors and scanned.
+func (s *UDPSession) answersPath(data []byte) bool {
+	off, ok := kcpOffset(data)
+	if !ok {
+		return false
+	}
+	pkt := append([]byte(nil), data[off:]...)
+	if !isBare(pkt) {
+		if pkt, ok = s.processIncoming(pkt); !ok {
+			return false
+		}
+	}
+
+	for len(pkt) >= IKCP_OVERHEAD {
+		if pkt[4] == IKCP_CMD_PACK && binary.LittleEndian.Uint32(pkt[IKCP_SN_OFFSET:]) == s.pathToken {
+			return true
+		}
+		length := binary.LittleEndian.Uint32(pkt[IKCP_OVERHEAD-4:])
+		if uint64(length) > uint64(len(pkt)-IKCP_OVERHEAD) {
+			return false
+		}
+		pkt = pkt[IKCP_OVERHEAD+int(length):]
+	}
+	return false
+}
+
+// writeControl sends a single segment to 'addr' out of band, bypassing FEC and
+// the post processing pipeline, the caller must hold the session lock.
+func (s *UDPSession) writeControl(seg *segment, addr net.Addr) {
+	var offset int
+	if s.block != nil {
+		offset = cryptHeaderSize
+	}
+
+	buf := make([]byte, offset+IKCP_OVERHEAD+len(seg.data))
+	copy(seg.encode(buf[offset:]), seg.data)
+	atomic.AddUint64(&s.Snmp().OutSegs, 1)
+	atomic.AddUint64(&s.stats.OutSegs, 1)
+	if chain := s.processors.Load(); chain != nil {
+		pkt, ok := s.applyOutgoing(*chain, buf[offset:])
+		if !ok {
+			return
+		}
+		buf = append(buf[:offset:offset], pkt...)
+	}
+	if s.block != nil {
+		io.ReadFull(rand.Reader, buf[:nonceSize])
+		checksum := crc32.ChecksumIEEE(buf[cryptHeaderSize:])
+		binary.LittleEndian.PutUint32(buf[nonceSize:], checksum)
+		s.block.Encrypt(buf, buf)
+	}
+
+	if _, err := s.conn.WriteTo(buf, addr); err != nil {
+		s.notifyWriteError(err)
+	}
+}
+
+// migrate holds an authenticated packet arriving from a new address for the
+// session 's' until the path is validated, then moves the session to the new
+// address and feeds it the packets held.
+func (l *Listener) migrate(s *UDPSession, data []byte, addr net.Addr) {
+	old := addrKey(s.remoteAddr())
+	held, migrated := s.migratePath(data, addr)
+	if !migrated {
+		return
+	}
+
+	l.sessionLock.Lock()
+	if l.sessionAddrs[old] == s {
+		delete(l.sessionAddrs, old)
+	}
+	l.sessionAddrs[addrKey(addr)] = s
+	l.sessionLock.Unlock()
+
+	for _, pkt := range held {
+		s.kcpInput(pkt)
+	}
+	s.kcpInput(data)
+}
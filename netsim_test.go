@@ -0,0 +1,177 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-12 20:41:18
+@Description: In-process simulated UDP network used by end-to-end tests
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// simPacket 是在模拟网络中传递的一个数据报
+type simPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// simNetwork 是一个进程内的 UDP 网络模拟器，支持丢包率配置
+type simNetwork struct {
+	mu    sync.Mutex
+	conns map[string]*simConn
+	loss  float64 // 丢包率 [0, 1)
+	rng   *rand.Rand
+	port  int
+}
+
+func newSimNetwork(loss float64) *simNetwork {
+	return &simNetwork{
+		conns: make(map[string]*simConn),
+		loss:  loss,
+		rng:   rand.New(rand.NewSource(1)),
+		port:  20000,
+	}
+}
+
+// listen 在模拟网络上分配一个新的端点
+func (n *simNetwork) listen() *simConn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.port++
+	c := &simConn{
+		network: n,
+		addr:    &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: n.port},
+		chIn:    make(chan simPacket, 1024),
+		die:     make(chan struct{}),
+	}
+	n.conns[c.addr.String()] = c
+	return c
+}
+
+// deliver 将数据报投递给目标端点，按照丢包率随机丢弃
+func (n *simNetwork) deliver(p []byte, from, to net.Addr) {
+	n.mu.Lock()
+	dst, ok := n.conns[to.String()]
+	drop := n.loss > 0 && n.rng.Float64() < n.loss
+	n.mu.Unlock()
+	if !ok || drop {
+		return
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case dst.chIn <- simPacket{data, from}:
+	default: // 接收队列已满，模拟内核丢包
+	}
+}
+
+// simConn 实现 net.PacketConn
+type simConn struct {
+	network *simNetwork
+	addr    *net.UDPAddr
+	chIn    chan simPacket
+
+	rd      time.Time
+	rdLock  sync.Mutex
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func (c *simConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.rdLock.Lock()
+	rd := c.rd
+	c.rdLock.Unlock()
+
+	var timeout <-chan time.Time
+	if !rd.IsZero() {
+		timer := time.NewTimer(time.Until(rd))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.chIn:
+		return copy(p, pkt.data), pkt.from, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.die:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *simConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.die:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.network.deliver(p, c.LocalAddr(), addr)
+	return len(p), nil
+}
+
+// rebind 模拟 NAT 重新绑定，端点获得一个新的源地址
+func (c *simConn) rebind() {
+	n := c.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.conns, c.addr.String())
+	n.port++
+	c.addr = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: n.port}
+	n.conns[c.addr.String()] = c
+}
+
+func (c *simConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		c.network.mu.Lock()
+		delete(c.network.conns, c.addr.String())
+		c.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	c.network.mu.Lock()
+	defer c.network.mu.Unlock()
+	return c.addr
+}
+
+func (c *simConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.rdLock.Lock()
+	c.rd = t
+	c.rdLock.Unlock()
+	return nil
+}
+
+func (c *simConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// newSimPair 在模拟网络上建立一个监听器和一个客户端会话
+func newSimPair(t *testing.T, network *simNetwork, block BlockCrypt, dataShards, parityShards int) (*Listener, *UDPSession) {
+	t.Helper()
+	serverConn := network.listen()
+	l, err := ServeConn(block, dataShards, parityShards, serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewConn4(uint32(network.port), serverConn.LocalAddr(), block, dataShards, parityShards, true, network.listen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	t.Cleanup(func() {
+		cli.Close()
+		l.Close()
+		serverConn.Close()
+	})
+	return l, cli
+}
@@ -0,0 +1,188 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:12:40
+@Description: Functional options for dialing and listening
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// setup collects the options of DialWith and ListenWith
+type setup struct {
+	config Config
+	block  BlockCrypt    // overrides config.Key, nil to derive it from the key
+	snmp   *Snmp         // counters, nil for DefaultSnmp
+	bind   *LocalBinding // local address of a dialed session, nil for any
+}
+
+// DialOption configures a session dialed with DialWith.
+type DialOption interface {
+	applyDial(*setup) error
+}
+
+// ListenOption configures a listener created with ListenWith.
+type ListenOption interface {
+	applyListen(*setup) error
+}
+
+// Option configures both dialed sessions and listeners, it is a DialOption
+// and a ListenOption.
+type Option func(*setup) error
+
+func (o Option) applyDial(s *setup) error   { return o(s) }
+func (o Option) applyListen(s *setup) error { return o(s) }
+
+// dialOption is an option of dialed sessions only
+type dialOption func(*setup) error
+
+func (o dialOption) applyDial(s *setup) error { return o(s) }
+
+// listenOption is an option of listeners only
+type listenOption func(*setup) error
+
+func (o listenOption) applyListen(s *setup) error { return o(s) }
+
+// WithConfig starts from the settings of 'config', the options after it
+// change them. It is best passed first, and fails with a nil config.
+func WithConfig(config *Config) Option {
+	return func(s *setup) error {
+		if config == nil {
+			return errors.New("WithConfig with a nil config")
+		}
+		s.config = *config
+		return nil
+	}
+}
+
+// WithCrypto encrypts the packets with 'block', taking precedence over the
+// key of a config.
+func WithCrypto(block BlockCrypt) Option {
+	return func(s *setup) error {
+		s.block = block
+		return nil
+	}
+}
+
+// WithFEC adds 'parity' Reed-Solomon parity shards to every 'data' packets,
+// see DialWithOptions.
+func WithFEC(data, parity int) Option {
+	return func(s *setup) error {
+		if data < 0 || parity < 0 {
+			return errors.New("FEC shards must not be negative")
+		}
+		s.config.FECData, s.config.FECParity = data, parity
+		return nil
+	}
+}
+
+// WithNoDelay sets the KCP latency settings, see UDPSession.SetNoDelay. A
+// listener applies them to the sessions it accepts.
+func WithNoDelay(nodelay, interval, resend, nc int) Option {
+	return func(s *setup) error {
+		s.config.NoDelay, s.config.Interval = nodelay, interval
+		s.config.Resend, s.config.NoCongestion = resend, nc
+		return nil
+	}
+}
+
+// WithSnmp makes the session, or the listener and its sessions, count into
+// 'snmp' instead of DefaultSnmp.
+func WithSnmp(snmp *Snmp) Option {
+	return func(s *setup) error {
+		s.snmp = snmp
+		return nil
+	}
+}
+
+// WithLocalBinding selects the local address of a dialed session, see
+// DialWithBinding.
+func WithLocalBinding(bind *LocalBinding) DialOption {
+	return dialOption(func(s *setup) error {
+		if bind != nil {
+			if err := bind.validate(); err != nil {
+				return err
+			}
+		}
+		s.bind = bind
+		return nil
+	})
+}
+
+// WithBacklog sets the sessions of a listener waiting for Accept and the
+// policy when they are as many, see Listener.SetBacklogPolicy.
+func WithBacklog(n int, policy BacklogPolicy) ListenOption {
+	return listenOption(func(s *setup) error {
+		s.config.Backlog, s.config.BacklogPolicy = n, policy
+		return nil
+	})
+}
+
+// DialWith connects to the remote address "raddr" with the settings of
+// 'opts', which are checked and applied like a Config by DialWithConfig,
+// including port hopping and plugins:
+//
+//	sess, err := safeudp.DialWith("example.com:4000",
+//		safeudp.WithCrypto(block), safeudp.WithFEC(10, 3), safeudp.WithNoDelay(1, 10, 2, 1))
+func DialWith(raddr string, opts ...DialOption) (*UDPSession, error) {
+	var st setup
+	for _, opt := range opts {
+		if err := opt.applyDial(&st); err != nil {
+			return nil, err
+		}
+	}
+	block, err := st.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := dialConfig(context.Background(), raddr, &st.config, block, st.bind)
+	if err != nil {
+		return nil, err
+	}
+	if st.snmp != nil {
+		s.SetSnmp(st.snmp)
+	}
+	return s, nil
+}
+
+// ListenWith listens on "laddr" with the settings of 'opts', which are checked
+// like a Config, see ListenWithConfig.
+func ListenWith(laddr string, opts ...ListenOption) (*Listener, error) {
+	var st setup
+	for _, opt := range opts {
+		if err := opt.applyListen(&st); err != nil {
+			return nil, err
+		}
+	}
+	block, err := st.cipher()
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := listenUDP(laddr, &st.config, block)
+	if err != nil {
+		return nil, err
+	}
+	if st.snmp != nil {
+		l.SetSnmp(st.snmp)
+	}
+	go l.monitor()
+	return l, nil
+}
+
+// cipher validates the settings and returns the cipher of the packets
+func (st *setup) cipher() (BlockCrypt, error) {
+	if err := st.config.Validate(); err != nil {
+		return nil, err
+	}
+	if st.block != nil {
+		return st.block, nil
+	}
+	return st.config.blockCrypt()
+}
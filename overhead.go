@@ -0,0 +1,51 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-22 15:03:27
+@Description: Per-packet overhead
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+// Sizes of the headers in front of the application data of each packet
+const (
+	CryptHeaderSize = cryptHeaderSize   // nonce and checksum, with encryption
+	FECHeaderSize   = fecHeaderSizePlus // FEC header and size, with FEC
+	KCPHeaderSize   = IKCP_OVERHEAD     // KCP segment header, always present
+)
+
+// OverheadBytes returns the header bytes of each packet sent with 'config',
+// a nil config counts the KCP header only.
+func OverheadBytes(config *Config) int {
+	overhead := KCPHeaderSize
+	if config == nil {
+		return overhead
+	}
+	if len(config.Key) > 0 {
+		overhead += CryptHeaderSize
+	}
+	if config.FECData > 0 && config.FECParity > 0 {
+		overhead += FECHeaderSize
+	}
+	if config.Compression {
+		overhead += CompressHeaderSize
+	}
+	return overhead
+}
+
+// MaxPayload returns the application bytes which fit in a packet of 'mtu' bytes
+// sent with 'config', 'mtu' is the UDP payload size as passed to SetMtu. It
+// returns 0 if the headers do not fit.
+//
+// For a 1500 bytes link MTU, 'mtu' is 1472 on IPv4 and 1452 on IPv6.
+func MaxPayload(config *Config, mtu int) int {
+	return max(mtu-OverheadBytes(config), 0)
+}
+
+// MaxPayload returns the application bytes carried by a packet of the session
+// at its current MTU, writes of this size are sent in a single packet.
+func (s *UDPSession) MaxPayload() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.kcp.mss)
+}
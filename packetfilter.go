@@ -0,0 +1,69 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-15 09:12:44
+@Description: Hook for the raw packets of a listener
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Verdict is the decision of a packet filter on a packet
+type Verdict int
+
+const (
+	VerdictPass     Verdict = iota // process the packet as usual
+	VerdictDrop                    // drop the packet, counted in InSourceDrops
+	VerdictConsumed                // the filter handled the packet itself, such as a STUN request sharing the port
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictPass:
+		return "pass"
+	case VerdictDrop:
+		return "drop"
+	case VerdictConsumed:
+		return "consumed"
+	default:
+		return "invalid"
+	}
+}
+
+// SetPacketFilter installs a hook called with every packet the listener reads,
+// as received and before decryption, for custom firewalling, port knocking, or
+// sharing the port with another protocol. Packets for which it returns other
+// than VerdictPass are not processed further. nil removes the hook.
+//
+// The hook runs on the read loop, or on the read workers concurrently, and must
+// not block. 'raw' is reused after the call, copy it to keep it.
+func (l *Listener) SetPacketFilter(filter func(raw []byte, addr net.Addr) Verdict) {
+	if filter == nil {
+		l.packetFilter.Store(nil)
+		return
+	}
+	l.packetFilter.Store(&filter)
+}
+
+// filterPacket reports whether the packet filter passes a packet, the
+// responses to STUNBinding and the relayed packets are consumed before it
+func (l *Listener) filterPacket(raw []byte, addr net.Addr) bool {
+	if l.stun.input(raw) || l.relayPacket(raw, addr) {
+		return false
+	}
+	filter := l.packetFilter.Load()
+	if filter == nil {
+		return true
+	}
+	switch (*filter)(raw, addr) {
+	case VerdictPass:
+		return true
+	case VerdictDrop:
+		atomic.AddUint64(&l.Snmp().InSourceDrops, 1)
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-11 21:06:45
+@Description: Source address of replies on listeners bound to wildcard addresses
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"net/netip"
+)
+
+// pktinfo is the local address a packet was sent to, from IP_PKTINFO or
+// IPV6_PKTINFO, the zero value if unknown
+type pktinfo struct {
+	addr    netip.Addr // destination of the packet, v4-mapped on dual-stack sockets
+	ifindex uint32     // interface the packet arrived on
+}
+
+// sourceControl is the control message which makes the packets of a session
+// leave from the address its remote sends to
+type sourceControl struct {
+	dst pktinfo
+	oob []byte
+}
+
+// setSource makes the session reply from the local address 'dst', the kernel
+// may otherwise pick another address of a multi-homed host, which the remote
+// does not recognize
+func (s *UDPSession) setSource(dst pktinfo) {
+	if !dst.addr.IsValid() {
+		return
+	}
+	if c := s.source.Load(); c != nil && c.dst == dst {
+		return
+	}
+	s.source.Store(&sourceControl{dst, pktinfoControl(dst)})
+}
+
+// sourceOOB returns the control message pinning the source address of the
+// packets of the session, nil for none
+func (s *UDPSession) sourceOOB() []byte {
+	if c := s.source.Load(); c != nil {
+		return c.oob
+	}
+	return nil
+}
+
+// wildcardConn reports whether 'conn' is a UDP socket bound to the unspecified
+// address, which receives on all the addresses of the host
+func wildcardConn(conn net.PacketConn) (*net.UDPConn, bool) {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, false
+	}
+	addr, ok := uc.LocalAddr().(*net.UDPAddr)
+	return uc, ok && addr.IP.IsUnspecified()
+}
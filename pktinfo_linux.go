@@ -0,0 +1,96 @@
+//go:build linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-11 21:06:45
+@Description: Packet info of received packets
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// pktinfoControlSize is the room for the control message carrying the destination
+var pktinfoControlSize = unix.CmsgSpace(unix.SizeofInet6Pktinfo)
+
+// enablePacketInfo requests the destination of received packets on 'conn' if
+// it is bound to the unspecified address, IPV6_PKTINFO on IPv6 sockets also
+// covers the IPv4 packets of dual-stack ones
+func enablePacketInfo(conn net.PacketConn) bool {
+	uc, ok := wildcardConn(conn)
+	if !ok {
+		return false
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	level, opt := unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO
+	if uc.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		level, opt = unix.IPPROTO_IP, unix.IP_PKTINFO
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+	}); err != nil {
+		return false
+	}
+	return sockErr == nil
+}
+
+// parsePacketInfo returns the destination of a received packet, the zero
+// value if the control messages carry none
+func parsePacketInfo(oob []byte) pktinfo {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return pktinfo{}
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_PKTINFO && len(m.Data) >= unix.SizeofInet4Pktinfo:
+			// struct in_pktinfo: ifindex, spec_dst, addr
+			return pktinfo{netip.AddrFrom4([4]byte(m.Data[8:12])), binary.NativeEndian.Uint32(m.Data)}
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_PKTINFO && len(m.Data) >= unix.SizeofInet6Pktinfo:
+			// struct in6_pktinfo: addr, ifindex
+			return pktinfo{netip.AddrFrom16([16]byte(m.Data[:16])), binary.NativeEndian.Uint32(m.Data[16:])}
+		}
+	}
+	return pktinfo{}
+}
+
+// pktinfoControl builds the control message setting the source address of a
+// packet to 'dst'. The interface is left to routing, except for IPv6 link-local
+// addresses, which are only meaningful on their own.
+func pktinfoControl(dst pktinfo) []byte {
+	if dst.addr.Is4() {
+		oob := make([]byte, unix.CmsgSpace(unix.SizeofInet4Pktinfo))
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		h.Level = unix.IPPROTO_IP
+		h.Type = unix.IP_PKTINFO
+		h.SetLen(unix.CmsgLen(unix.SizeofInet4Pktinfo))
+		addr := dst.addr.As4()
+		copy(oob[unix.CmsgLen(0)+4:], addr[:]) // spec_dst
+		return oob
+	}
+
+	oob := make([]byte, unix.CmsgSpace(unix.SizeofInet6Pktinfo))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_IPV6
+	h.Type = unix.IPV6_PKTINFO
+	h.SetLen(unix.CmsgLen(unix.SizeofInet6Pktinfo))
+	addr := dst.addr.As16()
+	copy(oob[unix.CmsgLen(0):], addr[:])
+	if dst.addr.IsLinkLocalUnicast() {
+		binary.NativeEndian.PutUint32(oob[unix.CmsgLen(0)+16:], dst.ifindex)
+	}
+	return oob
+}
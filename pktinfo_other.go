@@ -0,0 +1,24 @@
+//go:build !linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-11 21:06:45
+@Description: Packet info of received packets, unsupported
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "net"
+
+// pktinfoControlSize is the room for the control message carrying the destination
+var pktinfoControlSize = 0
+
+// enablePacketInfo requests the destination of received packets on 'conn'
+func enablePacketInfo(conn net.PacketConn) bool { return false }
+
+// parsePacketInfo returns the destination of a received packet
+func parsePacketInfo(oob []byte) pktinfo { return pktinfo{} }
+
+// pktinfoControl builds the control message setting the source address
+func pktinfoControl(dst pktinfo) []byte { return nil }
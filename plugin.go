@@ -0,0 +1,114 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:12:40
+@Description: Transport plugins transforming the datagrams on the wire
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Plugin is an in-process transport, such as an obfuscation, which transforms
+// the datagrams of sessions and listeners on their way to and from the
+// network, registered with RegisterPlugin and selected by Config.Plugin.
+// Package sip003 provides plugins running SIP003 executables.
+type Plugin interface {
+	// Wrap returns a packet connection over 'conn' which transforms the
+	// datagrams written before sending them on 'conn', and those read from
+	// 'conn' before returning them, dropping those it does not recognize.
+	// 'options' is Config.PluginOptions, 'server' tells a listener from a
+	// client session. Closing the connection closes 'conn'.
+	Wrap(conn net.PacketConn, options string, server bool) (net.PacketConn, error)
+}
+
+// errPluginConn is the error of a Plugin with a socket of the caller
+var errPluginConn = errors.New("Plugin applies to the sockets of the library, wrap a socket of the caller with Plugin.Wrap")
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   = make(map[string]Plugin)
+)
+
+// RegisterPlugin makes an in-process plugin available by name to
+// Config.Plugin, it panics if the name is empty or taken, or 'p' is nil.
+func RegisterPlugin(name string, p Plugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if name == "" || p == nil {
+		panic("safeudp: RegisterPlugin with an empty name or a nil plugin")
+	}
+	if _, dup := plugins[name]; dup {
+		panic("safeudp: RegisterPlugin called twice for " + name)
+	}
+	plugins[name] = p
+}
+
+// lookupPlugin returns the plugin registered as 'name', nil if none
+func lookupPlugin(name string) Plugin {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	return plugins[name]
+}
+
+// checkPlugin returns an error if 'name' is not a registered plugin
+func checkPlugin(name string) error {
+	if lookupPlugin(name) == nil {
+		return errors.Errorf("Plugin %s is not registered, see RegisterPlugin and package sip003 for executables", name)
+	}
+	return nil
+}
+
+// dialPlugin dials 'raddr' over a socket wrapped by the plugin of the config
+func dialPlugin(ctx context.Context, raddr string, config *Config, block BlockCrypt) (*UDPSession, error) {
+	var convid uint32
+	binary.Read(crand.Reader, binary.LittleEndian, &convid)
+
+	p := lookupPlugin(config.Plugin)
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	network := "udp4"
+	if udpaddr.IP.To4() == nil {
+		network = "udp"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	wrapped, err := p.Wrap(conn, config.PluginOptions, false)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "plugin %s", config.Plugin)
+	}
+	return newUDPSession(ctx, convid, config.FECData, config.FECParity, nil, wrapped, true, udpaddr, block), nil
+}
+
+// listenPlugin opens the socket of a listener on "laddr" wrapped by the plugin
+// of the config
+func listenPlugin(laddr string, config *Config) (net.PacketConn, error) {
+	p := lookupPlugin(config.Plugin)
+	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	wrapped, err := p.Wrap(conn, config.PluginOptions, true)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "plugin %s", config.Plugin)
+	}
+	return wrapped, nil
+}
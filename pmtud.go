@@ -0,0 +1,160 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 10:02:35
+@Description: Datagram packetization layer path MTU discovery (RFC 8899)
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "time"
+
+const (
+	// pmtudBase is the packet size assumed to work on any path, RFC 8899 BASE_PLPMTU
+	pmtudBase = 1200
+
+	// pmtudMaxProbes is the number of unacknowledged probes before a size is considered too large
+	pmtudMaxProbes = 3
+
+	// pmtudStep stops the search when the remaining interval is smaller than this
+	pmtudStep = 16
+
+	// pmtudProbeTimeout is the time to wait for a probe acknowledgement
+	pmtudProbeTimeout = time.Second
+
+	// pmtudRaiseTimer restarts the search periodically to detect a larger path MTU
+	pmtudRaiseTimer = 10 * time.Minute
+)
+
+// pmtud implements a binary search for the largest packet the path can deliver,
+// all sizes are packet sizes on wire, including crypt and FEC headers.
+//
+// The state is protected by the session lock.
+type pmtud struct {
+	lo, hi int // confirmed packet size, and the largest size still possible
+
+	probeSize int       // size of the outstanding probe, 0 if none
+	probeSent time.Time // time of the last probe
+	probes    int       // number of probes sent for probeSize
+
+	searchDone time.Time // time the last search finished
+}
+
+func newPMTUD(max int) *pmtud {
+	return &pmtud{lo: pmtudBase, hi: max}
+}
+
+// searching returns true if the search interval has not converged
+func (p *pmtud) searching() bool {
+	return p.hi-p.lo >= pmtudStep
+}
+
+// next returns the size of the probe to be sent now, or 0 if nothing has to be sent
+func (p *pmtud) next(now time.Time) int {
+	if !p.searching() {
+		if p.searchDone.IsZero() {
+			p.searchDone = now
+		}
+		if now.Sub(p.searchDone) < pmtudRaiseTimer {
+			return 0
+		}
+		// restart from the confirmed size to see if the path has grown
+		p.hi = mtuLimit
+		p.searchDone = time.Time{}
+	}
+
+	if p.probeSize != 0 {
+		if now.Sub(p.probeSent) < pmtudProbeTimeout {
+			return 0
+		}
+		if p.probes >= pmtudMaxProbes {
+			// the probe size is too large for this path
+			p.hi = p.probeSize - 1
+			p.probeSize, p.probes = 0, 0
+			return p.next(now)
+		}
+	} else {
+		p.probeSize = (p.lo + p.hi + 1) / 2
+	}
+
+	p.probes++
+	p.probeSent = now
+	return p.probeSize
+}
+
+// acked handles a probe acknowledgement, it returns true if the confirmed size has grown
+func (p *pmtud) acked(size int) bool {
+	if size != p.probeSize {
+		return false
+	}
+
+	p.probeSize, p.probes = 0, 0
+	if size > p.lo {
+		p.lo = size
+		return true
+	}
+	return false
+}
+
+// SetPMTUD enables or disables datagram path MTU discovery for the session.
+//
+// The session starts with a packet size no larger than the 1200 bytes base and
+// probes for a larger size with padded probe packets which are never retransmitted,
+// the KCP MSS is raised whenever a size is confirmed by the remote. FEC shards are
+// sized after the packets, so they follow the discovered MTU automatically.
+// It is refused on sessions of Config.KCPCompat, kcp-go does not echo probes.
+func (s *UDPSession) SetPMTUD(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !enable {
+		s.pmtud = nil
+		return
+	}
+	if s.refusedByKCPCompat("path MTU discovery") {
+		return
+	}
+
+	s.pmtud = newPMTUD(mtuLimit)
+	if int(s.kcp.mtu)+s.packetOverhead() > pmtudBase {
+		s.kcp.SetMtu(pmtudBase - s.packetOverhead())
+	}
+}
+
+// GetPMTU returns the largest packet size confirmed on the path, including
+// crypt and FEC headers, or 0 if path MTU discovery is disabled.
+func (s *UDPSession) GetPMTU() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pmtud == nil {
+		return 0
+	}
+	return s.pmtud.lo
+}
+
+// pmtudProbe sends the next probe if required, the caller must hold the session lock
+func (s *UDPSession) pmtudProbe() {
+	if s.pmtud == nil {
+		return
+	}
+
+	if size := s.pmtud.next(time.Now()); size > 0 {
+		s.kcp.SendProbe(uint32(size), size-s.packetOverhead())
+	}
+}
+
+// onProbeAck is invoked by KCP with the session lock held
+func (s *UDPSession) onProbeAck(token uint32) {
+	if token&pathTokenFlag != 0 {
+		return // path challenges are answered on the new path, see migratePath
+	}
+
+	if s.pmtud == nil {
+		return
+	}
+
+	if s.pmtud.acked(int(token)) {
+		s.kcp.SetMtu(s.pmtud.lo - s.packetOverhead())
+		s.logEvent("path mtu raised to %d", s.pmtud.lo)
+	}
+}
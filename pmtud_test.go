@@ -0,0 +1,73 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-13 16:40:12
+@Description: Path MTU discovery
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPMTUDSearch 模拟路径 MTU 为 1400 的链路，验证二分搜索收敛
+func TestPMTUDSearch(t *testing.T) {
+	const pathMTU = 1400
+	p := newPMTUD(mtuLimit)
+	now := time.Now()
+
+	for i := 0; i < 100 && p.searching(); i++ {
+		size := p.next(now)
+		if size == 0 {
+			now = now.Add(pmtudProbeTimeout)
+			continue
+		}
+		if size <= pathMTU {
+			p.acked(size)
+		} else {
+			now = now.Add(pmtudProbeTimeout) // 探测包被丢弃
+		}
+	}
+
+	if p.searching() {
+		t.Fatalf("search did not converge: lo=%d hi=%d", p.lo, p.hi)
+	}
+	if p.lo > pathMTU || p.lo < pathMTU-pmtudStep {
+		t.Errorf("Expected confirmed size close to %d, got %d", pathMTU, p.lo)
+	}
+
+	// 搜索结束后在 raise 定时器到期前不再发送探测包
+	if size := p.next(now); size != 0 {
+		t.Errorf("Expected no probe after convergence, got %d", size)
+	}
+	if size := p.next(now.Add(pmtudRaiseTimer)); size == 0 {
+		t.Error("Expected a new search after the raise timer")
+	}
+}
+
+// TestPMTUDProbeEcho 测试探测包经过 KCP 的回显
+func TestPMTUDProbeEcho(t *testing.T) {
+	var wire [][]byte
+	sender := NewKCP(1, func(buf []byte, size int) {
+		wire = append(wire, append([]byte(nil), buf[:size]...))
+	})
+	var echoed uint32
+	sender.probe_handler = func(token uint32) { echoed = token }
+
+	receiver := NewKCP(1, func(buf []byte, size int) {
+		sender.Input(buf[:size], true, false)
+	})
+
+	sender.SendProbe(1300, 1300)
+	if len(wire) != 1 || len(wire[0]) != 1300 {
+		t.Fatalf("Expected a single 1300 bytes probe, got %d packets", len(wire))
+	}
+
+	receiver.Input(wire[0], true, false)
+	receiver.flush(false)
+	if echoed != 1300 {
+		t.Errorf("Expected probe token 1300 echoed, got %d", echoed)
+	}
+}
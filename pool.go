@@ -0,0 +1,201 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 17:42:09
+@Description: Pool of client sessions handing out streams
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// ClientPool keeps a number of sessions to a server and opens streams over
+// the least loaded of them, for workloads opening many short lived logical
+// connections, such as RPCs: the streams skip the handshake of DialContext,
+// and spreading them over sessions limits the head of line blocking a lost
+// packet causes to the streams of a single session.
+//
+// The server accepts the sessions with StreamListener: Accept returns the
+// first stream of each session, AcceptStream the others. A failed session is
+// redialed in the background once a stream is requested; while none is up,
+// OpenStream dials one itself.
+type ClientPool struct {
+	raddr  string
+	config *Config
+	slots  []*poolSlot
+
+	changed chan struct{} // closed and replaced when a dial ends
+	closed  bool
+
+	ctx    context.Context // canceled on Close, ending the background dials
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+// poolSlot is a session of a ClientPool
+type poolSlot struct {
+	sess            *smux.Session // nil before the first dial succeeds
+	first           *Conn         // the stream of the dial, handed out first
+	unauthenticated bool
+	secured         net.Conn
+	dialing         bool
+}
+
+// NewClientPool dials 'size' sessions to "raddr" with the settings of 'config'
+// until the context is done, like DialContext, and fails if any cannot be
+// established. The config must not set NoMux.
+func NewClientPool(ctx context.Context, raddr string, config *Config, size int) (*ClientPool, error) {
+	if size <= 0 {
+		return nil, errors.New("pool size must be positive")
+	}
+	if config.NoMux {
+		return nil, errors.WithStack(errNoMux)
+	}
+	p := &ClientPool{raddr: raddr, config: config, changed: make(chan struct{})}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	errs := make([]error, size)
+	var wg sync.WaitGroup
+	for i := range size {
+		slot := &poolSlot{dialing: true}
+		p.slots = append(p.slots, slot)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = p.dial(ctx, slot)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// OpenStream opens a stream over the session with the fewest streams, until
+// the context is done if no session is up
+func (p *ClientPool) OpenStream(ctx context.Context) (*Conn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errors.WithStack(ErrClosed)
+		}
+		var best *poolSlot
+		var dead []*poolSlot
+		for _, slot := range p.slots {
+			switch {
+			case slot.dialing:
+			case slot.sess == nil || slot.sess.IsClosed():
+				dead = append(dead, slot)
+			case best == nil || slot.sess.NumStreams() < best.sess.NumStreams():
+				best = slot
+			}
+		}
+
+		if best == nil {
+			if len(dead) == 0 { // all being dialed
+				changed := p.changed
+				p.mu.Unlock()
+				select {
+				case <-changed:
+					continue
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			dead[0].dialing = true
+			p.mu.Unlock()
+			if err := p.dial(ctx, dead[0]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, slot := range dead {
+			slot.dialing = true
+			go func() {
+				ctx, cancel := context.WithTimeout(p.ctx, redialTimeout)
+				defer cancel()
+				p.dial(ctx, slot)
+			}()
+		}
+		if conn := best.first; conn != nil {
+			best.first = nil
+			p.mu.Unlock()
+			return conn, nil
+		}
+		sess, unauthenticated, secured := best.sess, best.unauthenticated, best.secured
+		p.mu.Unlock()
+
+		stream, err := sess.OpenStream()
+		if err != nil {
+			if sess.IsClosed() { // failed meanwhile, take another
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		return &Conn{stream: stream, sess: sess, unauthenticated: unauthenticated, secured: secured}, nil
+	}
+}
+
+// dial establishes the session of 'slot', which the caller marked as dialing
+func (p *ClientPool) dial(ctx context.Context, slot *poolSlot) error {
+	conn, err := DialContext(ctx, p.raddr, p.config)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slot.dialing = false
+	close(p.changed)
+	p.changed = make(chan struct{})
+	if err != nil {
+		return err
+	}
+	if p.closed {
+		conn.CloseSession()
+		return errors.WithStack(ErrClosed)
+	}
+	conn.owner = false // the pool owns the session
+	slot.sess, slot.first, slot.unauthenticated, slot.secured = conn.sess, conn, conn.unauthenticated, conn.secured
+	return nil
+}
+
+// Sessions returns the number of sessions up
+func (p *ClientPool) Sessions() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, slot := range p.slots {
+		if !slot.dialing && slot.sess != nil && !slot.sess.IsClosed() {
+			n++
+		}
+	}
+	return n
+}
+
+// Close closes the sessions of the pool with all their streams
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.WithStack(ErrClosed)
+	}
+	p.closed = true
+	p.cancel()
+	for _, slot := range p.slots {
+		if slot.sess != nil {
+			slot.sess.Close()
+		}
+	}
+	return nil
+}
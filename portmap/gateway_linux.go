@@ -0,0 +1,24 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 14:02:18
+@Description: Default gateway from the routing table of linux
+@Language: Go 1.23.4
+*/
+
+package portmap
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+)
+
+// defaultGateway returns the IPv4 gateway of the default route
+func defaultGateway() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer f.Close()
+	return parseRouteTable(bufio.NewScanner(f))
+}
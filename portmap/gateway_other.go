@@ -0,0 +1,20 @@
+//go:build !linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 14:02:18
+@Description: Default gateway, unsupported
+@Language: Go 1.23.4
+*/
+
+package portmap
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// defaultGateway returns the IPv4 gateway of the default route
+func defaultGateway() (netip.Addr, error) {
+	return netip.Addr{}, errors.New("default gateway unknown on this platform")
+}
@@ -0,0 +1,570 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 21:47:05
+@Description: UDP port mappings on home routers with NAT-PMP or UPnP IGD
+@Language: Go 1.23.4
+*/
+
+// Package portmap asks the router of a home network to forward a public UDP
+// port to a safe-udp listener, with NAT-PMP or UPnP IGD. It is apart from
+// safeudp so that the HTTP and XML clients of UPnP stay out of programs which
+// do not map ports.
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+const (
+	natpmpPort       = 5351
+	natpmpLifetime   = 2 * time.Hour          // requested lifetime, RFC 6886 section 3.3
+	natpmpInitialRTO = 250 * time.Millisecond // doubled on each retransmission
+	natpmpAttempts   = 4                      // requests before giving up, fewer than the 9 of the RFC as the router may not speak it
+	upnpLease        = time.Hour              // requested lease, 0 on routers with permanent leases only
+	ssdpAddr         = "239.255.255.250:1900"
+	ssdpWait         = 2 * time.Second // for the first answer to an M-SEARCH
+	portMapRetry     = time.Minute     // after a failed refresh
+	portMapTimeout   = 10 * time.Second
+	upnpDescription  = "safe-udp"
+	upnpPermanent    = 725 // OnlyPermanentLeasesSupported
+)
+
+// upnpServices are the IGD services which map ports, in order of preference
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// portMapper requests port mappings from a router with one protocol
+type portMapper interface {
+	// mapPort maps the public port 'external', or another the router picks,
+	// to 'internal' and returns the public address and the lifetime of the
+	// mapping, 0 if permanent
+	mapPort(ctx context.Context, internal, external uint16) (netip.AddrPort, time.Duration, error)
+	// unmap removes the mapping
+	unmap(ctx context.Context, internal, external uint16) error
+	protocol() string
+}
+
+// Mapping is a UDP port mapping on the router of the network forwarding a
+// public port to a listener behind it, see Map.
+type Mapping struct {
+	mapper   portMapper
+	internal uint16
+	die      chan struct{}
+	dieOnce  sync.Once
+	stopped  chan struct{} // closed when the refresh loop has removed the mapping
+
+	mu       sync.Mutex
+	external netip.AddrPort
+	lifetime time.Duration // 0 if permanent
+	err      error         // failure of the last refresh or of the removal
+}
+
+// Map asks the router of the network to forward a public UDP port to the
+// port of the listener, for servers at home behind a router. NAT-PMP, which
+// PCP routers also answer, is tried first on the default gateway, then UPnP
+// IGD. The mapping is refreshed until the listener or the mapping is closed,
+// which removes it. The router may pick another public port than that of the
+// listener, see Mapping.External. The context bounds the discovery of the
+// router and the first request.
+func Map(ctx context.Context, l *safeudp.Listener) (*Mapping, error) {
+	addr, err := netip.ParseAddrPort(l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMapping(ctx, []func(context.Context) (portMapper, error){discoverNATPMP, discoverUPnP}, addr.Port())
+	if err != nil {
+		return nil, err
+	}
+	go m.refresh(l.Done())
+	return m, nil
+}
+
+// newMapping maps 'port' with the first of the discovered mappers which succeeds
+func newMapping(ctx context.Context, discover []func(context.Context) (portMapper, error), port uint16) (*Mapping, error) {
+	var errs []string
+	for _, d := range discover {
+		mapper, err := d(ctx)
+		if err == nil {
+			var external netip.AddrPort
+			var lifetime time.Duration
+			if external, lifetime, err = mapper.mapPort(ctx, port, port); err == nil {
+				return &Mapping{mapper: mapper, internal: port, external: external, lifetime: lifetime,
+					die: make(chan struct{}), stopped: make(chan struct{})}, nil
+			}
+		}
+		errs = append(errs, err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no port mapping: %s", strings.Join(errs, "; "))
+}
+
+// refresh renews the mapping at half its lifetime until the mapping is
+// closed or 'done' is, then removes it
+func (m *Mapping) refresh(done <-chan struct{}) {
+	defer close(m.stopped)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		m.mu.Lock()
+		wait := m.lifetime / 2
+		if wait == 0 {
+			wait = upnpLease / 2 // permanent, renewed in case the router restarted
+		}
+		if m.err != nil {
+			wait = min(wait, portMapRetry)
+		}
+		external := m.external
+		m.mu.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-m.die:
+			m.remove(external)
+			return
+		case <-done:
+			m.remove(external)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), portMapTimeout)
+		mapped, lifetime, err := m.mapper.mapPort(ctx, m.internal, external.Port())
+		cancel()
+		m.mu.Lock()
+		if err == nil {
+			m.external, m.lifetime = mapped, lifetime
+		}
+		m.err = err
+		m.mu.Unlock()
+	}
+}
+
+// remove deletes the mapping from the router
+func (m *Mapping) remove(external netip.AddrPort) {
+	ctx, cancel := context.WithTimeout(context.Background(), portMapTimeout)
+	defer cancel()
+	err := m.mapper.unmap(ctx, m.internal, external.Port())
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
+
+// External returns the public address of the mapping, which may change on
+// a refresh.
+func (m *Mapping) External() netip.AddrPort {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.external
+}
+
+// Protocol returns the protocol of the mapping, "NAT-PMP" or "UPnP".
+func (m *Mapping) Protocol() string { return m.mapper.protocol() }
+
+// Err returns the failure of the last refresh, nil if it succeeded. The
+// mapping is retried every minute after a failure.
+func (m *Mapping) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close removes the mapping from the router and stops refreshing it.
+func (m *Mapping) Close() error {
+	m.dieOnce.Do(func() { close(m.die) })
+	<-m.stopped
+	return m.Err()
+}
+
+// natpmpMapper maps ports with NAT-PMP, RFC 6886
+type natpmpMapper struct {
+	gateway netip.AddrPort
+}
+
+// discoverNATPMP returns a NAT-PMP mapper for the default gateway
+func discoverNATPMP(context.Context) (portMapper, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	return &natpmpMapper{gateway: netip.AddrPortFrom(gw, natpmpPort)}, nil
+}
+
+func (p *natpmpMapper) protocol() string { return "NAT-PMP" }
+
+func (p *natpmpMapper) mapPort(ctx context.Context, internal, external uint16) (netip.AddrPort, time.Duration, error) {
+	resp, err := p.request(ctx, []byte{0, 0}, 12)
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	ip := netip.AddrFrom4([4]byte(resp[8:12]))
+	req := []byte{0, 1, 0, 0}
+	req = binary.BigEndian.AppendUint16(req, internal)
+	req = binary.BigEndian.AppendUint16(req, external)
+	req = binary.BigEndian.AppendUint32(req, uint32(natpmpLifetime/time.Second))
+	if resp, err = p.request(ctx, req, 16); err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	port := binary.BigEndian.Uint16(resp[10:])
+	lifetime := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	return netip.AddrPortFrom(ip, port), lifetime, nil
+}
+
+func (p *natpmpMapper) unmap(ctx context.Context, internal, external uint16) error {
+	req := binary.BigEndian.AppendUint16([]byte{0, 1, 0, 0}, internal)
+	req = append(req, 0, 0, 0, 0, 0, 0) // external port and lifetime 0 remove the mapping
+	_, err := p.request(ctx, req, 16)
+	return err
+}
+
+// request sends 'req' to the gateway until it answers with at least 'size'
+// bytes, and returns the answer
+func (p *natpmpMapper) request(ctx context.Context, req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(p.gateway))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	for n, rto := 0, natpmpInitialRTO; n < natpmpAttempts; n, rto = n+1, rto*2 {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(rto)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			k, err := conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if isTimeout(err) {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("NAT-PMP: %w", err)
+			}
+			if k < size || buf[0] != 0 || buf[1] != req[1]|0x80 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+				return nil, fmt.Errorf("NAT-PMP result code %d", code)
+			}
+			return buf[:k], nil
+		}
+	}
+	return nil, errors.New("no NAT-PMP response")
+}
+
+// isTimeout reports whether 'err' is the expiry of a deadline
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// upnpMapper maps ports with the WANIPConnection or WANPPPConnection service
+// of a UPnP internet gateway device
+type upnpMapper struct {
+	control string     // URL of the service
+	service string     // type of the service
+	local   netip.Addr // address of this host on the network of the router
+}
+
+// upnpError is the fault of a UPnP action
+type upnpError struct {
+	action string
+	code   int
+}
+
+func (e upnpError) Error() string {
+	return fmt.Sprintf("UPnP %s failed with error %d", e.action, e.code)
+}
+
+// discoverUPnP finds an internet gateway device with SSDP
+func discoverUPnP(ctx context.Context) (portMapper, error) {
+	location, err := ssdpSearch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return upnpFromDescription(ctx, location)
+}
+
+// ssdpSearch multicasts an M-SEARCH for the services of upnpServices and
+// returns the location of the description of the first device to answer
+func ssdpSearch(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	for _, st := range upnpServices {
+		msg := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: %s\r\n\r\n", ssdpAddr, st)
+		if _, err := conn.WriteTo([]byte(msg), dst); err != nil {
+			return "", err
+		}
+	}
+	deadline := time.Now().Add(ssdpWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", errors.New("no UPnP gateway answered")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		if location := ssdpLocation(resp, from); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// ssdpLocation returns the location of an SSDP response, or "" unless it is
+// an HTTP URL on the address of the responder 'from', so that any host on the
+// network cannot point the control requests elsewhere
+func ssdpLocation(resp *http.Response, from net.Addr) string {
+	location := resp.Header.Get("Location")
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "http" {
+		return ""
+	}
+	host, err := netip.ParseAddr(u.Hostname())
+	responder, ok := from.(*net.UDPAddr)
+	if err != nil || !ok || host.Unmap() != responder.AddrPort().Addr().Unmap() {
+		return ""
+	}
+	return location
+}
+
+// upnpDevice is a device of a UPnP description, with its embedded devices
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// controlURL returns the control URL of the service 'st' on the device or
+// the devices it embeds
+func (d *upnpDevice) controlURL(st string) string {
+	for _, s := range d.Services {
+		if s.ServiceType == st {
+			return s.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if u := d.Devices[i].controlURL(st); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// upnpFromDescription returns a mapper for the port mapping service of the
+// device described at 'location'
+func upnpFromDescription(ctx context.Context, location string) (*upnpMapper, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("UPnP description: %w", err)
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	gateway := base.Hostname()
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	for _, st := range upnpServices {
+		control := root.Device.controlURL(st)
+		if control == "" {
+			continue
+		}
+		ref, err := url.Parse(control)
+		if err != nil {
+			return nil, err
+		}
+		u := base.ResolveReference(ref)
+		if u.Hostname() != gateway {
+			return nil, fmt.Errorf("UPnP control URL %s is not on the gateway %s", u, gateway)
+		}
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		conn, err := net.Dial("udp", host) // finds the local address routed to the router, sends nothing
+		if err != nil {
+			return nil, err
+		}
+		local := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+		conn.Close()
+		return &upnpMapper{control: u.String(), service: st, local: local}, nil
+	}
+	return nil, errors.New("UPnP device without a port mapping service")
+}
+
+func (u *upnpMapper) protocol() string { return "UPnP" }
+
+func (u *upnpMapper) mapPort(ctx context.Context, internal, external uint16) (netip.AddrPort, time.Duration, error) {
+	ext, err := u.call(ctx, "GetExternalIPAddress", nil, "NewExternalIPAddress")
+	if err != nil {
+		return netip.AddrPort{}, 0, err
+	}
+	ip, err := netip.ParseAddr(ext)
+	if err != nil {
+		return netip.AddrPort{}, 0, fmt.Errorf("UPnP external address: %w", err)
+	}
+	lease := upnpLease
+	for {
+		_, err = u.call(ctx, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(external))},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", strconv.Itoa(int(internal))},
+			{"NewInternalClient", u.local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", upnpDescription},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		}, "")
+		var ue upnpError
+		if lease != 0 && errors.As(err, &ue) && ue.code == upnpPermanent {
+			lease = 0
+			continue
+		}
+		if err != nil {
+			return netip.AddrPort{}, 0, err
+		}
+		return netip.AddrPortFrom(ip, external), lease, nil
+	}
+}
+
+func (u *upnpMapper) unmap(ctx context.Context, internal, external uint16) error {
+	_, err := u.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(external))},
+		{"NewProtocol", "UDP"},
+	}, "")
+	return err
+}
+
+// call invokes the SOAP action 'action' of the service with the arguments
+// 'args', and returns the value of the output argument 'result'
+func (u *upnpMapper) call(ctx context.Context, action string, args [][2]string, result string) (string, error) {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, action, u.service)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.control, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.service, action))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(xmlElement(data, "errorCode"))
+		return "", upnpError{action, code}
+	}
+	if result == "" {
+		return "", nil
+	}
+	return xmlElement(data, result), nil
+}
+
+// xmlElement returns the text of the first element named 'name' in 'data'
+func xmlElement(data []byte, name string) string {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == name {
+			var text string
+			d.DecodeElement(&text, &se)
+			return strings.TrimSpace(text)
+		}
+	}
+}
+
+// parseRouteTable returns the gateway of the default route in the format of
+// /proc/net/route, addresses in hex of the host byte order
+func parseRouteTable(s *bufio.Scanner) (netip.Addr, error) {
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		var ip [4]byte
+		binary.LittleEndian.PutUint32(ip[:], binary.BigEndian.Uint32(b))
+		if addr := netip.AddrFrom4(ip); !addr.IsUnspecified() {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, errors.New("no default gateway")
+}
@@ -0,0 +1,182 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 21:47:05
+@Description: Port mapping tests
+@Language: Go 1.23.4
+*/
+
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMap 测试默认网关解析、NAT-PMP映射的续期与删除，以及UPnP描述与SOAP操作
+func TestMap(t *testing.T) {
+	route := "Iface\tDestination\tGateway\tFlags\n" +
+		"eth0\t0002A8C0\t00000000\t0001\n" +
+		"eth0\t00000000\t0102A8C0\t0003\n"
+	if gw, err := parseRouteTable(bufio.NewScanner(strings.NewReader(route))); err != nil || gw != netip.MustParseAddr("192.168.2.1") {
+		t.Errorf("gateway %v, %v", gw, err)
+	}
+
+	// NAT-PMP网关：选择下一个端口，寿命1秒
+	gw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	requests := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := gw.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := bytes.Clone(buf[:n])
+			requests <- req
+			switch req[1] {
+			case 0:
+				gw.WriteTo([]byte{0, 128, 0, 0, 0, 0, 0, 1, 198, 51, 100, 9}, addr)
+			case 1:
+				resp := append([]byte{0, 129, 0, 0, 0, 0, 0, 1}, req[4:6]...)
+				external := binary.BigEndian.Uint16(req[6:])
+				if external == binary.BigEndian.Uint16(req[4:]) {
+					external++
+				}
+				resp = binary.BigEndian.AppendUint16(resp, external)
+				gw.WriteTo(binary.BigEndian.AppendUint32(resp, 1), addr)
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	unavailable := func(context.Context) (portMapper, error) { return nil, errors.New("no router") }
+	natpmp := func(context.Context) (portMapper, error) {
+		return &natpmpMapper{gateway: gw.LocalAddr().(*net.UDPAddr).AddrPort()}, nil
+	}
+	if _, err := newMapping(ctx, []func(context.Context) (portMapper, error){unavailable}, 4000); err == nil {
+		t.Fatal("mapping without a router")
+	}
+	m, err := newMapping(ctx, []func(context.Context) (portMapper, error){unavailable, natpmp}, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.External() != netip.MustParseAddrPort("198.51.100.9:4001") || m.Protocol() != "NAT-PMP" {
+		t.Fatalf("mapped to %v with %s", m.External(), m.Protocol())
+	}
+	next := func() []byte {
+		t.Helper()
+		select {
+		case req := <-requests:
+			return req
+		case <-time.After(5 * time.Second):
+			t.Fatal("no request")
+			return nil
+		}
+	}
+	for range 2 { // external address and mapping
+		next()
+	}
+	die := make(chan struct{})
+	go m.refresh(die)
+	next()
+	if req := next(); req[1] != 1 || binary.BigEndian.Uint16(req[6:]) != 4001 || binary.BigEndian.Uint32(req[8:]) == 0 {
+		t.Fatalf("refresh request %v", req)
+	}
+	close(die) // 监听器关闭时删除映射
+	for {
+		if req := next(); req[1] == 1 && binary.BigEndian.Uint32(req[8:]) == 0 {
+			break
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Error(err)
+	}
+
+	// SSDP应答的描述地址必须位于应答者的地址上
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 2, 1), Port: 1900}
+	for location, want := range map[string]bool{
+		"http://192.168.2.1:5000/desc.xml": true,
+		"http://192.168.2.9:5000/desc.xml": false,
+		"http://router.lan/desc.xml":       false,
+		"file:///etc/passwd":               false,
+		"":                                 false,
+	} {
+		resp := &http.Response{Header: http.Header{"Location": {location}}}
+		if got := ssdpLocation(resp, from) != ""; got != want {
+			t.Errorf("location %q accepted %v", location, got)
+		}
+	}
+
+	// UPnP：嵌套的设备，仅支持永久租约
+	var actions []string
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType><deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType><deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType><serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl</controlURL>
+</service></serviceList></device></deviceList></device></deviceList></device></root>`)
+	})
+	mux.HandleFunc("/ctl", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		mu.Lock()
+		actions = append(actions, action)
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+			io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		case strings.HasSuffix(action, `#AddPortMapping"`) && !bytes.Contains(body, []byte("<NewLeaseDuration>0<")):
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`)
+		}
+	})
+	mux.HandleFunc("/elsewhere.xml", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device><serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>http://192.0.2.1/ctl</controlURL>
+</service></serviceList></device></root>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	if _, err := upnpFromDescription(ctx, srv.URL+"/elsewhere.xml"); err == nil {
+		t.Fatal("control URL off the gateway accepted")
+	}
+	u, err := upnpFromDescription(ctx, srv.URL+"/desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, lifetime, err := u.mapPort(ctx, 5000, 5000)
+	if err != nil || mapped != netip.MustParseAddrPort("203.0.113.7:5000") || lifetime != 0 {
+		t.Fatalf("mapped to %v for %v, %v", mapped, lifetime, err)
+	}
+	if err := u.unmap(ctx, 5000, 5000); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(actions) != 4 || !strings.HasSuffix(actions[3], `#DeletePortMapping"`) {
+		t.Errorf("actions %v", actions)
+	}
+}
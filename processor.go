@@ -0,0 +1,136 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-2 15:37:09
+@Description: Pluggable packet processing between KCP and the FEC and crypto layers
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+// PacketProcessor transforms the KCP packets of a session, such as for
+// compression, padding or a telemetry tap. Outgoing packets pass through the
+// processors in order after KCP and before FEC and encryption, incoming
+// packets in reverse order after decryption and FEC decoding.
+//
+// A packet starts with the header of its first KCP segment, IKCP_OVERHEAD
+// bytes which must be kept unchanged, as listeners route packets by it.
+// Processors must be safe for concurrent use, and must not block.
+//
+// A processor which may grow packets reports the bytes it adds with an
+// Overhead() int method, KCP leaves room for them in each packet.
+type PacketProcessor interface {
+	// Outgoing returns the packet to send for 'pkt', which may be 'pkt'
+	// modified in place. The result must not exceed the MTU limit of 1500
+	// bytes, the packet is dropped on an error and KCP retransmits it.
+	Outgoing(pkt []byte) ([]byte, error)
+
+	// Incoming reverses Outgoing for a packet received, which may be modified
+	// in place, and is dropped on an error.
+	Incoming(pkt []byte) ([]byte, error)
+}
+
+// processorChain is the list of processors of a session
+type processorChain []PacketProcessor
+
+// overheader is implemented by processors which grow packets
+type overheader interface {
+	Overhead() int
+}
+
+// SetPacketProcessors sets the processors of the session, both ends of a
+// session must use the same processors, so they are set before the first
+// packet. No processors removes them.
+func (s *UDPSession) SetPacketProcessors(processors ...PacketProcessor) {
+	overhead := 0
+	for _, p := range processors {
+		if o, ok := p.(overheader); ok {
+			overhead += o.Overhead()
+		}
+	}
+
+	s.mu.Lock()
+	if overhead != s.procOverhead {
+		s.kcp.SetMtu(int(s.kcp.mtu) + s.procOverhead - overhead)
+		s.procOverhead = overhead
+	}
+	s.mu.Unlock()
+
+	if len(processors) == 0 {
+		s.processors.Store(nil)
+		return
+	}
+	chain := processorChain(append([]PacketProcessor(nil), processors...))
+	s.processors.Store(&chain)
+}
+
+// packetOverhead returns the bytes of a packet in addition to the KCP packet,
+// the caller must hold the session lock
+func (s *UDPSession) packetOverhead() int {
+	return s.headerSize + s.procOverhead
+}
+
+// SetPacketProcessors sets a function creating the processors of each session
+// accepted afterwards, they are in place before the first packet of the session
+// is processed. A nil function removes them.
+func (l *Listener) SetPacketProcessors(newProcessors func() []PacketProcessor) {
+	if newProcessors == nil {
+		l.processors.Store(nil)
+		return
+	}
+	l.processors.Store(&newProcessors)
+}
+
+// newSessionProcessors sets the processors of a session accepted by the listener
+func (l *Listener) newSessionProcessors(s *UDPSession) {
+	if newProcessors := l.processors.Load(); newProcessors != nil {
+		s.SetPacketProcessors((*newProcessors)()...)
+	}
+}
+
+// processOutgoing passes a packet from xmitBuf, with the header space of the
+// session in front, through the processors. It returns the packet to send, or
+// nil if it was dropped.
+func (s *UDPSession) processOutgoing(chain processorChain, buf []byte) []byte {
+	pkt, ok := s.applyOutgoing(chain, buf[s.headerSize:])
+	if !ok {
+		xmitBuf.Put(buf)
+		return nil
+	}
+	buf = buf[:s.headerSize+len(pkt)]
+	copy(buf[s.headerSize:], pkt)
+	return buf
+}
+
+// applyOutgoing passes a KCP packet through the processors, it returns false
+// if a processor dropped it or the result does not fit in a packet.
+func (s *UDPSession) applyOutgoing(chain processorChain, pkt []byte) ([]byte, bool) {
+	for _, p := range chain {
+		var err error
+		if pkt, err = p.Outgoing(pkt); err != nil {
+			s.logEvent("packet processor dropped an outgoing packet: %v", err)
+			return nil, false
+		}
+	}
+
+	if s.headerSize+len(pkt) > mtuLimit || len(pkt) < IKCP_OVERHEAD {
+		s.logEvent("packet processor returned %d bytes, dropped", len(pkt))
+		return nil, false
+	}
+	return pkt, true
+}
+
+// processIncoming reverses the processors for a KCP packet received, it
+// returns false if a processor dropped it.
+func (s *UDPSession) processIncoming(pkt []byte) ([]byte, bool) {
+	chain := s.processors.Load()
+	if chain == nil {
+		return pkt, true
+	}
+	for i := len(*chain) - 1; i >= 0; i-- {
+		var err error
+		if pkt, err = (*chain)[i].Incoming(pkt); err != nil {
+			return nil, false
+		}
+	}
+	return pkt, true
+}
@@ -0,0 +1,75 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-12 19:54:36
+@Description: Named bundles of KCP settings
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Profile is a bundle of the KCP latency settings, see UDPSession.SetNoDelay
+type Profile struct {
+	NoDelay      int
+	Interval     int
+	Resend       int
+	NoCongestion int
+}
+
+// profiles are the bundles of kcptun's modes, from the most frugal to the
+// most aggressive
+var profiles = map[string]Profile{
+	"normal": {NoDelay: 0, Interval: 40, Resend: 2, NoCongestion: 1},
+	"fast":   {NoDelay: 0, Interval: 30, Resend: 2, NoCongestion: 1},
+	"fast2":  {NoDelay: 1, Interval: 20, Resend: 2, NoCongestion: 1},
+	"fast3":  {NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1},
+}
+
+// LookupProfile returns the profile of a name, "normal", "fast", "fast2" or
+// "fast3" in order of lower latency and higher bandwidth cost.
+func LookupProfile(name string) (Profile, bool) {
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// checkProfile fails on an unknown profile name, the empty name is none
+func checkProfile(name string) error {
+	if _, ok := profiles[name]; !ok && name != "" {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return errors.Errorf("unknown profile %q, one of %s", name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// withProfile returns the config with the zero KCP settings taken from its
+// profile
+func (c *Config) withProfile() *Config {
+	p, ok := profiles[c.Profile]
+	if !ok {
+		return c
+	}
+	cfg := *c
+	if cfg.NoDelay == 0 {
+		cfg.NoDelay = p.NoDelay
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = p.Interval
+	}
+	if cfg.Resend == 0 {
+		cfg.Resend = p.Resend
+	}
+	if cfg.NoCongestion == 0 {
+		cfg.NoCongestion = p.NoCongestion
+	}
+	return &cfg
+}
@@ -0,0 +1,165 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 11:08:19
+@Description: NAT hole punching between two peers
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	punchInterval = 50 * time.Millisecond // between the rounds of probes to the candidates
+	punchBurst    = 3                     // copies of the nomination, which is not answered
+	punchSize     = 21                    // magic, kind, tiebreaker and echoed tiebreaker
+)
+
+// kinds of the punching packets
+const (
+	punchProbe    byte = iota + 1 // sprayed to the candidates of the peer
+	punchAck                      // answers a probe, the path works both ways
+	punchNominate                 // the controlling peer chose the path
+)
+
+var punchMagic = []byte("SUPN")
+
+// punchPacket is a packet read while punching
+type punchPacket struct {
+	from       netip.AddrPort
+	kind       byte   // 0 for packets other than the punching ones
+	tiebreaker uint64 // of the sender
+	echo       uint64 // tiebreaker of the receiver, in acks and nominations
+}
+
+// Punch opens a session to a peer behind a NAT, which calls Punch at the same
+// time with the candidates of this side. 'candidates' are the addresses the
+// peer may be reached at, exchanged over a signaling channel: the public
+// address from STUNBinding and the local addresses of its socket.
+//
+// Both peers send probes from 'conn' to all the candidates of the other until
+// one is answered, opening the mappings of their NATs. The peer which drew the
+// larger random tiebreaker, the initiator, nominates the first path answered
+// and both promote it to a session with DialWithConn, on a conversation both
+// derive from the tiebreaker. Protocols on top of the session which need a
+// client and a server, such as the stream multiplexer, take the initiator as
+// the client.
+//
+// Probes are sent until the context is done. The probes are not authenticated,
+// the encryption of the session is, with a Key known to both peers. Versions
+// are not negotiated, there is no listener to choose one, and so neither is
+// Compression.
+func Punch(ctx context.Context, conn net.PacketConn, candidates []netip.AddrPort, config *Config) (s *UDPSession, initiator bool, err error) {
+	if err := config.Validate(); err != nil {
+		return nil, false, err
+	}
+	if len(config.Versions) > 0 || config.Compression {
+		return nil, false, errors.New("version negotiation, and Compression with it, needs a listener")
+	}
+	if len(candidates) == 0 {
+		return nil, false, errors.New("no candidates to punch")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	packets := make(chan punchPacket, 64)
+	r := startReader(conn, func(b []byte, addr net.Addr) {
+		p := parsePunch(b)
+		p.from = addrKey(addr)
+		select {
+		case packets <- p:
+		default:
+		}
+	})
+	raddr, conv, initiator, err := punch(ctx, conn, candidates, packets, r.done)
+	if readErr := r.stop(); err != nil && readErr != nil {
+		return nil, false, readErr
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	s, err = dialWithConn(conn, net.UDPAddrFromAddrPort(raddr), config, conv)
+	return s, initiator, err
+}
+
+// punch runs the probing of Punch and returns the path chosen, the
+// conversation and the role of this side
+func punch(ctx context.Context, conn net.PacketConn, candidates []netip.AddrPort, packets <-chan punchPacket, failed <-chan struct{}) (netip.AddrPort, uint32, bool, error) {
+	var b [8]byte
+	crand.Read(b[:])
+	tiebreaker := binary.LittleEndian.Uint64(b[:])
+	send := func(kind byte, to netip.AddrPort, echo uint64) {
+		conn.WriteTo(appendPunch(nil, kind, tiebreaker, echo), net.UDPAddrFromAddrPort(to))
+	}
+
+	acked := make(map[netip.AddrPort]uint64) // tiebreakers of the peers whose probes were answered
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+	for {
+		for _, c := range candidates {
+			send(punchProbe, c, 0)
+		}
+		for wait := true; wait; {
+			select {
+			case <-ctx.Done():
+				return netip.AddrPort{}, 0, false, errors.WithStack(ctx.Err())
+			case <-failed:
+				return netip.AddrPort{}, 0, false, errors.New("socket read failed")
+			case <-ticker.C:
+				wait = false
+			case p := <-packets:
+				switch {
+				case p.kind == 0:
+					// the initiator has started the session on a path
+					// answered here, the nomination was lost
+					if peer, ok := acked[p.from]; ok && peer > tiebreaker {
+						return p.from, uint32(peer), false, nil
+					}
+				case p.tiebreaker == tiebreaker:
+					// our own probe, looped back by a candidate
+				case p.kind == punchProbe:
+					send(punchAck, p.from, p.tiebreaker)
+					acked[p.from] = p.tiebreaker
+				case p.echo != tiebreaker:
+				case p.kind == punchAck && tiebreaker > p.tiebreaker:
+					for range punchBurst {
+						send(punchNominate, p.from, p.tiebreaker)
+					}
+					return p.from, uint32(tiebreaker), true, nil
+				case p.kind == punchNominate && p.tiebreaker > tiebreaker:
+					return p.from, uint32(p.tiebreaker), false, nil
+				}
+			}
+		}
+	}
+}
+
+// appendPunch appends a punching packet to 'b'
+func appendPunch(b []byte, kind byte, tiebreaker, echo uint64) []byte {
+	b = append(b, punchMagic...)
+	b = append(b, kind)
+	b = binary.LittleEndian.AppendUint64(b, tiebreaker)
+	return binary.LittleEndian.AppendUint64(b, echo)
+}
+
+// parsePunch decodes a punching packet, with kind 0 for other packets
+func parsePunch(b []byte) punchPacket {
+	if len(b) != punchSize || !bytes.Equal(b[:len(punchMagic)], punchMagic) {
+		return punchPacket{}
+	}
+	return punchPacket{
+		kind:       b[4],
+		tiebreaker: binary.LittleEndian.Uint64(b[5:]),
+		echo:       binary.LittleEndian.Uint64(b[13:]),
+	}
+}
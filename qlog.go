@@ -0,0 +1,119 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 23:02:44
+@Description: Structured per-session event log for offline analysis
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// qlogger writes the events of a session as JSON lines, safe for
+// concurrent use
+type qlogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time // time 0 of the events
+	err   error     // first write error, the log stops at it
+}
+
+// qlogRecord is a line of the log
+type qlogRecord struct {
+	Time float64 `json:"time"` // ms since the start of the log
+	Name string  `json:"name"`
+	Data any     `json:"data,omitempty"`
+}
+
+// SetQlog starts writing the events of the session to 'w' as JSON lines in
+// the spirit of the qlog of QUIC, for offline analysis and visualization of
+// the protocol: a header line with the conv and the reference time, then a
+// line per event with its time in ms since the reference time, its name and
+// its data:
+//
+//	packet_sent      size, class of each packet queued for the socket
+//	packet_received  size of each packet from remote
+//	loss_detected    segments retransmitted in a flush, by cause
+//	fec_recovered    packets recovered by FEC
+//	cwnd_update      cwnd and ssthresh when the congestion window changes
+//
+// Writes happen on the paths of the packets, 'w' should be buffered. A write
+// error stops the log, nil stops it too.
+func (s *UDPSession) SetQlog(w io.Writer) {
+	if w == nil {
+		s.qlog.Store(nil)
+		return
+	}
+	q := &qlogger{w: w, start: time.Now()}
+	s.mu.Lock()
+	s.qlogCwnd = 0
+	header := map[string]any{
+		"qlog_format":    "NDJSON",
+		"title":          "safe-udp",
+		"conv":           s.kcp.conv,
+		"reference_time": q.start.UnixMilli(),
+	}
+	s.mu.Unlock()
+	b, _ := json.Marshal(header)
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		s.logEvent("qlog: %v", err)
+		return
+	}
+	s.qlog.Store(q)
+}
+
+// qlogEvent writes an event, if the session has a log
+func (s *UDPSession) qlogEvent(name string, data any) {
+	q := s.qlog.Load()
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return
+	}
+	r := qlogRecord{float64(time.Since(q.start).Microseconds()) / 1000, name, data}
+	b, _ := json.Marshal(r)
+	if _, q.err = q.w.Write(append(b, '\n')); q.err != nil {
+		s.qlog.CompareAndSwap(q, nil)
+		s.logEvent("qlog: %v", q.err)
+	}
+}
+
+// qlogPacket logs a packet of 'size' bytes, with its class if it is not
+// negative, if the session has a log
+func (s *UDPSession) qlogPacket(name string, size int, class PacketClass) {
+	if s.qlog.Load() == nil {
+		return
+	}
+	data := map[string]any{"size": size}
+	if class >= 0 {
+		data["class"] = class.String()
+	}
+	s.qlogEvent(name, data)
+}
+
+// qlogCwndUpdate logs the congestion window if it changed, the caller holds
+// the session lock
+func (s *UDPSession) qlogCwndUpdate() {
+	if s.qlog.Load() == nil || s.kcp.cwnd == s.qlogCwnd {
+		return
+	}
+	s.qlogCwnd = s.kcp.cwnd
+	s.qlogEvent("cwnd_update", map[string]uint32{"cwnd": s.kcp.cwnd, "ssthresh": s.kcp.ssthresh})
+}
+
+// onLoss is invoked by KCP with the session lock held, with the segments
+// retransmitted in a flush by cause
+func (s *UDPSession) onLoss(lost, fast, early, rack, tlp uint64) {
+	if s.qlog.Load() == nil {
+		return
+	}
+	s.qlogEvent("loss_detected", map[string]uint64{"timeout": lost, "fast": fast, "early": early, "rack": rack, "tlp": tlp})
+}
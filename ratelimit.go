@@ -0,0 +1,118 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-17 14:06:51
+@Description: Per-session token bucket rate limiting
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// rateBurst is the burst allowed by a token bucket, in time of the rate
+const rateBurst = 50 * time.Millisecond
+
+// tokenBucket is a token bucket of bytes
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	burst  float64 // capacity of the bucket
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func newTokenBucket(bytesPerSec int) *tokenBucket {
+	burst := float64(bytesPerSec) * rateBurst.Seconds()
+	if burst < mtuLimit {
+		burst = mtuLimit
+	}
+	return &tokenBucket{rate: float64(bytesPerSec), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill adds the tokens accumulated since the last call, the caller must hold the lock
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve takes n bytes from the bucket, and returns the time to wait before they can be sent
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes n bytes from the bucket if available
+func (b *tokenBucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// SetRateLimit limits the outgoing bytes per second of the session, including
+// retransmissions, FEC parity and headers. Packets over the rate are delayed in
+// the transmit pipeline, which backs up into KCP. 0 removes the limit.
+func (s *UDPSession) SetRateLimit(bytesPerSec int) {
+	if bytesPerSec <= 0 {
+		s.txLimit.Store(nil)
+		return
+	}
+	s.txLimit.Store(newTokenBucket(bytesPerSec))
+}
+
+// SetReceiveRateLimit limits the incoming bytes per second of the session, packets
+// over the rate are dropped before reaching KCP, which makes the remote retransmit
+// and slow down. 0 removes the limit.
+func (s *UDPSession) SetReceiveRateLimit(bytesPerSec int) {
+	if bytesPerSec <= 0 {
+		s.rxLimit.Store(nil)
+		return
+	}
+	s.rxLimit.Store(newTokenBucket(bytesPerSec))
+}
+
+// shape takes txqueue from the send rate limit, and returns the time to wait
+// before sending it
+func (s *UDPSession) shape(txqueue []ipv4.Message) time.Duration {
+	b := s.txLimit.Load()
+	if b == nil {
+		return 0
+	}
+
+	n := 0
+	for k := range txqueue {
+		n += len(txqueue[k].Buffers[0])
+	}
+	return b.reserve(n)
+}
+
+// policeInput returns false if a packet of n bytes exceeds the receive rate limit
+func (s *UDPSession) policeInput(n int) bool {
+	b := s.rxLimit.Load()
+	if b == nil || b.allow(n) {
+		return true
+	}
+	atomic.AddUint64(&s.Snmp().InRateDrops, 1)
+	return false
+}
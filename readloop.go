@@ -0,0 +1,232 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 11:26:03
+@Description: Read loops of sessions and listeners
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// newBatchConn returns a batchConn for UDP sockets, or nil if 'conn' does not support batching.
+//
+// The family follows the local address: a socket bound to an IPv6 or unspecified
+// address is an AF_INET6 socket, dual-stack unless IPV6_V6ONLY is set, and IPv4
+// peers appear on it as v4-mapped addresses, which addrKey unmaps.
+func newBatchConn(conn net.PacketConn) batchConn {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+
+	addr, ok := uc.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	if addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// groBufferSize is the size of the read buffers with GRO, a coalesced buffer holds up to 64KB
+const groBufferSize = 65535
+
+// batchReader reads packets in batches with a reusable message slice, and splits
+// the buffers coalesced by GRO into the original packets.
+type batchReader struct {
+	msgs    []ipv4.Message
+	gro     bool // msgs are sized for coalesced buffers
+	pktinfo bool // the destinations of the packets are read, see enablePacketInfo
+}
+
+// read reads a batch of packets from 'xconn', or from 'conn' through 'ring' if
+// not nil, and passes each packet to 'input' with its destination, if the
+// reader asks for them
+func (r *batchReader) read(xconn batchConn, conn net.PacketConn, ring *ioRing, gro bool, input func(data []byte, addr net.Addr, dst pktinfo)) error {
+	if r.msgs == nil || r.gro != gro {
+		size, oob := mtuLimit, 0
+		if gro {
+			size, oob = groBufferSize, groControlSize
+		}
+		if r.pktinfo {
+			oob += pktinfoControlSize
+		}
+		r.msgs = make([]ipv4.Message, batchSize)
+		for k := range r.msgs {
+			r.msgs[k].Buffers = [][]byte{make([]byte, size)}
+			r.msgs[k].OOB = make([]byte, oob)
+		}
+		r.gro = gro
+	}
+
+	var count int
+	var err error
+	if ring != nil {
+		count, err = ring.recv(conn.(*net.UDPConn), r.msgs)
+	} else {
+		count, err = xconn.ReadBatch(r.msgs, 0)
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		msg := &r.msgs[i]
+		data := msg.Buffers[0][:msg.N]
+		size := 0
+		if gro {
+			size = groSegmentSize(msg.OOB[:msg.NN])
+		}
+		var dst pktinfo
+		if r.pktinfo {
+			dst = parsePacketInfo(msg.OOB[:msg.NN])
+		}
+		if size <= 0 {
+			input(data, msg.Addr, dst)
+			continue
+		}
+		for len(data) > 0 {
+			n := min(size, len(data))
+			input(data[:n], msg.Addr, dst)
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// readLoop continuously reads packets from the underlying connection for client sessions
+func (s *UDPSession) readLoop() {
+	if s.xconn != nil {
+		s.batchReadLoop()
+		return
+	}
+
+	buf := make([]byte, mtuLimit)
+	for {
+		select {
+		case <-s.die:
+			return
+		default:
+		}
+
+		if n, addr, err := s.conn.ReadFrom(buf); err == nil {
+			s.readInput(buf[:n], addr)
+		} else {
+			// Notify read error and exit the loop
+			s.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// batchReadLoop reads up to batchSize packets per system call, recvmmsg or
+// io_uring on linux
+func (s *UDPSession) batchReadLoop() {
+	var r batchReader
+	for {
+		select {
+		case <-s.die:
+			return
+		default:
+		}
+
+		ring := s.uring.Load()
+		err := r.read(s.xconn, s.conn, ring, s.gro.Load(), func(data []byte, addr net.Addr, _ pktinfo) { s.readInput(data, addr) })
+		if ring != nil && errors.Is(err, errIORing) {
+			s.turnOffIORing(ring, err)
+		} else if err != nil {
+			s.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// readInput handles a packet read by the client session
+func (s *UDPSession) readInput(data []byte, addr net.Addr) {
+	// Verify the packet is from our remote peer
+	if addrKey(addr) == addrKey(s.remote) {
+		s.packetInput(data)
+	} else {
+		s.stun.input(data)
+	}
+}
+
+// monitor continuously reads packets from the listener's connection
+func (l *Listener) monitor() {
+	if xconn := newBatchConn(l.conn); xconn != nil {
+		l.batchMonitor(xconn)
+		return
+	}
+
+	buf := make([]byte, mtuLimit)
+	for {
+		select {
+		case <-l.die:
+			return
+		default:
+		}
+
+		if n, addr, err := l.conn.ReadFrom(buf); err == nil {
+			l.receive(buf[:n], addr, pktinfo{})
+		} else {
+			l.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// batchMonitor reads up to batchSize packets per system call, recvmmsg or
+// io_uring on linux.
+// On a socket bound to the unspecified address it reads the destination of
+// each packet, which the sessions reply from.
+func (l *Listener) batchMonitor(xconn batchConn) {
+	r := batchReader{pktinfo: enablePacketInfo(l.conn)}
+	for {
+		select {
+		case <-l.die:
+			return
+		default:
+		}
+
+		ring := l.uring.Load()
+		err := r.read(xconn, l.conn, ring, l.gro.Load(), l.receive)
+		if ring != nil && errors.Is(err, errIORing) {
+			l.turnOffIORing(ring)
+		} else if err != nil {
+			l.notifyReadError(err)
+			return
+		}
+	}
+}
+
+// SetGRO enables UDP generic receive offload on linux, the kernel coalesces
+// bursts of packets from the same peer into large buffers which the read loop
+// splits again, reducing wakeups on high packet rates. It should be enabled
+// before packets arrive.
+//
+// It returns false if the socket or the kernel does not support it, or if the
+// session is accepted from a Listener, which reads for its sessions.
+func (s *UDPSession) SetGRO(enable bool) bool {
+	if s.l != nil || s.xconn == nil || !setGRO(s.conn, enable) {
+		return false
+	}
+	s.gro.Store(enable)
+	return true
+}
+
+// SetGRO enables UDP generic receive offload on linux for the packets of all
+// the sessions of the listener, see UDPSession.SetGRO.
+func (l *Listener) SetGRO(enable bool) bool {
+	if newBatchConn(l.conn) == nil || !setGRO(l.conn, enable) {
+		return false
+	}
+	l.gro.Store(enable)
+	return true
+}
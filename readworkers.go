@@ -0,0 +1,176 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 23:45:20
+@Description: Parallel processing of the packets read by a listener
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// readWorkerQueue is the number of packets queued for a worker before new ones are dropped
+const readWorkerQueue = 1024
+
+// readPacket is a packet queued for a read worker
+type readPacket struct {
+	data []byte // from xmitBuf
+	addr net.Addr
+	dst  pktinfo
+}
+
+// readWorkers decrypt and process the packets of a listener in parallel. A
+// conversation, or a source address before its session is known, always goes
+// to the same worker, so the packets of a session are processed in the order
+// they were read.
+type readWorkers struct {
+	queues []chan readPacket
+	die    chan struct{}  // closed when the workers are replaced or the listener closes
+	done   sync.WaitGroup // the workers have returned, their queues drained once replaced
+
+	mu       sync.RWMutex // held for reading by enqueue, so that no packet is queued once replaced
+	replaced bool
+}
+
+// SetReadWorkers spreads the decryption, FEC decoding and KCP input of the
+// packets read by the listener over 'n' goroutines, hashed by conversation, as
+// found in the plaintext or from the session of the source address, or else
+// by source address, so that the packets of a session keep their order, also
+// across a migration to another address. 0 or 1 processes them on the read
+// loop, which is the default and suits most servers; busy servers with many
+// sessions gain from more cores. The workers replaced process the packets
+// they have queued before the new ones start.
+//
+// Each worker queues up to 1024 packets, packets beyond are dropped and counted
+// as input errors. A BlockCrypt of the application must be safe for concurrent
+// use when workers are enabled, the bundled ones are.
+func (l *Listener) SetReadWorkers(n int) error {
+	if n < 0 {
+		return errors.New("read workers must not be negative")
+	}
+
+	var w *readWorkers
+	if n > 1 {
+		w = &readWorkers{queues: make([]chan readPacket, n), die: make(chan struct{})}
+		for k := range w.queues {
+			w.queues[k] = make(chan readPacket, readWorkerQueue)
+		}
+	}
+	if old := l.workers.Swap(w); old != nil {
+		// the packets enqueued from here on go to the new workers
+		old.mu.Lock()
+		old.replaced = true
+		old.mu.Unlock()
+		close(old.die)
+		old.done.Wait()
+	}
+	if w != nil {
+		w.done.Add(len(w.queues))
+		for _, q := range w.queues {
+			go l.readWorker(w, q, cloneBlock(l.block))
+		}
+	}
+	return nil
+}
+
+// receive hands a packet read from the socket to a read worker, or processes it inline
+func (l *Listener) receive(data []byte, addr net.Addr, dst pktinfo) {
+	if !l.toWorkers(data, addr, dst) {
+		l.packetInput(l.block, data, addr, dst)
+	}
+}
+
+// toWorkers hands a packet to the read workers, it returns false if there are
+// none and the caller processes the packet
+func (l *Listener) toWorkers(data []byte, addr net.Addr, dst pktinfo) bool {
+	for {
+		w := l.workers.Load()
+		if w == nil {
+			return false
+		}
+		queued, replaced := w.enqueue(l.readHash(data, addr), data, addr, dst)
+		if replaced {
+			continue // swapped meanwhile, the new workers are loaded
+		}
+		if !queued {
+			atomic.AddUint64(&l.Snmp().InErrs, 1)
+		}
+		return true
+	}
+}
+
+// readHash returns the hash selecting the worker of a packet: its
+// conversation when it can be told before decryption, from the plaintext or
+// the session of the source address, and the source address otherwise
+func (l *Listener) readHash(data []byte, addr net.Addr) uint64 {
+	key := addrKey(addr)
+	if l.block == nil {
+		if off, ok := kcpOffset(data); ok {
+			return convHash(binary.LittleEndian.Uint32(data[off:]))
+		}
+	}
+	if s := l.sessionByAddr(key); s != nil {
+		return convHash(s.GetConv())
+	}
+	ip := key.Addr().As16()
+	return binary.LittleEndian.Uint64(ip[:8]) ^ binary.LittleEndian.Uint64(ip[8:]) ^ uint64(key.Port())<<48
+}
+
+// convHash spreads the conversations over the 64 bits of a hash
+func convHash(conv uint32) uint64 {
+	return uint64(conv) * 0x9e3779b97f4a7c15
+}
+
+// enqueue copies the packet into the queue of the worker of 'hash', it
+// returns false if the queue is full and the packet dropped, and reports
+// 'replaced' without queuing once the workers have been replaced
+func (w *readWorkers) enqueue(hash uint64, data []byte, addr net.Addr, dst pktinfo) (queued, replaced bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.replaced {
+		return false, true
+	}
+	q := w.queues[jumpHash(hash, len(w.queues))]
+
+	pkt := readPacket{xmitBuf.Get().([]byte)[:len(data)], addr, dst}
+	copy(pkt.data, data)
+	select {
+	case q <- pkt:
+		return true, false
+	default:
+		xmitBuf.Put(pkt.data)
+		return false, false
+	}
+}
+
+// readWorker processes the packets of a queue until the listener closes, or
+// the workers are replaced and the queue is drained, with a cipher of its own
+func (l *Listener) readWorker(w *readWorkers, q chan readPacket, block BlockCrypt) {
+	defer w.done.Done()
+	for {
+		select {
+		case pkt := <-q:
+			l.packetInput(block, pkt.data, pkt.addr, pkt.dst)
+			xmitBuf.Put(pkt.data)
+		case <-w.die:
+			for {
+				select {
+				case pkt := <-q:
+					l.packetInput(block, pkt.data, pkt.addr, pkt.dst)
+					xmitBuf.Put(pkt.data)
+				default:
+					return
+				}
+			}
+		case <-l.die:
+			return
+		}
+	}
+}
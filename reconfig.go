@@ -0,0 +1,94 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 16:20:37
+@Description: Live reconfiguration of established sessions
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// runtimeSettings are the fields of Config which ApplyConfig can change on a
+// running session, any other set field fails it
+var runtimeSettings = map[string]bool{
+	"FECData": true, "FECParity": true, "FECBackend": true,
+	"NoDelay": true, "Interval": true, "Resend": true, "NoCongestion": true, "Profile": true,
+	"InitialRTO": true, "MinRTO": true, "MaxRTO": true, "RACK": true, "FRTO": true, "SACK": true,
+	"MaxRetransmit": true, "ProgressTimeout": true, "SendWindow": true, "RecvWindow": true,
+	"RateLimit": true, "ReceiveRateLimit": true,
+	"SendBuffer": true, "RecvBuffer": true, "DSCP": true,
+}
+
+// ApplyConfig changes the settings of the established session to those set
+// in 'partial', the zero settings are left as they are, so operators can
+// adjust the interval, the windows, the FEC ratio or the rate limits to the
+// network without reconnecting. Only the KCP settings, a profile, the windows,
+// the rate limits, the FEC ratio and backend and the socket settings can
+// change: it fails without changing anything if the config is invalid or sets
+// any other field, such as the key, the cipher, compression, versions, the
+// handshake, the transport or the settings of listeners. Socket settings fail
+// on accepted sessions, which share the socket of the listener.
+//
+// A new FEC ratio takes effect with the next group of packets and the remote
+// follows it by itself, but FEC can neither be turned on nor off, as that
+// changes the layout of the packets. Zero cannot be applied, the profiles and
+// SetNoDelay, SetRateLimit or SetFECBackend turn the settings off.
+func (s *UDPSession) ApplyConfig(partial *Config) error {
+	if err := partial.Validate(); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(partial).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if name := v.Type().Field(i).Name; !runtimeSettings[name] && !v.Field(i).IsZero() {
+			return errors.Errorf("%s cannot change on a running session", name)
+		}
+	}
+	if partial.FECData > 0 && s.fecEncoder == nil {
+		return errors.New("FEC cannot be turned on on a running session")
+	}
+	if err := s.checkSocketSettings(partial); err != nil {
+		return err
+	}
+
+	if err := partial.tuneSocket(s); err != nil {
+		return err
+	}
+	if partial.FECData > 0 {
+		s.fecShards.Store(uint32(partial.FECData)<<16 | uint32(partial.FECParity))
+	}
+	if partial.FECBackend != FECBackendAuto {
+		s.SetFECBackend(partial.FECBackend)
+	}
+	partial.tuneKCP(s)
+	s.logEvent("config applied")
+	return nil
+}
+
+// checkSocketSettings returns an error if the socket of the session cannot
+// take the socket settings of 'c', before any of them is applied
+func (s *UDPSession) checkSocketSettings(c *Config) error {
+	if c.RecvBuffer == 0 && c.SendBuffer == 0 && c.DSCP == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l != nil {
+		return errors.New("socket settings do not apply to accepted sessions, which share the socket of the listener")
+	}
+	_, readBuffer := s.conn.(setReadBuffer)
+	_, writeBuffer := s.conn.(setWriteBuffer)
+	_, dscp := s.conn.(setDSCP)
+	if _, ok := s.conn.(net.Conn); ok {
+		dscp = true
+	}
+	if c.RecvBuffer > 0 && !readBuffer || c.SendBuffer > 0 && !writeBuffer || c.DSCP > 0 && !dscp {
+		return errors.WithStack(errInvalidOperation)
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-13 17:25:48
+@Description: Stream connections redialing after session failures
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultMinBackoff and defaultMaxBackoff bound the wait between redials
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+
+	// redialTimeout bounds an attempt to redial, the resolution and the handshake
+	redialTimeout = 10 * time.Second
+)
+
+// ConnState is the state of a ReconnectingConn
+type ConnState int
+
+const (
+	ConnConnected    ConnState = iota // a connection is established
+	ConnReconnecting                  // the connection failed, it is being redialed
+	ConnClosed                        // closed by the application
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnected:
+		return "connected"
+	case ConnReconnecting:
+		return "reconnecting"
+	case ConnClosed:
+		return "closed"
+	default:
+		return "invalid"
+	}
+}
+
+// ReconnectingConn is a stream connection which redials its address once the
+// session fails, resolving the name again and setting up the key agreement
+// and smux anew, so it outlives server restarts and address changes.
+//
+// The data in flight when the session fails is lost and the server sees a new
+// connection, the application protocol must be able to resume on it. Reads
+// and writes wait for the connection to be redialed, up to their deadlines;
+// the remote closing the stream is not a failure, reads return io.EOF.
+type ReconnectingConn struct {
+	raddr  string
+	config *Config
+
+	conn      *Conn
+	gen       uint64 // incremented with each connection
+	state     ConnState
+	redialing chan struct{} // closed once the redial ends, nil while connected
+	rd, wd    time.Time
+
+	minBackoff, maxBackoff time.Duration
+	onState                func(state ConnState, err error)
+
+	ctx    context.Context // canceled on Close, ending the redials
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+// DialReconnecting dials "raddr" like DialContext, the context only applies
+// to this first connection, and returns a connection redialing it after
+// failures. The redials back off exponentially with jitter, from 100ms up to
+// 30s, see SetBackoff.
+func DialReconnecting(ctx context.Context, raddr string, config *Config) (*ReconnectingConn, error) {
+	conn, err := DialContext(ctx, raddr, config)
+	if err != nil {
+		return nil, err
+	}
+	c := &ReconnectingConn{
+		raddr:      raddr,
+		config:     config,
+		conn:       conn,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c, nil
+}
+
+// SetBackoff sets the wait before the first redial after a failure, doubled
+// after each failed attempt up to 'limit'. The waits are randomized between
+// half and all of their length, so that the clients of a restarting server
+// spread.
+func (c *ReconnectingConn) SetBackoff(initial, limit time.Duration) error {
+	if initial <= 0 || limit < initial {
+		return errors.New("backoff must be positive, the limit not below the initial wait")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.minBackoff, c.maxBackoff = initial, limit
+	return nil
+}
+
+// SetStateCallback installs a callback invoked with each change of state, with
+// the error that failed the connection for ConnReconnecting, and again with
+// the error of each failed redial. It runs on another goroutine than the
+// reads and writes, and must not block. nil removes it.
+func (c *ReconnectingConn) SetStateCallback(fn func(state ConnState, err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onState = fn
+}
+
+// State returns the current state of the connection
+func (c *ReconnectingConn) State() ConnState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Conn returns the current connection, nil while it is being redialed. It is
+// replaced after a failure, the application should not keep it.
+func (c *ReconnectingConn) Conn() *Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != ConnConnected {
+		return nil
+	}
+	return c.conn
+}
+
+func (c *ReconnectingConn) Read(b []byte) (int, error) {
+	for {
+		conn, gen, err := c.current(false)
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Read(b)
+		if err == nil || !broken(conn, err) {
+			return n, err
+		}
+		c.fail(gen, err)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Write writes the rest of 'b' on the new connection after a failure, the
+// part written on the failed one may be lost
+func (c *ReconnectingConn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		conn, gen, err := c.current(true)
+		if err != nil {
+			return written, err
+		}
+		n, err := conn.Write(b[written:])
+		written += n
+		if err == nil || !broken(conn, err) {
+			return written, err
+		}
+		c.fail(gen, err)
+	}
+}
+
+// broken reports whether 'err' of 'conn' means its session failed, rather than
+// a deadline expiring or the remote closing the stream
+func broken(conn *Conn, err error) bool {
+	if ne := net.Error(nil); errors.As(err, &ne) && ne.Timeout() {
+		return false
+	}
+	return conn.sess == nil || !errors.Is(err, io.EOF)
+}
+
+// current returns the connection and its generation, waiting while it is
+// redialed until the read or write deadline
+func (c *ReconnectingConn) current(write bool) (*Conn, uint64, error) {
+	for {
+		c.mu.Lock()
+		conn, gen, state, redialing := c.conn, c.gen, c.state, c.redialing
+		deadline := c.rd
+		if write {
+			deadline = c.wd
+		}
+		c.mu.Unlock()
+
+		switch state {
+		case ConnConnected:
+			return conn, gen, nil
+		case ConnClosed:
+			return nil, 0, errors.WithStack(ErrClosed)
+		}
+
+		if deadline.IsZero() {
+			select {
+			case <-redialing:
+			case <-c.ctx.Done():
+			}
+			continue
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-redialing:
+		case <-c.ctx.Done():
+		case <-timer.C:
+			return nil, 0, errors.WithStack(ErrTimeout)
+		}
+		timer.Stop()
+	}
+}
+
+// fail closes the connection of generation 'gen' and starts redialing, once
+// for the reads and writes failing with it
+func (c *ReconnectingConn) fail(gen uint64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || c.state != ConnConnected {
+		return
+	}
+	c.conn.CloseSession()
+	c.state = ConnReconnecting
+	c.redialing = make(chan struct{})
+	go c.redial(err)
+}
+
+// redial dials the address until it succeeds or the connection is closed
+func (c *ReconnectingConn) redial(cause error) {
+	c.changed(ConnReconnecting, cause)
+	c.mu.Lock()
+	backoff, maxBackoff := c.minBackoff, c.maxBackoff
+	c.mu.Unlock()
+
+	for {
+		jitter := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-time.After(jitter):
+		case <-c.ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, maxBackoff)
+
+		ctx, cancel := context.WithTimeout(c.ctx, redialTimeout)
+		conn, err := DialContext(ctx, c.raddr, c.config)
+		cancel()
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.changed(ConnReconnecting, err)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.state == ConnClosed {
+			c.mu.Unlock()
+			conn.CloseSession()
+			return
+		}
+		conn.SetReadDeadline(c.rd)
+		conn.SetWriteDeadline(c.wd)
+		c.conn, c.state = conn, ConnConnected
+		c.gen++
+		close(c.redialing)
+		c.redialing = nil
+		c.mu.Unlock()
+		c.changed(ConnConnected, nil)
+		return
+	}
+}
+
+// changed invokes the state callback
+func (c *ReconnectingConn) changed(state ConnState, err error) {
+	c.mu.Lock()
+	fn := c.onState
+	c.mu.Unlock()
+	if fn != nil {
+		fn(state, err)
+	}
+}
+
+// Close closes the connection and stops redialing it
+func (c *ReconnectingConn) Close() error {
+	c.mu.Lock()
+	if c.state == ConnClosed {
+		c.mu.Unlock()
+		return errors.WithStack(ErrClosed)
+	}
+	wasConnected := c.state == ConnConnected
+	c.state = ConnClosed
+	c.cancel()
+	c.mu.Unlock()
+
+	var err error
+	if wasConnected {
+		err = c.conn.CloseSession()
+	}
+	c.changed(ConnClosed, nil)
+	return err
+}
+
+// LocalAddr returns the local address of the current connection, which
+// changes with each redial
+func (c *ReconnectingConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the current connection, which
+// changes when the name resolves to another address
+func (c *ReconnectingConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline, SetReadDeadline and SetWriteDeadline also bound the waits for
+// a redial, and carry over to the new connections
+func (c *ReconnectingConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rd, c.wd = t, t
+	if c.state == ConnConnected {
+		return c.conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rd = t
+	if c.state == ConnConnected {
+		return c.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *ReconnectingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wd = t
+	if c.state == ConnConnected {
+		return c.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 10:03:17
+@Description: Relaying of packets between peers which cannot punch through their NATs
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	relayTableLimit   = 1 << 16                // allocations when RelayLimits.Allocations is 0
+	relayIdle         = time.Minute            // expiry when RelayLimits.Idle is 0
+	relayBindInterval = 200 * time.Millisecond // between the binds of DialRelay until paired
+	relayBindSize     = 45                     // magic, kind, token, time and MAC
+	relayBoundSize    = 23                     // magic, kind, token, index and paired
+	relayMACSize      = 16                     // truncated HMAC-SHA256 of a bind under the relay secret
+	relayBindWindow   = 30 * time.Second       // clock skew accepted on the time of a bind
+	minRelaySecret    = 16                     // bytes of a relay secret
+)
+
+// kinds of the relay control packets
+const (
+	relayBind  byte = iota + 1 // a peer joins an allocation, sent until paired
+	relayBound                 // answers a bind with the position of the peer
+)
+
+var relayMagic = []byte("SURL")
+
+// RelayToken names an allocation on a relay, a random secret the two peers
+// exchange over their signaling channel, see NewRelayToken.
+type RelayToken [16]byte
+
+// NewRelayToken returns a random RelayToken.
+func NewRelayToken() RelayToken {
+	var t RelayToken
+	crand.Read(t[:])
+	return t
+}
+
+// RelayLimits bound the allocations of a relay, see Listener.SetRelay.
+type RelayLimits struct {
+	Allocations int           // allocations at a time, 0 for 65536
+	BytesPerSec int           // relayed per allocation, both directions together, 0 for no limit
+	Bytes       int64         // relayed per allocation over its lifetime, 0 for no limit
+	Idle        time.Duration // an allocation without packets expires after this, 0 for a minute
+}
+
+// relayTable holds the allocations of a relay
+type relayTable struct {
+	secret []byte // authenticates the binds
+	limits RelayLimits
+	allocs map[RelayToken]*relayAlloc
+	peers  map[netip.AddrPort]*relayAlloc // allocations by the address of their peers
+	swept  time.Time                      // last sweep of expired allocations, at most one per second
+	mu     sync.Mutex
+}
+
+// relayAlloc is an allocation, relaying between its two peers once both bound
+type relayAlloc struct {
+	token   RelayToken
+	peers   [2]netip.AddrPort // in the order they bound, the second invalid until paired
+	rate    *tokenBucket      // limit of BytesPerSec, nil for none
+	relayed int64             // bytes relayed
+	last    time.Time         // last packet of either peer
+}
+
+// SetRelay makes the listener relay packets between pairs of peers which
+// could not punch through their NATs, see DialRelay, with the limits of each
+// allocation. Binds are authenticated with 'secret', at least 16 bytes the
+// relay shares with its users, so only they can allocate. nil limits stop
+// relaying and forget the allocations.
+//
+// Relayed packets are forwarded as received, still encrypted with the key of
+// the peers, ahead of the packet filter and the sessions of the listener, but
+// pass the source filter and the packet rate limit of SetSourceLimits, and a
+// new allocation takes from the new session rate limit. A peer address holds
+// one allocation and should not also have a session with the listener.
+// Packets over the limits and binds failing authentication are dropped and
+// counted in InSourceDrops, and an allocation which relayed Bytes is removed.
+func (l *Listener) SetRelay(secret []byte, limits *RelayLimits) error {
+	if limits == nil {
+		l.relay.Store(nil)
+		return nil
+	}
+	if len(secret) < minRelaySecret {
+		return errors.Errorf("relay secret must be at least %d bytes", minRelaySecret)
+	}
+	if limits.Allocations < 0 || limits.BytesPerSec < 0 || limits.Bytes < 0 || limits.Idle < 0 {
+		return errors.New("relay limits must not be negative")
+	}
+	t := &relayTable{secret: append([]byte(nil), secret...), limits: *limits, allocs: make(map[RelayToken]*relayAlloc), peers: make(map[netip.AddrPort]*relayAlloc)}
+	if t.limits.Allocations == 0 {
+		t.limits.Allocations = relayTableLimit
+	}
+	if t.limits.Idle == 0 {
+		t.limits.Idle = relayIdle
+	}
+	l.relay.Store(t)
+	return nil
+}
+
+// relayPacket handles the packet if it is relay traffic, and reports whether
+// it was consumed
+func (l *Listener) relayPacket(raw []byte, addr net.Addr) bool {
+	t := l.relay.Load()
+	if t == nil {
+		return false
+	}
+	from := addrKey(addr)
+	if token, ok := parseRelayBind(raw); ok {
+		now := time.Now()
+		if !t.authentic(raw, now) {
+			atomic.AddUint64(&l.Snmp().InSourceDrops, 1)
+			return true
+		}
+		if !l.admitPacket(addr) || !t.bound(token, from) && !l.admitSession(from.Addr()) {
+			return true
+		}
+		if reply := t.bind(token, from, now); reply != nil {
+			l.conn.WriteTo(reply, addr)
+		}
+		return true
+	}
+	to, relayed, ok := t.forward(from, len(raw), time.Now())
+	if !ok {
+		return false
+	}
+	if !l.admitPacket(addr) {
+		return true
+	}
+	if relayed {
+		l.conn.WriteTo(raw, net.UDPAddrFromAddrPort(to))
+	} else {
+		atomic.AddUint64(&l.Snmp().InSourceDrops, 1)
+	}
+	return true
+}
+
+// authentic reports whether a bind carries the MAC of the relay secret and a
+// time within relayBindWindow of 'now'
+func (t *relayTable) authentic(bind []byte, now time.Time) bool {
+	sent := time.Unix(int64(binary.BigEndian.Uint64(bind[21:29])), 0)
+	if d := now.Sub(sent); d > relayBindWindow || d < -relayBindWindow {
+		return false
+	}
+	return hmac.Equal(bind[29:], relayBindMAC(t.secret, bind[:29]))
+}
+
+// bound reports whether the peer at 'from' already holds the allocation of
+// 'token', so its repeated binds are not new allocations
+func (t *relayTable) bound(token RelayToken, from netip.AddrPort) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.peers[from]
+	return ok && a.token == token
+}
+
+// bind adds the peer at 'from' to the allocation of 'token' and returns the
+// reply, nil if the allocation is full or none can be created
+func (t *relayTable) bind(token RelayToken, from netip.AddrPort, now time.Time) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if a, ok := t.peers[from]; ok && a.token != token {
+		t.remove(a) // the peer moved to another allocation
+	}
+	a, ok := t.allocs[token]
+	if ok && now.Sub(a.last) > t.limits.Idle {
+		t.remove(a)
+		ok = false
+	}
+	if !ok {
+		if len(t.allocs) >= t.limits.Allocations && !t.sweep(now) {
+			return nil
+		}
+		a = &relayAlloc{token: token, peers: [2]netip.AddrPort{from}}
+		if t.limits.BytesPerSec > 0 {
+			a.rate = newTokenBucket(t.limits.BytesPerSec)
+		}
+		t.allocs[token] = a
+		t.peers[from] = a
+	}
+	index := 0
+	switch {
+	case a.peers[0] == from:
+	case a.peers[1] == from:
+		index = 1
+	case !a.peers[1].IsValid():
+		a.peers[1] = from
+		t.peers[from] = a
+		index = 1
+	default:
+		return nil
+	}
+	a.last = now
+	reply := append(append(append([]byte(nil), relayMagic...), relayBound), token[:]...)
+	paired := byte(0)
+	if a.peers[1].IsValid() {
+		paired = 1
+	}
+	return append(reply, byte(index), paired)
+}
+
+// forward returns the peer a packet of 'size' bytes from 'from' is relayed
+// to, with 'relayed' false if the limits drop it, and 'ok' false if 'from'
+// holds no allocation
+func (t *relayTable) forward(from netip.AddrPort, size int, now time.Time) (to netip.AddrPort, relayed, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.peers[from]
+	if !ok {
+		return to, false, false
+	}
+	if now.Sub(a.last) > t.limits.Idle {
+		t.remove(a)
+		return to, false, false
+	}
+	a.last = now
+	if !a.peers[1].IsValid() {
+		return to, false, true
+	}
+	if a.rate != nil && !a.rate.allow(size) {
+		return to, false, true
+	}
+	a.relayed += int64(size)
+	if t.limits.Bytes > 0 && a.relayed > t.limits.Bytes {
+		t.remove(a)
+		return to, false, true
+	}
+	if a.peers[0] == from {
+		return a.peers[1], true, true
+	}
+	return a.peers[0], true, true
+}
+
+// remove forgets an allocation, the caller must hold the lock
+func (t *relayTable) remove(a *relayAlloc) {
+	delete(t.allocs, a.token)
+	for _, p := range a.peers {
+		if t.peers[p] == a {
+			delete(t.peers, p)
+		}
+	}
+}
+
+// sweep removes the expired allocations, at most once per second, and
+// reports whether there is room for another. The caller must hold the lock.
+func (t *relayTable) sweep(now time.Time) bool {
+	if now.Sub(t.swept) >= time.Second {
+		t.swept = now
+		for _, a := range t.allocs {
+			if now.Sub(a.last) > t.limits.Idle {
+				t.remove(a)
+			}
+		}
+	}
+	return len(t.allocs) < t.limits.Allocations
+}
+
+// parseRelayBind returns the token of a bind packet, not yet authenticated
+func parseRelayBind(b []byte) (token RelayToken, ok bool) {
+	if len(b) != relayBindSize || !bytes.Equal(b[:len(relayMagic)], relayMagic) || b[4] != relayBind {
+		return token, false
+	}
+	copy(token[:], b[5:21])
+	return token, true
+}
+
+// relayBindMAC returns the MAC of the magic, kind, token and time of a bind
+func relayBindMAC(secret, msg []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	return mac.Sum(nil)[:relayMACSize]
+}
+
+// newRelayBind returns a bind for 'token' sent at 'now'
+func newRelayBind(secret []byte, token RelayToken, now time.Time) []byte {
+	bind := append(append(append([]byte(nil), relayMagic...), relayBind), token[:]...)
+	bind = binary.BigEndian.AppendUint64(bind, uint64(now.Unix()))
+	return append(bind, relayBindMAC(secret, bind)...)
+}
+
+// DialRelay opens a session to a peer through the relay at 'relay', a listener
+// with SetRelay, when Punch fails. Both peers call it with the secret of the
+// relay, the same token and the same key in the config, and are paired on the
+// allocation of the token; packets between them cross the relay still
+// encrypted. The peer which bound first is the initiator, as for Punch. Binds
+// are sent until the other peer binds or the context is done, so the clock of
+// the peers must be within 30 seconds of the relay's.
+func DialRelay(ctx context.Context, conn net.PacketConn, relay string, secret []byte, token RelayToken, config *Config) (s *UDPSession, initiator bool, err error) {
+	if err := config.Validate(); err != nil {
+		return nil, false, err
+	}
+	if len(secret) < minRelaySecret {
+		return nil, false, errors.Errorf("relay secret must be at least %d bytes", minRelaySecret)
+	}
+	if len(config.Versions) > 0 || config.Compression {
+		return nil, false, errors.New("version negotiation, and Compression with it, needs a listener")
+	}
+	raddr, err := resolveFamily(ctx, relay, conn.LocalAddr())
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	replies := make(chan [2]byte, 16)
+	r := startReader(conn, func(b []byte, addr net.Addr) {
+		if len(b) == relayBoundSize && bytes.Equal(b[:len(relayMagic)], relayMagic) && b[4] == relayBound &&
+			bytes.Equal(b[5:21], token[:]) && addrKey(addr) == addrKey(raddr) {
+			select {
+			case replies <- [2]byte{b[21], b[22]}:
+			default:
+			}
+		}
+	})
+	index, err := bindRelay(ctx, conn, raddr, secret, token, replies, r.done)
+	if readErr := r.stop(); err != nil && readErr != nil {
+		return nil, false, readErr
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	s, err = dialWithConn(conn, raddr, config, binary.LittleEndian.Uint32(token[:]))
+	return s, index == 0, err
+}
+
+// bindRelay sends binds until the relay pairs the allocation, and returns the
+// position of this peer
+func bindRelay(ctx context.Context, conn net.PacketConn, raddr net.Addr, secret []byte, token RelayToken, replies <-chan [2]byte, failed <-chan struct{}) (byte, error) {
+	ticker := time.NewTicker(relayBindInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := conn.WriteTo(newRelayBind(secret, token, time.Now()), raddr); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		for wait := true; wait; {
+			select {
+			case <-ctx.Done():
+				return 0, errors.WithStack(ctx.Err())
+			case <-failed:
+				return 0, errors.New("socket read failed")
+			case reply := <-replies:
+				if reply[1] == 1 {
+					return reply[0], nil
+				}
+			case <-ticker.C:
+				wait = false
+			}
+		}
+	}
+}
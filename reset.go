@@ -0,0 +1,148 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-11 16:20:37
+@Description: Reset of conversations refused or unknown to listeners
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// resetTokenSize is the token carried in the ts, sn and una fields of an
+	// IKCP_CMD_RESET or IKCP_CMD_TOKEN segment without data
+	resetTokenSize = 12
+
+	// resetTokenSends is the number of flushes of a new session which announce
+	// its reset token, so it reaches the client despite some loss
+	resetTokenSends = 4
+
+	// minResetKeySize is the minimum length of the secret of stateless resets
+	minResetKeySize = 16
+)
+
+// resetKey derives the reset tokens of a listener's conversations
+type resetKey struct {
+	macs sync.Pool // hash.Hash, HMAC-SHA256 with the secret of the listener
+}
+
+// token returns the reset token of conversation 'conv'
+func (k *resetKey) token(conv uint32) []byte {
+	var msg [4]byte
+	binary.LittleEndian.PutUint32(msg[:], conv)
+
+	mac := k.macs.Get().(hash.Hash)
+	defer k.macs.Put(mac)
+	mac.Reset()
+	mac.Write(msg[:])
+	return mac.Sum(nil)[:resetTokenSize]
+}
+
+// SetStatelessReset makes the listener answer the packets of conversations it
+// has no session for with a reset authenticated by 'key', a secret of at least
+// 16 bytes, so that after a restart the clients fail with ErrReset at once
+// instead of retransmitting until they time out. nil disables the resets,
+// which is the default.
+//
+// Each new session announces its token, derived from the key and the
+// conversation, to the client, and only resets carrying the token end an
+// established session. The key must therefore be kept across restarts and
+// shared by the shards and the instances serving the same clients, but not
+// with the clients.
+//
+// A packet is reset only if it acknowledges data of the listener, so new
+// conversations whose first packets arrive out of order are not mistaken for
+// stale ones, and sessions which never receive anything cannot be reset. The
+// reset is no larger than the packet, and resets are counted in
+// StatelessResets.
+func (l *Listener) SetStatelessReset(key []byte) error {
+	if key == nil {
+		l.resetKey.Store(nil)
+		return nil
+	}
+	if len(key) < minResetKeySize {
+		return errors.Errorf("reset key of %d bytes, must be at least %d", len(key), minResetKeySize)
+	}
+	secret := append([]byte(nil), key...)
+	l.resetKey.Store(&resetKey{macs: sync.Pool{New: func() any { return hmac.New(sha256.New, secret) }}})
+	return nil
+}
+
+// putToken writes 'token' into the ts, sn and una fields of 'seg'
+func putToken(seg *segment, token []byte) {
+	seg.ts = binary.LittleEndian.Uint32(token)
+	seg.sn = binary.LittleEndian.Uint32(token[4:])
+	seg.una = binary.LittleEndian.Uint32(token[8:])
+}
+
+// reset tells the client of conversation 'conv' at 'addr' that the listener
+// refuses it, with the token of the conversation if stateless resets are on
+func (l *Listener) reset(addr net.Addr, dst pktinfo, conv uint32) {
+	seg := segment{conv: conv, cmd: IKCP_CMD_RESET}
+	if k := l.resetKey.Load(); k != nil {
+		putToken(&seg, k.token(conv))
+	}
+	l.writeBare(&seg, addr, dst)
+}
+
+// statelessReset answers a KCP packet of conversation 'conv' the listener has
+// no session for, it reports whether the packet was stale and answered
+func (l *Listener) statelessReset(kcpPacket []byte, addr net.Addr, dst pktinfo, conv uint32) bool {
+	if l.resetKey.Load() == nil || len(kcpPacket) < IKCP_OVERHEAD || kcpPacket[4] == IKCP_CMD_COOKIE {
+		return false // the fields of a cookie are its MAC
+	}
+	if binary.LittleEndian.Uint32(kcpPacket[IKCP_SN_OFFSET+4:]) == 0 {
+		return false // una, nothing of the listener acknowledged
+	}
+	atomic.AddUint64(&l.Snmp().StatelessResets, 1)
+	l.reset(addr, dst, conv)
+	return true
+}
+
+// announceReset makes a new session of the listener announce the reset token
+// of its conversation in its first flushes
+func (l *Listener) announceReset(s *UDPSession) {
+	if k := l.resetKey.Load(); k != nil {
+		s.kcp.reset_token = k.token(s.kcp.conv)
+		s.kcp.reset_token_sends = resetTokenSends
+	}
+}
+
+// onResetToken is invoked by KCP with the session lock held, with the reset
+// token announced by the listener on the client
+func (s *UDPSession) onResetToken(token []byte) {
+	if s.l != nil {
+		return
+	}
+	s.resetToken = append(s.resetToken[:0], token...)
+}
+
+// onReset is invoked by KCP with the session lock held, with the token of a
+// reset from the listener on the client. A reset with the token announced by
+// the listener ends the session at any time. Any other reset is trusted only
+// before the listener has answered anything, it cannot end a session the
+// listener knows.
+func (s *UDPSession) onReset(token []byte) {
+	if s.l != nil {
+		return
+	}
+	authentic := s.resetToken != nil && hmac.Equal(token, s.resetToken)
+	if !authentic && (s.kcp.rcv_nxt != 0 || s.kcp.snd_una != 0) {
+		return
+	}
+	err := errors.Wrapf(ErrReset, "by %v", s.remoteAddr())
+	s.logEvent("%v", err)
+	s.notifyReadError(err)
+	s.notifyWriteError(err)
+}
@@ -0,0 +1,191 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 21:02:37
+@Description: Listener sharded over SO_REUSEPORT sockets
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// listenerGroup is the set of shards of a ShardedListener, each conversation
+// belongs to the shard picked by a consistent hash of its id.
+type listenerGroup struct {
+	shards []*Listener
+}
+
+// owner returns the shard of the conversation 'conv'
+func (g *listenerGroup) owner(conv uint32) *Listener {
+	return g.shards[jumpHash(uint64(conv), len(g.shards))]
+}
+
+// sessionByAddr returns the session of a remote address in any shard
+func (g *listenerGroup) sessionByAddr(key netip.AddrPort) *UDPSession {
+	for _, l := range g.shards {
+		l.sessionLock.RLock()
+		s := l.sessionAddrs[key]
+		l.sessionLock.RUnlock()
+		if s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// jumpHash is the jump consistent hash of Lamping and Veach, it maps 'key' to
+// one of 'buckets' and moves few keys when the number of buckets changes.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// ShardedListener is a Listener spread over several UDP sockets bound to the
+// same port with SO_REUSEPORT, each read by its own goroutine, so that a single
+// port scales across cores. The kernel spreads the packets over the sockets by
+// address, and a packet reaching another shard than the one owning its
+// conversation is passed over, which keeps sessions in place when their
+// address changes.
+type ShardedListener struct {
+	group *listenerGroup
+}
+
+// ListenReusePort listens on "laddr" with 'shards' sockets sharing the port,
+// 0 for one per CPU. The other parameters are those of ListenWithOptions.
+//
+// SO_REUSEPORT is supported on linux and the BSDs, ListenReusePort fails
+// elsewhere.
+func ListenReusePort(laddr string, shards int, block BlockCrypt, dataShards, parityShards int) (*ShardedListener, error) {
+	if err := checkFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+	if shards <= 0 {
+		shards = runtime.NumCPU()
+	}
+
+	var conns []net.PacketConn
+	for i := 0; i < shards; i++ {
+		conn, err := listenReusePort(laddr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, errors.WithStack(err)
+		}
+		// bind the other shards to the port picked for the first one
+		laddr = conn.LocalAddr().String()
+		conns = append(conns, conn)
+	}
+
+	sl := newShardedListener(conns, block, dataShards, parityShards)
+	sl.start()
+	return sl, nil
+}
+
+// newShardedListener creates a sharded listener on 'conns', one shard each,
+// without starting the read loops
+func newShardedListener(conns []net.PacketConn, block BlockCrypt, dataShards, parityShards int) *ShardedListener {
+	g := new(listenerGroup)
+	accepts := make(chan *UDPSession, acceptBacklog)
+	for _, conn := range conns {
+		l := newListener(block, dataShards, parityShards, conn, true)
+		l.chAccepts = accepts
+		l.group = g
+		g.shards = append(g.shards, l)
+	}
+	return &ShardedListener{g}
+}
+
+// start starts the read loops of the shards
+func (sl *ShardedListener) start() {
+	for _, l := range sl.group.shards {
+		go l.monitor()
+	}
+}
+
+// Shards returns the listeners of the shards to configure them, sessions are
+// accepted from the ShardedListener.
+func (sl *ShardedListener) Shards() []*Listener {
+	return append([]*Listener(nil), sl.group.shards...)
+}
+
+// Accept implements the Accept method in the Listener interface
+func (sl *ShardedListener) Accept() (net.Conn, error) {
+	return sl.AcceptKCP()
+}
+
+// AcceptKCP accepts a KCP connection from any of the shards
+func (sl *ShardedListener) AcceptKCP() (*UDPSession, error) {
+	return sl.group.shards[0].AcceptKCP()
+}
+
+// AcceptContext accepts a session from any of the shards, see Listener.AcceptContext
+func (sl *ShardedListener) AcceptContext(ctx context.Context) (*UDPSession, error) {
+	return sl.group.shards[0].AcceptContext(ctx)
+}
+
+// SetDeadline sets the deadline for Accept, a zero time value disables it
+func (sl *ShardedListener) SetDeadline(t time.Time) error {
+	return sl.group.shards[0].SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Accept
+func (sl *ShardedListener) SetReadDeadline(t time.Time) error {
+	return sl.group.shards[0].SetReadDeadline(t)
+}
+
+// Close closes all the shards and their sockets
+func (sl *ShardedListener) Close() error {
+	var err error
+	for _, l := range sl.group.shards {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Sessions returns a snapshot of the open sessions of all the shards, see Listener.Sessions
+func (sl *ShardedListener) Sessions() []SessionInfo {
+	var infos []SessionInfo
+	for _, l := range sl.group.shards {
+		infos = append(infos, l.Sessions()...)
+	}
+	return infos
+}
+
+// Shutdown closes all the shards gracefully, see Listener.Shutdown
+func (sl *ShardedListener) Shutdown(ctx context.Context) error {
+	for _, l := range sl.group.shards {
+		l.stopAccepting()
+	}
+	var err error
+	for _, l := range sl.group.shards {
+		if err == nil {
+			err = l.drain(ctx)
+		}
+	}
+	for _, l := range sl.group.shards {
+		l.closeSessions()
+		if e := l.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Addr returns the listener's network address, shared by all the shards
+func (sl *ShardedListener) Addr() net.Addr { return sl.group.shards[0].Addr() }
@@ -0,0 +1,21 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-28 21:06:44
+@Description: SO_REUSEPORT sockets, unsupported
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// listenReusePort fails, SO_REUSEPORT is not available on this platform
+func listenReusePort(laddr string) (net.PacketConn, error) {
+	return nil, errors.New("SO_REUSEPORT not supported")
+}
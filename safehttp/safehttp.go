@@ -0,0 +1,29 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 15:52:10
+@Description: HTTP transport over stream connections
+@Language: Go 1.23.4
+*/
+
+// Package safehttp carries HTTP clients over the stream connections of
+// safe-udp. It is apart from safeudp so that programs without HTTP do not
+// carry net/http.
+package safehttp
+
+import (
+	"net/http"
+
+	safeudp "safe-udp"
+)
+
+// NewTransport returns an http.RoundTripper carrying the requests over
+// streams dialed by safeudp.HTTPDialer, with the settings of
+// http.DefaultTransport otherwise, except that proxies are not used:
+//
+//	client := &http.Client{Transport: safehttp.NewTransport(config)}
+func NewTransport(config *safeudp.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = safeudp.HTTPDialer(config)
+	return t
+}
@@ -0,0 +1,53 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 15:52:10
+@Description: HTTP transport tests
+@Language: Go 1.23.4
+*/
+
+package safehttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+// TestNewTransport 测试HTTP客户端通过流连接访问服务器，且不经过代理
+func TestNewTransport(t *testing.T) {
+	config := &safeudp.Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if (&safeudp.Config{Key: make([]byte, 16)}).Validate() == nil {
+		config.Key = make([]byte, 32)
+	}
+	sl, err := safeudp.ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go http.Serve(sl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+	transport := NewTransport(config)
+	defer transport.CloseIdleConnections()
+	if transport.Proxy != nil {
+		t.Fatal("proxy in use")
+	}
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := client.Get("http://" + sl.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "GET "+path {
+			t.Fatalf("body %q, %v", body, err)
+		}
+	}
+}
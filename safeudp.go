@@ -10,31 +10,160 @@ package safeudp
 import (
 	"container/heap"
 	"encoding/binary"
+	"slices"
 	"sync/atomic"
 	"time"
+
+	"github.com/xtaci/smux"
 )
 
 func timediff(a, b uint32) int32 {
 	return int32(int64(a) - int64(b))
 }
 
+// Config is the settings of sessions and listeners, it is read from JSON and
+// YAML files by configfile.Load with the names of the tags.
 type Config struct {
 	// Pre-shared key for encryption (32 bytes for AES-256)
-	Key []byte
+	Key []byte `json:"key,omitempty"`
+
+	// Cipher of the key by name, "aes" if empty, see CipherNames
+	Cipher string `json:"cipher,omitempty"`
+
+	// Without a Key the connections of DialStream, DialContext and
+	// ListenStream agree on an ephemeral key, unauthenticated, unless
+	// Plaintext is set. Both ends must agree on it.
+	Plaintext bool `json:"plaintext,omitempty"`
+
+	// Secures the connections of DialStream, DialContext and ListenStream with
+	// the handshake of a backend, such as TLS 1.3 of package tlshandshake or
+	// DTLS of package dtlshandshake, instead of a Key or an ephemeral key.
+	// Both ends must use it, it is not read from config files.
+	Handshake HandshakeBackend `json:"-"`
 
 	// FEC settings
-	FECData   int // Number of data packets in FEC group
-	FECParity int // Number of parity packets in FEC group
+	FECData   int `json:"fec_data,omitempty"`   // Number of data packets in FEC group
+	FECParity int `json:"fec_parity,omitempty"` // Number of parity packets in FEC group
+
+	// Reed-Solomon implementation, both ends must agree on FECBackendLeopard
+	FECBackend FECBackend `json:"fec_backend,omitempty"`
+
+	// Compress payloads with snappy, agreed on in the version negotiation,
+	// which a dialed session starts with SupportedVersions if Versions is
+	// empty; sessions fail with ErrVersion if only one end enables it
+	Compression bool `json:"compression,omitempty"`
 
 	// KCP settings
-	NoDelay      int // Enable nodelay mode
-	Interval     int // Internal update timer interval in millisec
-	Resend       int // Fast resend mode
-	NoCongestion int // Disable congestion control
-
-	// Buffer settings
-	SendBuffer int // Send buffer size
-	RecvBuffer int // Receive buffer size
+	NoDelay      int `json:"no_delay,omitempty"`      // Enable nodelay mode
+	Interval     int `json:"interval,omitempty"`      // Internal update timer interval in millisec
+	Resend       int `json:"resend,omitempty"`        // Fast resend mode
+	NoCongestion int `json:"no_congestion,omitempty"` // Disable congestion control
+
+	// KCP settings above by name, "normal", "fast", "fast2" or "fast3", the
+	// settings set explicitly take precedence, see LookupProfile
+	Profile string `json:"profile,omitempty"`
+
+	// Retransmission timeout in millisec, 0 for the defaults
+	InitialRTO int `json:"initial_rto,omitempty"` // Timeout until the first RTT sample
+	MinRTO     int `json:"min_rto,omitempty"`     // Floor of the timeout, 30 with NoDelay or 100 otherwise by default
+	MaxRTO     int `json:"max_rto,omitempty"`     // Ceiling of the timeout, 60000 by default
+
+	// Retransmit on time based loss detection and tail loss probes, see SetRACK
+	RACK bool `json:"rack,omitempty"`
+
+	// Detect spurious retransmission timeouts, see SetFRTO
+	FRTO bool `json:"frto,omitempty"`
+
+	// Send selective acknowledgement ranges, see SetSACK
+	SACK bool `json:"sack,omitempty"`
+
+	// Unreachable remote detection, 0 for the defaults, see SetMaxRetransmit
+	MaxRetransmit   int `json:"max_retransmit,omitempty"`   // Retransmissions of a segment, 19 by default
+	ProgressTimeout int `json:"progress_timeout,omitempty"` // Millisec without any data acknowledged, unlimited by default
+
+	// Window sizes in packets, 0 for the defaults of 32, see SetWindowSize
+	SendWindow int `json:"send_window,omitempty"`
+	RecvWindow int `json:"recv_window,omitempty"`
+
+	// Bytes per second of a session, 0 for no limit, see SetRateLimit
+	RateLimit        int `json:"rate_limit,omitempty"`         // Outgoing, including retransmissions and FEC parity
+	ReceiveRateLimit int `json:"receive_rate_limit,omitempty"` // Incoming, packets over it are dropped
+
+	// Answer new conversations with a stateless cookie, see Listener.SetStatelessCookies
+	StatelessCookies bool `json:"stateless_cookies,omitempty"`
+
+	// Secret of the stateless resets a listener sends for unknown
+	// conversations, none if empty, see Listener.SetStatelessReset
+	ResetKey []byte `json:"reset_key,omitempty"`
+
+	// Cap on the sessions of a listener, 0 for none, and the policy at the
+	// cap, see Listener.SetMaxSessions
+	MaxSessions int            `json:"max_sessions,omitempty"`
+	Eviction    EvictionPolicy `json:"eviction,omitempty"`
+
+	// Goroutines processing the packets of a listener, see Listener.SetReadWorkers
+	ReadWorkers int `json:"read_workers,omitempty"`
+
+	// Rate limits of a listener per source address, see Listener.SetSourceLimits
+	SourceLimits SourceLimits `json:"source_limits,omitempty"`
+
+	// Sessions of a listener waiting for Accept, 128 if 0, and the policy
+	// when they are as many, see Listener.SetBacklogPolicy
+	Backlog       int           `json:"backlog,omitempty"`
+	BacklogPolicy BacklogPolicy `json:"backlog_policy,omitempty"`
+
+	// Protocol versions offered by a client in order of preference, or accepted
+	// by a listener, see UDPSession.SetVersions
+	Versions []Version `json:"versions,omitempty"`
+
+	// Stream multiplexer of DialStream, DialContext and ListenStream,
+	// smux.DefaultConfig() if nil, both ends must use the same Version
+	Smux *smux.Config `json:"smux,omitempty"`
+
+	// Skip the multiplexer, the Conn of DialStream, DialContext and
+	// ListenStream is the session itself, both ends must set it
+	NoMux bool `json:"no_mux,omitempty"`
+
+	// Experimental subsystems to enable, see Experiment
+	Experimental Experiment `json:"experimental,omitempty"`
+
+	// Keep the packets those of xtaci/kcp-go, to interoperate with kcp-go and
+	// kcptun deployments: Validate rejects the settings changing them, and
+	// the sessions refuse SetSACK, SetChecksum, SetPMTUD and tickets. See
+	// KCPTunKey for the keys of kcptun.
+	KCPCompat bool `json:"kcp_compat,omitempty"`
+
+	// Hop the destination port among the ports "min-max" on a schedule derived
+	// from the Key: clients send to the port of the current interval and
+	// listeners serve the ports of the previous, current and next ones,
+	// ignoring the port of their address. Both ends must use the same range,
+	// interval and Key, and keep their clocks synchronized within an interval.
+	HopPorts    string `json:"hop_ports,omitempty"`
+	HopInterval int    `json:"hop_interval,omitempty"` // Seconds between hops, 30 by default
+
+	// Transport plugin transforming the datagrams on the wire, such as an
+	// obfuscation: the name of a plugin of RegisterPlugin, such as a SIP003
+	// executable of package sip003. PluginOptions are passed to it. Both ends
+	// need matching plugins.
+	Plugin        string `json:"plugin,omitempty"`
+	PluginOptions string `json:"plugin_opts,omitempty"`
+
+	// Socket settings, 0 leaves the system default
+	SendBuffer int `json:"send_buffer,omitempty"` // Send buffer size
+	RecvBuffer int `json:"recv_buffer,omitempty"` // Receive buffer size
+	DSCP       int `json:"dscp,omitempty"`        // 6bit DSCP field in IPv4 header, or Traffic Class in IPv6 header
+
+	// Send and receive through io_uring on linux, see UDPSession.SetIOUring,
+	// batch sends and receives are used where it is unavailable
+	IOUring bool `json:"io_uring,omitempty"`
+
+	// Experimental, for dedicated relay hosts: receive the packets to the port
+	// of a listener on the first XDPQueues receive queues of the interface
+	// through AF_XDP sockets, bypassing the kernel UDP stack, in builds with
+	// the safeudp_xdp tag on linux. Other packets, and those of other queues,
+	// reach the socket as usual; sends always do.
+	XDPInterface string `json:"xdp_interface,omitempty"`
+	XDPQueues    int    `json:"xdp_queues,omitempty"` // 1 by default
 }
 
 const (
@@ -46,6 +175,15 @@ const (
 	IKCP_CMD_ACK     = 82 // cmd: ack
 	IKCP_CMD_WASK    = 83 // cmd: window probe (ask)
 	IKCP_CMD_WINS    = 84 // cmd: window size (tell)
+	IKCP_CMD_PROBE   = 85 // cmd: padded path probe, echoed by peer
+	IKCP_CMD_PACK    = 86 // cmd: path probe acknowledgement
+	IKCP_CMD_DIGEST  = 87 // cmd: end-to-end checksum of the application data
+	IKCP_CMD_TICKET  = 88 // cmd: session ticket, or the verdict of the server on it
+	IKCP_CMD_SACK    = 89 // cmd: ranges of segments received beyond una
+	IKCP_CMD_COOKIE  = 90 // cmd: stateless cookie of the listener in ts, sn and una
+	IKCP_CMD_VERSION = 91 // cmd: protocol versions offered by the client, or the choice of the server
+	IKCP_CMD_RESET   = 92 // cmd: the listener has no session for the conversation, a token in ts, sn and una
+	IKCP_CMD_TOKEN   = 93 // cmd: reset token of the conversation in ts, sn and una
 	IKCP_ASK_SEND    = 1  // need to send IKCP_CMD_WASK
 	IKCP_ASK_TELL    = 2  // need to send IKCP_CMD_WINS
 	IKCP_WND_SND     = 32
@@ -62,6 +200,16 @@ const (
 	IKCP_SN_OFFSET   = 12
 )
 
+// maximum ranges in an IKCP_CMD_SACK segment, each is a pair of 32bit sn
+const sackMaxRanges = 16
+
+// F-RTO states after a retransmission timeout
+const (
+	frtoIdle   = iota // no timeout pending
+	frtoWait          // the oldest segment was retransmitted, the others wait for the next ack
+	frtoResend        // the timeout was genuine, the waiting segments are retransmitted in the next flush
+)
+
 // monotonic reference time point
 var refTime time.Time = time.Now()
 
@@ -156,10 +304,16 @@ func (seg *segment) encode(ptr []byte) []byte {
 	ptr = ikcp_encode32u(ptr, seg.sn)
 	ptr = ikcp_encode32u(ptr, seg.una)
 	ptr = ikcp_encode32u(ptr, uint32(len(seg.data)))
-	atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
 	return ptr
 }
 
+// encodeSegment encodes a segment of the connection into buffer and counts it
+func (kcp *KCP) encodeSegment(seg *segment, ptr []byte) []byte {
+	atomic.AddUint64(&kcp.snmp.OutSegs, 1)
+	atomic.AddUint64(&kcp.stats.OutSegs, 1)
+	return seg.encode(ptr)
+}
+
 // segmentHeap is a min-heap of segments, used for receiving segments in order
 type segmentHeap struct {
 	segments []segment
@@ -205,7 +359,8 @@ type KCP struct {
 	snd_una, snd_nxt, rcv_nxt              uint32
 	ssthresh                               uint32
 	rx_rttvar, rx_srtt                     int32
-	rx_rto, rx_minrto                      uint32
+	rx_rto, rx_minrto, rx_maxrto           uint32
+	rto_floor                              uint32 // rx_minrto set by the application, 0 to follow nodelay
 	snd_wnd, rcv_wnd, rmt_wnd, cwnd, probe uint32
 	interval, ts_flush                     uint32
 	nodelay, updated                       uint32
@@ -222,8 +377,52 @@ type KCP struct {
 
 	acklist []ackItem
 
+	out_segs, retrans_segs uint64 // data segments transmitted, and retransmitted by this connection
+
+	probe_echo    []uint32           // tokens of path probes waiting to be acknowledged
+	probe_handler func(token uint32) // called when a path probe is acknowledged by remote
+
+	digest_handler func(data []byte) // called with the end-to-end checksum announced by remote
+
+	loss_handler func(lost, fast, early, rack, tlp uint64) // called with the segments retransmitted by a flush, by cause
+
+	ticket         []byte            // session ticket or verdict sent first in the next flush, nil for none
+	ticket_repeat  bool              // send the ticket in every flush until it is cleared
+	ticket_handler func(data []byte) // called with the session ticket or verdict from remote
+
+	version         []byte                 // version offer or choice sent first in the next flush, nil for none
+	version_repeat  bool                   // send the version offer in every flush until it is cleared
+	version_handler func(data []byte) bool // called with the version offer or choice from remote, false drops the packet
+
+	cookie         []byte              // cookie of the listener, sent ahead of each flush until remote answers
+	cookie_handler func(cookie []byte) // called with the cookie demanded by remote
+
+	reset_token       []byte             // reset token of the conversation, sent ahead of the first flushes
+	reset_token_sends int                // flushes left to announce reset_token in
+	reset_handler     func(token []byte) // called with the token of a reset from remote
+	token_handler     func(token []byte) // called with the reset token announced by remote
+
+	rcv_mem, rcv_mem_limit int // payload bytes held in rcv_buf and rcv_queue, and their cap, 0 for none
+
+	rack     bool   // time based loss detection and tail loss probes
+	rack_ts  uint32 // send time of the most recently sent segment known to be delivered
+	rack_set bool   // rack_ts is set by an acknowledgement
+	ts_ack   uint32 // time of the last acknowledgement received
+	tlp_sent bool   // a tail loss probe is outstanding, cleared by the next acknowledgement
+
+	frto                     bool   // detect spurious retransmission timeouts
+	frto_state               int    // frtoIdle, frtoWait or frtoResend
+	frto_sn, frto_ts         uint32 // segment retransmitted on the timeout, and when
+	frto_cwnd, frto_ssthresh uint32 // congestion state before the timeout, restored if spurious
+
+	sack      bool     // announce the ranges held in rcv_buf along with acks
+	sack_sns  []uint32 // scratch space for sorting rcv_buf
+	sack_data []byte   // encoded ranges of the last IKCP_CMD_SACK
+
 	buffer []byte
 	output output_callback
+	snmp   *Snmp // counters of the connection, DefaultSnmp unless its session has its own
+	stats  *Snmp // counters of the connection alone, those of its session
 }
 
 type ackItem struct {
@@ -239,6 +438,7 @@ type ackItem struct {
 func NewKCP(conv uint32, output output_callback) *KCP {
 	kcp := new(KCP)
 	kcp.conv = conv
+	kcp.snmp, kcp.stats = DefaultSnmp, new(Snmp)
 	kcp.snd_wnd = IKCP_WND_SND
 	kcp.rcv_wnd = IKCP_WND_RCV
 	kcp.rmt_wnd = IKCP_WND_RCV
@@ -247,6 +447,7 @@ func NewKCP(conv uint32, output output_callback) *KCP {
 	kcp.buffer = make([]byte, kcp.mtu)
 	kcp.rx_rto = IKCP_RTO_DEF
 	kcp.rx_minrto = IKCP_RTO_MIN
+	kcp.rx_maxrto = IKCP_RTO_MAX
 	kcp.interval = IKCP_INTERVAL
 	kcp.ts_flush = IKCP_INTERVAL
 	kcp.ssthresh = IKCP_THRESH_INIT
@@ -315,7 +516,7 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	}
 
 	var fast_recover bool
-	if kcp.rcv_queue.Len() >= int(kcp.rcv_wnd) {
+	if kcp.wnd_unused() == 0 {
 		fast_recover = true
 	}
 
@@ -329,6 +530,7 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 		copy(buffer, seg.data)
 		buffer = buffer[len(seg.data):]
 		n += len(seg.data)
+		kcp.rcv_mem -= len(seg.data)
 		kcp.recycleSegment(&seg)
 		if seg.frg == 0 {
 			break
@@ -349,7 +551,7 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	}
 
 	// fast recover
-	if kcp.rcv_queue.Len() < int(kcp.rcv_wnd) && fast_recover {
+	if kcp.wnd_unused() > 0 && fast_recover {
 		// ready to send back IKCP_CMD_WINS in ikcp_flush
 		// tell remote my window size
 		kcp.probe |= IKCP_ASK_TELL
@@ -448,7 +650,111 @@ func (kcp *KCP) update_ack(rtt int32) {
 		}
 	}
 	rto = uint32(kcp.rx_srtt) + _imax_(kcp.interval, uint32(kcp.rx_rttvar)<<2)
-	kcp.rx_rto = _ibound_(kcp.rx_minrto, rto, IKCP_RTO_MAX)
+	kcp.rx_rto = _ibound_(kcp.rx_minrto, rto, kcp.rx_maxrto)
+}
+
+// SetRTO sets the initial retransmission timeout used until the first RTT
+// sample, and the floor and ceiling of the timeout, in millisec. A value of 0
+// keeps the current setting, a floor set here is kept by NoDelay.
+func (kcp *KCP) SetRTO(initial, minrto, maxrto int) {
+	if minrto > 0 {
+		kcp.rto_floor = uint32(minrto)
+		kcp.rx_minrto = uint32(minrto)
+	}
+	if maxrto > 0 {
+		kcp.rx_maxrto = uint32(maxrto)
+	}
+	if kcp.rx_minrto > kcp.rx_maxrto {
+		kcp.rx_minrto = kcp.rx_maxrto
+	}
+	if initial > 0 && kcp.rx_srtt == 0 {
+		kcp.rx_rto = uint32(initial)
+	}
+	kcp.rx_rto = _ibound_(kcp.rx_minrto, kcp.rx_rto, kcp.rx_maxrto)
+}
+
+// SeedRTT takes 'rtt' in millisec, measured out of band such as by a handshake,
+// as the first RTT sample if none has been taken yet.
+func (kcp *KCP) SeedRTT(rtt int32) {
+	if kcp.rx_srtt == 0 && rtt > 0 {
+		kcp.update_ack(rtt)
+	}
+}
+
+// SetRACK enables time based loss detection and tail loss probes. A segment
+// is retransmitted once a segment sent after it is acknowledged and a quarter
+// RTT has passed, and the newest segment is sent again if no acknowledgement
+// arrives for two RTTs, so losses at the end of a flight are recovered in
+// about one RTT instead of an RTO. Only the sender is involved.
+func (kcp *KCP) SetRACK(enable bool) {
+	kcp.rack = enable
+	kcp.tlp_sent = false
+}
+
+// SetSACK enables selective acknowledgement ranges. While segments wait in
+// rcv_buf for a missing one, every flush with acks also carries the ranges of
+// sn received beyond una, so the remote marks them delivered even if their own
+// acks were lost, and retransmits only the missing segments. The remote must
+// understand IKCP_CMD_SACK, which every version with this option does.
+func (kcp *KCP) SetSACK(enable bool) {
+	kcp.sack = enable
+}
+
+// SetFRTO enables the detection of spurious retransmission timeouts. On a
+// timeout only the oldest segment is retransmitted, and the first ack decides:
+// if it acknowledges a transmission from before the timeout, the timeout came
+// from a delay spike, the congestion window is restored and the other segments
+// are not retransmitted, otherwise they are retransmitted at once.
+func (kcp *KCP) SetFRTO(enable bool) {
+	kcp.frto = enable
+	kcp.frto_state = frtoIdle
+}
+
+// frto_timeout is called for a segment whose retransmission timer expired, it
+// returns true if the retransmission waits for the next ack
+func (kcp *KCP) frto_timeout(seg *segment, current uint32) bool {
+	if !kcp.frto {
+		return false
+	}
+
+	switch {
+	case kcp.frto_state == frtoIdle:
+		kcp.frto_state = frtoWait
+		kcp.frto_sn, kcp.frto_ts = seg.sn, current
+		kcp.frto_cwnd, kcp.frto_ssthresh = kcp.cwnd, kcp.ssthresh
+		return false
+	case kcp.frto_state == frtoWait && seg.sn != kcp.frto_sn:
+		seg.resendts = current + seg.rto
+		return true
+	case kcp.frto_state == frtoWait:
+		// timed out again without any ack, the path is down rather than slow
+		kcp.frto_state = frtoIdle
+	}
+	return false
+}
+
+// frto_ack decides on the pending timeout with the timestamp echoed by the first ack
+func (kcp *KCP) frto_ack(ts uint32) {
+	if _itimediff(ts, kcp.frto_ts) < 0 {
+		// a transmission from before the timeout arrived
+		kcp.frto_state = frtoIdle
+		if kcp.nocwnd == 0 {
+			kcp.cwnd = _imax_(kcp.cwnd, kcp.frto_cwnd)
+			kcp.ssthresh = _imax_(kcp.ssthresh, kcp.frto_ssthresh)
+			kcp.incr = kcp.cwnd * kcp.mss
+		}
+		atomic.AddUint64(&kcp.snmp.SpuriousRTOs, 1)
+		atomic.AddUint64(&kcp.stats.SpuriousRTOs, 1)
+		return
+	}
+
+	kcp.frto_state = frtoResend
+	current := currentMs()
+	for seg := range kcp.snd_buf.ForEach {
+		if seg.acked == 0 && seg.xmit > 0 && _itimediff(seg.ts, kcp.frto_ts) < 0 {
+			seg.resendts = current
+		}
+	}
 }
 
 func (kcp *KCP) shrink_buf() {
@@ -494,6 +800,51 @@ func (kcp *KCP) parse_fastack(sn, ts uint32) {
 	}
 }
 
+// sack_ranges encodes the runs of consecutive sn in rcv_buf as [first, last]
+// pairs, the oldest first, at most sackMaxRanges of them
+func (kcp *KCP) sack_ranges() []byte {
+	sns := kcp.sack_sns[:0]
+	for _, seg := range kcp.rcv_buf.segments {
+		sns = append(sns, seg.sn)
+	}
+	slices.SortFunc(sns, func(a, b uint32) int { return int(_itimediff(a, b)) })
+	kcp.sack_sns = sns
+
+	data := kcp.sack_data[:0]
+	for i := 0; i < len(sns) && len(data) < sackMaxRanges*8; {
+		j := i
+		for j+1 < len(sns) && sns[j+1] == sns[j]+1 {
+			j++
+		}
+		data = binary.LittleEndian.AppendUint32(data, sns[i])
+		data = binary.LittleEndian.AppendUint32(data, sns[j])
+		i = j + 1
+	}
+	kcp.sack_data = data
+	return data
+}
+
+// parse_sack marks the segments in the [first, last] ranges as delivered
+func (kcp *KCP) parse_sack(data []byte) {
+	var sacked uint64
+	for ; len(data) >= 8; data = data[8:] {
+		first := binary.LittleEndian.Uint32(data)
+		last := binary.LittleEndian.Uint32(data[4:])
+		for seg := range kcp.snd_buf.ForEach {
+			if _itimediff(seg.sn, last) > 0 {
+				break
+			}
+			if _itimediff(seg.sn, first) >= 0 && seg.acked == 0 {
+				seg.acked = 1
+				kcp.recycleSegment(seg)
+				sacked++
+			}
+		}
+	}
+	atomic.AddUint64(&kcp.snmp.SACKSegs, sacked)
+	atomic.AddUint64(&kcp.stats.SACKSegs, sacked)
+}
+
 func (kcp *KCP) parse_una(una uint32) int {
 	count := 0
 	for seg := range kcp.snd_buf.ForEach {
@@ -527,6 +878,7 @@ func (kcp *KCP) parse_data(newseg segment) bool {
 		dataCopy := xmitBuf.Get().([]byte)[:len(newseg.data)]
 		copy(dataCopy, newseg.data)
 		newseg.data = dataCopy
+		kcp.rcv_mem += len(dataCopy)
 
 		// insert the new segment into rcv_buf
 		heap.Push(kcp.rcv_buf, newseg)
@@ -562,6 +914,7 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 
 	var latest uint32 // the latest ack packet
 	var flag int
+	var challenged, answered bool // a cookie was demanded, other segments arrived
 	var inSegs uint64
 	var windowSlides bool
 
@@ -591,10 +944,60 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		}
 
 		if cmd != IKCP_CMD_PUSH && cmd != IKCP_CMD_ACK &&
-			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS {
+			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS &&
+			cmd != IKCP_CMD_PROBE && cmd != IKCP_CMD_PACK &&
+			cmd != IKCP_CMD_DIGEST && cmd != IKCP_CMD_TICKET &&
+			cmd != IKCP_CMD_SACK && cmd != IKCP_CMD_COOKIE &&
+			cmd != IKCP_CMD_VERSION && cmd != IKCP_CMD_RESET &&
+			cmd != IKCP_CMD_TOKEN {
 			return -3
 		}
 
+		// the fields of a cookie carry the MAC, not the state of the sender
+		if cmd == IKCP_CMD_COOKIE {
+			if kcp.cookie_handler != nil {
+				var cookie [cookieSize]byte
+				binary.LittleEndian.PutUint32(cookie[:], ts)
+				binary.LittleEndian.PutUint32(cookie[4:], sn)
+				binary.LittleEndian.PutUint32(cookie[8:], una)
+				kcp.cookie_handler(cookie[:])
+			}
+			challenged = true
+			inSegs++
+			data = data[length:]
+			continue
+		}
+
+		// nor do the fields of a reset
+		if cmd == IKCP_CMD_RESET {
+			if kcp.reset_handler != nil {
+				var token [resetTokenSize]byte
+				binary.LittleEndian.PutUint32(token[:], ts)
+				binary.LittleEndian.PutUint32(token[4:], sn)
+				binary.LittleEndian.PutUint32(token[8:], una)
+				kcp.reset_handler(token[:])
+			}
+			inSegs++
+			data = data[length:]
+			continue
+		}
+
+		// nor do the fields of a reset token, announced by the session
+		if cmd == IKCP_CMD_TOKEN {
+			if kcp.token_handler != nil {
+				var token [resetTokenSize]byte
+				binary.LittleEndian.PutUint32(token[:], ts)
+				binary.LittleEndian.PutUint32(token[4:], sn)
+				binary.LittleEndian.PutUint32(token[8:], una)
+				kcp.token_handler(token[:])
+			}
+			answered = true
+			inSegs++
+			data = data[length:]
+			continue
+		}
+		answered = true
+
 		// only trust window updates from regular packets. i.e: latest update
 		if regular {
 			kcp.rmt_wnd = uint32(wnd)
@@ -609,9 +1012,17 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 			kcp.parse_fastack(sn, ts)
 			flag |= 1
 			latest = ts
+			// the timestamp echoes the transmission which arrived, so
+			// retransmissions cannot confuse it
+			if !kcp.rack_set || _itimediff(ts, kcp.rack_ts) > 0 {
+				kcp.rack_ts, kcp.rack_set = ts, true
+			}
+			if kcp.frto_state == frtoWait {
+				kcp.frto_ack(ts)
+			}
 		} else if cmd == IKCP_CMD_PUSH {
 			repeat := true
-			if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) < 0 {
+			if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) < 0 && kcp.rcv_mem_admit(sn, length) {
 				kcp.ack_push(sn, ts)
 				if _itimediff(sn, kcp.rcv_nxt) >= 0 {
 					var seg segment
@@ -627,7 +1038,8 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 				}
 			}
 			if regular && repeat {
-				atomic.AddUint64(&DefaultSnmp.RepeatSegs, 1)
+				atomic.AddUint64(&kcp.snmp.RepeatSegs, 1)
+				atomic.AddUint64(&kcp.stats.RepeatSegs, 1)
 			}
 		} else if cmd == IKCP_CMD_WASK {
 			// ready to send back IKCP_CMD_WINS in Ikcp_flush
@@ -635,6 +1047,27 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 			kcp.probe |= IKCP_ASK_TELL
 		} else if cmd == IKCP_CMD_WINS {
 			// do nothing
+		} else if cmd == IKCP_CMD_PROBE {
+			// echo the token in next flush, the padding is discarded
+			kcp.probe_echo = append(kcp.probe_echo, sn)
+		} else if cmd == IKCP_CMD_PACK {
+			if kcp.probe_handler != nil {
+				kcp.probe_handler(sn)
+			}
+		} else if cmd == IKCP_CMD_DIGEST {
+			if kcp.digest_handler != nil {
+				kcp.digest_handler(data[:length])
+			}
+		} else if cmd == IKCP_CMD_TICKET {
+			if kcp.ticket_handler != nil {
+				kcp.ticket_handler(data[:length])
+			}
+		} else if cmd == IKCP_CMD_SACK {
+			kcp.parse_sack(data[:length])
+		} else if cmd == IKCP_CMD_VERSION {
+			if kcp.version_handler != nil && !kcp.version_handler(data[:length]) {
+				return -3 // the rest is in a format this side does not know
+			}
 		} else {
 			return -3
 		}
@@ -642,7 +1075,18 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		inSegs++
 		data = data[length:]
 	}
-	atomic.AddUint64(&DefaultSnmp.InSegs, inSegs)
+	atomic.AddUint64(&kcp.snmp.InSegs, inSegs)
+	atomic.AddUint64(&kcp.stats.InSegs, inSegs)
+
+	if flag != 0 {
+		kcp.ts_ack = currentMs()
+		kcp.tlp_sent = false
+	}
+
+	// remote has a session for us once it sends anything but a cookie
+	if answered && kcp.cookie != nil {
+		kcp.cookie = nil
+	}
 
 	// update rtt with the latest ts
 	// ignore the FEC packet
@@ -682,7 +1126,7 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		}
 	}
 
-	if windowSlides { // if window has slided, flush
+	if windowSlides || challenged && kcp.cookie != nil { // if window has slided or a cookie is demanded, flush
 		kcp.flush(false)
 	} else if ackNoDelay && len(kcp.acklist) > 0 { // ack immediately
 		kcp.flush(true)
@@ -692,17 +1136,37 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 
 func (kcp *KCP) wnd_unused() uint16 {
 	if kcp.rcv_queue.Len() < int(kcp.rcv_wnd) {
-		return uint16(int(kcp.rcv_wnd) - kcp.rcv_queue.Len())
+		wnd := int(kcp.rcv_wnd) - kcp.rcv_queue.Len()
+		if kcp.rcv_mem_limit > 0 {
+			wnd = min(wnd, max(kcp.rcv_mem_limit-kcp.rcv_mem, 0)/int(kcp.mss))
+			if wnd == 0 && kcp.rcv_mem == 0 {
+				wnd = 1 // a cap below mss still lets one segment through
+			}
+		}
+		return uint16(wnd)
 	}
 	return 0
 }
 
+// rcv_mem_admit reports whether a data segment fits the receive memory cap, the
+// next expected segment is admitted on an empty rcv_queue so out of order
+// segments filling rcv_buf cannot stall delivery.
+func (kcp *KCP) rcv_mem_admit(sn, length uint32) bool {
+	if kcp.rcv_mem_limit <= 0 || kcp.rcv_buf.Has(sn) {
+		return true
+	}
+	if sn == kcp.rcv_nxt && kcp.rcv_queue.Len() == 0 {
+		return true
+	}
+	return kcp.rcv_mem+int(length) <= kcp.rcv_mem_limit
+}
+
 // flush pending data
 func (kcp *KCP) flush(ackOnly bool) uint32 {
 	defer func() {
-		atomic.StoreUint64(&DefaultSnmp.RingBufferSndQueue, uint64(kcp.snd_queue.MaxLen()))
-		atomic.StoreUint64(&DefaultSnmp.RingBufferRcvQueue, uint64(kcp.rcv_queue.MaxLen()))
-		atomic.StoreUint64(&DefaultSnmp.RingBufferSndBuffer, uint64(kcp.snd_buf.MaxLen()))
+		atomic.StoreUint64(&kcp.snmp.RingBufferSndQueue, uint64(kcp.snd_queue.MaxLen()))
+		atomic.StoreUint64(&kcp.snmp.RingBufferRcvQueue, uint64(kcp.rcv_queue.MaxLen()))
+		atomic.StoreUint64(&kcp.snmp.RingBufferSndBuffer, uint64(kcp.snd_buf.MaxLen()))
 	}()
 
 	var seg segment
@@ -714,11 +1178,63 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	buffer := kcp.buffer
 	ptr := buffer
 
+	// the version offer leads, the remote reads the rest of the packet knowing
+	// it comes from a peer of a known protocol
+	if kcp.version != nil {
+		seg.cmd = IKCP_CMD_VERSION
+		seg.data = kcp.version
+		ptr = kcp.encodeSegment(&seg, ptr)
+		ptr = ptr[copy(ptr, seg.data):]
+		seg.cmd, seg.data = IKCP_CMD_ACK, nil
+		if !kcp.version_repeat {
+			kcp.version = nil
+		}
+	}
+
+	// the session ticket goes first, so it reaches the server with the packet
+	// creating the session whichever packet that is
+	if kcp.ticket != nil {
+		seg.cmd = IKCP_CMD_TICKET
+		seg.data = kcp.ticket
+		ptr = kcp.encodeSegment(&seg, ptr)
+		ptr = ptr[copy(ptr, seg.data):]
+		seg.cmd, seg.data = IKCP_CMD_ACK, nil
+		if !kcp.ticket_repeat {
+			kcp.ticket = nil
+		}
+	}
+
+	// output sends the buffer, preceded by the cookie in a packet of its own
+	// so that the listener finds it in the first header, and by the reset
+	// token in another, which peers unaware of it drop whole
+	cookie := kcp.cookie
+	token := kcp.reset_token_sends > 0
+	output := func(size int) {
+		if cookie != nil {
+			var pkt [IKCP_OVERHEAD]byte
+			c := segment{conv: kcp.conv, cmd: IKCP_CMD_COOKIE}
+			putToken(&c, cookie)
+			kcp.encodeSegment(&c, pkt[:])
+			kcp.output(pkt[:], IKCP_OVERHEAD)
+			cookie = nil
+		}
+		if token {
+			var pkt [IKCP_OVERHEAD]byte
+			t := segment{conv: kcp.conv, cmd: IKCP_CMD_TOKEN}
+			putToken(&t, kcp.reset_token)
+			kcp.encodeSegment(&t, pkt[:])
+			kcp.output(pkt[:], IKCP_OVERHEAD)
+			kcp.reset_token_sends--
+			token = false
+		}
+		kcp.output(buffer, size)
+	}
+
 	// makeSpace makes room for writing
 	makeSpace := func(space int) {
 		size := len(buffer) - len(ptr)
 		if size+space > int(kcp.mtu) {
-			kcp.output(buffer, size)
+			output(size)
 			ptr = buffer
 		}
 	}
@@ -727,21 +1243,44 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	flushBuffer := func() {
 		size := len(buffer) - len(ptr)
 		if size > 0 {
-			kcp.output(buffer, size)
+			output(size)
 		}
 	}
 
 	// flush acknowledges
+	acks := len(kcp.acklist)
 	for i, ack := range kcp.acklist {
 		makeSpace(IKCP_OVERHEAD)
 		// filter jitters caused by bufferbloat
 		if _itimediff(ack.sn, kcp.rcv_nxt) >= 0 || len(kcp.acklist)-1 == i {
 			seg.sn, seg.ts = ack.sn, ack.ts
-			ptr = seg.encode(ptr)
+			ptr = kcp.encodeSegment(&seg, ptr)
 		}
 	}
 	kcp.acklist = kcp.acklist[0:0]
 
+	// flush path probe acknowledges
+	for _, token := range kcp.probe_echo {
+		makeSpace(IKCP_OVERHEAD)
+		seg.cmd = IKCP_CMD_PACK
+		seg.sn, seg.ts = token, 0
+		ptr = kcp.encodeSegment(&seg, ptr)
+	}
+	kcp.probe_echo = kcp.probe_echo[0:0]
+	seg.cmd = IKCP_CMD_ACK
+
+	// flush the ranges beyond una, repeated while acks are sent so a lost ack
+	// does not cost a retransmission
+	if acks > 0 && kcp.sack && kcp.rcv_buf.Len() > 0 {
+		seg.cmd = IKCP_CMD_SACK
+		seg.sn, seg.ts = 0, 0
+		seg.data = kcp.sack_ranges()
+		makeSpace(IKCP_OVERHEAD + len(seg.data))
+		ptr = kcp.encodeSegment(&seg, ptr)
+		ptr = ptr[copy(ptr, seg.data):]
+		seg.cmd, seg.data = IKCP_CMD_ACK, nil
+	}
+
 	if ackOnly { // flash remain ack segments
 		flushBuffer()
 		return kcp.interval
@@ -775,14 +1314,14 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	if (kcp.probe & IKCP_ASK_SEND) != 0 {
 		seg.cmd = IKCP_CMD_WASK
 		makeSpace(IKCP_OVERHEAD)
-		ptr = seg.encode(ptr)
+		ptr = kcp.encodeSegment(&seg, ptr)
 	}
 
 	// flush window probing commands
 	if (kcp.probe & IKCP_ASK_TELL) != 0 {
 		seg.cmd = IKCP_CMD_WINS
 		makeSpace(IKCP_OVERHEAD)
-		ptr = seg.encode(ptr)
+		ptr = kcp.encodeSegment(&seg, ptr)
 	}
 
 	kcp.probe = 0
@@ -822,9 +1361,22 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 
 	// check for retransmissions
 	current := currentMs()
-	var change, lostSegs, fastRetransSegs, earlyRetransSegs uint64
+	var change, lostSegs, fastRetransSegs, earlyRetransSegs, rackSegs uint64
 	minrto := int32(kcp.interval)
 
+	// a segment sent before one which was delivered is lost once the
+	// reordering window of a quarter RTT has passed, RACK of RFC 8985
+	rack := kcp.rack && kcp.rx_srtt > 0 && kcp.rack_set
+	rackWait := kcp.rx_srtt + kcp.rx_srtt/4
+	var tail *segment // newest segment in flight, for the tail loss probe
+
+	// the segments held back by F-RTO are retransmitted without another
+	// reduction of the congestion window
+	frtoResend := kcp.frto_state == frtoResend
+	if frtoResend {
+		kcp.frto_state = frtoIdle
+	}
+
 	for segment := range kcp.snd_buf.ForEach {
 		needsend := false
 		if segment.acked == 1 {
@@ -848,34 +1400,47 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			segment.resendts = current + segment.rto
 			change++
 			earlyRetransSegs++
-		} else if _itimediff(current, segment.resendts) >= 0 { // RTO
+		} else if rack && _itimediff(segment.ts, kcp.rack_ts) < 0 &&
+			_itimediff(current, segment.ts) >= rackWait { // time based loss detection
+			needsend = true
+			segment.fastack = 0
+			segment.rto = kcp.rx_rto
+			segment.resendts = current + segment.rto
+			change++
+			rackSegs++
+		} else if _itimediff(current, segment.resendts) >= 0 && (frtoResend || !kcp.frto_timeout(segment, current)) { // RTO
 			needsend = true
 			if kcp.nodelay == 0 {
 				segment.rto += kcp.rx_rto
 			} else {
 				segment.rto += kcp.rx_rto / 2
 			}
+			segment.rto = _imin_(segment.rto, kcp.rx_maxrto)
 			segment.fastack = 0
 			segment.resendts = current + segment.rto
 			lostSegs++
 		}
 
 		if needsend {
+			tail = nil
 			current = currentMs()
 			segment.xmit++
 			segment.ts = current
+			kcp.out_segs++
 			segment.wnd = seg.wnd
 			segment.una = seg.una
 
 			need := IKCP_OVERHEAD + len(segment.data)
 			makeSpace(need)
-			ptr = segment.encode(ptr)
+			ptr = kcp.encodeSegment(segment, ptr)
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
 
 			if segment.xmit >= kcp.dead_link {
 				kcp.state = 0xFFFFFFFF
 			}
+		} else {
+			tail = segment
 		}
 
 		// get the nearest rto
@@ -884,25 +1449,70 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		}
 	}
 
+	// without new data to send, an ack for the newest segment is elicited by
+	// sending it again after two RTTs, so that the losses at the end of a
+	// flight are detected before the RTO
+	var tlpSegs uint64
+	if kcp.rack && !kcp.tlp_sent && tail != nil && newSegsCount == 0 && kcp.snd_queue.Len() == 0 && kcp.rx_srtt > 0 {
+		since := tail.ts
+		if _itimediff(kcp.ts_ack, since) > 0 {
+			since = kcp.ts_ack
+		}
+		pto := 2*kcp.rx_srtt + int32(kcp.interval)
+		if _itimediff(current, since) >= pto && _itimediff(tail.resendts, current) > 0 {
+			kcp.tlp_sent = true
+			tail.xmit++
+			tail.ts = current
+			tail.fastack = 0
+			tail.wnd = seg.wnd
+			tail.una = seg.una
+			kcp.out_segs++
+			tlpSegs++
+
+			makeSpace(IKCP_OVERHEAD + len(tail.data))
+			ptr = kcp.encodeSegment(tail, ptr)
+			copy(ptr, tail.data)
+			ptr = ptr[len(tail.data):]
+		}
+	}
+
 	// flash remain segments
 	flushBuffer()
 
 	// counter updates
 	sum := lostSegs
 	if lostSegs > 0 {
-		atomic.AddUint64(&DefaultSnmp.LostSegs, lostSegs)
+		atomic.AddUint64(&kcp.snmp.LostSegs, lostSegs)
+		atomic.AddUint64(&kcp.stats.LostSegs, lostSegs)
 	}
 	if fastRetransSegs > 0 {
-		atomic.AddUint64(&DefaultSnmp.FastRetransSegs, fastRetransSegs)
+		atomic.AddUint64(&kcp.snmp.FastRetransSegs, fastRetransSegs)
+		atomic.AddUint64(&kcp.stats.FastRetransSegs, fastRetransSegs)
 		sum += fastRetransSegs
 	}
 	if earlyRetransSegs > 0 {
-		atomic.AddUint64(&DefaultSnmp.EarlyRetransSegs, earlyRetransSegs)
+		atomic.AddUint64(&kcp.snmp.EarlyRetransSegs, earlyRetransSegs)
+		atomic.AddUint64(&kcp.stats.EarlyRetransSegs, earlyRetransSegs)
 		sum += earlyRetransSegs
 	}
+	if rackSegs > 0 {
+		atomic.AddUint64(&kcp.snmp.RACKRetransSegs, rackSegs)
+		atomic.AddUint64(&kcp.stats.RACKRetransSegs, rackSegs)
+		sum += rackSegs
+	}
+	if tlpSegs > 0 {
+		atomic.AddUint64(&kcp.snmp.TLPSegs, tlpSegs)
+		atomic.AddUint64(&kcp.stats.TLPSegs, tlpSegs)
+		sum += tlpSegs
+	}
 	if sum > 0 {
-		atomic.AddUint64(&DefaultSnmp.RetransSegs, sum)
+		atomic.AddUint64(&kcp.snmp.RetransSegs, sum)
+		atomic.AddUint64(&kcp.stats.RetransSegs, sum)
+		if kcp.loss_handler != nil {
+			kcp.loss_handler(lostSegs, fastRetransSegs, earlyRetransSegs, rackSegs, tlpSegs)
+		}
 	}
+	kcp.retrans_segs += sum
 
 	// cwnd update
 	if kcp.nocwnd == 0 {
@@ -919,7 +1529,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		}
 
 		// congestion control, https://tools.ietf.org/html/rfc5681
-		if lostSegs > 0 {
+		if lostSegs > 0 && !frtoResend {
 			kcp.ssthresh = cwnd / 2
 			if kcp.ssthresh < IKCP_THRESH_MIN {
 				kcp.ssthresh = IKCP_THRESH_MIN
@@ -1032,6 +1642,28 @@ func (kcp *KCP) SetMtu(mtu int) int {
 	return 0
 }
 
+// SendProbe sends a padded IKCP_CMD_PROBE segment of 'size' bytes in a packet of its own,
+// bypassing the sliding window. The remote echoes 'token' back with IKCP_CMD_PACK.
+func (kcp *KCP) SendProbe(token uint32, size int) int {
+	if size < IKCP_OVERHEAD {
+		return -1
+	}
+
+	var seg segment
+	seg.conv = kcp.conv
+	seg.cmd = IKCP_CMD_PROBE
+	seg.wnd = kcp.wnd_unused()
+	seg.una = kcp.rcv_nxt
+	seg.sn = token
+	seg.ts = currentMs()
+	seg.data = make([]byte, size-IKCP_OVERHEAD)
+
+	buf := make([]byte, size)
+	kcp.encodeSegment(&seg, buf)
+	kcp.output(buf, size)
+	return 0
+}
+
 // NoDelay options
 // fastest: ikcp_nodelay(kcp, 1, 20, 2, 1)
 // nodelay: 0:disable(default), 1:enable
@@ -1041,7 +1673,9 @@ func (kcp *KCP) SetMtu(mtu int) int {
 func (kcp *KCP) NoDelay(nodelay, interval, resend, nc int) int {
 	if nodelay >= 0 {
 		kcp.nodelay = uint32(nodelay)
-		if nodelay != 0 {
+		if kcp.rto_floor != 0 {
+			kcp.rx_minrto = kcp.rto_floor
+		} else if nodelay != 0 {
 			kcp.rx_minrto = IKCP_RTO_NDL
 		} else {
 			kcp.rx_minrto = IKCP_RTO_MIN
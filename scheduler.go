@@ -0,0 +1,183 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-17 17:40:12
+@Description: Pluggable scheduling of outgoing packets
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"encoding/binary"
+	"slices"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// PacketClass classifies an outgoing packet for scheduling
+type PacketClass int
+
+const (
+	PacketData    PacketClass = iota // carries data segments, may piggyback acknowledgements
+	PacketAck                        // carries acknowledgements only
+	PacketControl                    // window and path probes
+	PacketParity                     // FEC parity shard
+	PacketDup                        // duplicated copy of a previous packet
+)
+
+func (c PacketClass) String() string {
+	switch c {
+	case PacketData:
+		return "data"
+	case PacketAck:
+		return "ack"
+	case PacketControl:
+		return "control"
+	case PacketParity:
+		return "parity"
+	case PacketDup:
+		return "dup"
+	}
+	return "unknown"
+}
+
+// Packet is an outgoing packet waiting in the transmit queue, already FEC encoded and encrypted
+type Packet struct {
+	Class PacketClass
+	Size  int // bytes on wire, excluding UDP/IP headers
+
+	msg ipv4.Message
+}
+
+// Scheduler decides the order and timing of the packets sent by a session.
+//
+// Schedule is called from the transmit goroutine of the session each time the
+// KCP flush output has been queued, with the packets in the order produced: for
+// every KCP packet, its duplicated copies and FEC parity shards follow it.
+// The scheduler may reorder 'pkts' in place, and return a delay to wait before
+// the batch is written to the socket. Packets must not be dropped or retained.
+//
+// Acknowledgement and control packets the scheduler leaves at the front of the
+// batch are sent without waiting for the send rate limit.
+type Scheduler interface {
+	Schedule(pkts []Packet) time.Duration
+}
+
+// FIFOScheduler sends the packets in the order they are produced. Without a
+// scheduler, acknowledgement and control packets are moved ahead of data.
+type FIFOScheduler struct{}
+
+// Schedule implements Scheduler
+func (FIFOScheduler) Schedule(pkts []Packet) time.Duration { return 0 }
+
+// schedulerHolder makes a Scheduler storable in atomic.Value
+type schedulerHolder struct{ Scheduler }
+
+// SetScheduler sets the scheduler of outgoing packets, nil restores the
+// default which sends acknowledgement and control packets first
+func (s *UDPSession) SetScheduler(sched Scheduler) {
+	s.scheduler.Store(schedulerHolder{sched})
+}
+
+// classify returns the class of a KCP output packet
+func classify(kcpPacket []byte) PacketClass {
+	class := PacketAck
+	for len(kcpPacket) >= IKCP_OVERHEAD {
+		switch kcpPacket[4] {
+		case IKCP_CMD_PUSH:
+			return PacketData
+		case IKCP_CMD_WASK, IKCP_CMD_WINS, IKCP_CMD_PROBE, IKCP_CMD_TICKET, IKCP_CMD_COOKIE, IKCP_CMD_VERSION:
+			class = PacketControl
+		}
+		length := binary.LittleEndian.Uint32(kcpPacket[20:])
+		if uint64(length) > uint64(len(kcpPacket)-IKCP_OVERHEAD) {
+			break
+		}
+		kcpPacket = kcpPacket[IKCP_OVERHEAD+int(length):]
+	}
+	return class
+}
+
+// urgent reports whether a packet of the class goes ahead of data, so a
+// saturated uplink does not hold back acknowledgements and make the remote
+// retransmit
+func (c PacketClass) urgent() bool { return c == PacketAck || c == PacketControl }
+
+// schedule runs the scheduler over txqueue, reordering it and classes in place
+func (s *UDPSession) schedule(txqueue []ipv4.Message, classes []PacketClass, spare *[]Packet) {
+	h, _ := s.scheduler.Load().(schedulerHolder)
+	if h.Scheduler == nil {
+		prioritize(txqueue, classes, spare)
+		return
+	}
+
+	pkts := make([]Packet, len(txqueue))
+	for k := range txqueue {
+		pkts[k] = Packet{Class: classes[k], Size: len(txqueue[k].Buffers[0]), msg: txqueue[k]}
+	}
+
+	delay := h.Schedule(pkts)
+	for k := range pkts {
+		txqueue[k], classes[k] = pkts[k].msg, pkts[k].Class
+	}
+	s.sleep(delay)
+}
+
+// prioritize moves the urgent packets to the front of txqueue, keeping the
+// order within urgent and other packets, 'spare' is reused between calls
+func prioritize(txqueue []ipv4.Message, classes []PacketClass, spare *[]Packet) {
+	first := slices.IndexFunc(classes, func(c PacketClass) bool { return !c.urgent() })
+	if first < 0 || !slices.ContainsFunc(classes[first:], PacketClass.urgent) {
+		return
+	}
+
+	rest := (*spare)[:0]
+	n := first
+	for k := first; k < len(txqueue); k++ {
+		if classes[k].urgent() {
+			txqueue[n], classes[n] = txqueue[k], classes[k]
+			n++
+		} else {
+			rest = append(rest, Packet{Class: classes[k], msg: txqueue[k]})
+		}
+	}
+	for k := range rest {
+		txqueue[n+k], classes[n+k] = rest[k].msg, rest[k].Class
+		rest[k].msg = ipv4.Message{}
+	}
+	*spare = rest
+}
+
+// transmit sends the scheduled txqueue, the urgent packets at its front at
+// once and the rest after the wait for the send rate limit
+func (s *UDPSession) transmit(txqueue []ipv4.Message, classes []PacketClass) {
+	wait := s.shape(txqueue)
+	if wait > 0 {
+		urgent := slices.IndexFunc(classes, func(c PacketClass) bool { return !c.urgent() })
+		if urgent < 0 {
+			urgent = len(txqueue)
+		}
+		if urgent > 0 {
+			s.tx(txqueue[:urgent])
+			txqueue = txqueue[urgent:]
+		}
+		s.sleep(wait)
+	}
+	if len(txqueue) > 0 {
+		s.tx(txqueue)
+	}
+}
+
+// sleep waits for 'd', it returns early if the session is closed
+func (s *UDPSession) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.die:
+	}
+}
@@ -8,11 +8,14 @@
 package safeudp
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"hash/crc32"
 	"io"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -44,22 +47,51 @@ const (
 
 var (
 	errInvalidOperation = errors.New("invalid operation")
-	errTimeout          = errors.New("timeout")
 	errNotOwner         = errors.New("not owner")
+	errChecksumMismatch = errors.New("end-to-end checksum mismatch")
+	errChecksumPending  = errors.New("end-to-end checksum not verified yet")
 )
 
-type timeoutError struct{}
+// DecryptFailurePolicy defines how a session reacts to packets which fail
+// decryption or integrity checking.
+type DecryptFailurePolicy int
 
-func (timeoutError) Error() string {
-	return "timeout"
+const (
+	// DecryptDrop silently drops the packet and counts it in InCsumErrors, this is the default.
+	DecryptDrop DecryptFailurePolicy = iota
+	// DecryptTerminate closes the session after a number of consecutive failures.
+	DecryptTerminate
+	// DecryptCallback reports every failure to an application callback.
+	DecryptCallback
+)
+
+// deadlineTimer tracks the deadline of a blocking operation, which may be
+// changed by another goroutine while the operation is blocked.
+type deadlineTimer struct {
+	deadline time.Time
+	timer    *time.Timer
+	C        <-chan time.Time // fires when the deadline expires, nil without deadline
 }
 
-func (timeoutError) Timeout() bool {
-	return true
+// reset re-arms the timer if the deadline has changed, it returns false if the deadline has passed
+func (d *deadlineTimer) reset(t time.Time) bool {
+	if !t.Equal(d.deadline) {
+		d.stop()
+		d.deadline = t
+		if !t.IsZero() {
+			d.timer = time.NewTimer(time.Until(t))
+			d.C = d.timer.C
+		}
+	}
+	return t.IsZero() || time.Now().Before(t)
 }
 
-func (timeoutError) Temporary() bool {
-	return true
+func (d *deadlineTimer) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+		d.C = nil
+	}
 }
 
 var (
@@ -88,6 +120,8 @@ type (
 
 		fecDecoder *fecDecoder
 		fecEncoder *fecEncoder
+		fecBackend atomic.Int32  // FECBackend requested, the encoder switches to it between groups
+		fecShards  atomic.Uint32 // data<<16|parity shards requested by ApplyConfig, 0 for no change
 
 		remote     net.Addr
 		rd         time.Time
@@ -95,7 +129,11 @@ type (
 		headerSize int
 		ackNoDelay bool
 		writeDelay bool
-		dup        int
+		dup        int32                       // copies sent of each packet, accessed atomically
+		txLimit    atomic.Pointer[tokenBucket] // send rate limit, nil if unlimited
+		rxLimit    atomic.Pointer[tokenBucket] // receive rate limit, nil if unlimited
+		scheduler  atomic.Value                // schedulerHolder of outgoing packets
+		adaptDup   *dupPolicy
 
 		die          chan struct{}
 		dieOnce      sync.Once
@@ -111,10 +149,82 @@ type (
 
 		nonce Entropy
 
+		// decryption failure handling
+		decryptPolicy   DecryptFailurePolicy
+		decryptLimit    int
+		decryptCallback func(s *UDPSession, failures int)
+		decryptFailures uint32 // consecutive failures, accessed atomically
+
+		created   time.Time     // creation of the session, for its uptime
+		lastInput atomic.Uint32 // currentMs of the last packet received, for the eviction of idle sessions
+
 		chPostProcessing chan []byte
+		txQueued         atomic.Uint64 // packets delivered to post processing
+		txDone           atomic.Uint64 // packets handed to the socket by post processing
+		flushMu          sync.Mutex
+		flushWaiters     []flushWaiter // Flush calls waiting for their packets to be sent
 
 		xconn           batchConn
-		xconnWriteError error
+		xconnWriteError error         // last failure of batch sends, nil if working
+		xconnRetry      time.Time     // batch sends are probed again after this time
+		xconnBackoff    time.Duration // interval between probes, doubled on each failure
+
+		gro       atomic.Bool // read loop expects buffers coalesced by UDP_GRO
+		gso       atomic.Bool // send runs of packets as UDP_SEGMENT super packets
+		gsoBuffer []byte      // reusable super packet, only used by tx
+
+		processors   atomic.Pointer[processorChain] // packet processors, nil for none
+		procOverhead int                            // bytes added to packets by the processors, KCP leaves room for them
+
+		ticketStatus TicketStatus // resumption with a session ticket
+		ticketState  []byte       // state of the accepted ticket, on the server
+		kcpCompat    bool         // packets kept those of kcp-go, see Config.KCPCompat
+
+		version      Version   // protocol version negotiated, 0 if none was
+		versionOffer []Version // versions offered by the client until the server chooses
+
+		resetToken []byte // token of the stateless resets of the listener, on the client
+
+		source atomic.Pointer[sourceControl] // local address of the packets on wildcard listeners, nil for any
+
+		zeroCopy atomic.Bool // send with MSG_ZEROCOPY
+		zc       *zeroCopy   // buffers held for the kernel, only used by tx
+
+		pmtud *pmtud // path MTU discovery, nil if disabled
+
+		earlyWnd uint32 // receive window restored on Accept, 0 if not limited
+
+		writePolicy WritePolicy // handling of writes larger than the free send window
+
+		e2e *e2eChecksum // end-to-end checksum, nil if disabled
+
+		writeWaiters []writeWaiter // asynchronous writes waiting for acknowledgement
+
+		// connection migration
+		peer           atomic.Value // net.Addr of the peer after migration
+		pathCandidate  net.Addr     // new address being validated
+		pathToken      uint32       // token of the outstanding path challenge
+		pathHeld       [][]byte     // packets from the new address until it is validated
+		pathChallenged time.Time    // time of the last path challenge
+
+		garbage atomic.Pointer[garbageHook] // handler of dropped packets, nil if none
+		tap     atomic.Pointer[packetTap]   // of SetPacketTap on a client session, nil if none
+		uring   atomic.Pointer[ioRing]      // sends through io_uring, nil for sendmmsg
+		stun    stunTransactions            // binding requests of STUNBinding, on client sessions
+
+		snmp  atomic.Pointer[Snmp] // counters of the session, those of its listener or DefaultSnmp
+		stats Snmp                 // counters of the session alone, see Stats
+
+		events   eventLog                // recent significant events, for DebugState
+		trace    SessionTracer           // of SetTracer, set at creation, nil if none
+		qlog     atomic.Pointer[qlogger] // event log of SetQlog, nil if none
+		qlogCwnd uint32                  // cwnd last logged
+		lastRTO  uint32                  // rto at the previous update, to detect spikes
+
+		progressTimeout time.Duration // unreachable without acknowledgements for this long, 0 to disable
+		progressUna     uint32        // snd_una at the last progress
+		progressAt      time.Time     // time of the last progress, or since nothing was outstanding
+		progressLogged  bool          // the stall has been logged
 
 		mu sync.Mutex
 	}
@@ -132,9 +242,11 @@ type (
 	}
 )
 
-func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn net.PacketConn, ownConn bool, remote net.Addr, block BlockCrypt) *UDPSession {
+func newUDPSession(ctx context.Context, conv uint32, dataShards, parityShards int, l *Listener, conn net.PacketConn, ownConn bool, remote net.Addr, block BlockCrypt) *UDPSession {
 	sess := new(UDPSession)
 	sess.die = make(chan struct{})
+	sess.created = time.Now()
+	sess.lastInput.Store(currentMs())
 	sess.nonce = new(nonceAES128)
 	sess.nonce.Init()
 	sess.chReadEvent = make(chan struct{}, 1)
@@ -149,22 +261,13 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 	sess.block = block
 	sess.recvbuf = make([]byte, mtuLimit)
 
-	if _, ok := conn.(*net.UDPConn); ok {
-		addr, err := net.ResolveUDPAddr("udp", conn.LocalAddr().String())
-		if err == nil {
-			if addr.IP.To4() != nil {
-				sess.xconn = ipv4.NewPacketConn(conn)
-			} else {
-				sess.xconn = ipv6.NewPacketConn(conn)
-			}
-		}
-	}
+	sess.xconn = newBatchConn(conn)
 
-	sess.fecDecoder = newFECDecoder(dataShards, parityShards)
+	sess.fecDecoder = newFECDecoder(dataShards, parityShards, FECBackendAuto)
 	if sess.block != nil {
-		sess.fecEncoder = newFECEncoder(dataShards, parityShards, cryptHeaderSize)
+		sess.fecEncoder = newFECEncoder(dataShards, parityShards, cryptHeaderSize, FECBackendAuto)
 	} else {
-		sess.fecEncoder = newFECEncoder(dataShards, parityShards, 0)
+		sess.fecEncoder = newFECEncoder(dataShards, parityShards, 0, FECBackendAuto)
 	}
 
 	if sess.block != nil {
@@ -185,80 +288,94 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 			// delivery to post processing
 			select {
 			case sess.chPostProcessing <- bts:
+				sess.txQueued.Add(1)
 			case <-sess.die:
 				return
 			}
 
 		}
 	})
+	snmp := DefaultSnmp
+	if l != nil {
+		snmp = l.Snmp()
+	}
+	sess.snmp.Store(snmp)
+	sess.kcp.snmp, sess.kcp.stats = snmp, &sess.stats
+	if sess.fecDecoder != nil {
+		sess.fecDecoder.setSnmp(snmp, &sess.stats)
+	}
+	sess.kcp.probe_handler = sess.onProbeAck
+	sess.kcp.digest_handler = sess.onDigest
+	sess.kcp.ticket_handler = sess.onTicket
+	sess.kcp.version_handler = sess.onVersion
+	sess.kcp.cookie_handler = sess.onCookie
+	sess.kcp.reset_handler = sess.onReset
+	sess.kcp.token_handler = sess.onResetToken
+	sess.kcp.loss_handler = sess.onLoss
+
+	sess.startTrace(ctx, conv, remote)
+
 	// create post-processing goroutine
 	go sess.postProcess()
 
 	if sess.l == nil { // it's a client connection
+		sess.logEvent("dialed %v, conv %d", remote, conv)
 		go sess.readLoop()
-		atomic.AddUint64(&DefaultSnmp.ActiveOpens, 1)
+		atomic.AddUint64(&snmp.ActiveOpens, 1)
 	} else {
-		atomic.AddUint64(&DefaultSnmp.PassiveOpens, 1)
+		sess.logEvent("first packet from %v, conv %d", remote, conv)
+		atomic.AddUint64(&snmp.PassiveOpens, 1)
 	}
 
 	// start per-session updater
 	SystemTimer.Put(sess.update, time.Now())
 
-	currestab := atomic.AddUint64(&DefaultSnmp.CurrEstab, 1)
-	maxconn := atomic.LoadUint64(&DefaultSnmp.MaxConn)
-	if currestab > maxconn {
-		atomic.CompareAndSwapUint64(&DefaultSnmp.MaxConn, maxconn, currestab)
-	}
+	snmp.established()
 
 	return sess
 }
 
-// readLoop continuously reads packets from the underlying connection for client sessions
-func (s *UDPSession) readLoop() {
-	buf := make([]byte, mtuLimit)
-	for {
-		select {
-		case <-s.die:
-			return
-		default:
-		}
+// Read implements net.Conn
+func (s *UDPSession) Read(b []byte) (n int, err error) { return s.read(context.Background(), b) }
 
-		if n, addr, err := s.conn.ReadFrom(buf); err == nil {
-			// Verify the packet is from our remote peer
-			if addr.String() == s.remote.String() {
-				s.packetInput(buf[:n])
-			}
-		} else {
-			// Notify read error and exit the loop
-			s.notifyReadError(err)
-			return
-		}
-	}
+// ReadContext reads like Read, and returns ctx.Err() if the context is done
+// before any data arrives, the read deadline still applies.
+func (s *UDPSession) ReadContext(ctx context.Context, b []byte) (n int, err error) {
+	return s.read(ctx, b)
 }
 
-// Read implements net.Conn
-func (s *UDPSession) Read(b []byte) (n int, err error) {
-RESET_TIMER:
-	var timeout *time.Timer
-	// deadline for current reading operation
-	var c <-chan time.Time
-	if !s.rd.IsZero() {
-		delay := time.Until(s.rd)
-		timeout = time.NewTimer(delay)
-		c = timeout.C
-		defer timeout.Stop()
-	}
+func (s *UDPSession) read(ctx context.Context, b []byte) (n int, err error) {
+	// deadline for current reading operation, it may be changed while blocked
+	var deadline deadlineTimer
+	defer deadline.stop()
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
 		s.mu.Lock()
+		if !deadline.reset(s.rd) {
+			s.mu.Unlock()
+			return 0, ErrTimeout
+		}
+
 		// bufptr points to the current position of recvbuf,
 		// if previous 'b' is insufficient to accommodate the data, the
 		// remaining data will be stored in bufptr for next read.
+		if s.e2e != nil && s.e2e.err != nil {
+			err = s.e2e.err
+			s.mu.Unlock()
+			return 0, err
+		}
+
 		if len(s.bufptr) > 0 {
 			n = copy(b, s.bufptr)
 			s.bufptr = s.bufptr[n:]
+			s.e2eRead(b[:n])
 			s.mu.Unlock()
-			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.Snmp().BytesReceived, uint64(n))
+			atomic.AddUint64(&s.stats.BytesReceived, uint64(n))
 			return n, nil
 		}
 
@@ -267,8 +384,10 @@ RESET_TIMER:
 			// from kcp.recv() to 'b', like 'DMA'.
 			if len(b) >= size {
 				s.kcp.Recv(b)
+				s.e2eRead(b[:size])
 				s.mu.Unlock()
-				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(size))
+				atomic.AddUint64(&s.Snmp().BytesReceived, uint64(size))
+				atomic.AddUint64(&s.stats.BytesReceived, uint64(size))
 				return size, nil
 			}
 
@@ -284,9 +403,11 @@ RESET_TIMER:
 			s.kcp.Recv(s.recvbuf)    // read data to recvbuf first
 			n = copy(b, s.recvbuf)   // then copy bytes to 'b' as many as possible
 			s.bufptr = s.recvbuf[n:] // pointer update
+			s.e2eRead(b[:n])
 
 			s.mu.Unlock()
-			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.Snmp().BytesReceived, uint64(n))
+			atomic.AddUint64(&s.stats.BytesReceived, uint64(n))
 			return n, nil
 		}
 
@@ -296,16 +417,14 @@ RESET_TIMER:
 		// next data packet arrives.
 		select {
 		case <-s.chReadEvent:
-			if timeout != nil {
-				timeout.Stop()
-				goto RESET_TIMER
-			}
-		case <-c:
-			return 0, errors.WithStack(errTimeout)
+		case <-deadline.C:
+			return 0, ErrTimeout
+		case <-ctx.Done():
+			return 0, ctx.Err()
 		case <-s.chSocketReadError:
 			return 0, s.socketReadError.Load().(error)
 		case <-s.die:
-			return 0, errors.WithStack(io.ErrClosedPipe)
+			return 0, errors.WithStack(ErrClosed)
 		}
 	}
 }
@@ -315,47 +434,101 @@ func (s *UDPSession) Write(b []byte) (n int, err error) { return s.WriteBuffers(
 
 // WriteBuffers write a vector of byte slices to the underlying connection
 func (s *UDPSession) WriteBuffers(v [][]byte) (n int, err error) {
-RESET_TIMER:
-	var timeout *time.Timer
-	var c <-chan time.Time
-	if !s.wd.IsZero() {
-		delay := time.Until(s.wd)
-		timeout = time.NewTimer(delay)
-		c = timeout.C
-		defer timeout.Stop()
-	}
+	return s.writeBuffers(context.Background(), v, nil, false)
+}
+
+// WriteContext writes like Write, and returns ctx.Err() if the context is done
+// while waiting for the send window, nothing has been written in that case.
+func (s *UDPSession) WriteContext(ctx context.Context, b []byte) (n int, err error) {
+	return s.writeBuffers(ctx, [][]byte{b}, nil, false)
+}
+
+// WriteAtomic writes a vector of byte slices as a whole, it blocks until the
+// send window can accommodate all of them, and either enqueues all the buffers
+// or none of them, so that a message is never split by backpressure, deadline or close.
+//
+// An error is returned immediately if the buffers can never fit in the send window.
+func (s *UDPSession) WriteAtomic(v [][]byte) (n int, err error) {
+	return s.writeBuffers(context.Background(), v, nil, true)
+}
+
+// writeBuffers writes 'v' to kcp, 'done' will be registered to be notified when
+// the written data has been acknowledged by remote.
+//
+// if 'whole' is set, it waits until the send window has room for all of 'v',
+// otherwise 'v' is enqueued according to the write policy of the session.
+func (s *UDPSession) writeBuffers(ctx context.Context, v [][]byte, done func(error), whole bool) (n int, err error) {
+	// deadline for current writing operation, it may be changed while blocked
+	var deadline deadlineTimer
+	defer deadline.stop()
 
 	for {
-		// check for connection close and socket error
+		// check for connection close, socket error and cancellation
 		select {
 		case <-s.chSocketWriteError:
 			return 0, s.socketWriteError.Load().(error)
 		case <-s.die:
-			return 0, errors.WithStack(io.ErrClosedPipe)
+			return 0, errors.WithStack(ErrClosed)
+		case <-ctx.Done():
+			return 0, ctx.Err()
 		default:
 		}
 
 		s.mu.Lock()
+		if !deadline.reset(s.wd) {
+			s.mu.Unlock()
+			return 0, ErrTimeout
+		}
+
+		// the number of segments which must fit in the window at once
+		policy := s.writePolicy
+		entire := whole || policy == WriteMessage
+		need := 1
+		if entire {
+			need = max(s.segmentsFor(v), 1)
+			if need > s.maxMessageSegments(policy == WriteMessage) {
+				s.mu.Unlock()
+				return 0, errors.WithStack(ErrMsgTooLarge)
+			}
+		}
 
 		// make sure write do not overflow the max sliding window on both side
-		waitsnd := s.kcp.WaitSnd()
-		if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
+		free := min(int(s.kcp.snd_wnd), int(s.kcp.rmt_wnd)) - s.kcp.WaitSnd()
+		if free >= need {
+			head := v
+			if policy == WritePartial && !entire {
+				head, v = s.splitSegments(v, free)
+			} else {
+				v = nil
+			}
+
 			// transmit all data sequentially, make sure every packet size is within 'mss'
-			for _, b := range v {
-				n += len(b)
-				// handle each slice for packet splitting
-				for {
-					if len(b) <= int(s.kcp.mss) {
-						s.kcp.Send(b)
-						break
-					} else {
-						s.kcp.Send(b[:s.kcp.mss])
-						b = b[s.kcp.mss:]
+			if policy == WriteMessage {
+				msg := bytes.Join(head, nil)
+				s.kcp.Send(msg)
+				n = len(msg)
+			} else {
+				for _, b := range head {
+					n += len(b)
+					// handle each slice for packet splitting
+					for {
+						if len(b) <= int(s.kcp.mss) {
+							s.kcp.Send(b)
+							break
+						} else {
+							s.kcp.Send(b[:s.kcp.mss])
+							b = b[s.kcp.mss:]
+						}
 					}
 				}
 			}
+			s.e2eWrite(head)
+
+			if done != nil {
+				s.addWriteWaiter(done)
+			}
 
-			waitsnd = s.kcp.WaitSnd()
+			waitsnd := s.kcp.WaitSnd()
 			if waitsnd >= int(s.kcp.snd_wnd) || waitsnd >= int(s.kcp.rmt_wnd) || !s.writeDelay {
 				// put the packets on wire immediately if the inflight window is full
 				// or if we've specified write no delay(NO merging of outgoing bytes)
@@ -363,7 +536,12 @@ RESET_TIMER:
 				s.kcp.flush(false)
 			}
 			s.mu.Unlock()
-			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
+			atomic.AddUint64(&s.Snmp().BytesSent, uint64(n))
+			atomic.AddUint64(&s.stats.BytesSent, uint64(n))
+
+			if len(v) > 0 {
+				return n, errors.WithStack(io.ErrShortWrite)
+			}
 			return n, nil
 		}
 
@@ -373,20 +551,27 @@ RESET_TIMER:
 		// transmit buffer to become available again.
 		select {
 		case <-s.chWriteEvent:
-			if timeout != nil {
-				timeout.Stop()
-				goto RESET_TIMER
-			}
-		case <-c:
-			return 0, errors.WithStack(errTimeout)
+		case <-deadline.C:
+			return 0, ErrTimeout
+		case <-ctx.Done():
+			return 0, ctx.Err()
 		case <-s.chSocketWriteError:
 			return 0, s.socketWriteError.Load().(error)
 		case <-s.die:
-			return 0, errors.WithStack(io.ErrClosedPipe)
+			return 0, errors.WithStack(ErrClosed)
 		}
 	}
 }
 
+// segmentsFor returns the number of segments 'v' will be split into, the caller must hold the session lock
+func (s *UDPSession) segmentsFor(v [][]byte) (count int) {
+	mss := int(s.kcp.mss)
+	for _, b := range v {
+		count += (len(b) + mss - 1) / mss
+	}
+	return
+}
+
 func (s *UDPSession) isClosed() bool {
 	select {
 	case <-s.die:
@@ -405,23 +590,43 @@ func (s *UDPSession) Close() error {
 	})
 
 	if once {
-		atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
+		s.logEvent("closed")
+		if s.trace != nil {
+			s.trace.End()
+		}
+		if s.l == nil {
+			releaseIORing(&s.uring)
+		}
 
 		// try best to send all queued messages especially the data in txqueue
 		s.mu.Lock()
+		atomic.AddUint64(&s.Snmp().CurrEstab, ^uint64(0)) // under the lock, as SetSnmp moves the count
 		s.kcp.flush(false)
+		s.sendDigest()
+		waiters := s.writeWaiters
+		s.writeWaiters = nil
+		var e2eErr error
+		if s.e2e != nil {
+			e2eErr = s.e2e.err
+		}
 		s.mu.Unlock()
 
+		// pending asynchronous writes will never be acknowledged
+		for _, w := range waiters {
+			w.done(errors.WithStack(ErrClosed))
+		}
+
 		if s.l != nil { // belongs to listener
-			s.l.closeSession(s.remote)
-			return nil
+			s.l.closeSession(s)
+			return e2eErr
 		} else if s.ownConn { // client socket close
-			return s.conn.Close()
-		} else {
-			return nil
+			if err := s.conn.Close(); err != nil {
+				return err
+			}
 		}
+		return e2eErr
 	} else {
-		return errors.WithStack(io.ErrClosedPipe)
+		return errors.WithStack(ErrClosed)
 	}
 }
 
@@ -429,9 +634,10 @@ func (s *UDPSession) Close() error {
 func (s *UDPSession) LocalAddr() net.Addr { return s.conn.LocalAddr() }
 
 // RemoteAddr returns the remote network address. The Addr returned is shared by all invocations of RemoteAddr, so do not modify it.
-func (s *UDPSession) RemoteAddr() net.Addr { return s.remote }
+func (s *UDPSession) RemoteAddr() net.Addr { return s.remoteAddr() }
 
-// SetDeadline sets the deadline associated with the listener. A zero time value disables the deadline.
+// SetDeadline sets the deadline of the pending and future Accept calls, which
+// then fail with ErrTimeout. A zero time value disables the deadline.
 func (s *UDPSession) SetDeadline(t time.Time) error {
 	s.mu.Lock()
 	s.rd = t
@@ -461,6 +667,11 @@ func (s *UDPSession) SetWriteDeadline(t time.Time) error {
 }
 
 // SetWriteDelay delays write for bulk transfer until the next update interval
+//
+// With delay enabled, small writes are merged into full segments and sent by the
+// periodical update, which saves packets and headers at the cost of up to one
+// update interval of latency. It is disabled by default, every Write flushes.
+// It can be changed at any time.
 func (s *UDPSession) SetWriteDelay(delay bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -474,7 +685,27 @@ func (s *UDPSession) SetWindowSize(sndwnd, rcvwnd int) {
 	s.kcp.WndSize(sndwnd, rcvwnd)
 }
 
-// SetMtu sets the maximum transmission unit(not including UDP header)
+// SetReceiveMemoryLimit caps the payload bytes buffered for the application
+// at 'bytes', 0 for no cap other than the receive window.
+//
+// The window advertised to remote shrinks as the buffered data grows, so a slow
+// reader throttles the sender, and out of order segments beyond the cap are
+// dropped unacknowledged for remote to retransmit.
+func (s *UDPSession) SetReceiveMemoryLimit(bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.rcv_mem_limit = max(bytes, 0)
+}
+
+// GetReceiveMemory returns the payload bytes buffered for the application
+func (s *UDPSession) GetReceiveMemory() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.rcv_mem
+}
+
+// SetMtu sets the maximum transmission unit(not including UDP header), the
+// crypt and FEC headers are included, see MaxPayload for the data per packet.
 func (s *UDPSession) SetMtu(mtu int) bool {
 	if mtu > mtuLimit {
 		return false
@@ -482,7 +713,10 @@ func (s *UDPSession) SetMtu(mtu int) bool {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.kcp.SetMtu(mtu)
+	if s.kcp.SetMtu(mtu-s.packetOverhead()) != 0 {
+		return false
+	}
+	s.logEvent("mtu set to %d", mtu)
 	return true
 }
 
@@ -498,6 +732,11 @@ func (s *UDPSession) SetStreamMode(enable bool) {
 }
 
 // SetACKNoDelay changes ack flush option, set true to flush ack immediately,
+// otherwise acks are sent with the next update interval or piggybacked on data.
+//
+// Immediate acks let the remote measure a lower RTT and retransmit earlier, which
+// helps interactive traffic, but every received packet may trigger an ack packet,
+// costing bandwidth and CPU on bulk transfers. It can be changed at any time.
 func (s *UDPSession) SetACKNoDelay(nodelay bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -506,11 +745,22 @@ func (s *UDPSession) SetACKNoDelay(nodelay bool) {
 
 // (deprecated)
 //
-// SetDUP duplicates udp packets for kcp output.
-func (s *UDPSession) SetDUP(dup int) {
+// SetDUP duplicates udp packets for kcp output, use SetDup instead.
+func (s *UDPSession) SetDUP(dup int) { s.SetDup(dup) }
+
+// SetDecryptFailurePolicy sets how the session handles packets which fail decryption.
+//
+// 'limit' is the number of consecutive failures tolerated before DecryptTerminate closes the session,
+// read and write calls will fail with a decryption error afterwards.
+//
+// 'callback' is invoked on every failure with DecryptCallback, together with the number of consecutive
+// failures, it runs on the receiving goroutine so it must not block.
+func (s *UDPSession) SetDecryptFailurePolicy(policy DecryptFailurePolicy, limit int, callback func(s *UDPSession, failures int)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.dup = dup
+	s.decryptPolicy = policy
+	s.decryptLimit = limit
+	s.decryptCallback = callback
 }
 
 // SetNoDelay calls nodelay() of kcp
@@ -521,6 +771,93 @@ func (s *UDPSession) SetNoDelay(nodelay, interval, resend, nc int) {
 	s.kcp.NoDelay(nodelay, interval, resend, nc)
 }
 
+// SetRTO sets the initial retransmission timeout, used until the first RTT
+// sample, and the floor and ceiling of the timeout, in millisec, 0 keeps the
+// current setting. A high initial timeout avoids spurious retransmissions of
+// the first packets on long paths, a low one recovers them quickly on short
+// paths.
+func (s *UDPSession) SetRTO(initial, minrto, maxrto int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SetRTO(initial, minrto, maxrto)
+}
+
+// SetMaxRetransmit sets when the remote is considered unreachable: once a
+// segment has been retransmitted 'n' times, or once no data has been
+// acknowledged for 'timeout' while some is outstanding. Pending and later reads
+// and writes then fail with ErrMaxRetransmit. 'n' of 0 keeps the current
+// limit, 19 by default, and 'timeout' of 0 disables the progress check.
+func (s *UDPSession) SetMaxRetransmit(n int, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > 0 {
+		s.kcp.dead_link = uint32(n) + 1
+	}
+	s.progressTimeout = timeout
+	s.progressAt = time.Now()
+}
+
+// stalled reports whether the session has made no progress for longer than
+// the progress timeout, the caller must hold the session lock
+func (s *UDPSession) stalled() bool {
+	if s.progressTimeout <= 0 {
+		return false
+	}
+	now := time.Now()
+	if s.kcp.snd_buf.Len() == 0 || s.kcp.snd_una != s.progressUna {
+		s.progressUna, s.progressAt = s.kcp.snd_una, now
+		return false
+	}
+	if now.Sub(s.progressAt) < s.progressTimeout {
+		return false
+	}
+	if !s.progressLogged {
+		s.progressLogged = true
+		s.logEvent("no progress for %v", now.Sub(s.progressAt).Round(time.Millisecond))
+	}
+	return true
+}
+
+// SetRACK enables time based loss detection and tail loss probes, which
+// recover losses at the end of a flight in about one RTT instead of waiting for
+// the RTO, reducing the tail latency of request and response traffic. It only
+// changes when the session retransmits, the remote needs no support.
+func (s *UDPSession) SetRACK(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SetRACK(enable)
+}
+
+// SetFRTO enables the detection of spurious retransmission timeouts: after a
+// delay spike rather than a loss, the session keeps its congestion window and
+// does not retransmit the whole window. It only changes the sender.
+func (s *UDPSession) SetFRTO(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SetFRTO(enable)
+}
+
+// SetSACK makes the session announce the ranges of segments received out of
+// order along with its acks, so the remote retransmits only the missing
+// segments even when acks are lost. The remote must be a version which
+// understands the ranges. It is refused on sessions of Config.KCPCompat.
+func (s *UDPSession) SetSACK(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enable && s.refusedByKCPCompat("SACK") {
+		return
+	}
+	s.kcp.SetSACK(enable)
+}
+
+// SeedRTT takes an RTT measured by the application, such as during its own
+// handshake, as the first sample before the session has measured one itself.
+func (s *UDPSession) SeedRTT(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SeedRTT(int32(max(rtt.Milliseconds(), 1)))
+}
+
 // SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
 //
 // if the underlying connection has implemented `func SetDSCP(int) error`, SetDSCP() will invoke
@@ -594,22 +931,55 @@ func (s *UDPSession) Control(f func(conn net.PacketConn) error) error {
 // a goroutine to handle post processing of kcp and make the critical section smaller
 // pipeline for outgoing packets (from ARQ to network)
 //
-//	KCP output -> FEC encoding -> CRC32 integrity -> Encryption -> TxQueue
+//	KCP output -> FEC encoding -> CRC32 integrity -> Encryption -> TxQueue -> Scheduler
 func (s *UDPSession) postProcess() {
 	txqueue := make([]ipv4.Message, 0, acceptBacklog)
+	classes := make([]PacketClass, 0, acceptBacklog)
 	chCork := make(chan struct{}, 1)
 	chDie := s.die
+	var dequeued uint64 // packets taken from chPostProcessing
+	var spare []Packet  // scratch space of the scheduling
+
+	// notify chCork only when chPostProcessing is empty
+	cork := func() {
+		if len(s.chPostProcessing) == 0 {
+			select {
+			case chCork <- struct{}{}:
+			default:
+			}
+		}
+	}
 
 	for {
 		select {
 		case buf := <-s.chPostProcessing: // dequeue from post processing
 			var ecc [][]byte
+			class := classify(buf[s.headerSize:])
+			dequeued++
+
+			// 0. packet processors
+			if chain := s.processors.Load(); chain != nil {
+				if buf = s.processOutgoing(*chain, buf); buf == nil {
+					cork()
+					continue
+				}
+			}
 
 			// 1. FEC encoding
 			if s.fecEncoder != nil {
+				s.fecEncoder.setBackend(FECBackend(s.fecBackend.Load()))
+				if shards := s.fecShards.Load(); shards != 0 {
+					s.fecEncoder.setShards(int(shards>>16), int(shards&0xffff))
+				}
+				s.fecEncoder.setSnmp(s.Snmp(), &s.stats)
 				ecc = s.fecEncoder.encode(buf, maxFECEncodingLatency)
 			}
 
+			// tap the plaintext datagrams
+			if tap := s.packetTap(); tap != nil {
+				s.tapOutgoing(tap, buf, ecc)
+			}
+
 			// 2&3. crc32 & encryption
 			if s.block != nil {
 				s.nonce.Fill(buf[:nonceSize])
@@ -627,18 +997,23 @@ func (s *UDPSession) postProcess() {
 
 			// 4. TxQueue
 			var msg ipv4.Message
-			msg.Addr = s.remote
+			msg.Addr = s.remoteAddr()
+			msg.OOB = s.sourceOOB()
 
 			// original copy, move buf to txqueue directly
 			msg.Buffers = [][]byte{buf}
 			txqueue = append(txqueue, msg)
+			classes = append(classes, class)
+			s.qlogPacket("packet_sent", len(buf), class)
 
 			// dup copies for testing if set
-			for i := 0; i < s.dup; i++ {
+			for i := 0; i < int(atomic.LoadInt32(&s.dup)); i++ {
 				bts := xmitBuf.Get().([]byte)[:len(buf)]
 				copy(bts, buf)
 				msg.Buffers = [][]byte{bts}
 				txqueue = append(txqueue, msg)
+				classes = append(classes, PacketDup)
+				s.qlogPacket("packet_sent", len(bts), PacketDup)
 			}
 
 			// parity
@@ -647,29 +1022,30 @@ func (s *UDPSession) postProcess() {
 				copy(bts, ecc[k])
 				msg.Buffers = [][]byte{bts}
 				txqueue = append(txqueue, msg)
+				classes = append(classes, PacketParity)
+				s.qlogPacket("packet_sent", len(bts), PacketParity)
 			}
 
-			// notify chCork only when chPostProcessing is empty
-			if len(s.chPostProcessing) == 0 {
-				select {
-				case chCork <- struct{}{}:
-				default:
-				}
-			}
+			cork()
 
 			// re-enable die channel
 			chDie = s.die
 
 		case <-chCork: // emulate a corked socket
 			if len(txqueue) > 0 {
-				s.tx(txqueue)
-				// recycle
+				s.schedule(txqueue, classes, &spare)
+				s.transmit(txqueue, classes)
+				// recycle, buffers sent without a copy are held until completion
 				for k := range txqueue {
-					xmitBuf.Put(txqueue[k].Buffers[0])
+					if buf := txqueue[k].Buffers[0]; buf != nil {
+						xmitBuf.Put(buf)
+					}
 					txqueue[k].Buffers = nil
 				}
 				txqueue = txqueue[:0]
+				classes = classes[:0]
 			}
+			s.flushed(dequeued)
 
 			// re-enable die channel
 			chDie = s.die
@@ -692,13 +1068,26 @@ func (s *UDPSession) update() {
 	default:
 		s.mu.Lock()
 		interval := s.kcp.flush(false)
+		s.qlogCwndUpdate()
+		s.pmtudProbe()
+		s.adjustDup()
+		if s.kcp.state == 0xFFFFFFFF || s.stalled() {
+			// a segment has reached the dead link limit, or nothing has been
+			// acknowledged for too long, the remote is unreachable
+			s.notifyReadError(errors.WithStack(ErrMaxRetransmit))
+			s.notifyWriteError(errors.WithStack(ErrMaxRetransmit))
+		}
+		if rto := s.kcp.rx_rto; s.lastRTO > 0 && rto >= 2*s.lastRTO {
+			s.traceEvent(TraceRTOStorm, "rto spike %d -> %d ms", s.lastRTO, rto)
+		}
+		s.lastRTO = s.kcp.rx_rto
 		waitsnd := s.kcp.WaitSnd()
 		if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
 			s.notifyWriteEvent()
 		}
 		s.mu.Unlock()
 		// self-synchronized timed scheduling
-		SystemTimer.Put(s.update, time.Now().Add(time.Duration(interval)*time.Millisecond))
+		SystemTimer.Put(s.update, time.Now().Add(time.Duration(interval)*time.Millisecond+faultTimerDelay()))
 	}
 }
 
@@ -742,6 +1131,7 @@ func (s *UDPSession) notifyWriteEvent() {
 
 func (s *UDPSession) notifyReadError(err error) {
 	s.socketReadErrorOnce.Do(func() {
+		s.logEvent("read error: %v", err)
 		s.socketReadError.Store(err)
 		close(s.chSocketReadError)
 	})
@@ -749,6 +1139,7 @@ func (s *UDPSession) notifyReadError(err error) {
 
 func (s *UDPSession) notifyWriteError(err error) {
 	s.socketWriteErrorOnce.Do(func() {
+		s.logEvent("write error: %v", err)
 		s.socketWriteError.Store(err)
 		close(s.chSocketWriteError)
 	})
@@ -757,16 +1148,21 @@ func (s *UDPSession) notifyWriteError(err error) {
 // packet input pipeline:
 // network -> [decryption ->] [crc32 ->] [FEC ->] [KCP input ->] stream -> application
 func (s *UDPSession) packetInput(data []byte) {
+	hook := s.garbageHook()
 	decrypted := false
 	if s.block != nil && len(data) >= cryptHeaderSize {
+		raw := hook.rawCopy(data)
+		defer releaseRaw(raw)
 		s.block.Decrypt(data, data)
 		data = data[nonceSize:]
 		checksum := crc32.ChecksumIEEE(data[crcSize:])
-		if checksum == binary.LittleEndian.Uint32(data) {
+		if checksum == binary.LittleEndian.Uint32(data) && !faultDecrypt() {
 			data = data[crcSize:]
 			decrypted = true
+			atomic.StoreUint32(&s.decryptFailures, 0)
 		} else {
-			atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+			hook.report(raw, s.remoteAddr(), GarbageChecksum)
+			s.decryptFailed()
 		}
 	} else if s.block == nil {
 		decrypted = true
@@ -774,11 +1170,65 @@ func (s *UDPSession) packetInput(data []byte) {
 
 	if decrypted && len(data) >= IKCP_OVERHEAD {
 		s.kcpInput(data)
+	} else if decrypted || s.block != nil && len(data) < cryptHeaderSize {
+		hook.report(data, s.remoteAddr(), GarbageMalformed)
 	}
 }
 
+// decryptFailed counts a packet which failed the integrity check, and applies
+// the decryption failure policy of the session.
+func (s *UDPSession) decryptFailed() {
+	atomic.AddUint64(&s.Snmp().InCsumErrors, 1)
+	atomic.AddUint64(&s.stats.InCsumErrors, 1)
+	failures := int(atomic.AddUint32(&s.decryptFailures, 1))
+
+	s.mu.Lock()
+	policy, limit, callback := s.decryptPolicy, s.decryptLimit, s.decryptCallback
+	s.mu.Unlock()
+
+	switch policy {
+	case DecryptTerminate:
+		if limit > 0 && failures >= limit {
+			s.logEvent("%d consecutive decryption failures", failures)
+			err := errors.WithStack(ErrDecrypt)
+			s.notifyReadError(err)
+			s.notifyWriteError(err)
+			s.Close()
+		}
+	case DecryptCallback:
+		if callback != nil {
+			callback(s, failures)
+		}
+	}
+}
+
+// input passes a KCP packet through the packet processors to KCP, the caller holds the session lock
+func (s *UDPSession) input(data []byte, regular bool) int {
+	if isBare(data) {
+		return s.kcp.Input(data, regular, s.ackNoDelay)
+	}
+	if s.unnegotiated(data) {
+		return -4
+	}
+	data, ok := s.processIncoming(data)
+	if !ok {
+		return -4
+	}
+	return s.kcp.Input(data, regular, s.ackNoDelay)
+}
+
 func (s *UDPSession) kcpInput(data []byte) {
+	if !s.policeInput(len(data)) {
+		return
+	}
+	s.lastInput.Store(currentMs())
+	s.qlogPacket("packet_received", len(data), -1)
+	if tap := s.packetTap(); tap != nil {
+		tap.Tap(TapIncoming, s.LocalAddr(), s.remoteAddr(), data)
+	}
+
 	var kcpInErrors uint64
+	var acked []writeWaiter
 
 	fecFlag := binary.LittleEndian.Uint16(data[4:])
 	if fecFlag == typeData || fecFlag == typeParity { // 16bit kcp cmd [81-84] and frg [0-255] will not overlap with FEC type 0x00f1 0x00f2
@@ -789,13 +1239,17 @@ func (s *UDPSession) kcpInput(data []byte) {
 			// if fecDecoder is not initialized, create one with default parameter
 			// lazy initialization
 			if s.fecDecoder == nil {
-				s.fecDecoder = newFECDecoder(1, 1)
+				s.fecDecoder = newFECDecoder(1, 1, FECBackend(s.fecBackend.Load()))
+				s.fecDecoder.setSnmp(s.Snmp(), &s.stats)
 			}
 
 			// FEC decoding
 			recovers := s.fecDecoder.decode(f)
+			if len(recovers) > 0 {
+				s.qlogEvent("fec_recovered", map[string]int{"packets": len(recovers)})
+			}
 			if f.flag() == typeData {
-				if ret := s.kcp.Input(data[fecHeaderSizePlus:], true, s.ackNoDelay); ret != 0 {
+				if ret := s.input(data[fecHeaderSizePlus:], true); ret != 0 {
 					kcpInErrors++
 				}
 			}
@@ -805,7 +1259,7 @@ func (s *UDPSession) kcpInput(data []byte) {
 				if len(r) >= 2 { // must be larger than 2bytes
 					sz := binary.LittleEndian.Uint16(r)
 					if int(sz) <= len(r) && sz >= 2 {
-						if ret := s.kcp.Input(r[2:sz], false, s.ackNoDelay); ret != 0 {
+						if ret := s.input(r[2:sz], false); ret != 0 {
 							kcpInErrors++
 						}
 					}
@@ -825,13 +1279,17 @@ func (s *UDPSession) kcpInput(data []byte) {
 			if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
 				s.notifyWriteEvent()
 			}
+			s.qlogCwndUpdate()
+			acked = s.ackedWriteWaiters()
 			s.mu.Unlock()
 		} else {
-			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			atomic.AddUint64(&s.Snmp().InErrs, 1)
+			atomic.AddUint64(&s.stats.InErrs, 1)
+			s.garbageHook().report(data, s.remoteAddr(), GarbageMalformed)
 		}
 	} else {
 		s.mu.Lock()
-		if ret := s.kcp.Input(data, true, s.ackNoDelay); ret != 0 {
+		if ret := s.input(data, true); ret != 0 {
 			kcpInErrors++
 		}
 		if n := s.kcp.PeekSize(); n > 0 {
@@ -841,13 +1299,23 @@ func (s *UDPSession) kcpInput(data []byte) {
 		if waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd) {
 			s.notifyWriteEvent()
 		}
+		s.qlogCwndUpdate()
+		acked = s.ackedWriteWaiters()
 		s.mu.Unlock()
 	}
 
-	atomic.AddUint64(&DefaultSnmp.InPkts, 1)
-	atomic.AddUint64(&DefaultSnmp.InBytes, uint64(len(data)))
+	for _, w := range acked {
+		w.done(nil)
+	}
+
+	atomic.AddUint64(&s.Snmp().InPkts, 1)
+	atomic.AddUint64(&s.stats.InPkts, 1)
+	atomic.AddUint64(&s.Snmp().InBytes, uint64(len(data)))
+	atomic.AddUint64(&s.stats.InBytes, uint64(len(data)))
 	if kcpInErrors > 0 {
-		atomic.AddUint64(&DefaultSnmp.SafeUdpInErrors, kcpInErrors)
+		atomic.AddUint64(&s.Snmp().SafeUdpInErrors, kcpInErrors)
+		atomic.AddUint64(&s.stats.SafeUdpInErrors, kcpInErrors)
+		s.garbageHook().report(data, s.remoteAddr(), GarbageMalformed)
 	}
 }
 
@@ -860,7 +1328,8 @@ type (
 		conn         net.PacketConn // the underlying packet connection
 		ownConn      bool           // true if we created conn internally, false if provided by caller
 
-		sessions        map[string]*UDPSession // all sessions accepted by this Listener
+		sessions        map[uint32]*UDPSession         // the first session of each conversation id, for migrations
+		sessionAddrs    map[netip.AddrPort]*UDPSession // all sessions accepted by this Listener, keyed by remote address
 		sessionLock     sync.RWMutex
 		chAccepts       chan *UDPSession // Listen() backlog
 		chSessionClosed chan net.Addr    // session close queue
@@ -868,74 +1337,250 @@ type (
 		die     chan struct{} // notify the listener has closed
 		dieOnce sync.Once
 
+		draining  chan struct{} // closed by Shutdown, new conversations are ignored
+		drainOnce sync.Once
+
 		// socket error handling
 		socketReadError     atomic.Value
 		chSocketReadError   chan struct{}
 		socketReadErrorOnce sync.Once
 
-		rd atomic.Value // read deadline for Accept()
+		rd         time.Time     // read deadline for Accept()
+		chDeadline chan struct{} // closed when the read deadline changes
+		rdLock     sync.Mutex
+
+		// decryption failure policy inherited by accepted sessions
+		decryptPolicy   DecryptFailurePolicy
+		decryptLimit    int
+		decryptCallback func(s *UDPSession, failures int)
+
+		earlyDataLimit int64 // bytes buffered by a session before Accept, accessed atomically
+
+		sessionConfig *Config // KCP settings of accepted sessions, nil for the defaults
+
+		fair     *fairInput // fair receive processing, nil if packets are processed inline
+		fairLock sync.RWMutex
+
+		gro atomic.Bool // read loop expects buffers coalesced by UDP_GRO
+
+		garbage atomic.Pointer[garbageHook] // handler of dropped packets, nil if none
+		tap     atomic.Pointer[packetTap]   // tap of the datagrams of the sessions, nil if none
+		uring   atomic.Pointer[ioRing]      // shared by the sessions to send, nil if none
+		xdp     *xdpReceiver                // AF_XDP receive path, nil if none
+
+		group *listenerGroup // SO_REUSEPORT shards sharing the port, nil if not sharded
+
+		ticketKey atomic.Pointer[TicketKey] // opens session tickets, nil rejects them
+
+		processors atomic.Pointer[func() []PacketProcessor] // creates the packet processors of accepted sessions
+		fecBackend atomic.Int32                             // FECBackend of accepted sessions
+		cookies    atomic.Pointer[cookieKey]                // stateless cookies of new sessions, nil if disabled
+		versions   atomic.Pointer[[]Version]                // protocol versions accepted, nil for all supported
+
+		maxSessions atomic.Int64 // cap on the sessions, 0 for none
+		eviction    atomic.Int32 // EvictionPolicy at the cap
+
+		sourceFilter atomic.Pointer[func(addr net.Addr) bool] // allows the packets of a source address, nil for all
+		sources      atomic.Pointer[sourceTable]              // rate limits per source address, nil for none
+
+		workers      atomic.Pointer[readWorkers]                             // parallel processing of the packets read, nil for inline
+		packetFilter atomic.Pointer[func(raw []byte, addr net.Addr) Verdict] // hook for the raw packets, nil for none
+		stun         stunTransactions                                        // binding requests of STUNBinding
+		relay        atomic.Pointer[relayTable]                              // allocations relayed, nil if not a relay
+
+		snmp atomic.Pointer[Snmp] // counters of the listener and its new sessions, DefaultSnmp unless set
+
+		backlogPolicy   atomic.Int32                        // BacklogPolicy when chAccepts is full
+		backlogOverflow atomic.Pointer[func(addr net.Addr)] // called when chAccepts is full, nil for none
+
+		resetKey atomic.Pointer[resetKey] // stateless resets of unknown conversations, nil if disabled
 	}
 )
 
-// packet input stage
-func (l *Listener) packetInput(data []byte, addr net.Addr) {
+// packet input stage, 'block' is the cipher of the calling goroutine, 'dst'
+// the local address the packet was sent to if known
+func (l *Listener) packetInput(block BlockCrypt, data []byte, addr net.Addr, dst pktinfo) {
+	if !l.filterPacket(data, addr) || !l.admitPacket(addr) {
+		return
+	}
+	key := addrKey(addr)
+	hook := l.garbage.Load()
 	decrypted := false
-	if l.block != nil && len(data) >= cryptHeaderSize {
-		l.block.Decrypt(data, data)
+	if block != nil && len(data) >= cryptHeaderSize {
+		raw := hook.rawCopy(data)
+		defer releaseRaw(raw)
+		block.Decrypt(data, data)
 		data = data[nonceSize:]
 		checksum := crc32.ChecksumIEEE(data[crcSize:])
-		if checksum == binary.LittleEndian.Uint32(data) {
+		if checksum == binary.LittleEndian.Uint32(data) && !faultDecrypt() {
 			data = data[crcSize:]
 			decrypted = true
 		} else {
-			atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+			hook.report(raw, addr, GarbageChecksum)
+			if s := l.sessionByAddr(key); s != nil {
+				s.decryptFailed()
+			} else {
+				atomic.AddUint64(&l.Snmp().InCsumErrors, 1)
+			}
 		}
-	} else if l.block == nil {
+	} else if block == nil {
 		decrypted = true
 	}
 
 	if decrypted && len(data) >= IKCP_OVERHEAD {
+		l.demux(data, addr, dst)
+	} else if decrypted || block != nil && len(data) < cryptHeaderSize {
+		hook.report(data, addr, GarbageMalformed)
+	}
+}
+
+// kcpOffset returns where the KCP header of a decrypted packet starts, after
+// the FEC header of a data shard, false for parity shards and short packets
+func kcpOffset(data []byte) (int, bool) {
+	if len(data) < IKCP_OVERHEAD {
+		return 0, false
+	}
+	switch binary.LittleEndian.Uint16(data[4:]) { // 16bit kcp cmd [81-84] and frg [0-255] will not overlap with FEC type 0x00f1 0x00f2
+	case typeData:
+		return fecHeaderSizePlus, len(data) >= fecHeaderSizePlus+IKCP_OVERHEAD
+	case typeParity:
+		return 0, false
+	}
+	return 0, true
+}
+
+// demux passes a decrypted packet to its session, or accepts a new session
+func (l *Listener) demux(data []byte, addr net.Addr, dst pktinfo) {
+	key := addrKey(addr)
+	var conv, sn uint32
+	off, convRecovered := kcpOffset(data)
+	if convRecovered {
+		conv = binary.LittleEndian.Uint32(data[off:])
+		sn = binary.LittleEndian.Uint32(data[off+IKCP_SN_OFFSET:])
+	}
+
+	// a conversation belongs to one shard whichever socket the kernel picked
+	if convRecovered && l.group != nil {
+		if owner := l.group.owner(conv); owner != l {
+			owner.demux(data, addr, dst)
+			return
+		}
+	}
+
+	// a session is found by its address first, a conversation id alone cannot
+	// tell apart two clients which picked the same one
+	s := l.sessionByAddr(key)
+	if s != nil && (!convRecovered || s.kcp.conv == conv) { // parity data or packet from current peer
+		atomic.StoreUint32(&s.decryptFailures, 0)
+		s.setSource(dst)
+		s.l.dispatch(s, data)
+		return
+	}
+
+	if convRecovered { // new session
 		l.sessionLock.RLock()
-		s, ok := l.sessions[addr.String()]
+		s = l.sessions[conv]
 		l.sessionLock.RUnlock()
+		if s != nil && s.samePeer(data[off:]) {
+			if l.block != nil {
+				// an authenticated packet of a known conversation from a new address,
+				// the peer may have been rebound by NAT
+				l.migrate(s, data, addr)
+			}
+			return
+		}
+		// otherwise another client picked the conversation id of a session at
+		// another address, the two are kept apart by their addresses
+
+		if l.isDraining() {
+			return // shutting down, the client retries elsewhere
+		}
 
-		var conv, sn uint32
-		convRecovered := false
-		fecFlag := binary.LittleEndian.Uint16(data[4:])
-		if fecFlag == typeData || fecFlag == typeParity { // 16bit kcp cmd [81-84] and frg [0-255] will not overlap with FEC type 0x00f1 0x00f2
-			// packet with FEC
-			if fecFlag == typeData && len(data) >= fecHeaderSizePlus+IKCP_OVERHEAD {
-				conv = binary.LittleEndian.Uint32(data[fecHeaderSizePlus:])
-				sn = binary.LittleEndian.Uint32(data[fecHeaderSizePlus+IKCP_SN_OFFSET:])
-				convRecovered = true
+		kcpPacket := data[off:]
+		if l.statelessReset(kcpPacket, addr, dst, conv) {
+			return // stale packet of a conversation this listener never had
+		}
+
+		// a cookie proves the source address before any state is created,
+		// the answer is no larger than the packet so it cannot amplify floods
+		if k := l.cookies.Load(); k != nil {
+			if !k.verify(kcpPacket, key, conv, l.Snmp()) {
+				l.challenge(k, addr, dst, key, conv)
+				return
 			}
-		} else {
-			// packet without FEC
-			conv = binary.LittleEndian.Uint32(data)
-			sn = binary.LittleEndian.Uint32(data[IKCP_SN_OFFSET:])
-			convRecovered = true
+			sn = 0 // the cookie opens the conversation, its sn field is part of the MAC
 		}
 
-		if ok { // existing connection
-			if !convRecovered || conv == s.kcp.conv { // parity data or valid conversation
-				s.kcpInput(data)
-			} else if sn == 0 { // should replace current connection
-				s.Close()
-				s = nil
+		if prev := l.sessionByAddr(key); prev != nil {
+			if sn != 0 { // stale packet of another conversation from the same address
+				return
 			}
+			prev.Close() // should replace current connection
+		}
+
+		if len(l.chAccepts) >= cap(l.chAccepts) { // do not let the new sessions overwhelm accept queue
+			l.overflow(addr, dst, conv)
+			return
 		}
 
-		if s == nil && convRecovered { // new session
-			if len(l.chAccepts) < cap(l.chAccepts) { // do not let the new sessions overwhelm accept queue
-				s := newUDPSession(conv, l.dataShards, l.parityShards, l, l.conn, false, addr, l.block)
-				s.kcpInput(data)
-				l.sessionLock.Lock()
-				l.sessions[addr.String()] = s
+		if l.admitSession(key.Addr()) && l.admit() {
+			s := l.newSession(conv, addr)
+			s.setSource(dst)
+			s.holdEarlyData(l.EarlyDataLimit())
+			s.kcpInput(data)
+			l.sessionLock.Lock()
+			if l.sessionAddrs[key] != nil { // created meanwhile by another read worker
 				l.sessionLock.Unlock()
-				l.chAccepts <- s
+				s.Close()
+				return
+			}
+			if l.sessions[conv] == nil { // another client may have picked the same conversation id
+				l.sessions[conv] = s
+			}
+			l.sessionAddrs[key] = s
+			l.sessionLock.Unlock()
+			select {
+			case l.chAccepts <- s:
+			default: // filled meanwhile by another shard of the group
+				s.Close()
+				l.overflow(addr, dst, conv)
 			}
 		}
+	} else {
+		l.garbage.Load().report(data, addr, GarbageUnknown)
+	}
+}
+
+// newSession creates a session of the listener with its settings for accepted sessions
+func (l *Listener) newSession(conv uint32, addr net.Addr) *UDPSession {
+	s := newUDPSession(context.Background(), conv, l.dataShards, l.parityShards, l, l.conn, false, addr, l.block)
+	s.SetDecryptFailurePolicy(l.decryptPolicy, l.decryptLimit, l.decryptCallback)
+	if c := l.sessionConfig; c != nil {
+		if c.KCPCompat {
+			s.setKCPCompat()
+		}
+		c.tuneKCP(s)
+	}
+	l.newSessionProcessors(s)
+	l.announceReset(s)
+	if r := l.uring.Load(); r != nil {
+		s.uring.Store(r)
+	}
+	if b := FECBackend(l.fecBackend.Load()); b != FECBackendAuto {
+		s.SetFECBackend(b)
 	}
+	return s
+}
+
+// sessionByAddr returns the session of a remote address, in any shard of the group
+func (l *Listener) sessionByAddr(key netip.AddrPort) *UDPSession {
+	l.sessionLock.RLock()
+	s := l.sessionAddrs[key]
+	l.sessionLock.RUnlock()
+	if s != nil || l.group == nil {
+		return s
+	}
+	return l.group.sessionByAddr(key)
 }
 
 func (l *Listener) notifyReadError(err error) {
@@ -945,11 +1590,26 @@ func (l *Listener) notifyReadError(err error) {
 
 		// propagate read error to all sessions
 		l.sessionLock.RLock()
-		for _, s := range l.sessions {
+		for _, s := range l.sessionAddrs {
 			s.notifyReadError(err)
 		}
 		l.sessionLock.RUnlock()
 	})
+
+	// Accept of a sharded listener waits on the first shard
+	if l.group != nil && l != l.group.shards[0] {
+		l.group.shards[0].notifyReadError(err)
+	}
+}
+
+// SetDecryptFailurePolicy sets the decryption failure policy for sessions accepted afterwards,
+// packets failing decryption from unknown sources are always dropped and counted.
+func (l *Listener) SetDecryptFailurePolicy(policy DecryptFailurePolicy, limit int, callback func(s *UDPSession, failures int)) {
+	l.sessionLock.Lock()
+	defer l.sessionLock.Unlock()
+	l.decryptPolicy = policy
+	l.decryptLimit = limit
+	l.decryptCallback = callback
 }
 
 // SetReadBuffer sets the socket read buffer for the Listener
@@ -999,25 +1659,53 @@ func (l *Listener) Accept() (net.Conn, error) {
 	return l.AcceptKCP()
 }
 
-// AcceptKCP accepts a KCP connection
+// AcceptKCP accepts the next session like Accept, without the net.Conn
+// conversion, so the session settings are reachable.
 func (l *Listener) AcceptKCP() (*UDPSession, error) {
-	var timeout <-chan time.Time
-	if tdeadline, ok := l.rd.Load().(time.Time); ok && !tdeadline.IsZero() {
-		timer := time.NewTimer(time.Until(tdeadline))
-		defer timer.Stop()
+	return l.accept(context.Background())
+}
 
-		timeout = timer.C
-	}
+// AcceptContext accepts the next session like AcceptKCP, and returns
+// ctx.Err() if the context is done before one arrives, the deadline set with
+// SetDeadline still applies.
+func (l *Listener) AcceptContext(ctx context.Context) (*UDPSession, error) {
+	return l.accept(ctx)
+}
 
-	select {
-	case <-timeout:
-		return nil, errors.WithStack(errTimeout)
-	case c := <-l.chAccepts:
-		return c, nil
-	case <-l.chSocketReadError:
-		return nil, l.socketReadError.Load().(error)
-	case <-l.die:
-		return nil, errors.WithStack(io.ErrClosedPipe)
+func (l *Listener) accept(ctx context.Context) (*UDPSession, error) {
+	// the deadline may be changed while blocked
+	var deadline deadlineTimer
+	defer deadline.stop()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		l.rdLock.Lock()
+		rd, rdChanged := l.rd, l.chDeadline
+		l.rdLock.Unlock()
+		if !deadline.reset(rd) {
+			return nil, ErrTimeout
+		}
+
+		select {
+		case <-deadline.C:
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-rdChanged:
+		case c := <-l.chAccepts:
+			c.releaseEarlyData()
+			c.logEvent("accepted")
+			return c, nil
+		case <-l.chSocketReadError:
+			return nil, l.socketReadError.Load().(error)
+		case <-l.draining:
+			return nil, errors.WithStack(ErrClosed)
+		case <-l.die:
+			return nil, errors.WithStack(ErrClosed)
+		}
 	}
 }
 
@@ -1030,7 +1718,11 @@ func (l *Listener) SetDeadline(t time.Time) error {
 
 // SetReadDeadline implements the Conn SetReadDeadline method.
 func (l *Listener) SetReadDeadline(t time.Time) error {
-	l.rd.Store(t)
+	l.rdLock.Lock()
+	l.rd = t
+	close(l.chDeadline) // wake up blocked Accept calls
+	l.chDeadline = make(chan struct{})
+	l.rdLock.Unlock()
 	return nil
 }
 
@@ -1047,11 +1739,12 @@ func (l *Listener) Close() error {
 
 	var err error
 	if once {
+		releaseIORing(&l.uring)
 		if l.ownConn {
 			err = l.conn.Close()
 		}
 	} else {
-		err = errors.WithStack(io.ErrClosedPipe)
+		err = errors.WithStack(ErrClosed)
 	}
 	return err
 }
@@ -1065,16 +1758,25 @@ func (l *Listener) Control(f func(conn net.PacketConn) error) error {
 }
 
 // closeSession notify the listener that a session has closed
-func (l *Listener) closeSession(remote net.Addr) (ret bool) {
+func (l *Listener) closeSession(s *UDPSession) (ret bool) {
 	l.sessionLock.Lock()
 	defer l.sessionLock.Unlock()
-	if _, ok := l.sessions[remote.String()]; ok {
-		delete(l.sessions, remote.String())
+	key := addrKey(s.remoteAddr())
+	if l.sessions[s.kcp.conv] == s {
+		delete(l.sessions, s.kcp.conv)
+	}
+	if l.sessionAddrs[key] == s {
+		delete(l.sessionAddrs, key)
 		return true
 	}
 	return false
 }
 
+// Done returns a channel closed when the listener is closed, so that helpers
+// living as long as the listener, such as the port mappings of package
+// portmap, can stop with it.
+func (l *Listener) Done() <-chan struct{} { return l.die }
+
 // Addr returns the listener's network address, The Addr returned is shared by all invocations of Addr, so do not modify it.
 func (l *Listener) Addr() net.Addr { return l.conn.LocalAddr() }
 
@@ -1089,6 +1791,9 @@ func Listen(laddr string) (net.Listener, error) { return ListenWithOptions(laddr
 //
 // Check https://github.com/klauspost/reedsolomon for details
 func ListenWithOptions(laddr string, block BlockCrypt, dataShards, parityShards int) (*Listener, error) {
+	if err := checkFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
 	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -1101,44 +1806,39 @@ func ListenWithOptions(laddr string, block BlockCrypt, dataShards, parityShards
 	return serveConn(block, dataShards, parityShards, conn, true)
 }
 
-// ServeConn serves KCP protocol for a single packet connection.
+// ServeConn serves KCP protocol for a single packet connection of the caller,
+// which Close leaves open. See ListenWithConn for the Config counterpart.
 func ServeConn(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*Listener, error) {
+	if err := checkFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
 	return serveConn(block, dataShards, parityShards, conn, false)
 }
 
 func serveConn(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn, ownConn bool) (*Listener, error) {
+	l := newListener(block, dataShards, parityShards, conn, ownConn)
+	go l.monitor()
+	return l, nil
+}
+
+// newListener creates a listener on 'conn' without starting its read loop
+func newListener(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn, ownConn bool) *Listener {
 	l := new(Listener)
 	l.conn = conn
 	l.ownConn = ownConn
-	l.sessions = make(map[string]*UDPSession)
+	l.sessions = make(map[uint32]*UDPSession)
+	l.sessionAddrs = make(map[netip.AddrPort]*UDPSession)
 	l.chAccepts = make(chan *UDPSession, acceptBacklog)
 	l.chSessionClosed = make(chan net.Addr)
 	l.die = make(chan struct{})
+	l.draining = make(chan struct{})
 	l.dataShards = dataShards
 	l.parityShards = parityShards
 	l.block = block
 	l.chSocketReadError = make(chan struct{})
-	go l.monitor()
-	return l, nil
-}
-
-// monitor continuously reads packets from the listener's connection
-func (l *Listener) monitor() {
-	buf := make([]byte, mtuLimit)
-	for {
-		select {
-		case <-l.die:
-			return
-		default:
-		}
-
-		if n, addr, err := l.conn.ReadFrom(buf); err == nil {
-			l.packetInput(buf[:n], addr)
-		} else {
-			l.notifyReadError(err)
-			return
-		}
-	}
+	l.earlyDataLimit = defaultEarlyDataLimit
+	l.chDeadline = make(chan struct{})
+	return l
 }
 
 // Dial connects to the remote address "raddr" on the network "udp" without encryption and FEC
@@ -1152,34 +1852,25 @@ func Dial(raddr string) (net.Conn, error) { return DialWithOptions(raddr, nil, 0
 //
 // Check https://github.com/klauspost/reedsolomon for details
 func DialWithOptions(raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
-	// network type detection
-	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	network := "udp4"
-	if udpaddr.IP.To4() == nil {
-		network = "udp"
-	}
-
-	conn, err := net.ListenUDP(network, nil)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-
-	var convid uint32
-	binary.Read(rand.Reader, binary.LittleEndian, &convid)
-	return newUDPSession(convid, dataShards, parityShards, nil, conn, true, udpaddr, block), nil
+	return DialWithBinding(raddr, nil, block, dataShards, parityShards)
 }
 
-// NewConn4 establishes a session and talks KCP protocol over a packet connection.
+// NewConn4 establishes a session and talks KCP protocol over a packet connection,
+// 'ownConn' makes Close of the session close 'conn'.
 func NewConn4(convid uint32, raddr net.Addr, block BlockCrypt, dataShards, parityShards int, ownConn bool, conn net.PacketConn) (*UDPSession, error) {
-	return newUDPSession(convid, dataShards, parityShards, nil, conn, ownConn, raddr, block), nil
+	if err := checkFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+	return newUDPSession(context.Background(), convid, dataShards, parityShards, nil, conn, ownConn, raddr, block), nil
 }
 
-// NewConn3 establishes a session and talks KCP protocol over a packet connection.
+// NewConn3 establishes a session and talks KCP protocol over a packet connection,
+// which Close of the session leaves open.
 func NewConn3(convid uint32, raddr net.Addr, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
-	return newUDPSession(convid, dataShards, parityShards, nil, conn, false, raddr, block), nil
+	if err := checkFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+	return newUDPSession(context.Background(), convid, dataShards, parityShards, nil, conn, false, raddr, block), nil
 }
 
 // NewConn2 establishes a session and talks KCP protocol over a packet connection.
@@ -8,12 +8,35 @@
 package safeudp
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/xtaci/smux"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // MockPacketConn 模拟 PacketConn 用于测试
@@ -96,21 +119,22 @@ func createTestSession(t *testing.T, mockConn *MockPacketConn) *UDPSession {
 	// Create a mock listener to prevent automatic readLoop startup
 	mockListener := &Listener{
 		conn:              mockConn,
-		sessions:          make(map[string]*UDPSession),
+		sessions:          make(map[uint32]*UDPSession),
+		sessionAddrs:      make(map[netip.AddrPort]*UDPSession),
 		chAccepts:         make(chan *UDPSession, 10),
 		chSessionClosed:   make(chan net.Addr, 10),
 		die:               make(chan struct{}),
 		chSocketReadError: make(chan struct{}),
 	}
 
-	sess := newUDPSession(12345, 10, 3, mockListener, mockConn, false, remoteAddr, nil)
+	sess := newUDPSession(context.Background(), 12345, 10, 3, mockListener, mockConn, false, remoteAddr, nil)
 	return sess
 }
 
 // Test helper function to create a client session (with readLoop)
 func createClientSession(t *testing.T, mockConn *MockPacketConn) *UDPSession {
 	remoteAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.100"), Port: 9999}
-	sess := newUDPSession(12345, 10, 3, nil, mockConn, false, remoteAddr, nil)
+	sess := newUDPSession(context.Background(), 12345, 10, 3, nil, mockConn, false, remoteAddr, nil)
 	return sess
 }
 
@@ -253,7 +277,8 @@ func TestMonitor(t *testing.T) {
 
 		listener := &Listener{
 			conn:              mockConn,
-			sessions:          make(map[string]*UDPSession),
+			sessions:          make(map[uint32]*UDPSession),
+			sessionAddrs:      make(map[netip.AddrPort]*UDPSession),
 			chAccepts:         make(chan *UDPSession, 10),
 			chSessionClosed:   make(chan net.Addr, 10),
 			die:               make(chan struct{}),
@@ -370,4 +395,5636 @@ func TestErrorHandling(t *testing.T) {
 			t.Error("Expected xconnWriteError to be set")
 		}
 	})
+
+	t.Run("BatchTxReprobe", func(t *testing.T) {
+		mockConn := &MockPacketConn{}
+		mockBatchConn := &MockBatchConn{
+			MockPacketConn:  mockConn,
+			batchWriteError: &net.OpError{Op: "write", Err: os.NewSyscallError("sendmmsg", syscall.ENOBUFS)},
+		}
+		sess := createTestSession(t, mockConn)
+		sess.xconn = mockBatchConn
+		msgs := func() []ipv4.Message {
+			return []ipv4.Message{{Buffers: [][]byte{[]byte("probe")}, Addr: sess.remote}}
+		}
+
+		before := DefaultSnmp.Copy()
+		sess.tx(msgs())
+		after := DefaultSnmp.Copy()
+		if after.BatchTxFallbacks-before.BatchTxFallbacks != 1 || after.BatchTxTransient-before.BatchTxTransient != 1 {
+			t.Fatal("fallback not counted as transient")
+		}
+
+		// 退避期间直接使用默认发送
+		mockBatchConn.batchWriteError = nil
+		sess.tx(msgs())
+		if mockBatchConn.batchWriteCount != 0 || mockConn.writeCount != 2 {
+			t.Fatalf("batch used while backing off: batch %d, default %d", mockBatchConn.batchWriteCount, mockConn.writeCount)
+		}
+
+		// 退避结束后重新探测批量发送
+		sess.xconnRetry = time.Now()
+		sess.tx(msgs())
+		if mockBatchConn.batchWriteCount != 1 || sess.xconnWriteError != nil {
+			t.Fatal("batch send not probed again")
+		}
+	})
+}
+
+// TestDecryptFailurePolicy 测试解密失败处理策略
+func TestDecryptFailurePolicy(t *testing.T) {
+	block, _ := NewNoneBlockCrypt(nil)
+	garbage := make([]byte, 64)
+
+	t.Run("Terminate", func(t *testing.T) {
+		mockConn := &MockPacketConn{readError: net.ErrClosed}
+		sess := newUDPSession(context.Background(), 12345, 0, 0, nil, mockConn, false, mockConn.LocalAddr(), block)
+		sess.SetDecryptFailurePolicy(DecryptTerminate, 3, nil)
+
+		for i := 0; i < 2; i++ {
+			sess.packetInput(append([]byte(nil), garbage...))
+		}
+		if sess.isClosed() {
+			t.Fatal("session should tolerate failures below the limit")
+		}
+
+		sess.packetInput(append([]byte(nil), garbage...))
+		if !sess.isClosed() {
+			t.Fatal("session should be closed after reaching the limit")
+		}
+	})
+
+	t.Run("Callback", func(t *testing.T) {
+		mockConn := &MockPacketConn{readError: net.ErrClosed}
+		sess := newUDPSession(context.Background(), 12345, 0, 0, nil, mockConn, false, mockConn.LocalAddr(), block)
+		defer sess.Close()
+
+		var reported int
+		sess.SetDecryptFailurePolicy(DecryptCallback, 0, func(s *UDPSession, failures int) {
+			reported = failures
+		})
+		sess.packetInput(append([]byte(nil), garbage...))
+		sess.packetInput(append([]byte(nil), garbage...))
+		if reported != 2 {
+			t.Errorf("Expected 2 consecutive failures reported, got %d", reported)
+		}
+	})
+}
+
+// TestWriteAsync 测试异步写入在数据被确认后回调
+func TestWriteAsync(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+
+	chDone := make(chan error, 2)
+	if _, err := cli.WriteAsync([]byte("first"), func(err error) { chDone <- err }); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetNoDelay(1, 10, 2, 1)
+
+	select {
+	case err := <-chDone:
+		if err != nil {
+			t.Fatalf("Expected successful completion, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write completion was not notified")
+	}
+
+	// 会话关闭时未确认的写入应该以错误结束
+	s.Close()
+	cli.WriteAsync([]byte("second"), func(err error) { chDone <- err })
+	cli.Close()
+	select {
+	case err := <-chDone:
+		if err == nil {
+			t.Fatal("Expected an error for unacknowledged write")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending write was not notified on close")
+	}
+}
+
+// TestFlushSync 测试 Flush 立即发出排队的数据，Sync 等待数据被确认
+func TestFlushSync(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// 没有排队的数据时立即返回
+	if err := cli.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 更新间隔很长并且延迟写入，只有 Flush 能及时发出数据
+	cli.SetNoDelay(0, 5000, 0, 1)
+	cli.SetWriteDelay(true)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := cli.Write([]byte("flush")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 16)
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "flush" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+
+	// Sync 在确认到达后返回
+	if _, err := cli.Write([]byte("sync")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cli.mu.Lock()
+	inflight := cli.kcp.snd_buf.Len() + cli.kcp.snd_queue.Len()
+	cli.mu.Unlock()
+	if inflight != 0 {
+		t.Fatalf("%d segments unacknowledged after Sync", inflight)
+	}
+
+	cli.Close()
+	if err := cli.Flush(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Flush on a closed session returned %v", err)
+	}
+}
+
+// TestConnectionMigration 测试 NAT 重新绑定后会话迁移到新地址
+func TestConnectionMigration(t *testing.T) {
+	network := newSimNetwork(0)
+	block, _ := NewNoneBlockCrypt(nil)
+	l, cli := newSimPair(t, network, block, 0, 0)
+
+	buf := make([]byte, 16)
+	if _, err := cli.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetNoDelay(1, 10, 2, 1)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// 客户端源地址变化
+	cliConn := cli.conn.(*simConn)
+	cliConn.rebind()
+	if _, err := cli.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := cli.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Fatalf("unexpected reply %q", buf[:n])
+	}
+	if s.RemoteAddr().String() != cliConn.LocalAddr().String() {
+		t.Errorf("Expected session migrated to %v, got %v", cliConn.LocalAddr(), s.RemoteAddr())
+	}
+	l.sessionLock.RLock()
+	defer l.sessionLock.RUnlock()
+	if len(l.sessions) != 1 {
+		t.Errorf("Expected 1 session after migration, got %d", len(l.sessions))
+	}
+}
+
+// TestMigrationHold 测试新地址的数据在路径验证前被扣留，旧地址的应答不能验证新路径
+func TestMigrationHold(t *testing.T) {
+	network := newSimNetwork(0)
+	block, _ := NewNoneBlockCrypt(nil)
+	l, cli := newSimPair(t, network, block, 0, 0)
+
+	buf := make([]byte, 64)
+	if _, err := cli.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(conn net.PacketConn, seg segment) {
+		pkt := make([]byte, cryptHeaderSize+IKCP_OVERHEAD+len(seg.data))
+		copy(seg.encode(pkt[cryptHeaderSize:]), seg.data)
+		binary.LittleEndian.PutUint32(pkt[nonceSize:], crc32.ChecksumIEEE(pkt[cryptHeaderSize:]))
+		conn.WriteTo(pkt, l.Addr())
+	}
+	expectHeld := func() {
+		t.Helper()
+		s.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, err := s.Read(buf); err == nil {
+			t.Fatalf("Packet of an unvalidated path delivered: %q", buf[:n])
+		}
+	}
+
+	// 新地址的数据只触发路径挑战
+	raw := network.listen()
+	defer raw.Close()
+	send(raw, segment{conv: cli.GetConv(), cmd: IKCP_CMD_PUSH, sn: 1, wnd: 128, data: []byte("moved")})
+	expectHeld()
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := raw.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := buf[cryptHeaderSize:n]
+	if probe[4] != IKCP_CMD_PROBE {
+		t.Fatalf("Expected a path challenge, got cmd %d", probe[4])
+	}
+	token := binary.LittleEndian.Uint32(probe[IKCP_SN_OFFSET:])
+
+	// 旧地址回显挑战不算验证
+	send(cli.conn, segment{conv: cli.GetConv(), cmd: IKCP_CMD_PACK, sn: token, una: 0, wnd: 128})
+	expectHeld()
+	if s.RemoteAddr().String() != cli.LocalAddr().String() {
+		t.Fatalf("Migrated to %v on an answer from the old path", s.RemoteAddr())
+	}
+
+	// 新地址回显挑战后，扣留的数据才交给会话
+	send(raw, segment{conv: cli.GetConv(), cmd: IKCP_CMD_PACK, sn: token, wnd: 128})
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "moved" {
+		t.Fatalf("Expected the held packet, got %q", buf[:n])
+	}
+	if s.RemoteAddr().String() != raw.LocalAddr().String() {
+		t.Errorf("Expected session migrated to %v, got %v", raw.LocalAddr(), s.RemoteAddr())
+	}
+}
+
+// TestConvCollision 测试不同地址的两个客户端选中同一会话号时，监听器按地址分开两个会话而不合并
+func TestConvCollision(t *testing.T) {
+	block, _ := NewNoneBlockCrypt(nil)
+	for _, block := range []BlockCrypt{nil, block} {
+		network := newSimNetwork(0)
+		l, cli := newSimPair(t, network, block, 0, 0)
+		other, err := NewConn4(cli.GetConv(), l.Addr(), block, 0, 0, true, network.listen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		other.SetNoDelay(1, 10, 2, 1)
+
+		buf := make([]byte, 16)
+		accept := func(c *UDPSession, msg string) *UDPSession {
+			if _, err := c.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			s, err := l.AcceptKCP()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetNoDelay(1, 10, 2, 1)
+			s.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := s.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != msg {
+				t.Fatalf("Expected %q, got %q", msg, buf[:n])
+			}
+			return s
+		}
+		s1 := accept(cli, "one")
+		defer s1.Close()
+		s2 := accept(other, "two")
+		defer s2.Close()
+
+		if s1 == s2 || s1.RemoteAddr().String() != cli.LocalAddr().String() || s2.RemoteAddr().String() != other.LocalAddr().String() {
+			t.Fatalf("Sessions merged: %v and %v", s1.RemoteAddr(), s2.RemoteAddr())
+		}
+		for _, p := range []struct {
+			s, c *UDPSession
+			msg  string
+		}{{s1, cli, "pong one"}, {s2, other, "pong two"}} {
+			if _, err := p.s.Write([]byte(p.msg)); err != nil {
+				t.Fatal(err)
+			}
+			p.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := p.c.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != p.msg {
+				t.Fatalf("Expected %q, got %q", p.msg, buf[:n])
+			}
+		}
+	}
+}
+
+// TestStatelessCookies 测试监听器先用无状态 cookie 应答新会话，伪造源地址的洪泛不会创建会话
+func TestStatelessCookies(t *testing.T) {
+	shards := [][2]int{{0, 0}}
+	if fecEnabled {
+		shards = append(shards, [2]int{10, 3})
+	}
+	for _, fec := range shards {
+		network := newSimNetwork(0)
+		block, _ := NewNoneBlockCrypt(nil)
+		l, cli := newSimPair(t, network, block, fec[0], fec[1])
+		l.SetStatelessCookies(true)
+
+		// 伪造的首包只得到一个不大于它的 cookie 应答
+		raw := network.listen()
+		spoof := func(seg segment) {
+			buf := make([]byte, cryptHeaderSize+IKCP_OVERHEAD)
+			seg.encode(buf[cryptHeaderSize:])
+			binary.LittleEndian.PutUint32(buf[nonceSize:], crc32.ChecksumIEEE(buf[cryptHeaderSize:]))
+			raw.WriteTo(buf, l.Addr())
+		}
+		before := DefaultSnmp.Copy()
+		for conv := uint32(1); conv <= 100; conv++ {
+			spoof(segment{conv: conv, cmd: IKCP_CMD_PUSH, wnd: 32})
+		}
+		select {
+		case pkt := <-raw.chIn:
+			if len(pkt.data) != cryptHeaderSize+IKCP_OVERHEAD || pkt.data[cryptHeaderSize+4] != IKCP_CMD_COOKIE {
+				t.Fatalf("unexpected challenge of %d bytes", len(pkt.data))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no cookie challenge")
+		}
+
+		// 伪造的 cookie 被拒绝
+		spoof(segment{conv: 1, cmd: IKCP_CMD_COOKIE, ts: 1, sn: 2, una: 3})
+		deadline := time.Now().Add(2 * time.Second)
+		for DefaultSnmp.Copy().CookieRejects == before.CookieRejects && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		after := DefaultSnmp.Copy()
+		if after.CookieRejects == before.CookieRejects {
+			t.Fatal("forged cookie not rejected")
+		}
+		if after.CookieChallenges-before.CookieChallenges < 100 {
+			t.Fatalf("%d challenges for 100 spoofed packets", after.CookieChallenges-before.CookieChallenges)
+		}
+		l.sessionLock.RLock()
+		n := len(l.sessions)
+		l.sessionLock.RUnlock()
+		if n != 0 {
+			t.Fatalf("%d sessions created by spoofed packets", n)
+		}
+
+		// 真实的客户端回显 cookie 后建立会话
+		go func() {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			s.SetNoDelay(1, 10, 2, 1)
+			io.Copy(s, s)
+		}()
+		msg := bytes.Repeat([]byte("cookie"), 4096)
+		go cli.Write(msg)
+		echo := make([]byte, len(msg))
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(cli, echo); err != nil {
+			t.Fatal(fec, err)
+		}
+		if !bytes.Equal(msg, echo) {
+			t.Fatal("echoed data mismatch")
+		}
+		cli.mu.Lock()
+		cookie := cli.kcp.cookie
+		cli.mu.Unlock()
+		if cookie != nil {
+			t.Fatal("cookie kept after the listener answered")
+		}
+	}
+}
+
+// TestMaxSessions 测试监听器的会话上限，以及拒绝和驱逐最久未活动会话两种策略
+func TestMaxSessions(t *testing.T) {
+	network := newSimNetwork(0)
+	l, first := newSimPair(t, network, nil, 0, 0)
+	if l.SetMaxSessions(1, EvictionPolicy(7)) == nil {
+		t.Fatal("invalid eviction policy accepted")
+	}
+	if err := l.SetMaxSessions(2, EvictionReject); err != nil {
+		t.Fatal(err)
+	}
+	dial := func(conv uint32) *UDPSession {
+		cli, err := NewConn4(conv, l.Addr(), nil, 0, 0, true, network.listen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetNoDelay(1, 10, 2, 1)
+		t.Cleanup(func() { cli.Close() })
+		return cli
+	}
+	accept := func(cli *UDPSession) *UDPSession {
+		cli.Write([]byte("hello"))
+		l.SetDeadline(time.Now().Add(2 * time.Second))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	sessions := func() int {
+		l.sessionLock.RLock()
+		defer l.sessionLock.RUnlock()
+		return len(l.sessions)
+	}
+
+	idle := accept(first)
+	second := dial(1001)
+	active := accept(second)
+
+	// 达到上限后新会话被拒绝
+	before := DefaultSnmp.Copy()
+	third := dial(1002)
+	third.Write([]byte("hello"))
+	l.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := l.AcceptKCP(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("session accepted beyond the cap: %v", err)
+	}
+	if n := sessions(); n != 2 {
+		t.Fatalf("%d sessions at a cap of 2", n)
+	}
+	if DefaultSnmp.Copy().SessionRejects == before.SessionRejects {
+		t.Fatal("rejected session not counted")
+	}
+
+	// 驱逐最久没有收到数据的会话，先让活跃会话收到更新的数据，
+	// 以免第三个客户端的重传在切换策略后先到达
+	time.Sleep(20 * time.Millisecond)
+	second.Write([]byte("ping"))
+	buf := make([]byte, 9)
+	active.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(active, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetMaxSessions(2, EvictionLRU); err != nil {
+		t.Fatal(err)
+	}
+	if s := accept(third); s.RemoteAddr().String() != third.LocalAddr().String() {
+		t.Fatal("unexpected session accepted")
+	}
+	if !idle.isClosed() || active.isClosed() {
+		t.Fatal("evicted a session other than the idle one")
+	}
+	if n := sessions(); n != 2 {
+		t.Fatalf("%d sessions at a cap of 2", n)
+	}
+	if DefaultSnmp.Copy().SessionEvictions == before.SessionEvictions {
+		t.Fatal("eviction not counted")
+	}
+}
+
+// TestSourceLimits 测试监听器在解密之前按源地址过滤，以及每个地址的包速率和新会话速率限制
+func TestSourceLimits(t *testing.T) {
+	network := newSimNetwork(0)
+	l, cli := newSimPair(t, network, nil, 0, 0)
+	if l.SetSourceLimits(SourceLimits{PacketsPerSec: -1}) == nil {
+		t.Fatal("negative limit accepted")
+	}
+
+	// 被过滤的地址不会创建会话
+	blocked := cli.LocalAddr().String()
+	l.SetSourceFilter(func(addr net.Addr) bool { return addr.String() != blocked })
+	before := DefaultSnmp.Copy()
+	cli.Write([]byte("hello"))
+	l.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := l.AcceptKCP(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("session accepted from a filtered address: %v", err)
+	}
+	if DefaultSnmp.Copy().InSourceDrops == before.InSourceDrops {
+		t.Fatal("filtered packets not counted")
+	}
+	l.SetSourceFilter(nil)
+	l.SetDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 同一地址的第二个会话要等到新会话令牌恢复
+	if err := l.SetSourceLimits(SourceLimits{NewSessionsPerSec: 1}); err != nil {
+		t.Fatal(err)
+	}
+	dial := func(conv uint32) *UDPSession {
+		c, err := NewConn4(conv, l.Addr(), nil, 0, 0, true, network.listen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetNoDelay(1, 10, 2, 1)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	dial(2001).Write([]byte("hello"))
+	l.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := l.AcceptKCP(); err != nil {
+		t.Fatal(err)
+	}
+	dial(2002).Write([]byte("hello"))
+	l.SetDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := l.AcceptKCP(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("session accepted beyond the rate: %v", err)
+	}
+	l.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := l.AcceptKCP(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超过包速率的数据包在解密之前被丢弃
+	if err := l.SetSourceLimits(SourceLimits{PacketsPerSec: 10}); err != nil {
+		t.Fatal(err)
+	}
+	before = DefaultSnmp.Copy()
+	raw := network.listen()
+	pkt := make([]byte, IKCP_OVERHEAD)
+	(&segment{conv: 3000, cmd: IKCP_CMD_WASK}).encode(pkt)
+	for i := 0; i < 50; i++ {
+		raw.WriteTo(pkt, l.Addr())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for DefaultSnmp.Copy().InSourceDrops-before.InSourceDrops < 40 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 50 packets dropped at 10 per second", DefaultSnmp.Copy().InSourceDrops-before.InSourceDrops)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestShutdown 测试监听器优雅关闭：停止接受新会话，等待已有会话的数据被确认后再关闭
+func TestShutdown(t *testing.T) {
+	network := newSimNetwork(0.05)
+	l, cli := newSimPair(t, network, nil, 0, 0)
+	cli.Write([]byte("hello"))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetNoDelay(1, 10, 2, 1)
+
+	msg := bytes.Repeat([]byte("drain"), 20000)
+	if _, err := s.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	chShutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		chShutdown <- l.Shutdown(ctx)
+	}()
+
+	// 关闭期间新的会话被忽略，Accept 立即失败
+	time.Sleep(20 * time.Millisecond)
+	if _, err := l.AcceptKCP(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Accept during shutdown: %v", err)
+	}
+	late, err := NewConn4(4001, l.Addr(), nil, 0, 0, true, network.listen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	late.Write([]byte("hello"))
+
+	buf := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("drained data mismatch")
+	}
+	if err := <-chShutdown; err != nil {
+		t.Fatal(err)
+	}
+	if !s.isClosed() {
+		t.Fatal("session open after shutdown")
+	}
+	l.sessionLock.RLock()
+	_, found := l.sessions[4001]
+	l.sessionLock.RUnlock()
+	if found {
+		t.Fatal("session created during shutdown")
+	}
+
+	// 对端不再确认时在上下文结束后强制关闭
+	l, cli = newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	cli.Write([]byte("hello"))
+	s, err = l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Close()
+	s.Write(msg)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown: expected context.DeadlineExceeded, got %v", err)
+	}
+	if !s.isClosed() {
+		t.Fatal("session open after shutdown")
+	}
+}
+
+// TestListenerSessions 测试枚举监听器的会话，以及在遍历中关闭会话
+func TestListenerSessions(t *testing.T) {
+	network := newSimNetwork(0)
+	l, first := newSimPair(t, network, nil, 0, 0)
+	second, err := NewConn4(5001, l.Addr(), nil, 0, 0, true, network.listen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	for _, cli := range []*UDPSession{first, second} {
+		cli.Write([]byte("hello"))
+		if _, err := l.AcceptKCP(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos := l.Sessions()
+	if len(infos) != 2 {
+		t.Fatalf("%d sessions listed", len(infos))
+	}
+	for _, info := range infos {
+		cli := first
+		if info.Conv == 5001 {
+			cli = second
+		}
+		if info.RemoteAddr.String() != cli.LocalAddr().String() || info.Session.GetConv() != info.Conv {
+			t.Fatalf("session %d listed with remote %v", info.Conv, info.RemoteAddr)
+		}
+		if info.Uptime <= 0 || info.Idle < 0 || info.RTO <= 0 {
+			t.Fatalf("unexpected session info %+v", info)
+		}
+	}
+
+	// 遍历时关闭指定的会话
+	l.RangeSessions(func(s *UDPSession) bool {
+		if s.GetConv() == 5001 {
+			s.Close()
+			return false
+		}
+		return true
+	})
+	if infos := l.Sessions(); len(infos) != 1 || infos[0].Conv == 5001 {
+		t.Fatalf("sessions after close: %+v", infos)
+	}
+}
+
+// TestReadWorkers 测试监听器的并行读取协程，多个会话同时回显数据且保持顺序
+func TestReadWorkers(t *testing.T) {
+	network := newSimNetwork(0.02)
+	block, _ := NewNoneBlockCrypt(nil)
+	if cryptoEnabled {
+		block, _ = keyBlockCrypt(make([]byte, 32))
+	}
+	l, first := newSimPair(t, network, block, 0, 0)
+	if l.SetReadWorkers(-1) == nil {
+		t.Fatal("negative workers accepted")
+	}
+	if err := l.SetReadWorkers(4); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			s.SetNoDelay(1, 10, 2, 1)
+			go io.Copy(s, s)
+		}
+	}()
+
+	clients := []*UDPSession{first}
+	for conv := uint32(6001); conv < 6008; conv++ {
+		cli, err := NewConn4(conv, l.Addr(), block, 0, 0, true, network.listen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetNoDelay(1, 10, 2, 1)
+		defer cli.Close()
+		clients = append(clients, cli)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(clients))
+	for k, cli := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := make([]byte, 32*1024)
+			for i := range msg {
+				msg[i] = byte(i*7 + k)
+			}
+			go cli.Write(msg)
+			echo := make([]byte, len(msg))
+			cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(cli, echo); err != nil {
+				errs <- err
+			} else if !bytes.Equal(msg, echo) {
+				errs <- fmt.Errorf("client %d: echoed data mismatch", k)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// 关闭并行读取后回到读取循环内处理
+	if err := l.SetReadWorkers(0); err != nil {
+		t.Fatal(err)
+	}
+	first.Write([]byte("inline"))
+	buf := make([]byte, 6)
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(first, buf); err != nil || string(buf) != "inline" {
+		t.Fatal("read failed", err)
+	}
+
+	// 会话按会话号选择工作协程，迁移到新地址时不换协程
+	if h := l.readHash([]byte("sealed"), first.LocalAddr()); h != convHash(first.GetConv()) {
+		t.Fatal("known session hashed by address")
+	}
+	plain := new(Listener)
+	pkt := make([]byte, IKCP_OVERHEAD)
+	binary.LittleEndian.PutUint32(pkt, 6001)
+	if plain.readHash(pkt, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}) != plain.readHash(pkt, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000}) {
+		t.Fatal("plaintext conversation hashed by address")
+	}
+
+	// 被替换的工作协程先处理完队列中的数据包
+	w := &readWorkers{queues: []chan readPacket{make(chan readPacket, 8)}, die: make(chan struct{})}
+	for range 5 {
+		w.enqueue(0, []byte("queued"), first.LocalAddr(), pktinfo{})
+	}
+	close(w.die)
+	w.done.Add(1)
+	l.readWorker(w, w.queues[0], block)
+	if n := len(w.queues[0]); n != 0 {
+		t.Fatal(n, "packets left in a replaced queue")
+	}
+
+	// 替换之后不再向旧队列放入数据包，以免无人处理
+	if err := l.SetReadWorkers(2); err != nil {
+		t.Fatal(err)
+	}
+	old := l.workers.Load()
+	if err := l.SetReadWorkers(0); err != nil {
+		t.Fatal(err)
+	}
+	if queued, replaced := old.enqueue(0, []byte("late"), first.LocalAddr(), pktinfo{}); queued || !replaced {
+		t.Fatal("packet queued to replaced workers")
+	}
+	for _, q := range old.queues {
+		if len(q) != 0 {
+			t.Fatal("packet stranded in a replaced queue")
+		}
+	}
+}
+
+// TestPacketFilter 测试监听器在解密前的数据包钩子：共享端口的其他协议、丢弃与放行
+func TestPacketFilter(t *testing.T) {
+	network := newSimNetwork(0)
+	block, _ := NewNoneBlockCrypt(nil)
+	l, cli := newSimPair(t, network, block, 0, 0)
+	var garbage atomic.Int32
+	l.SetGarbageHandler(func(GarbagePacket) { garbage.Add(1) }, 100)
+
+	blocked := cli.LocalAddr().String()
+	l.SetPacketFilter(func(raw []byte, addr net.Addr) Verdict {
+		if bytes.Equal(raw, []byte("PING")) {
+			l.conn.WriteTo([]byte("PONG"), addr)
+			return VerdictConsumed
+		}
+		if addr.String() == blocked {
+			return VerdictDrop
+		}
+		return VerdictPass
+	})
+
+	// 其他协议的数据包由钩子应答，不当作垃圾包
+	raw := network.listen()
+	raw.WriteTo([]byte("PING"), l.Addr())
+	raw.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	if n, _, err := raw.ReadFrom(buf); err != nil || string(buf[:n]) != "PONG" {
+		t.Fatal("no answer from the packet filter", err)
+	}
+
+	before := DefaultSnmp.Copy()
+	cli.Write([]byte("hello"))
+	l.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := l.AcceptKCP(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("session accepted from a dropped address: %v", err)
+	}
+	if DefaultSnmp.Copy().InSourceDrops == before.InSourceDrops {
+		t.Fatal("dropped packets not counted")
+	}
+	if garbage.Load() != 0 {
+		t.Fatal("filtered packets reported as garbage")
+	}
+
+	l.SetPacketFilter(nil)
+	l.SetDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v := VerdictConsumed.String(); v != "consumed" {
+		t.Fatalf("verdict %q", v)
+	}
+}
+
+// TestWriteAtomic 测试多缓冲区原子写入
+func TestWriteAtomic(t *testing.T) {
+	mockConn := &MockPacketConn{readError: net.ErrClosed}
+	sess := newUDPSession(context.Background(), 12345, 0, 0, nil, mockConn, false, mockConn.LocalAddr(), nil)
+	defer sess.Close()
+	sess.SetWindowSize(4, 4)
+	mss := int(sess.kcp.mss)
+
+	// 超过发送窗口的写入永远无法完成，应该立即失败
+	if _, err := sess.WriteAtomic([][]byte{make([]byte, mss*5)}); err == nil {
+		t.Fatal("Expected error for write larger than the send window")
+	}
+
+	if _, err := sess.WriteAtomic([][]byte{make([]byte, mss), make([]byte, mss*2)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 剩余窗口只能容纳一个分段，两个分段的写入在超时后不应该入队任何数据
+	waitsnd := sess.kcp.WaitSnd()
+	sess.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := sess.WriteAtomic([][]byte{make([]byte, mss), make([]byte, 1)}); err == nil {
+		t.Fatal("Expected timeout when the window can't fit the buffers")
+	}
+	if sess.kcp.WaitSnd() != waitsnd {
+		t.Errorf("Expected nothing enqueued, waitsnd changed from %d to %d", waitsnd, sess.kcp.WaitSnd())
+	}
+}
+
+// TestFECMemoryPressure 测试内存压力下 FEC 编码器暂停生成校验分片，并在压力解除后自动恢复
+func TestFECMemoryPressure(t *testing.T) {
+	if !fecEnabled {
+		t.Skip("built without FEC")
+	}
+	defer SetMemoryPressure(false)
+
+	enc := newFECEncoder(2, 1, 0, FECBackendAuto)
+	pkt := func() []byte { return make([]byte, fecHeaderSizePlus+16) }
+
+	suspended := atomic.LoadUint64(&DefaultSnmp.FECSuspended)
+	SetMemoryPressure(true)
+	if !MemoryPressure() {
+		t.Fatal("memory pressure not signaled")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.FECSuspended) != suspended+1 {
+		t.Fatal("suspension not counted")
+	}
+	if ps := enc.encode(pkt(), 1000); ps != nil {
+		t.Fatal("parity generated under memory pressure")
+	}
+
+	// 压力解除后，被中断的分组不生成校验分片
+	SetMemoryPressure(false)
+	if ps := enc.encode(pkt(), 1000); ps != nil {
+		t.Fatal("parity generated for an interrupted group")
+	}
+
+	// 新的分组恢复正常编码，序号保持对齐
+	enc.encode(pkt(), 1000)
+	b := pkt()
+	ps := enc.encode(b, 1000)
+	if len(ps) != 1 {
+		t.Fatalf("expected 1 parity shard after recovery, got %d", len(ps))
+	}
+	if seqid := binary.LittleEndian.Uint32(b); seqid != 4 {
+		t.Fatalf("unexpected seqid %d after recovery", seqid)
+	}
+}
+
+// TestFECDecodeGroup 测试解码器收齐一组缓存的分片后才恢复：完整的数据分片不被
+// 伪造的恢复结果替换，每个丢失的数据包只恢复一次
+func TestFECDecodeGroup(t *testing.T) {
+	if !fecEnabled {
+		t.Skip("built without FEC")
+	}
+	const ds, ps = 4, 3
+	enc := newFECEncoder(ds, ps, 0, FECBackendMatrix)
+	var data, parity [][]byte
+	for i := 0; i < ds; i++ {
+		pkt := make([]byte, fecHeaderSizePlus+64+i*11)
+		for k := fecHeaderSizePlus; k < len(pkt); k++ {
+			pkt[k] = byte(i*7 + k)
+		}
+		for _, p := range enc.encode(pkt, 0xffffffff) {
+			parity = append(parity, append([]byte(nil), p...))
+		}
+		data = append(data, pkt)
+	}
+
+	// 丢失两个数据包，先到的校验分片与数据分片交错
+	dec := newFECDecoder(ds, ps, FECBackendMatrix)
+	var recovered [][]byte
+	for _, pkt := range [][]byte{parity[2], data[1], parity[0], data[3]} {
+		recovered = append(recovered, dec.decode(fecPacket(pkt))...)
+	}
+	if len(recovered) != 2 {
+		t.Fatalf("%d packets recovered", len(recovered))
+	}
+	for i, r := range recovered {
+		want := data[[]int{0, 2}[i]]
+		if sz := binary.LittleEndian.Uint16(r); string(r[2:sz]) != string(want[fecHeaderSize+2:]) {
+			t.Fatalf("packet %d recovered wrong", i)
+		}
+	}
+}
+
+// TestAdaptiveDup 测试自适应冗余发送策略
+func TestAdaptiveDup(t *testing.T) {
+	p := &dupPolicy{maxDup: 2, threshold: 0.05, rttBudget: 200 * time.Millisecond}
+
+	if n := p.next(0, 0.01, 50*time.Millisecond); n != 0 {
+		t.Errorf("low loss: expected 0 copies, got %d", n)
+	}
+	if n := p.next(0, 0.06, 50*time.Millisecond); n != 1 {
+		t.Errorf("loss above threshold: expected 1 copy, got %d", n)
+	}
+	if n := p.next(1, 0.5, 50*time.Millisecond); n != 2 {
+		t.Errorf("heavy loss: expected copies capped at 2, got %d", n)
+	}
+	if n := p.next(1, 0.03, 50*time.Millisecond); n != 1 {
+		t.Errorf("hysteresis: expected 1 copy kept, got %d", n)
+	}
+	if n := p.next(2, 0.5, 300*time.Millisecond); n != 0 {
+		t.Errorf("over rtt budget: expected 0 copies, got %d", n)
+	}
+
+	sess := newUDPSession(context.Background(), 1, 0, 0, nil, &MockPacketConn{readError: net.ErrClosed}, true, &net.UDPAddr{}, nil)
+	defer sess.Close()
+	sess.SetDup(2)
+	if sess.GetDup() != 2 {
+		t.Fatalf("SetDup: got %d", sess.GetDup())
+	}
+	sess.SetAdaptiveDup(2, 0.05, 0)
+	if sess.GetDup() != 0 {
+		t.Fatalf("SetAdaptiveDup should start without duplication, got %d", sess.GetDup())
+	}
+}
+
+// TestEarlyDataLimit 测试 Accept 之前到达的数据被限量缓存，Accept 之后完整交付
+func TestEarlyDataLimit(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	l.SetEarlyDataLimit(4 * 1024)
+	if l.EarlyDataLimit() != 4*1024 {
+		t.Fatalf("unexpected early data limit %d", l.EarlyDataLimit())
+	}
+
+	msg := make([]byte, 256*1024)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go cli.Write(msg)
+
+	// 等待会话建立并缓存早期数据
+	var pending *UDPSession
+	for i := 0; i < 100 && pending == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		l.sessionLock.RLock()
+		for _, s := range l.sessions {
+			pending = s
+		}
+		l.sessionLock.RUnlock()
+	}
+	if pending == nil {
+		t.Fatal("session not created")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	pending.mu.Lock()
+	buffered := pending.kcp.rcv_queue.Len() + pending.kcp.rcv_buf.Len()
+	wnd := pending.kcp.rcv_wnd
+	pending.mu.Unlock()
+	if buffered*int(pending.kcp.mss) > 4*1024 {
+		t.Fatalf("early data exceeds limit: %d segments buffered, window %d", buffered, wnd)
+	}
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetNoDelay(1, 10, 2, 1)
+
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch after accept")
+	}
+}
+
+// TestRateLimit 测试会话发送速率限制
+func TestRateLimit(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	cli.SetWindowSize(1024, 1024)
+	cli.SetRateLimit(256 * 1024)
+
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetWindowSize(1024, 1024)
+		io.Copy(io.Discard, s)
+	}()
+
+	msg := make([]byte, 128*1024)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := cli.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 等待全部数据被确认
+	waitsnd := func() int {
+		cli.mu.Lock()
+		defer cli.mu.Unlock()
+		return cli.kcp.WaitSnd()
+	}
+	for waitsnd() > 0 && time.Since(start) < 10*time.Second {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 256KB 在 256KB/s 的限速下至少需要约 1 秒 (扣除初始突发)
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatalf("rate limit not enforced, 256KB sent in %v", elapsed)
+	}
+
+	b := newTokenBucket(1000)
+	if !b.allow(mtuLimit) || b.allow(mtuLimit) {
+		t.Fatal("receive bucket should allow exactly the burst")
+	}
+}
+
+// recordScheduler 记录调度的报文类型，并把纯确认报文排在最前
+type recordScheduler struct {
+	mu      sync.Mutex
+	classes map[PacketClass]int
+}
+
+func (r *recordScheduler) Schedule(pkts []Packet) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range pkts {
+		r.classes[p.Class]++
+	}
+	sort.SliceStable(pkts, func(i, j int) bool { return pkts[i].Class == PacketAck && pkts[j].Class != PacketAck })
+	return 0
+}
+
+// TestScheduler 测试自定义发送调度器
+func TestScheduler(t *testing.T) {
+	if !fecEnabled {
+		t.Skip("built without FEC")
+	}
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 10, 3)
+	sched := &recordScheduler{classes: make(map[PacketClass]int)}
+	cli.SetScheduler(sched)
+
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	msg := bytes.Repeat([]byte("scheduler"), 4096)
+	go cli.Write(msg)
+	echo := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, echo) {
+		t.Fatal("echoed data mismatch")
+	}
+
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	if sched.classes[PacketData] == 0 || sched.classes[PacketParity] == 0 {
+		t.Fatalf("unexpected packet classes scheduled: %v", sched.classes)
+	}
+}
+
+// TestPrioritize 测试确认和控制报文排在数据之前，并且不等待发送限速
+func TestPrioritize(t *testing.T) {
+	network := newSimNetwork(0)
+	_, cli := newSimPair(t, network, nil, 0, 0)
+	sink := network.listen()
+	defer sink.Close()
+
+	queue := func(classes []PacketClass) []ipv4.Message {
+		txqueue := make([]ipv4.Message, len(classes))
+		for k, class := range classes {
+			size := 100
+			if !class.urgent() {
+				size = 1400
+			}
+			buf := make([]byte, size)
+			buf[0] = byte(k)
+			txqueue[k] = ipv4.Message{Buffers: [][]byte{buf}, Addr: sink.LocalAddr()}
+		}
+		return txqueue
+	}
+	order := func(txqueue []ipv4.Message) (idx []byte) {
+		for _, msg := range txqueue {
+			idx = append(idx, msg.Buffers[0][0])
+		}
+		return idx
+	}
+
+	var spare []Packet
+	classes := []PacketClass{PacketData, PacketParity, PacketAck, PacketData, PacketControl, PacketDup}
+	txqueue := queue(classes)
+	cli.schedule(txqueue, classes, &spare)
+	if got := order(txqueue); !bytes.Equal(got, []byte{2, 4, 0, 1, 3, 5}) {
+		t.Fatalf("packets scheduled in order %v", got)
+	}
+	if !slices.Equal(classes, []PacketClass{PacketAck, PacketControl, PacketData, PacketParity, PacketData, PacketDup}) {
+		t.Fatalf("classes scheduled %v", classes)
+	}
+
+	// 显式的 FIFOScheduler 保持产生的顺序
+	cli.SetScheduler(FIFOScheduler{})
+	classes = []PacketClass{PacketData, PacketAck}
+	txqueue = queue(classes)
+	cli.schedule(txqueue, classes, &spare)
+	if got := order(txqueue); !bytes.Equal(got, []byte{0, 1}) {
+		t.Fatalf("FIFO scheduler reordered packets %v", got)
+	}
+	cli.SetScheduler(nil)
+
+	// 超过突发的数据等待限速，排在前面的确认立即发出
+	cli.SetRateLimit(10000)
+	classes = []PacketClass{PacketData, PacketAck, PacketData, PacketData}
+	txqueue = queue(classes)
+	cli.schedule(txqueue, classes, &spare)
+	start := time.Now()
+	go cli.transmit(txqueue, classes)
+
+	buf := make([]byte, mtuLimit)
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err := sink.ReadFrom(buf); err != nil || n != 100 {
+		t.Fatalf("first packet of %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("ack delayed %v by the rate limit", elapsed)
+	}
+	if _, _, err := sink.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("data sent after %v, before the rate limit allows", elapsed)
+	}
+}
+
+// TestReceiveQuota 测试公平接收处理下多个会话的数据均能完整交付
+func TestReceiveQuota(t *testing.T) {
+	network := newSimNetwork(0)
+	serverConn := network.listen()
+	l, err := ServeConn(nil, 0, 0, serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetReceiveQuota(4)
+
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			s.SetNoDelay(1, 10, 2, 1)
+			go io.Copy(s, s)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		cli, err := NewConn4(uint32(100+i), serverConn.LocalAddr(), nil, 0, 0, true, network.listen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.SetNoDelay(1, 10, 2, 1)
+
+		wg.Add(1)
+		go func(cli *UDPSession, size int) {
+			defer wg.Done()
+			msg := bytes.Repeat([]byte{byte(size)}, size)
+			go cli.Write(msg)
+			echo := make([]byte, size)
+			cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(cli, echo); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(msg, echo) {
+				t.Error("echoed data mismatch")
+			}
+		}(cli, 1024*(i+1)*16)
+	}
+	wg.Wait()
+}
+
+// TestEndToEndChecksum 测试端到端应用数据校验
+func TestEndToEndChecksum(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	cli.SetChecksum(true)
+
+	msg := bytes.Repeat([]byte("checksum"), 8192)
+	if _, err := cli.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetChecksum(true)
+
+	buf := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyChecksum(); err == nil {
+		t.Fatal("verified before the digest was sent")
+	}
+
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && s.VerifyChecksum() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.VerifyChecksum(); err != nil {
+		t.Fatalf("checksum not verified: %v", err)
+	}
+
+	// 篡改摘要后应报告不一致
+	s.mu.Lock()
+	s.e2e.verified = false
+	s.e2e.remoteSum = nil
+	bogus := make([]byte, digestSize)
+	binary.LittleEndian.PutUint64(bogus, uint64(len(msg)))
+	s.onDigest(bogus)
+	s.mu.Unlock()
+	if _, err := s.Read(buf); err == nil {
+		t.Fatal("expected checksum mismatch on Read")
+	}
+	if err := s.Close(); err == nil {
+		t.Fatal("expected checksum mismatch on Close")
+	}
+}
+
+// TestDeadlineErrors 测试超时错误满足 net.Error，且阻塞中的调用能被新设置的截止时间唤醒
+func TestDeadlineErrors(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+
+	checkTimeout := func(name string, err error) {
+		t.Helper()
+		ne, ok := err.(net.Error)
+		if !ok || !ne.Timeout() {
+			t.Errorf("%s: expected net.Error with Timeout(), got %v", name, err)
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%s: expected os.ErrDeadlineExceeded, got %v", name, err)
+		}
+	}
+
+	chRead := make(chan error, 1)
+	go func() {
+		_, err := cli.Read(make([]byte, 16))
+		chRead <- err
+	}()
+	chAccept := make(chan error, 1)
+	go func() {
+		_, err := l.AcceptKCP()
+		chAccept <- err
+	}()
+
+	// 调用已经阻塞后再设置截止时间
+	time.Sleep(50 * time.Millisecond)
+	cli.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	l.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	for name, ch := range map[string]chan error{"Read": chRead, "Accept": chAccept} {
+		select {
+		case err := <-ch:
+			checkTimeout(name, err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not woken by a late deadline", name)
+		}
+	}
+
+	// 已经过期的截止时间立即返回
+	cli.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err := cli.Write([]byte("late"))
+	checkTimeout("Write", err)
+}
+
+// TestConfigValidate 测试配置校验
+func TestConfigValidate(t *testing.T) {
+	valid := Config{Key: make([]byte, 32), NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		if err := valid.Validate(); err != nil {
+			t.Fatalf("valid config rejected: %v", err)
+		}
+	} else if err := valid.Validate(); err == nil {
+		t.Fatal("key accepted in a build without crypto")
+	}
+
+	for _, c := range []Config{
+		{Key: make([]byte, 7)},
+		{FECData: -1},
+		{FECData: 200, FECParity: 100},
+		{NoDelay: 2},
+		{Interval: -1},
+		{DSCP: 64},
+		{MinRTO: 500, MaxRTO: 200},
+		{MaxRetransmit: -1},
+		{Experimental: 1 << 63},
+		{Versions: []Version{0}},
+		{MaxSessions: -1},
+		{Eviction: 5},
+		{SourceLimits: SourceLimits{NewSessionsPerSec: -1}},
+		{ReadWorkers: -1},
+		{Backlog: -1},
+		{BacklogPolicy: 3},
+		{ResetKey: make([]byte, 8)},
+		{FECData: 10},
+		{FECParity: 3},
+		{MinRTO: IKCP_RTO_MAX + 1},
+		{InitialRTO: 2000, MaxRTO: 1000},
+		{Profile: "turbo"},
+		{SendWindow: -1},
+		{RateLimit: -1},
+		{Cipher: "aes"},
+		{Key: make([]byte, 16), Cipher: "3des"},
+		{Key: make([]byte, 16), Cipher: "rot13"},
+		{Smux: smux.DefaultConfig(), NoMux: true},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("invalid config accepted: %+v", c)
+		}
+	}
+
+	fec := Config{FECData: 10, FECParity: 3}
+	if err := fec.Validate(); (err == nil) != fecEnabled {
+		t.Errorf("unexpected FEC validation result %v, FEC compiled in: %v", err, fecEnabled)
+	}
+	if _, err := DialWithOptions("127.0.0.1:1", nil, 10, -3); err == nil {
+		t.Error("negative parity shards accepted")
+	}
+
+	// 填充默认值后仍然合法，且与KCP的默认值一致
+	defaults := Config{NoDelay: 1}
+	defaults.ApplyDefaults()
+	if err := defaults.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.NoDelay(1, -1, 0, 0)
+	if defaults.Interval != int(kcp.interval) || defaults.MinRTO != int(kcp.rx_minrto) ||
+		defaults.MaxRTO != int(kcp.rx_maxrto) || defaults.InitialRTO != int(kcp.rx_rto) ||
+		defaults.MaxRetransmit != int(kcp.dead_link)-1 || defaults.Backlog != acceptBacklog {
+		t.Errorf("defaults differ from KCP: %+v", defaults)
+	}
+	set := Config{Interval: 20, MinRTO: 50}
+	set.ApplyDefaults()
+	if set.Interval != 20 || set.MinRTO != 50 {
+		t.Error("settings overwritten by the defaults")
+	}
+}
+
+// TestDialListenWithConfig 测试按配置建立连接并应用套接字与KCP参数
+func TestDialListenWithConfig(t *testing.T) {
+	config := &Config{
+		NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1,
+		SendBuffer: 1 << 20, RecvBuffer: 1 << 20, DSCP: 46, Compression: true, RACK: true, FRTO: true, SACK: true, ProgressTimeout: 30000, StatelessCookies: true,
+		Versions: SupportedVersions(),
+	}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithConfig(l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.kcp.nodelay != 1 || cli.kcp.interval != 10 || cli.kcp.fastresend != 2 || cli.kcp.nocwnd != 1 {
+		t.Fatal("KCP settings not applied to the dialed session")
+	}
+
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("read failed", err)
+	}
+	s.mu.Lock()
+	fastresend := s.kcp.fastresend
+	s.mu.Unlock()
+	if fastresend != 2 {
+		t.Fatal("KCP settings not applied to the accepted session")
+	}
+
+	// 被接受的会话共享监听套接字，不能单独调整
+	if err := s.SetReadBuffer(1 << 20); err == nil {
+		t.Fatal("socket tuning allowed on an accepted session")
+	}
+
+	if _, err := DialWithConfig(l.Addr().String(), &Config{DSCP: 64}); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+}
+
+// TestListenWithConn 测试在调用方提供的PacketConn上按配置监听
+func TestListenWithConn(t *testing.T) {
+	network := newSimNetwork(0)
+	serverConn := network.listen()
+	defer serverConn.Close()
+
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	var block BlockCrypt
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+		block, _ = keyBlockCrypt(config.Key)
+	}
+
+	// 模拟连接没有套接字缓冲区设置
+	if _, err := ListenWithConn(serverConn, &Config{RecvBuffer: 1 << 20}); err == nil {
+		t.Fatal("socket settings accepted on a conn without them")
+	}
+	if _, err := ListenWithConn(serverConn, &Config{Key: make([]byte, 32), HopPorts: "4000-4010"}); err == nil {
+		t.Fatal("port hopping accepted on a conn of the caller")
+	}
+
+	l, err := ListenWithConn(serverConn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewConn3(1, serverConn.LocalAddr(), block, 0, 0, network.listen())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("read failed", err)
+	}
+	s.mu.Lock()
+	fastresend := s.kcp.fastresend
+	s.mu.Unlock()
+	if fastresend != 2 {
+		t.Fatal("KCP settings not applied to the accepted session")
+	}
+
+	// 关闭监听器不关闭调用方的连接
+	s.Close()
+	l.Close()
+	if _, err := serverConn.WriteTo([]byte("ping"), cli.LocalAddr()); err != nil {
+		t.Fatal("conn of the caller closed with the listener", err)
+	}
+}
+
+// TestHandover 测试将监听套接字与会话状态移交给新的监听器
+func TestHandover(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	var block BlockCrypt
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+		block, _ = keyBlockCrypt(config.Key)
+	}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(l.Addr().String(), block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetChecksum(true)
+	cli.Write([]byte("hello"))
+
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetChecksum(true)
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("read failed", err)
+	}
+	// 移交前写入的数据可能尚未被确认，由后继者重传
+	s.Write([]byte("ping"))
+
+	h, err := l.Handover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if _, err := l.AcceptKCP(); err == nil {
+		t.Fatal("accepted after the handover")
+	}
+	if _, err := s.Write([]byte("lost")); err == nil {
+		t.Fatal("session written after the handover")
+	}
+
+	// 模拟新进程接管
+	l2, sessions, err := ListenHandover(h, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	if len(sessions) != 1 || sessions[0].GetConv() != cli.GetConv() {
+		t.Fatalf("%d sessions resumed", len(sessions))
+	}
+	if l2.Addr().String() != l.Addr().String() {
+		t.Fatal("socket not handed over", l2.Addr())
+	}
+	s2 := sessions[0]
+	defer s2.Close()
+
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(cli, buf[:4]); err != nil || string(buf[:4]) != "ping" {
+		t.Fatal("data sent before the handover lost", err)
+	}
+	cli.Write([]byte("world"))
+	s2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s2, buf); err != nil || string(buf) != "world" {
+		t.Fatal("read after the handover failed", err)
+	}
+	s2.Write([]byte("back"))
+	if _, err := io.ReadFull(cli, buf[:4]); err != nil || string(buf[:4]) != "back" {
+		t.Fatal("write after the handover failed", err)
+	}
+
+	// 端到端校验和的状态随会话移交，覆盖移交前后的全部数据
+	s2.mu.Lock()
+	var txSum []byte
+	var txBytes uint64
+	if s2.e2e != nil {
+		txSum, txBytes = s2.e2e.tx.Sum(nil), s2.e2e.txBytes
+	}
+	s2.mu.Unlock()
+	if want := sha256.Sum256([]byte("pingback")); !bytes.Equal(txSum, want[:]) || txBytes != 8 {
+		t.Fatal("checksum of the data written not handed over", txBytes)
+	}
+	cli.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for s2.VerifyChecksum() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s2.VerifyChecksum(); err != nil {
+		t.Fatal("checksum of the data read not handed over", err)
+	}
+
+	// 模拟连接没有文件描述符，损坏的状态被拒绝
+	network := newSimNetwork(0)
+	conn := network.listen()
+	defer conn.Close()
+	l3, err := ServeConn(nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l3.Close()
+	if _, err := l3.Handover(); err == nil {
+		t.Fatal("socket without a file handed over")
+	}
+	if _, err := parseHandover(h.State[:len(h.State)-1]); err == nil {
+		t.Fatal("truncated state accepted")
+	}
+}
+
+// TestListenerSnmp 测试监听器与客户端会话使用各自的统计计数器
+func TestListenerSnmp(t *testing.T) {
+	network := newSimNetwork(0)
+	la, cli := newSimPair(t, network, nil, 0, 0)
+	lb, _ := newSimPair(t, network, nil, 0, 0)
+	sa, sb, sc := NewSnmp(), NewSnmp(), NewSnmp()
+	la.SetSnmp(sa)
+	lb.SetSnmp(sb)
+	if la.Snmp() != sa {
+		t.Fatal("counters of the listener not set")
+	}
+
+	// 客户端切换计数器时带走已建立连接的计数
+	cli.SetSnmp(sc)
+	if atomic.LoadUint64(&sc.CurrEstab) != 1 {
+		t.Fatal("established connection not moved", sc.CurrEstab)
+	}
+
+	cli.Write([]byte("hello"))
+	la.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := la.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if s.Snmp() != sa {
+		t.Fatal("accepted session does not count into its listener's counters")
+	}
+	if atomic.LoadUint64(&sa.PassiveOpens) != 1 || atomic.LoadUint64(&sa.BytesReceived) != 5 || atomic.LoadUint64(&sa.InSegs) == 0 {
+		t.Fatalf("counters of the listener %+v", sa.Copy())
+	}
+	if atomic.LoadUint64(&sc.OutSegs) == 0 || atomic.LoadUint64(&sc.BytesSent) != 5 {
+		t.Fatalf("counters of the client %+v", sc.Copy())
+	}
+	if atomic.LoadUint64(&sb.PassiveOpens) != 0 || atomic.LoadUint64(&sb.InSegs) != 0 {
+		t.Fatal("counted into another listener")
+	}
+
+	s.Close()
+	if atomic.LoadUint64(&sa.CurrEstab) != 0 {
+		t.Fatal("closed session still established", sa.CurrEstab)
+	}
+}
+
+// TestBacklogOverflow 测试接受队列已满时丢弃或重置新会话
+func TestBacklogOverflow(t *testing.T) {
+	network := newSimNetwork(0)
+	serverConn := network.listen()
+	defer serverConn.Close()
+	l, err := ListenWithConn(serverConn, &Config{Backlog: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	snmp := NewSnmp()
+	l.SetSnmp(snmp)
+	var overflows atomic.Int32
+	if l.SetBacklogPolicy(BacklogPolicy(9), nil) == nil {
+		t.Fatal("invalid backlog policy accepted")
+	}
+	if err := l.SetBacklogPolicy(BacklogDrop, func(net.Addr) { overflows.Add(1) }); err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func(conv uint32) *UDPSession {
+		cli, err := NewConn4(conv, serverConn.LocalAddr(), nil, 0, 0, true, network.listen())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetNoDelay(1, 10, 2, 1)
+		t.Cleanup(func() { cli.Close() })
+		cli.Write([]byte("hello"))
+		return cli
+	}
+	waitFor := func(cond func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// 队列已满时新会话被丢弃，客户端重传后仍可被接受
+	a := dial(2001)
+	waitFor(func() bool { return len(l.chAccepts) == 1 })
+	b := dial(2002)
+	waitFor(func() bool { return overflows.Load() > 0 })
+	if atomic.LoadUint64(&snmp.BacklogDrops) == 0 {
+		t.Fatal("refused session not counted")
+	}
+	for _, cli := range []*UDPSession{a, b} {
+		l.SetDeadline(time.Now().Add(2 * time.Second))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if s.GetConv() != cli.GetConv() {
+			t.Fatal("sessions accepted out of order")
+		}
+	}
+
+	// 服务端已应答的会话不接受无令牌的重置
+	l.reset(a.LocalAddr(), pktinfo{}, a.GetConv())
+	time.Sleep(50 * time.Millisecond)
+	if _, err := a.Write([]byte("ping")); err != nil {
+		t.Fatal("established session reset", err)
+	}
+
+	// 重置策略下客户端立即失败
+	if err := l.SetBacklogPolicy(BacklogReset, nil); err != nil {
+		t.Fatal(err)
+	}
+	dial(2003)
+	waitFor(func() bool { return len(l.chAccepts) == 1 })
+	c := dial(2004)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 5)); !errors.Is(err, ErrReset) {
+		t.Fatal("client not reset", err)
+	}
+}
+
+// TestStatelessReset 测试重启后的监听器以认证的重置结束旧会话
+func TestStatelessReset(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, ResetKey: []byte("0123456789abcdef")}
+	var block BlockCrypt
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+		block, _ = keyBlockCrypt(config.Key)
+	}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if l.SetStatelessReset(make([]byte, 8)) == nil {
+		t.Fatal("short reset key accepted")
+	}
+
+	cli, err := DialWithOptions(addr, block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+	cli.mu.Lock()
+	token := slices.Clone(cli.resetToken)
+	// 令牌不符的重置被忽略
+	cli.onReset(make([]byte, resetTokenSize))
+	cli.mu.Unlock()
+	if len(token) != resetTokenSize {
+		t.Fatal("reset token not announced")
+	}
+	if _, err := cli.Write([]byte("ping")); err != nil {
+		t.Fatal("session reset without its token", err)
+	}
+
+	// 模拟服务端重启，会话状态丢失
+	s.Close()
+	l.Close()
+	l2, err := ListenWithConfig(addr, config)
+	if err != nil {
+		t.Skip("address not reusable", err)
+	}
+	defer l2.Close()
+	snmp := NewSnmp()
+	l2.SetSnmp(snmp)
+
+	cli.Write([]byte("again"))
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := cli.Read(buf); !errors.Is(err, ErrReset) {
+		t.Fatal("stale session not reset", err)
+	}
+	if atomic.LoadUint64(&snmp.StatelessResets) == 0 {
+		t.Fatal("reset not counted")
+	}
+
+	// 新会话不受影响
+	cli2, err := DialWithOptions(addr, block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+	cli2.Write([]byte("hello"))
+	l2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s2, err := l2.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	s2.Write([]byte("pong"))
+	cli2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(cli2, buf); err != nil {
+		t.Fatal(err)
+	}
+	cli2.mu.Lock()
+	token2 := cli2.resetToken
+	cli2.mu.Unlock()
+	if s2.GetConv() == cli.GetConv() || bytes.Equal(token, token2) {
+		t.Fatal("reset token shared by conversations")
+	}
+}
+
+// TestWildcardSource 测试通配地址上的监听器从客户端所连的地址应答
+func TestWildcardSource(t *testing.T) {
+	l, err := ListenWithOptions("0.0.0.0:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !enablePacketInfo(l.conn) {
+		t.Skip("packet info not supported")
+	}
+	port := l.Addr().(*net.UDPAddr).Port
+
+	// 127.0.0.2 的应答默认从 127.0.0.1 发出，客户端会丢弃
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.2:%d", port), nil, 0, 0)
+	if err != nil {
+		t.Skip("no second loopback address", err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("hello"))
+
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetNoDelay(1, 10, 2, 1)
+	s.Write([]byte("world"))
+	buf := make([]byte, 5)
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "world" {
+		t.Fatal("reply not received from the address dialed", err)
+	}
+}
+
+// TestDialContext 测试带上下文的流拨号及握手超时
+func TestDialContext(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		sl := newStreamListener(l, config)
+		conn, err := sl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := DialContext(ctx, l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo failed", err)
+	}
+	// 拨号的连接拥有其会话，关闭时一并关闭
+	stream, err := conn.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !conn.sess.IsClosed() {
+		t.Fatal("session left open")
+	}
+	if _, err := stream.Write([]byte("x")); err == nil {
+		t.Fatal("stream outlived the session")
+	}
+
+	// 对端不应答时握手随上下文超时
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := DialContext(ctx, silent.LocalAddr().String(), config); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("handshake not bounded by the context", err)
+	}
+	if _, err := DialContext(ctx, "127.0.0.1:x", config); err == nil {
+		t.Fatal("invalid address dialed")
+	}
+}
+
+// TestDialWithConn 测试在调用方的连接上拨号，包括已连接的套接字
+func TestDialWithConn(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	unconnected, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unconnected.Close()
+	connected, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connected.Close()
+
+	if _, err := DialWithConn(unconnected, nil, config); err == nil {
+		t.Fatal("dialed without a remote address")
+	}
+	if _, err := DialWithConn(connected, unconnected.LocalAddr(), config); err == nil {
+		t.Fatal("dialed another address than the socket is connected to")
+	}
+	hop := *config
+	hop.Key, hop.HopPorts = make([]byte, 32), "4000-4010"
+	if _, err := DialWithConn(unconnected, l.Addr(), &hop); err == nil {
+		t.Fatal("port hopping over a socket of the caller accepted")
+	}
+	hop.HopPorts, hop.HopInterval = "", 10
+	if _, err := DialWithConn(unconnected, l.Addr(), &hop); err == nil {
+		t.Fatal("HopInterval over a socket of the caller accepted")
+	}
+
+	for _, c := range []struct {
+		conn  *net.UDPConn
+		raddr net.Addr
+	}{{unconnected, l.Addr()}, {connected, nil}} {
+		cli, err := DialWithConn(c.conn, c.raddr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Write([]byte("hello"))
+		l.SetReadDeadline(time.Now().Add(2 * time.Second))
+		s, err := l.AcceptKCP()
+		// 上一轮的迟到确认可能重建旧会话
+		for err == nil && s.GetConv() != cli.GetConv() {
+			s.Close()
+			s, err = l.AcceptKCP()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Write([]byte("world"))
+		buf := make([]byte, 5)
+		cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "world" {
+			t.Fatal("read failed", err)
+		}
+		s.Close()
+
+		// 关闭会话不关闭调用方的连接
+		cli.Close()
+		if c.conn.LocalAddr() == nil || c.conn.SetReadBuffer(1<<16) != nil {
+			t.Fatal("conn of the caller closed with the session")
+		}
+	}
+}
+
+// TestFunctionalOptions 测试函数式选项的拨号与监听
+func TestFunctionalOptions(t *testing.T) {
+	var block BlockCrypt
+	if cryptoEnabled {
+		block, _ = keyBlockCrypt(make([]byte, 32))
+	}
+	serverSnmp, clientSnmp := NewSnmp(), NewSnmp()
+	l, err := ListenWith("127.0.0.1:0", WithCrypto(block), WithNoDelay(1, 10, 2, 1),
+		WithSnmp(serverSnmp), WithBacklog(4, BacklogDrop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if cap(l.chAccepts) != 4 {
+		t.Fatal("backlog not applied", cap(l.chAccepts))
+	}
+
+	if _, err := DialWith(l.Addr().String(), WithFEC(-1, 3)); err == nil {
+		t.Fatal("negative FEC shards accepted")
+	}
+	if _, err := DialWith(l.Addr().String(), WithConfig(&Config{NoDelay: 2})); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	if _, err := DialWith(l.Addr().String(), WithConfig(nil)); err == nil {
+		t.Fatal("nil config accepted")
+	}
+	if _, err := ListenWith("127.0.0.1:0", WithConfig(nil)); err == nil {
+		t.Fatal("nil config accepted")
+	}
+
+	// 选项与DialWithConfig一样经过插件拨号
+	if lookupPlugin("xor-test") == nil {
+		RegisterPlugin("xor-test", xorPlugin{})
+	}
+	plugged, err := DialWith(l.Addr().String(), WithConfig(&Config{Plugin: "xor-test", PluginOptions: "\x5a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plugged.conn.(*xorConn); !ok {
+		t.Errorf("plugin bypassed, conn %T", plugged.conn)
+	}
+	plugged.Close()
+	if _, err := DialWith(l.Addr().String(), WithConfig(&Config{Plugin: "xor-test", PluginOptions: "\x5a"}),
+		WithLocalBinding(&LocalBinding{IP: net.IPv4(127, 0, 0, 1)})); err == nil {
+		t.Fatal("local binding with a plugin accepted")
+	}
+	cli, err := DialWith(l.Addr().String(), WithConfig(&Config{Interval: 20}), WithCrypto(block),
+		WithNoDelay(1, 10, 2, 1), WithSnmp(clientSnmp), WithLocalBinding(&LocalBinding{IP: net.IPv4(127, 0, 0, 1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.mu.Lock()
+	interval, fastresend := cli.kcp.interval, cli.kcp.fastresend
+	cli.mu.Unlock()
+	if interval != 10 || fastresend != 2 {
+		t.Fatal("later options do not override the config", interval, fastresend)
+	}
+
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("read failed", err)
+	}
+	if atomic.LoadUint64(&serverSnmp.InPkts) == 0 || atomic.LoadUint64(&clientSnmp.OutPkts) == 0 {
+		t.Fatal("packets not counted in the counters of the options")
+	}
+}
+
+// TestProfiles 测试按名称选择的KCP参数组合，显式设置优先
+func TestProfiles(t *testing.T) {
+	if _, ok := LookupProfile("fast3"); !ok {
+		t.Fatal("fast3 profile missing")
+	}
+	for _, c := range []struct {
+		config                            Config
+		nodelay, interval, resend, nocwnd int
+	}{
+		{Config{Profile: "normal"}, 0, 40, 2, 1},
+		{Config{Profile: "fast3"}, 1, 10, 2, 1},
+		{Config{Profile: "fast2", Interval: 15, Resend: 3}, 1, 15, 3, 1},
+	} {
+		s, err := DialWithConfig("127.0.0.1:1", &c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.mu.Lock()
+		nodelay, interval, resend, nocwnd := int(s.kcp.nodelay), int(s.kcp.interval), int(s.kcp.fastresend), int(s.kcp.nocwnd)
+		s.mu.Unlock()
+		s.Close()
+		if nodelay != c.nodelay || interval != c.interval || resend != c.resend || nocwnd != c.nocwnd {
+			t.Errorf("profile %q applied as %d %d %d %d", c.config.Profile, nodelay, interval, resend, nocwnd)
+		}
+	}
+
+	config := Config{Profile: "fast2"}
+	config.ApplyDefaults()
+	if config.Interval != 20 || config.NoDelay != 1 || config.MinRTO != IKCP_RTO_NDL {
+		t.Errorf("defaults not filled from the profile: %+v", config)
+	}
+}
+
+// TestApplyConfig 测试在已建立的会话上修改间隔、窗口、限速以及FEC比例
+func TestApplyConfig(t *testing.T) {
+	config := &Config{}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	if fecEnabled {
+		config.FECData, config.FECParity = 10, 3
+	}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithConfig(l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cli.ApplyConfig(&Config{Interval: 25, SendWindow: 128, RecvWindow: 256, RateLimit: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	cli.mu.Lock()
+	interval, sndwnd, rcvwnd := cli.kcp.interval, cli.kcp.snd_wnd, cli.kcp.rcv_wnd
+	cli.mu.Unlock()
+	if interval != 25 || sndwnd != 128 || rcvwnd != 256 || cli.txLimit.Load() == nil {
+		t.Fatal("config not applied", interval, sndwnd, rcvwnd)
+	}
+
+	// 不能在运行中修改的设置被拒绝
+	for _, c := range []*Config{
+		{Compression: true},
+		{MaxSessions: 10},
+		{NoDelay: 2},
+		{Cipher: "aes"},
+		{Plaintext: true},
+		{KCPCompat: true},
+		{HopPorts: "4000-4010", Key: make([]byte, 32)},
+		{Plugin: "xor-test"},
+		{NoMux: true},
+		{IOUring: true},
+		{Interval: 20, Smux: &smux.Config{}},
+	} {
+		if err := cli.ApplyConfig(c); err == nil {
+			t.Errorf("config applied: %+v", c)
+		}
+	}
+	if err := s.ApplyConfig(&Config{RecvBuffer: 1 << 20}); err == nil {
+		t.Error("socket settings applied to an accepted session")
+	}
+	// 被拒绝的配置不会部分生效
+	if err := cli.ApplyConfig(&Config{Interval: 40, Cipher: "aes"}); err == nil {
+		t.Error("cipher applied")
+	}
+	if err := s.ApplyConfig(&Config{Interval: 40, DSCP: 46}); err == nil {
+		t.Error("socket settings applied to an accepted session")
+	}
+	cli.mu.Lock()
+	interval = cli.kcp.interval
+	cli.mu.Unlock()
+	s.mu.Lock()
+	sinterval := s.kcp.interval
+	s.mu.Unlock()
+	if interval != 25 || sinterval == 40 {
+		t.Error("rejected config half applied", interval, sinterval)
+	}
+	if !fecEnabled {
+		return
+	}
+
+	// FEC比例在下一组生效，对端自动跟随
+	if err := cli.ApplyConfig(&Config{FECData: 4, FECParity: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if cli.FECBackend() != FECBackendAuto.resolve(4, 2) {
+		t.Error("backend not resolved for the new shards")
+	}
+	data := make([]byte, 256<<10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go cli.Write(data)
+	got := make([]byte, len(data))
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatal("data lost after the FEC change", err)
+	}
+	s.mu.Lock()
+	dataShards, parityShards := s.fecDecoder.shards()
+	s.mu.Unlock()
+	if dataShards != 4 || parityShards != 2 {
+		t.Fatalf("remote decoder at %d/%d shards", dataShards, parityShards)
+	}
+}
+
+// TestListenStream 测试流监听与拨号经过KCP、加密与FEC
+func TestListenStream(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key, config.Cipher = make([]byte, 32), "salsa20"
+	}
+	if fecEnabled {
+		config.FECData, config.FECParity = 10, 3
+	}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		conn, err := sl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := DialStream(sl.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := make([]byte, 64<<10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatal("echo failed", err)
+	}
+
+	snmp := sl.listener.(*Listener).Snmp()
+	if fecEnabled && atomic.LoadUint64(&snmp.FECParityShards) == 0 {
+		t.Error("streams not protected by FEC")
+	}
+	// 关闭连接同时关闭其会话
+	conn.Close()
+	if !conn.sess.IsClosed() {
+		t.Error("session left open")
+	}
+	if _, err := ListenStream("127.0.0.1:0", &Config{NoDelay: 2}); err == nil {
+		t.Error("invalid config accepted")
+	}
+}
+
+// TestSmuxConfig 测试流复用层的配置与协议版本
+func TestSmuxConfig(t *testing.T) {
+	mux := smux.DefaultConfig()
+	mux.Version = 2
+	mux.MaxFrameSize = 4096
+	mux.KeepAliveInterval, mux.KeepAliveTimeout = time.Second, 5*time.Second
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, Smux: mux}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		conn, err := sl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := DialStream(sl.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := bytes.Repeat([]byte("smux"), 4096)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatal("echo over smux v2 failed", err)
+	}
+
+	invalid := *mux
+	invalid.Version = 3
+	if err := (&Config{Smux: &invalid}).Validate(); err == nil {
+		t.Error("invalid smux config accepted")
+	}
+}
+
+// TestNoMux 测试不经过smux直接使用会话的单流模式
+func TestNoMux(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, NoMux: true, Plaintext: true}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := sl.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := DialStream(sl.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.stream.(*UDPSession); !ok || conn.sess != nil {
+		t.Fatal("stream multiplexed with NoMux")
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo failed", err)
+	}
+
+	// 服务端接受的是会话本身，没有smux帧头
+	server := <-accepted
+	defer server.Close()
+	if _, ok := server.(*Conn).stream.(*UDPSession); !ok {
+		t.Fatal("accepted stream multiplexed with NoMux")
+	}
+	if server.RemoteAddr().(*net.UDPAddr).Port != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatal("addresses of the session not reported", server.RemoteAddr(), conn.LocalAddr())
+	}
+}
+
+// TestKeyAgreement 测试没有预共享密钥时的临时密钥协商
+func TestKeyAgreement(t *testing.T) {
+	for _, noMux := range []bool{false, true} {
+		config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, NoMux: noMux}
+		sl, err := ListenStream("127.0.0.1:0", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+			io.Copy(conn, conn)
+		}()
+
+		// 抓取客户端发出的报文，明文不应出现在线路上
+		var wire bytes.Buffer
+		var wireMu sync.Mutex
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewConn2(sl.Addr(), nil, 0, 0, &tapConn{UDPConn: udp, tap: func(b []byte) {
+			wireMu.Lock()
+			wire.Write(b)
+			wireMu.Unlock()
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.tuneDialed(s)
+		agreed, err := agreeKey(context.Background(), s, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stream net.Conn = agreed
+		if !noMux {
+			conn, err := clientStream(context.Background(), s, agreed, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream = conn
+		}
+
+		secret := bytes.Repeat([]byte("attack at dawn "), 1000)
+		go stream.Write(secret)
+		got := make([]byte, len(secret))
+		stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(stream, got); err != nil || !bytes.Equal(got, secret) {
+			t.Fatal("echo failed", noMux, err)
+		}
+		wireMu.Lock()
+		leaked := bytes.Contains(wire.Bytes(), []byte("attack at dawn")) || wire.Len() < len(secret)
+		wireMu.Unlock()
+		if leaked {
+			t.Fatal("plaintext on the wire", noMux)
+		}
+		server := <-accepted
+		if !server.(*Conn).Unauthenticated() {
+			t.Fatal("agreed key not flagged", noMux)
+		}
+		server.Close()
+		stream.Close()
+		s.Close()
+		udp.Close()
+		sl.Close()
+	}
+
+	// 明文一端与协商密钥的一端握手失败
+	sl, err := ListenStream("127.0.0.1:0", &Config{Plaintext: true, NoMux: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		if conn, err := sl.Accept(); err == nil {
+			io.Copy(conn, conn) // 原样回显问候
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := DialContext(ctx, sl.Addr().String(), &Config{})
+	if err == nil {
+		// 回显的问候是自己的公钥，协商出的密钥与对端不同
+		conn.Write([]byte("hello"))
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 5)); err == nil {
+			t.Fatal("agreed with a plaintext server")
+		}
+		conn.Close()
+	}
+	if err := (&Config{Key: make([]byte, 16), Plaintext: true}).Validate(); err == nil {
+		t.Error("Plaintext accepted with a key")
+	}
+}
+
+// tapConn 记录经过套接字发出的报文
+type tapConn struct {
+	*net.UDPConn
+	tap func([]byte)
+}
+
+func (c *tapConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.tap(b)
+	return c.UDPConn.WriteTo(b, addr)
+}
+
+// TestMultiStream 测试在同一会话上打开和接受多个流
+func TestMultiStream(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	echo := func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}
+	go func() {
+		conn, err := sl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.(*Conn).CloseSession()
+		go echo(conn)
+		for {
+			stream, err := conn.(*Conn).AcceptStream()
+			if err != nil {
+				return
+			}
+			go echo(stream)
+		}
+	}()
+
+	conn, err := DialStream(sl.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseSession()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := range 8 {
+		stream := conn
+		if i > 0 {
+			if stream, err = conn.OpenStream(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(i)}, 8192)
+			go stream.Write(data)
+			got := make([]byte, len(data))
+			stream.SetReadDeadline(time.Now().Add(3 * time.Second))
+			if _, err := io.ReadFull(stream, got); err != nil || !bytes.Equal(got, data) {
+				errs <- fmt.Errorf("stream %d: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	plain := &Conn{stream: conn.stream}
+	if _, err := plain.OpenStream(); err == nil {
+		t.Error("stream opened without a multiplexer")
+	}
+}
+
+// TestDialRace 测试多个解析地址的交错排序与错开启动的竞速拨号
+func TestDialRace(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3"),
+		netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("::ffff:192.0.2.4"),
+	}
+	got := fmt.Sprint(interleaveFamilies(ips))
+	if want := "[2001:db8::1 192.0.2.1 192.0.2.2 192.0.2.3 192.0.2.4]"; got != want {
+		t.Fatalf("order %s, want %s", got, want)
+	}
+
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	// 不回应的地址
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// 第一个地址不回应，在领先时间后第二个地址胜出
+	const delay = 100 * time.Millisecond
+	addrs := []*net.UDPAddr{silent.LocalAddr().(*net.UDPAddr), sl.Addr().(*net.UDPAddr)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialRace(ctx, addrs, config, delay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("second address dialed after %v, before the head start", elapsed)
+	}
+	if conn.RemoteAddr().String() != sl.Addr().String() {
+		t.Errorf("connected to %v, want %v", conn.RemoteAddr(), sl.Addr())
+	}
+
+	// 所有地址都不回应时返回上下文的错误
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	addrs = []*net.UDPAddr{silent.LocalAddr().(*net.UDPAddr), silent.LocalAddr().(*net.UDPAddr)}
+	if _, err := dialRace(ctx, addrs, config, delay); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// TestReconnectingConn 测试会话失败后的自动重拨、状态回调与关闭
+func TestReconnectingConn(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialReconnecting(ctx, sl.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetBackoff(10*time.Millisecond, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if c.SetBackoff(time.Second, time.Millisecond) == nil {
+		t.Error("backoff limit below the initial wait accepted")
+	}
+	var states []ConnState
+	var mu sync.Mutex
+	c.SetStateCallback(func(state ConnState, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	})
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	echo := func(msg string) {
+		t.Helper()
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != msg {
+			t.Fatalf("echo %q, got %q, %v", msg, got, err)
+		}
+	}
+	echo("before")
+
+	// 会话失败后，读写等待重拨并在新连接上继续
+	c.Conn().CloseSession()
+	echo("after")
+	if c.State() != ConnConnected || accepted.Load() != 2 {
+		t.Errorf("state %v after %d accepts, want connected after 2", c.State(), accepted.Load())
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrClosed) {
+		t.Errorf("read after close: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []ConnState{ConnReconnecting, ConnConnected, ConnClosed}; !slices.Equal(states, want) {
+		t.Errorf("states %v, want %v", states, want)
+	}
+}
+
+// TestClientPool 测试连接池在最空闲的会话上打开流，以及失败会话的重拨
+func TestClientPool(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	echo := func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go echo(conn)
+			go func() {
+				for {
+					stream, err := conn.(*Conn).AcceptStream()
+					if err != nil {
+						return
+					}
+					go echo(stream)
+				}
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := NewClientPool(ctx, sl.Addr().String(), &Config{NoMux: true}, 2); err == nil {
+		t.Error("pool without a multiplexer accepted")
+	}
+	p, err := NewClientPool(ctx, sl.Addr().String(), config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// 四个流均匀分布在两个会话上
+	sessions := make(map[*smux.Session]int)
+	for i := range 4 {
+		conn, err := p.OpenStream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		msg := fmt.Sprint("stream ", i)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(msg))
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != msg {
+			t.Fatalf("echo %q, got %q, %v", msg, got, err)
+		}
+		sessions[conn.sess]++
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("streams over %d sessions, want 2", len(sessions))
+	}
+	for sess, n := range sessions {
+		if n != 2 {
+			t.Errorf("%d streams over a session, want 2", n)
+		}
+		sess.Close() // 其中一个会话失败
+		break
+	}
+
+	// 剩下的会话继续服务，失败的会话在后台重拨
+	if p.Sessions() != 1 {
+		t.Errorf("%d sessions up, want 1", p.Sessions())
+	}
+	if _, err := p.OpenStream(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for p.Sessions() != 2 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("failed session not redialed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	p.Close()
+	if _, err := p.OpenStream(ctx); !errors.Is(err, ErrClosed) {
+		t.Errorf("open after close: %v", err)
+	}
+}
+
+// TestHTTPDialer 测试HTTP客户端经拨号函数通过流连接访问服务器
+func TestHTTPDialer(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go http.Serve(sl, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+
+	transport := &http.Transport{DialContext: HTTPDialer(config)}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := client.Get("http://" + sl.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "GET "+path {
+			t.Fatalf("body %q, %v", body, err)
+		}
+	}
+
+	// 关闭连接时同时关闭其会话
+	conn, err := HTTPDialer(config)(context.Background(), "tcp", sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if sess := conn.(*Conn).sess; !sess.IsClosed() {
+		t.Error("session left open")
+	}
+	if _, err := HTTPDialer(config)(context.Background(), "udp", sl.Addr().String()); err == nil {
+		t.Error("udp network dialed")
+	}
+}
+
+// TestGRPCAdapters 测试gRPC所需的拨号函数与监听器约定：截止时间、地址以及握手失败不终止服务
+func TestGRPCAdapters(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+
+	// 不协商密钥的客户端使Accept返回临时错误
+	badClient := func() {
+		s, err := DialWithConfig(sl.Addr().String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		s.Write(bytes.Repeat([]byte{'x'}, agreeHello))
+	}
+	badClient()
+	_, err = sl.Accept()
+	var ne net.Error
+	if !errors.Is(err, ErrHandshake) || !errors.As(err, &ne) || !ne.Temporary() {
+		t.Fatalf("got %v, want a temporary handshake error", err)
+	}
+
+	// 服务在失败的握手之后继续
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go srv.Serve(sl)
+	badClient()
+	dial := GRPCDialer(config)
+	transport := &http.Transport{DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dial(ctx, addr)
+	}}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// 连接的地址与截止时间如同TCP连接
+	conn, err := dial(context.Background(), sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != sl.Addr().String() {
+		t.Errorf("remote address %v, want %v", conn.RemoteAddr(), sl.Addr())
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("read past the deadline: %v", err)
+	}
+}
+
+// TestStreamListenerBacklog 测试同时握手的会话数以积压上限为界，其余会话留在监听者的积压队列中
+func TestStreamListenerBacklog(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, Backlog: 2}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go sl.Accept()
+
+	// 不握手的客户端占满握手名额
+	for range 5 {
+		s, err := DialWithConfig(sl.Addr().String(), &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, Key: config.Key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.Write([]byte{0})
+	}
+	l := sl.listener.(*Listener)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(sl.handshakes) < 2 || len(l.chAccepts) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d handshakes, %d sessions waiting", len(sl.handshakes), len(l.chAccepts))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(sl.handshakes) != 2 || len(l.chAccepts) != 2 {
+		t.Fatalf("%d handshakes, %d sessions waiting", len(sl.handshakes), len(l.chAccepts))
+	}
+
+	// 关闭后Accept失败，而不是等待握手名额
+	sl.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := sl.Accept()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("accepted after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept blocked after close")
+	}
+}
+
+// stunServer starts a STUN server answering binding requests with the source
+// address in XOR-MAPPED-ADDRESS, after a MAPPED-ADDRESS to be ignored
+func stunServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n != stunHeaderSize || binary.BigEndian.Uint16(buf) != stunBindingReq {
+				continue
+			}
+			from := addr.(*net.UDPAddr)
+			resp := make([]byte, stunHeaderSize, stunHeaderSize+24)
+			binary.BigEndian.PutUint16(resp, stunBindingResp)
+			copy(resp[4:], buf[4:stunHeaderSize])
+			resp = append(resp, 0, stunMappedAddr, 0, 8, 0, 1, 0, 1, 192, 0, 2, 1)
+			resp = binary.BigEndian.AppendUint16(resp, stunXorMapped)
+			resp = append(resp, 0, 8, 0, 1)
+			resp = binary.BigEndian.AppendUint16(resp, uint16(from.Port)^stunMagicCookie>>16)
+			for i, b := range from.IP.To4() {
+				resp = append(resp, b^buf[4+i])
+			}
+			binary.BigEndian.PutUint16(resp[2:], uint16(len(resp)-stunHeaderSize))
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// TestSTUNBinding 测试从原始套接字、监听器和客户端会话发出STUN绑定请求，会话不受影响
+func TestSTUNBinding(t *testing.T) {
+	server := stunServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 原始套接字
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mapped, err := STUNBinding(ctx, conn, server)
+	if err != nil || mapped != addrKey(conn.LocalAddr()) {
+		t.Fatalf("raw socket mapped to %v, want %v, %v", mapped, conn.LocalAddr(), err)
+	}
+
+	// 监听器与客户端会话在传输数据的同时查询
+	l, err := ListenWithConfig("127.0.0.1:0", &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := DialWithConfig(l.Addr().String(), &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello"))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if mapped, err := l.STUNBinding(ctx, server); err != nil || mapped != addrKey(l.Addr()) {
+		t.Fatalf("listener mapped to %v, want %v, %v", mapped, l.Addr(), err)
+	}
+	if mapped, err := s.STUNBinding(ctx, server); err != nil || mapped != addrKey(l.Addr()) {
+		t.Fatalf("accepted session mapped to %v, want %v, %v", mapped, l.Addr(), err)
+	}
+	if mapped, err := client.STUNBinding(ctx, server); err != nil || mapped.Port() != addrKey(client.LocalAddr()).Port() {
+		t.Fatalf("client mapped to %v, want %v, %v", mapped, client.LocalAddr(), err)
+	}
+	client.Write([]byte(" world"))
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(io.LimitReader(s, 11))
+	if err != nil || string(got) != "hello world" {
+		t.Fatalf("session read %q, %v", got, err)
+	}
+
+	// 无响应的服务器
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	short, cancel := context.WithTimeout(ctx, 700*time.Millisecond)
+	defer cancel()
+	if _, err := client.STUNBinding(short, silent.LocalAddr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("silent server: %v", err)
+	}
+}
+
+// TestPunch 测试两端同时打洞，恰有一端为发起方，会话双向传输数据
+func TestPunch(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	if _, _, err := Punch(context.Background(), nil, nil, &Config{Versions: []Version{Version1}}); err == nil {
+		t.Error("punching with version negotiation accepted")
+	}
+
+	var conns [2]net.PacketConn
+	for i := range conns {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	// 每端的候选地址中有一个不可达
+	unreachable := netip.MustParseAddrPort("127.0.0.1:1")
+	type result struct {
+		s         *UDPSession
+		initiator bool
+		err       error
+	}
+	results := make(chan result, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, conn := range conns {
+		peer := addrKey(conns[1-i].LocalAddr())
+		go func() {
+			s, initiator, err := Punch(ctx, conn, []netip.AddrPort{unreachable, peer}, config)
+			results <- result{s, initiator, err}
+		}()
+	}
+	var sessions [2]*UDPSession
+	initiators := 0
+	for i := range sessions {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		defer r.s.Close()
+		sessions[i] = r.s
+		if r.initiator {
+			initiators++
+		}
+	}
+	if initiators != 1 {
+		t.Fatalf("%d initiators", initiators)
+	}
+	if sessions[0].GetConv() != sessions[1].GetConv() {
+		t.Fatal("conversations differ")
+	}
+	for i, s := range sessions {
+		peer := sessions[1-i]
+		msg := fmt.Sprintf("from %d", i)
+		if _, err := s.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, err := peer.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("read %q, %v", buf[:n], err)
+		}
+	}
+
+	// 对端不在时，打洞随上下文结束
+	lone, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lone.Close()
+	short, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, _, err := Punch(short, lone, []netip.AddrPort{unreachable}, config); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("punching without a peer: %v", err)
+	}
+}
+
+// TestRelay 测试两端经由中继监听器配对并双向传输，监听器自身的会话不受影响
+func TestRelay(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	secret := make([]byte, 16)
+	if err := l.SetRelay(secret, &RelayLimits{Bytes: -1}); err == nil {
+		t.Error("negative relay limit accepted")
+	}
+	if err := l.SetRelay(secret[:8], &RelayLimits{}); err == nil {
+		t.Error("short relay secret accepted")
+	}
+	if err := l.SetRelay(secret, &RelayLimits{}); err != nil {
+		t.Fatal(err)
+	}
+
+	token := NewRelayToken()
+	type result struct {
+		s         *UDPSession
+		initiator bool
+		err       error
+	}
+	results := make(chan result, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for range 2 {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go func() {
+			s, initiator, err := DialRelay(ctx, conn, l.Addr().String(), secret, token, config)
+			results <- result{s, initiator, err}
+		}()
+	}
+	var sessions [2]*UDPSession
+	initiators := 0
+	for i := range sessions {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		defer r.s.Close()
+		sessions[i] = r.s
+		if r.initiator {
+			initiators++
+		}
+	}
+	if initiators != 1 {
+		t.Fatalf("%d initiators", initiators)
+	}
+	data := bytes.Repeat([]byte("relay"), 20000)
+	for i, s := range sessions {
+		go s.Write(data)
+		peer := sessions[1-i]
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(peer, got); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("relayed data corrupted, %v", err)
+		}
+	}
+
+	// 中继监听器仍接受自己的会话
+	client, err := DialWithConfig(l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("direct"))
+	l.SetDeadline(time.Now().Add(5 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+// TestRelayBindAuth 测试中继拒绝密钥错误或过期的绑定，并对绑定施加来源限速
+func TestRelayBindAuth(t *testing.T) {
+	l, err := ListenWithConfig("127.0.0.1:0", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	secret := bytes.Repeat([]byte{1}, 16)
+	if err := l.SetRelay(secret, &RelayLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetSourceLimits(SourceLimits{NewSessionsPerSec: 1}); err != nil {
+		t.Fatal(err)
+	}
+	table := l.relay.Load()
+	now := time.Now()
+	token := NewRelayToken()
+	bind := newRelayBind(secret, token, now)
+	if !table.authentic(bind, now) {
+		t.Fatal("authentic bind rejected")
+	}
+	if table.authentic(newRelayBind(make([]byte, 16), token, now), now) {
+		t.Error("bind under another secret accepted")
+	}
+	if table.authentic(bind, now.Add(time.Minute)) {
+		t.Error("stale bind accepted")
+	}
+	forged := append([]byte(nil), bind...)
+	forged[5] ^= 1
+	if table.authentic(forged, now) {
+		t.Error("bind with a changed token accepted")
+	}
+
+	// 每秒一个新分配，第二个来源地址相同的分配被限速
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	drops := l.Snmp().InSourceDrops
+	if !l.relayPacket(bind, addr) || len(table.allocs) != 1 {
+		t.Fatal("bind not allocated")
+	}
+	l.relayPacket(newRelayBind(secret, token, now), addr) // 已绑定的重发不受新会话限速
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2000}
+	if !l.relayPacket(newRelayBind(secret, NewRelayToken(), now), other) || len(table.allocs) != 1 {
+		t.Error("allocation over the new session rate")
+	}
+	if !l.relayPacket(forged, addr) || l.Snmp().InSourceDrops != drops+2 {
+		t.Errorf("%d source drops", l.Snmp().InSourceDrops-drops)
+	}
+}
+
+// TestRelayLimits 测试中继分配的字节配额、速率、数量上限与空闲过期
+func TestRelayLimits(t *testing.T) {
+	a := netip.MustParseAddrPort("192.0.2.1:1000")
+	b := netip.MustParseAddrPort("192.0.2.2:2000")
+	c := netip.MustParseAddrPort("192.0.2.3:3000")
+	now := time.Now()
+	newTable := func(limits RelayLimits) *relayTable {
+		l := new(Listener)
+		if err := l.SetRelay(make([]byte, 16), &limits); err != nil {
+			t.Fatal(err)
+		}
+		return l.relay.Load()
+	}
+
+	// 配对与转发，第三个对端被拒绝
+	table := newTable(RelayLimits{Bytes: 3000})
+	token := NewRelayToken()
+	if reply := table.bind(token, a, now); reply == nil || reply[21] != 0 || reply[22] != 0 {
+		t.Fatalf("first bind replied %v", reply)
+	}
+	if _, relayed, ok := table.forward(a, 100, now); relayed || !ok {
+		t.Error("packet relayed before pairing")
+	}
+	if reply := table.bind(token, b, now); reply == nil || reply[21] != 1 || reply[22] != 1 {
+		t.Fatalf("second bind replied %v", reply)
+	}
+	if table.bind(token, c, now) != nil {
+		t.Error("third peer bound")
+	}
+	if to, relayed, _ := table.forward(a, 1000, now); !relayed || to != b {
+		t.Errorf("relayed to %v, %v", to, relayed)
+	}
+	if to, relayed, _ := table.forward(b, 1000, now); !relayed || to != a {
+		t.Errorf("relayed to %v, %v", to, relayed)
+	}
+	if _, _, ok := table.forward(c, 1000, now); ok {
+		t.Error("packet of an unknown peer consumed")
+	}
+
+	// 超出字节配额后移除分配
+	if _, relayed, _ := table.forward(a, 1001, now); relayed {
+		t.Error("packet over the byte quota relayed")
+	}
+	if _, _, ok := table.forward(a, 10, now); ok {
+		t.Error("allocation over its quota kept")
+	}
+
+	// 速率限制
+	table = newTable(RelayLimits{BytesPerSec: 10000})
+	table.bind(token, a, now)
+	table.bind(token, b, now)
+	drops := 0
+	for range 10 {
+		if _, relayed, _ := table.forward(a, 1000, now); !relayed {
+			drops++
+		}
+	}
+	if drops == 0 {
+		t.Error("rate limit not applied")
+	}
+
+	// 数量上限与空闲过期
+	table = newTable(RelayLimits{Allocations: 1, Idle: time.Minute})
+	table.bind(token, a, now)
+	if table.bind(NewRelayToken(), c, now) != nil {
+		t.Error("allocation over the limit created")
+	}
+	later := now.Add(2 * time.Minute)
+	if _, _, ok := table.forward(a, 10, later); ok {
+		t.Error("expired allocation relayed")
+	}
+	if table.bind(NewRelayToken(), c, later) == nil {
+		t.Error("expired allocation not swept")
+	}
+}
+
+// TestPortHopping 测试端口跳变的配置校验、由密钥决定的端口序列，以及跨多次跳变的传输
+func TestPortHopping(t *testing.T) {
+	key := make([]byte, 32)
+	for _, c := range []Config{
+		{HopPorts: "4000", Key: key},
+		{HopPorts: "5000-4000", Key: key},
+		{HopPorts: "0-100", Key: key},
+		{HopPorts: "4000-70000", Key: key},
+		{HopPorts: "4000-5000"},
+		{HopPorts: "4000-5000", Key: key, HopInterval: -1},
+		{HopPorts: "4000-5000", Key: key, KCPCompat: true},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+
+	// 相同密钥得到相同的序列，不同密钥不同
+	a := &hopSchedule{key: key, min: 40000, max: 40999, interval: time.Second}
+	b := &hopSchedule{key: key, min: 40000, max: 40999, interval: time.Second}
+	other := &hopSchedule{key: bytes.Repeat([]byte{1}, 32), min: 40000, max: 40999, interval: time.Second}
+	same := 0
+	for e := int64(0); e < 100; e++ {
+		if a.port(e) != b.port(e) || !a.inRange(uint16(a.port(e))) {
+			t.Fatalf("epoch %d: ports %d and %d", e, a.port(e), b.port(e))
+		}
+		if a.port(e) == other.port(e) {
+			same++
+		}
+	}
+	if same > 5 {
+		t.Errorf("%d of 100 ports shared with another key", same)
+	}
+
+	// 每200毫秒跳变一次，传输持续多个间隔
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = key
+	}
+	block, err := config.blockCrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := &hopSchedule{key: key, min: 41000, max: 41063, interval: 200 * time.Millisecond}
+	conn, err := listenHopping("127.0.0.1:0", schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newConfigListener(conn, config, block, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.monitor()
+	defer l.Close()
+	client, err := dialHopping(context.Background(), "127.0.0.1:9", config, block, schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	config.tuneDialed(client)
+
+	client.Write([]byte{0})
+	l.SetDeadline(time.Now().Add(5 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go io.Copy(s, s)
+	buf := make([]byte, 1)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	ports := make(map[int]bool)
+	for end := time.Now().Add(time.Second); time.Now().Before(end); {
+		ports[schedule.port(schedule.epoch(time.Now()))] = true
+		msg := bytes.Repeat([]byte{byte(len(ports))}, 1000)
+		client.Write(msg)
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(client, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("echo after %d ports failed, %v", len(ports), err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(ports) < 3 {
+		t.Errorf("sent to %d ports", len(ports))
+	}
+}
+
+// testTracer 记录会话的跟踪事件
+type testTracer struct {
+	mu      sync.Mutex
+	convs   []uint32
+	parents map[bool][]any // the parent spans in the contexts, by client
+	events  []string
+	ended   int
+}
+
+// parentSpan is the key of the parent span in the contexts of testTracer
+type parentSpan struct{}
+
+func (t *testTracer) StartSession(ctx context.Context, conv uint32, local, remote net.Addr, client bool) SessionTracer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.convs = append(t.convs, conv)
+	if t.parents == nil {
+		t.parents = make(map[bool][]any)
+	}
+	t.parents[client] = append(t.parents[client], ctx.Value(parentSpan{}))
+	return t
+}
+
+func (t *testTracer) Event(name, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, name+": "+detail)
+}
+
+func (t *testTracer) End() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ended++
+}
+
+// TestTracer 测试会话生命周期上报给跟踪器
+func TestTracer(t *testing.T) {
+	tracer := new(testTracer)
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTracer(nil)
+	s.Close()
+	cli.Close()
+
+	tracer.mu.Lock()
+	convs, ended, events := tracer.convs, tracer.ended, tracer.events
+	tracer.mu.Unlock()
+	if len(convs) != 2 || convs[0] != cli.GetConv() || convs[1] != cli.GetConv() {
+		t.Fatal("sessions started", convs)
+	}
+	if ended != 2 {
+		t.Fatal("sessions ended", ended)
+	}
+	if !slices.Contains(events, TraceEvent+": closed") {
+		t.Fatal("events", events)
+	}
+
+	// DialContext 的上下文传给跟踪器，会话的 span 挂在调用者的 span 下
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	if cryptoEnabled {
+		config.Key = make([]byte, 32)
+	}
+	sl, err := ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		if conn, err := sl.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	tracer = new(testTracer)
+	SetTracer(tracer)
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), parentSpan{}, "rpc"), 5*time.Second)
+	defer cancel()
+	conn, err := DialContext(ctx, sl.Addr().String(), config)
+	SetTracer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if !slices.Equal(tracer.parents[true], []any{"rpc"}) || !slices.Equal(tracer.parents[false], []any{nil}) {
+		t.Fatal("parent spans", tracer.parents)
+	}
+}
+
+// TestQlog 测试会话事件以JSON行写出
+func TestQlog(t *testing.T) {
+	events := []string{"packet_sent", "packet_received", "loss_detected", "cwnd_update"}
+	data, parity := 0, 0
+	if fecEnabled {
+		events = append(events, "fec_recovered")
+		data, parity = 4, 2
+	}
+	l, cli := newSimPair(t, newSimNetwork(0.2), nil, data, parity)
+	var buf bytes.Buffer
+	w := &lockedWriter{w: &buf}
+	cli.SetNoDelay(1, 10, 2, 0) // 启用拥塞控制
+	cli.SetQlog(w)
+
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		io.Copy(s, s)
+	}()
+	payload := make([]byte, 64<<10)
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	go cli.Write(payload)
+	if _, err := io.ReadFull(cli, payload); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetQlog(nil)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sc := bufio.NewScanner(&buf)
+	if !sc.Scan() || !strings.Contains(sc.Text(), `"qlog_format":"NDJSON"`) {
+		t.Fatal("header", sc.Text())
+	}
+	names := make(map[string]int)
+	for sc.Scan() {
+		var r struct {
+			Time float64        `json:"time"`
+			Name string         `json:"name"`
+			Data map[string]any `json:"data"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatal(err, sc.Text())
+		}
+		names[r.Name]++
+	}
+	for _, name := range events {
+		if names[name] == 0 {
+			t.Fatal("no event", name, names)
+		}
+	}
+}
+
+// lockedWriter 串行化并发写入
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// recordingTap 记录截获的数据报
+type recordingTap struct {
+	mu      sync.Mutex
+	packets map[TapDirection][][]byte
+}
+
+func (r *recordingTap) Tap(dir TapDirection, local, remote net.Addr, pkt []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets[dir] = append(r.packets[dir], append([]byte(nil), pkt...))
+}
+
+// contains 报告某方向是否有包含data的数据报
+func (r *recordingTap) contains(dir TapDirection, data []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.packets[dir] {
+		if bytes.Contains(p, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestPacketTap 测试截获会话加密前与解密后的数据报
+func TestPacketTap(t *testing.T) {
+	block, _ := NewNoneBlockCrypt(nil)
+	if cryptoEnabled {
+		block, _ = keyBlockCrypt(make([]byte, 32))
+	}
+	l, cli := newSimPair(t, newSimNetwork(0), block, 0, 0)
+	serverTap := &recordingTap{packets: make(map[TapDirection][][]byte)}
+	clientTap := &recordingTap{packets: make(map[TapDirection][][]byte)}
+	l.SetPacketTap(serverTap)
+	cli.SetPacketTap(clientTap)
+
+	cli.Write([]byte("hello tap"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 9)
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !clientTap.contains(TapOutgoing, []byte("hello tap")) || !serverTap.contains(TapIncoming, []byte("hello tap")) {
+		t.Fatal("plaintext datagram not tapped")
+	}
+	s.Write([]byte("reply"))
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(cli, buf[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if !serverTap.contains(TapOutgoing, []byte("reply")) || !clientTap.contains(TapIncoming, []byte("reply")) {
+		t.Fatal("reply not tapped")
+	}
+}
+
+// TestPcapWriter 测试pcap文件头与IP/UDP封装及校验和
+func TestPcapWriter(t *testing.T) {
+	for _, c := range []struct{ local, remote string }{
+		{"10.0.0.1:1000", "10.0.0.2:2000"},
+		{"[fe80::1]:1000", "[fe80::2]:2000"},
+	} {
+		var out bytes.Buffer
+		p, err := NewPcapWriter(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, _ := net.ResolveUDPAddr("udp", c.local)
+		remote, _ := net.ResolveUDPAddr("udp", c.remote)
+		payload := []byte("datagram")
+		p.Tap(TapIncoming, local, remote, payload)
+
+		b := out.Bytes()
+		if binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != 101 {
+			t.Fatal("file header", b[:24])
+		}
+		rec := b[24:]
+		pkt := rec[16:]
+		if int(binary.LittleEndian.Uint32(rec[8:])) != len(pkt) {
+			t.Fatal("record length", len(pkt))
+		}
+		ipLen := 20
+		src, dst := net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		pseudo := onesSum(0, pkt[12:20])
+		if pkt[0]>>4 == 6 {
+			ipLen = 40
+			src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+			pseudo = onesSum(0, pkt[8:40])
+		} else if onesSum(0, pkt[:20]) != 0xffff {
+			t.Fatal("ipv4 header checksum")
+		}
+		// 入方向：源为远端，目的为本地
+		if !src.Equal(remote.IP) || !dst.Equal(local.IP) {
+			t.Fatal("addresses", src, dst)
+		}
+		udp := pkt[ipLen:]
+		if binary.BigEndian.Uint16(udp) != 2000 || binary.BigEndian.Uint16(udp[2:]) != 1000 || !bytes.Equal(udp[8:], payload) {
+			t.Fatal("udp header", udp[:8])
+		}
+		pseudo = onesSum(pseudo, []byte{0, 17, byte(len(udp) >> 8), byte(len(udp))})
+		if onesSum(pseudo, udp) != 0xffff {
+			t.Fatal("udp checksum")
+		}
+	}
+}
+
+// TestIOUring 测试经由 io_uring 收发，监听器的会话共享其环
+func TestIOUring(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, SendWindow: 128, RecvWindow: 128, IOUring: true}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithConfig(l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if !cli.GetIOUring() {
+		t.Skip("io_uring not available")
+	}
+
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		if !s.GetIOUring() {
+			s.Write([]byte("accepted session without the ring of its listener"))
+			return
+		}
+		io.Copy(s, s)
+	}()
+
+	msg := make([]byte, 512*1024)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	go cli.Write(msg)
+	got := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo mismatch")
+	}
+	if !cli.GetIOUring() {
+		t.Fatal("io_uring turned off", cli.DebugState())
+	}
+
+	// 关闭后回退到批量发送
+	cli.SetIOUring(false)
+	if cli.GetIOUring() {
+		t.Fatal("io_uring still on")
+	}
+	cli.Write([]byte("after"))
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(cli, got[:5]); err != nil || string(got[:5]) != "after" {
+		t.Fatal(err, got[:5])
+	}
+}
+
+// TestIOUringRecv 测试经由 io_uring 接收，读超时和关闭会中断等待
+func TestIOUringRecv(t *testing.T) {
+	r, err := newIORing()
+	if err != nil {
+		t.Skip("io_uring not available")
+	}
+	defer r.close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	msgs := make([]ipv4.Message, batchSize)
+	for k := range msgs {
+		msgs[k].Buffers = [][]byte{make([]byte, mtuLimit)}
+	}
+	const count = 100
+	for i := 0; i < count; i++ {
+		peer.WriteTo([]byte{byte(i)}, conn.LocalAddr())
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for got := 0; got < count; {
+		n, err := r.recv(conn, msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs[:n] {
+			if msg.N != 1 || msg.Buffers[0][0] != byte(got) || addrKey(msg.Addr) != addrKey(peer.LocalAddr()) {
+				t.Fatalf("packet %d: %v from %v", got, msg.Buffers[0][:msg.N], msg.Addr)
+			}
+			got++
+		}
+	}
+
+	// 没有数据时在读超时返回
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := r.recv(conn, msgs); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("recv past the deadline returned %v", err)
+	}
+
+	// 关闭的环交回批量接收
+	conn.SetReadDeadline(time.Time{})
+	closed, _ := newIORing()
+	closed.close()
+	if _, err := closed.recv(conn, msgs); !errors.Is(err, errIORing) {
+		t.Fatalf("recv on a closed ring returned %v", err)
+	}
+
+	// 关闭套接字中断等待
+	time.AfterFunc(50*time.Millisecond, func() { conn.Close() })
+	if _, err := r.recv(conn, msgs); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("recv on a closed socket returned %v", err)
+	}
+
+}
+
+// testHandshake 是测试用的握手后端，交换一个字节，失败时返回 err
+type testHandshake struct{ err error }
+
+func (h testHandshake) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	return h.exchange(conn)
+}
+
+func (h testHandshake) Server(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	return h.exchange(conn)
+}
+
+func (h testHandshake) exchange(conn net.Conn) (net.Conn, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// TestHandshakeBackend 测试流连接经由握手后端建立，后端失败时以 ErrHandshake 结束
+func TestHandshakeBackend(t *testing.T) {
+	server := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, Handshake: testHandshake{}}
+	sl, err := ListenStream("127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				if errors.Is(err, ErrHandshake) {
+					continue
+				}
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialContext(ctx, sl.Addr().String(), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Unauthenticated() || conn.Secured() == nil {
+		t.Fatal("connection not secured by the backend")
+	}
+	conn.Write([]byte("secured"))
+	got := make([]byte, 7)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "secured" {
+		t.Fatal(err, got)
+	}
+
+	// 错误同时匹配 ErrHandshake 与后端的错误
+	refused := errors.New("refused")
+	failing := *server
+	failing.Handshake = testHandshake{err: refused}
+	if _, err := DialContext(ctx, sl.Addr().String(), &failing); !errors.Is(err, ErrHandshake) || !errors.Is(err, refused) || err.Error() != "handshake failed: refused" {
+		t.Fatal("failed handshake:", err)
+	}
+
+	if err := (&Config{Key: make([]byte, 32), Handshake: testHandshake{}}).Validate(); err == nil {
+		t.Fatal("Handshake with a Key accepted")
+	}
+	if err := (&Config{Plaintext: true, Handshake: testHandshake{}}).Validate(); err == nil {
+		t.Fatal("Handshake with Plaintext accepted")
+	}
+}
+
+// xorPlugin 是测试用的进程内插件，按选项中的字节异或数据报
+type xorPlugin struct{}
+
+func (xorPlugin) Wrap(conn net.PacketConn, options string, server bool) (net.PacketConn, error) {
+	if len(options) != 1 {
+		return nil, errors.New("want a single byte")
+	}
+	return &xorConn{PacketConn: conn, key: options[0]}, nil
+}
+
+type xorConn struct {
+	net.PacketConn
+	key byte
+}
+
+func (c *xorConn) xor(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[i] ^ c.key
+	}
+	return out
+}
+
+func (c *xorConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(c.xor(b), addr)
+}
+
+func (c *xorConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	copy(b, c.xor(b[:n]))
+	return n, addr, err
+}
+
+// TestPlugin 测试进程内插件变换线路上的数据报
+func TestPlugin(t *testing.T) {
+	if lookupPlugin("xor-test") == nil {
+		RegisterPlugin("xor-test", xorPlugin{})
+	}
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, Plugin: "xor-test", PluginOptions: "\x5a"}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	cli, err := DialWithConfig(l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	msg := bytes.Repeat([]byte("obfuscated "), 1000)
+	go cli.Write(msg)
+	got := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatal(err)
+	}
+
+	// 没有插件的客户端无法与之通信
+	plain, err := DialWithConfig(l.Addr().String(), &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Write([]byte("hello"))
+	plain.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := plain.Read(got); !errors.Is(err, ErrTimeout) {
+		t.Fatal("plain client answered", err)
+	}
+
+	for _, c := range []*Config{
+		{Plugin: "no-such-plugin"},
+		{PluginOptions: "x"},
+		{Plugin: "xor-test", HopPorts: "4000-4010", Key: make([]byte, 32)},
+	} {
+		if c.Validate() == nil {
+			t.Fatal("invalid plugin settings accepted", c.Plugin, c.PluginOptions)
+		}
+	}
+	if _, err := DialWithConn(plain.conn, plain.RemoteAddr(), config); err == nil {
+		t.Fatal("plugin with a socket of the caller accepted")
+	}
+}
+
+// TestSessionStats 测试会话自身的计数器与共享计数器一同累加
+func TestSessionStats(t *testing.T) {
+	block, _ := NewNoneBlockCrypt(nil)
+	ds, ps := 0, 0
+	if fecEnabled {
+		ds, ps = 4, 2
+	}
+	l, cli := newSimPair(t, newSimNetwork(0.1), block, ds, ps)
+	msg := bytes.Repeat([]byte("per session "), 4000)
+	go cli.Write(msg)
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetNoDelay(1, 10, 2, 1)
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, ss := cli.Stats(), s.Stats()
+	if cs.BytesSent != uint64(len(msg)) || ss.BytesReceived != uint64(len(msg)) {
+		t.Fatal("bytes", cs.BytesSent, ss.BytesReceived)
+	}
+	if cs.OutPkts == 0 || cs.OutSegs == 0 || ss.InPkts == 0 || ss.InSegs == 0 {
+		t.Fatal("packets", cs.OutPkts, cs.OutSegs, ss.InPkts, ss.InSegs)
+	}
+	if !fecEnabled && cs.RetransSegs == 0 {
+		t.Fatal("no retransmissions counted under loss")
+	}
+	if fecEnabled && ss.FECRecovered == 0 {
+		t.Fatal("no FEC recoveries counted under loss")
+	}
+	// 共享的计数器包含会话的计数
+	if shared := l.Snmp().Copy(); shared.InPkts < ss.InPkts || shared.FECRecovered < ss.FECRecovered {
+		t.Fatal("shared counters", shared.InPkts, ss.InPkts)
+	}
+	if cs.CurrEstab != 0 || cs.ActiveOpens != 0 {
+		t.Fatal("gauges of a session", cs.CurrEstab, cs.ActiveOpens)
+	}
+}
+
+// TestZeroCopyListenerSessions 测试监听器的会话共享套接字的错误队列，不能启用零拷贝
+func TestZeroCopyListenerSessions(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !enableZeroCopy(l.conn) {
+		t.Skip("SO_ZEROCOPY not supported")
+	}
+
+	var sessions []*UDPSession
+	for i := 0; i < 2; i++ {
+		cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.Write([]byte("hello"))
+		l.SetReadDeadline(time.Now().Add(2 * time.Second))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		cli.SetNoDelay(1, 10, 2, 1)
+		s.SetNoDelay(1, 10, 2, 1)
+		sessions = append(sessions, s)
+
+		if s.SetZeroCopy(true) || s.GetZeroCopy() {
+			t.Fatal("zero copy enabled on a listener session", i)
+		}
+		// 两个会话的数据仍然完整
+		msg := bytes.Repeat([]byte{byte('a' + i)}, 64*1024)
+		go s.Write(msg)
+		got := make([]byte, len(msg))
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(cli, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatal(err, i)
+		}
+	}
+	if !sessions[0].SetZeroCopy(false) {
+		t.Fatal("disabling zero copy failed")
+	}
+}
+
+// TestSourceLimitsFirstSession 测试新来源地址在每秒一个会话的限速下立即获得首个会话
+func TestSourceLimitsFirstSession(t *testing.T) {
+	l := new(Listener)
+	if err := l.SetSourceLimits(SourceLimits{NewSessionsPerSec: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ip := netip.MustParseAddr("192.0.2.1")
+	if !l.admitSession(ip) {
+		t.Fatal("first session of a new source refused")
+	}
+	if l.admitSession(ip) {
+		t.Error("second session within the second admitted")
+	}
+}
+
+// TestRTOSettings 测试初始RTO、上下限以及RTT种子
+func TestRTOSettings(t *testing.T) {
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.SetRTO(1000, 50, 2000)
+	if kcp.rx_rto != 1000 {
+		t.Fatalf("initial rto %d", kcp.rx_rto)
+	}
+	kcp.NoDelay(1, 20, 2, 1)
+	if kcp.rx_minrto != 50 {
+		t.Fatalf("rto floor %d replaced by NoDelay", kcp.rx_minrto)
+	}
+
+	// 握手测得的RTT作为第一个样本，之后的种子被忽略
+	kcp.SeedRTT(300)
+	if kcp.rx_srtt != 300 || kcp.rx_rto != 300+4*150 {
+		t.Fatalf("seeded srtt %d rto %d", kcp.rx_srtt, kcp.rx_rto)
+	}
+	kcp.SeedRTT(10)
+	if kcp.rx_srtt != 300 {
+		t.Fatal("seed replaced a measured srtt")
+	}
+	kcp.update_ack(5000)
+	if kcp.rx_rto != 2000 {
+		t.Fatalf("rto %d above the ceiling", kcp.rx_rto)
+	}
+
+	l, err := ListenWithConfig("127.0.0.1:0", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithConfig(l.Addr().String(), &Config{InitialRTO: 1500, MaxRTO: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if rto := cli.GetRTO(); rto != 1500 {
+		t.Fatalf("initial rto %d from config", rto)
+	}
+}
+
+// TestRACK 测试基于时间的丢包检测和尾部丢包探测
+func TestRACK(t *testing.T) {
+	// newPair 创建直连的发送方和接收方，发送方的包记录在 wire 中
+	newPair := func(rack bool) (sender, receiver *KCP, wire *[][]byte) {
+		wire = new([][]byte)
+		sender = NewKCP(1, func(buf []byte, size int) {
+			*wire = append(*wire, append([]byte(nil), buf[:size]...))
+		})
+		sender.NoDelay(1, 10, 0, 1)
+		sender.SeedRTT(40)
+		sender.SetRACK(rack)
+		receiver = NewKCP(1, func(buf []byte, size int) {
+			sender.Input(buf[:size], true, false)
+		})
+		return sender, receiver, wire
+	}
+	// sent 返回 wire 中数据段的序号
+	sent := func(wire [][]byte) (sns []uint32) {
+		for _, pkt := range wire {
+			if pkt[4] == IKCP_CMD_PUSH {
+				sns = append(sns, binary.LittleEndian.Uint32(pkt[12:]))
+			}
+		}
+		return sns
+	}
+	payload := make([]byte, IKCP_MTU_DEF-IKCP_OVERHEAD)
+
+	// 后发送的段已确认，且超过重排序窗口，先发送的段视为丢失；
+	// 同时有新数据发送，提前重传不会触发
+	for _, rack := range []bool{false, true} {
+		sender, receiver, wire := newPair(rack)
+		sender.Send(payload)
+		sender.Send(payload)
+		sender.flush(false)
+		if len(*wire) != 2 {
+			t.Fatalf("%d packets sent", len(*wire))
+		}
+		second := (*wire)[1]
+		*wire = nil
+
+		// 第一个段在 100ms 前发送，并且丢失
+		for s := range sender.snd_buf.ForEach {
+			s.ts -= 100
+			break
+		}
+		receiver.Input(second, true, false)
+		receiver.flush(false)
+
+		sender.Send(payload)
+		sender.flush(false)
+		if got := sent(*wire); rack != slices.Contains(got, 0) {
+			t.Fatalf("rack %v: segments sent %v", rack, got)
+		}
+	}
+
+	// 尾部的段丢失，两个RTT内没有确认时重发最新的段，且只探测一次
+	for _, rack := range []bool{false, true} {
+		sender, receiver, wire := newPair(rack)
+		sender.Send(payload)
+		sender.Send(payload)
+		sender.flush(false)
+		first := (*wire)[0]
+		*wire = nil
+
+		receiver.Input(first, true, false)
+		receiver.flush(false)
+		// 最后一次确认和发送都在 200ms 前
+		for s := range sender.snd_buf.ForEach {
+			s.ts -= 200
+		}
+		sender.ts_ack -= 200
+		*wire = nil
+
+		sender.flush(false)
+		if got := sent(*wire); rack != slices.Equal(got, []uint32{1}) {
+			t.Fatalf("rack %v: segments sent %v", rack, got)
+		}
+		*wire = nil
+		sender.flush(false)
+		if got := sent(*wire); len(got) != 0 {
+			t.Fatalf("rack %v: probed again %v", rack, got)
+		}
+	}
+}
+
+// TestFRTO 测试虚假超时的检测
+func TestFRTO(t *testing.T) {
+	// timeout 发送4个段后让它们全部超时，返回超时后发出的包
+	timeout := func(frto bool) (sender, receiver *KCP, original, wire *[][]byte) {
+		wire = new([][]byte)
+		sender = NewKCP(1, func(buf []byte, size int) {
+			*wire = append(*wire, append([]byte(nil), buf[:size]...))
+		})
+		sender.NoDelay(0, 10, 0, 0)
+		sender.SeedRTT(40)
+		sender.SetFRTO(frto)
+		sender.cwnd = 8
+		receiver = NewKCP(1, func(buf []byte, size int) {
+			sender.Input(buf[:size], true, false)
+		})
+
+		payload := make([]byte, IKCP_MTU_DEF-IKCP_OVERHEAD)
+		for i := 0; i < 4; i++ {
+			sender.Send(payload)
+		}
+		sender.flush(false)
+		original = &[][]byte{}
+		*original, *wire = *wire, nil
+
+		// 确认的时间戳早于超时重传
+		time.Sleep(5 * time.Millisecond)
+		current := currentMs()
+		for s := range sender.snd_buf.ForEach {
+			s.resendts = current
+		}
+		sender.flush(false)
+		return sender, receiver, original, wire
+	}
+	sns := func(wire [][]byte) (sns []uint32) {
+		for _, pkt := range wire {
+			sns = append(sns, binary.LittleEndian.Uint32(pkt[12:]))
+		}
+		return sns
+	}
+
+	// 未启用时重传整个窗口
+	_, _, _, wire := timeout(false)
+	if got := sns(*wire); len(got) != 4 {
+		t.Fatalf("segments retransmitted without F-RTO %v", got)
+	}
+
+	// 超时前发送的段被确认：超时是虚假的，恢复拥塞窗口，不再重传
+	sender, receiver, original, wire := timeout(true)
+	if got := sns(*wire); !slices.Equal(got, []uint32{0}) {
+		t.Fatalf("segments retransmitted on timeout %v", got)
+	}
+	if sender.cwnd != 1 {
+		t.Fatalf("cwnd %d after timeout", sender.cwnd)
+	}
+	*wire = nil
+	receiver.Input((*original)[1], true, false)
+	receiver.flush(false)
+	if sender.cwnd != 8 || sender.frto_state != frtoIdle {
+		t.Fatalf("cwnd %d state %d after a spurious timeout", sender.cwnd, sender.frto_state)
+	}
+	sender.flush(false)
+	if got := sns(*wire); len(got) != 0 {
+		t.Fatalf("segments retransmitted after a spurious timeout %v", got)
+	}
+
+	// 只有重传的段被确认：超时是真实的，立即重传其余的段，且不再次减小窗口
+	sender, receiver, _, wire = timeout(true)
+	retransmit := (*wire)[0]
+	ssthresh := sender.ssthresh
+	*wire = nil
+	receiver.Input(retransmit, true, false)
+	receiver.flush(false)
+	if got := sns(*wire); !slices.Equal(got, []uint32{1, 2, 3}) {
+		t.Fatalf("segments retransmitted after a genuine timeout %v", got)
+	}
+	if sender.cwnd > 2 || sender.ssthresh != ssthresh {
+		t.Fatalf("cwnd %d ssthresh %d after a genuine timeout", sender.cwnd, sender.ssthresh)
+	}
+}
+
+// TestSACK 测试选择性确认范围在确认丢失时避免重传已收到的段
+func TestSACK(t *testing.T) {
+	// retransmits 段0丢失，段1和段2的确认丢失，只有段3的确认到达，返回超时后重传的段
+	retransmits := func(sack bool) []uint32 {
+		var wire [][]byte
+		sender := NewKCP(1, func(buf []byte, size int) {
+			wire = append(wire, append([]byte(nil), buf[:size]...))
+		})
+		sender.NoDelay(0, 10, 0, 1)
+		drop := true
+		receiver := NewKCP(1, func(buf []byte, size int) {
+			if !drop {
+				sender.Input(buf[:size], true, false)
+			}
+		})
+		receiver.SetSACK(sack)
+
+		payload := make([]byte, IKCP_MTU_DEF-IKCP_OVERHEAD)
+		for i := 0; i < 4; i++ {
+			sender.Send(payload)
+		}
+		sender.flush(false)
+		receiver.Input(wire[1], true, false)
+		receiver.Input(wire[2], true, false)
+		receiver.flush(false)
+		drop = false
+		receiver.Input(wire[3], true, false)
+		receiver.flush(false)
+
+		wire = nil
+		current := currentMs()
+		for seg := range sender.snd_buf.ForEach {
+			seg.resendts = current
+		}
+		sender.flush(false)
+
+		var sns []uint32
+		for _, pkt := range wire {
+			sns = append(sns, binary.LittleEndian.Uint32(pkt[12:]))
+		}
+		return sns
+	}
+
+	if got := retransmits(false); !slices.Equal(got, []uint32{0, 1, 2}) {
+		t.Fatalf("retransmitted without SACK %v", got)
+	}
+	sacked := DefaultSnmp.Copy().SACKSegs
+	if got := retransmits(true); !slices.Equal(got, []uint32{0}) {
+		t.Fatalf("retransmitted with SACK %v", got)
+	}
+	if n := DefaultSnmp.Copy().SACKSegs - sacked; n != 2 {
+		t.Fatalf("%d segments acknowledged by ranges", n)
+	}
+
+	// 不连续的段编码为多个范围
+	kcp := NewKCP(1, func([]byte, int) {})
+	for _, sn := range []uint32{7, 1, 2, 4} {
+		heap.Push(kcp.rcv_buf, segment{sn: sn})
+	}
+	var ranges []uint32
+	for data := kcp.sack_ranges(); len(data) > 0; data = data[4:] {
+		ranges = append(ranges, binary.LittleEndian.Uint32(data))
+	}
+	if !slices.Equal(ranges, []uint32{1, 2, 4, 4, 7, 7}) {
+		t.Fatalf("ranges %v", ranges)
+	}
+}
+
+// TestReadWriteContext 测试上下文取消能中止阻塞的读写
+func TestReadWriteContext(t *testing.T) {
+	_, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cli.ReadContext(ctx, make([]byte, 16)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadContext: expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// 填满发送窗口后写入应阻塞，直到上下文取消
+	cli.SetWindowSize(1, 1)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	var err error
+	for i := 0; i < 16 && err == nil; i++ {
+		_, err = cli.WriteContext(ctx, make([]byte, 64))
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("WriteContext: expected context.Canceled, got %v", err)
+	}
+}
+
+// TestAcceptContext 测试监听器的上下文取消和截止时间
+func TestAcceptContext(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AcceptContext: expected context.DeadlineExceeded, got %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.AcceptContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("AcceptContext: expected context.Canceled, got %v", err)
+	}
+
+	// 截止时间对上下文版本同样有效
+	l.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := l.AcceptContext(context.Background()); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("AcceptContext: expected ErrTimeout, got %v", err)
+	}
+	l.SetDeadline(time.Time{})
+
+	cli.Write([]byte("hello"))
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	s, err := l.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 5)
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("read failed", err)
+	}
+
+	l.Close()
+	if _, err := l.AcceptKCP(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("AcceptKCP: expected ErrClosed, got %v", err)
+	}
+}
+
+// TestSentinelErrors 测试导出的错误可以用 errors.Is 判断
+func TestSentinelErrors(t *testing.T) {
+	_, cli := newSimPair(t, newSimNetwork(1), nil, 0, 0)
+
+	// 所有包都丢失，超过重传上限后读写失败
+	cli.mu.Lock()
+	cli.kcp.dead_link = 2
+	cli.mu.Unlock()
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cli.Write([]byte("unreachable"))
+	if _, err := cli.Read(make([]byte, 16)); !errors.Is(err, ErrMaxRetransmit) {
+		t.Fatalf("expected ErrMaxRetransmit, got %v", err)
+	}
+	if _, err := cli.Write([]byte("unreachable")); !errors.Is(err, ErrMaxRetransmit) {
+		t.Fatalf("expected ErrMaxRetransmit on write, got %v", err)
+	}
+
+	_, cli = newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	cli.Close()
+	_, err := cli.Read(make([]byte, 16))
+	for _, target := range []error{ErrClosed, io.ErrClosedPipe, net.ErrClosed} {
+		if !errors.Is(err, target) {
+			t.Errorf("expected %v to match %v", err, target)
+		}
+	}
+	if errors.Is(err, ErrTimeout) {
+		t.Errorf("closed session reported as a timeout")
+	}
+
+	if !errors.Is(fmt.Errorf("read: %w", ErrTimeout), os.ErrDeadlineExceeded) {
+		t.Errorf("ErrTimeout does not match os.ErrDeadlineExceeded")
+	}
+}
+
+// TestMaxRetransmit 测试重传次数上限和无进展超时使读写失败
+func TestMaxRetransmit(t *testing.T) {
+	for _, c := range []struct {
+		n       int
+		timeout time.Duration
+	}{{2, 0}, {1000, 300 * time.Millisecond}} {
+		_, cli := newSimPair(t, newSimNetwork(1), nil, 0, 0)
+		cli.SetMaxRetransmit(c.n, c.timeout)
+		start := time.Now()
+		cli.Write([]byte("unreachable"))
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := cli.Read(make([]byte, 16)); !errors.Is(err, ErrMaxRetransmit) {
+			t.Fatalf("%d/%v: expected ErrMaxRetransmit, got %v", c.n, c.timeout, err)
+		}
+		if elapsed := time.Since(start); elapsed < c.timeout {
+			t.Fatalf("failed after %v, before the progress timeout", elapsed)
+		}
+		if _, err := cli.Write([]byte("unreachable")); !errors.Is(err, ErrMaxRetransmit) {
+			t.Fatalf("%d/%v: expected ErrMaxRetransmit on write, got %v", c.n, c.timeout, err)
+		}
+	}
+
+	// 数据被确认时不会超时
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	cli.SetMaxRetransmit(0, 100*time.Millisecond)
+	go func() {
+		if s, err := l.AcceptKCP(); err == nil {
+			io.Copy(s, s)
+		}
+	}()
+	buf := make([]byte, 5)
+	for i := 0; i < 5; i++ {
+		cli.Write([]byte("hello"))
+		cli.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(cli, buf); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestDialLocalBinding 测试本地端口选择与端口占用时的回退
+func TestDialLocalBinding(t *testing.T) {
+	busy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busyPort := busy.LocalAddr().(*net.UDPAddr).Port
+
+	// 固定端口被占用时从随机区间中选择
+	bind := &LocalBinding{IP: net.IPv4(127, 0, 0, 1), Port: busyPort, PortMin: 40000, PortMax: 40999}
+	for i := 0; i < 4; i++ {
+		sess, err := DialWithBinding("127.0.0.1:9", bind, nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := sess.LocalAddr().(*net.UDPAddr).Port
+		sess.Close()
+		if port < bind.PortMin || port > bind.PortMax {
+			t.Fatalf("local port %d outside %d-%d", port, bind.PortMin, bind.PortMax)
+		}
+	}
+
+	// 没有回退区间时直接返回错误
+	if _, err := DialWithBinding("127.0.0.1:9", &LocalBinding{IP: net.IPv4(127, 0, 0, 1), Port: busyPort}, nil, 0, 0); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("expected EADDRINUSE, got %v", err)
+	}
+	if _, err := DialWithBinding("127.0.0.1:9", &LocalBinding{PortMin: 2000, PortMax: 1000}, nil, 0, 0); err == nil {
+		t.Fatal("invalid port range accepted")
+	}
+}
+
+// TestReceiveMemoryLimit 测试读取缓慢时接收缓存不超过上限
+func TestReceiveMemoryLimit(t *testing.T) {
+	const limit = 32 * 1024
+	l, cli := newSimPair(t, newSimNetwork(0.1), nil, 0, 0)
+
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetNoDelay(1, 10, 2, 1)
+	s.SetReceiveMemoryLimit(limit)
+
+	msg := make([]byte, 512*1024)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	go cli.Write(msg)
+
+	// 应用暂不读取，缓存的数据受上限约束
+	for i := 0; i < 20; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if mem := s.GetReceiveMemory(); mem > limit+int(s.kcp.mss) {
+			t.Fatalf("receive memory %d exceeds limit %d", mem, limit)
+		}
+	}
+
+	got := make([]byte, len(msg)+5)
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[5:], msg) {
+		t.Fatal("data mismatch")
+	}
+	if mem := s.GetReceiveMemory(); mem != 0 {
+		t.Fatalf("receive memory %d after draining", mem)
+	}
+}
+
+// TestReadAhead 测试应用未读取时数据已解密并进入就绪队列
+func TestReadAhead(t *testing.T) {
+	dataShards, parityShards := 0, 0
+	if fecEnabled {
+		dataShards, parityShards = 10, 3
+	}
+	block, _ := NewNoneBlockCrypt(nil)
+	l, cli := newSimPair(t, newSimNetwork(0.05), block, dataShards, parityShards)
+
+	// 小于默认接收窗口
+	msg := make([]byte, 24*1024)
+	for i := range msg {
+		msg[i] = byte(i * 5)
+	}
+	cli.Write(msg)
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 不调用Read，等待数据全部进入就绪队列
+	deadline := time.Now().Add(5 * time.Second)
+	for s.GetReceiveMemory() < len(msg) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d bytes ready before Read", s.GetReceiveMemory(), len(msg))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := s.DebugState(); d.RcvBuf != 0 || d.RcvQueue == 0 {
+		t.Fatalf("data not reassembled before Read: rcv_queue %d, rcv_buf %d", d.RcvQueue, d.RcvBuf)
+	}
+
+	// 后续读取只需复制
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+}
+
+// TestDebugState 测试事件环与调试状态快照
+func TestDebugState(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetMtu(1000)
+
+	d := cli.DebugState()
+	if d.Conv != cli.GetConv() || d.MTU != 1000 {
+		t.Fatalf("unexpected state %+v", d)
+	}
+	if len(d.Events) != 2 || !strings.HasPrefix(d.Events[0].Message, "dialed") {
+		t.Fatalf("unexpected events %v", d.Events)
+	}
+	if events := s.DebugState().Events; events[len(events)-1].Message != "accepted" {
+		t.Fatalf("unexpected server events %v", events)
+	}
+
+	// 事件环只保留最近的事件
+	for i := 0; i < eventLogSize+10; i++ {
+		cli.logEvent("event %d", i)
+	}
+	cli.Close()
+	events := cli.DebugState().Events
+	if len(events) != eventLogSize || events[len(events)-1].Message != "closed" {
+		t.Fatalf("unexpected ring content: %d events, last %v", len(events), events[len(events)-1])
+	}
+	if events[0].Message != "event 11" {
+		t.Fatalf("oldest event %q", events[0].Message)
+	}
+	if !strings.Contains(cli.DebugState().String(), "closed") {
+		t.Fatal("events missing from report")
+	}
+}
+
+// TestBatchRead 测试读循环使用批量接收
+func TestBatchRead(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if newBatchConn(l.conn) == nil {
+		t.Fatal("expected a batch connection for UDP sockets")
+	}
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.xconn == nil {
+		t.Fatal("expected a batch connection for the client session")
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	// 一次写入多个分片，接收端按批读取
+	msg := make([]byte, 64*1024)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go cli.Write(msg)
+
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+
+	// 回显给客户端，经过客户端的批量读循环
+	s.Write(got[:1024])
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, got[:1024]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:1024], msg[:1024]) {
+		t.Fatal("echo mismatch")
+	}
+}
+
+// TestWritePolicy 测试超大写入的三种策略
+func TestWritePolicy(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 1<<20)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, buf[:5]); err != nil {
+		t.Fatal(err)
+	}
+	mss := int(cli.kcp.mss)
+
+	// 消息模式：整条消息一次读出，超过上限返回 ErrMsgTooLarge
+	cli.SetWritePolicy(WriteMessage)
+	if cli.GetWritePolicy() != WriteMessage {
+		t.Fatal("policy not set")
+	}
+	limit := cli.MaxMessageSize()
+	if _, err := cli.Write(make([]byte, limit+1)); !errors.Is(err, ErrMsgTooLarge) {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+	msg := bytes.Repeat([]byte{0x5a}, 3*mss+7)
+	if n, err := cli.Write(msg); err != nil || n != len(msg) {
+		t.Fatalf("message write: %d, %v", n, err)
+	}
+	if n, err := s.Read(buf); err != nil || n != len(msg) {
+		t.Fatalf("expected one message of %d bytes, got %d, %v", len(msg), n, err)
+	}
+
+	// 默认策略：全部写入
+	cli.SetWritePolicy(WriteChunk)
+	big := make([]byte, 100*mss)
+	if n, err := cli.Write(big); err != nil || n != len(big) {
+		t.Fatalf("chunked write: %d, %v", n, err)
+	}
+	if _, err := io.ReadFull(s, buf[:len(big)]); err != nil {
+		t.Fatal(err)
+	}
+
+	// 部分写入：只写入窗口能容纳的部分
+	cli.SetWritePolicy(WritePartial)
+	n, err := cli.Write(big)
+	if !errors.Is(err, io.ErrShortWrite) || n == 0 || n >= len(big) || n%mss != 0 {
+		t.Fatalf("partial write: %d, %v", n, err)
+	}
+	if _, err := io.ReadFull(s, buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOverhead 测试每个包的头部开销计算
+func TestOverhead(t *testing.T) {
+	if n := OverheadBytes(nil); n != 24 {
+		t.Fatalf("unexpected KCP overhead %d", n)
+	}
+	config := &Config{Key: make([]byte, 32), FECData: 10, FECParity: 3}
+	if n := OverheadBytes(config); n != 24+20+8 {
+		t.Fatalf("unexpected overhead %d", n)
+	}
+	if n := MaxPayload(config, 1472); n != 1472-52 {
+		t.Fatalf("unexpected payload %d", n)
+	}
+	if n := MaxPayload(config, 40); n != 0 {
+		t.Fatalf("unexpected payload %d for a tiny mtu", n)
+	}
+
+	// 会话的有效载荷与辅助函数一致
+	ds, ps := 0, 0
+	if fecEnabled {
+		ds, ps = 10, 3
+	} else {
+		config.FECData, config.FECParity = 0, 0
+	}
+	block, _ := NewNoneBlockCrypt(nil)
+	_, cli := newSimPair(t, newSimNetwork(0), block, ds, ps)
+	if !cli.SetMtu(1200) {
+		t.Fatal("SetMtu failed")
+	}
+	if got, want := cli.MaxPayload(), MaxPayload(config, 1200); got != want {
+		t.Fatalf("session payload %d, expected %d", got, want)
+	}
+	if d := cli.DebugState(); d.MTU != 1200 {
+		t.Fatalf("unexpected packet size %d", d.MTU)
+	}
+}
+
+// TestGSO 测试 UDP 分段卸载发送
+func TestGSO(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if !cli.SetGSO(true) {
+		t.Skip("UDP_SEGMENT not supported")
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetWindowSize(128, 128)
+
+	msg := make([]byte, 256*1024)
+	for i := range msg {
+		msg[i] = byte(i * 3)
+	}
+	go cli.Write(msg)
+
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetWindowSize(128, 128)
+
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+	if !cli.GetGSO() {
+		t.Fatal("GSO turned off by a failed send")
+	}
+}
+
+// TestZeroCopy 测试MSG_ZEROCOPY发送的数据完整性
+func TestZeroCopy(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if !cli.SetZeroCopy(true) {
+		t.Skip("SO_ZEROCOPY not supported")
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetWindowSize(128, 128)
+
+	msg := make([]byte, 256*1024)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	go cli.Write(msg)
+
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetWindowSize(128, 128)
+
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+	if !cli.GetZeroCopy() {
+		t.Fatal("zero copy turned off by a failed send")
+	}
+
+	// 关闭后仍需回收内核持有的缓冲区
+	if !cli.SetZeroCopy(false) || cli.GetZeroCopy() {
+		t.Fatal("zero copy not disabled")
+	}
+	if _, err := cli.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "after" {
+		t.Fatal("write after disabling zero copy failed", err)
+	}
+}
+
+// TestListenReusePort 测试SO_REUSEPORT分片监听器
+func TestListenReusePort(t *testing.T) {
+	const shards = 4
+	l, err := ListenReusePort("127.0.0.1:0", shards, nil, 0, 0)
+	if err != nil {
+		t.Skip("SO_REUSEPORT not supported:", err)
+	}
+	defer l.Close()
+	if len(l.Shards()) != shards {
+		t.Fatalf("%d shards, want %d", len(l.Shards()), shards)
+	}
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	// 多个客户端，会话按conv哈希归属分片
+	for i := 0; i < 16; i++ {
+		cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte(fmt.Sprintf("client %d", i))
+		cli.Write(msg)
+		got := make([]byte, len(msg))
+		cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(cli, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal("echo mismatch")
+		}
+
+		owner := l.group.owner(cli.kcp.conv)
+		owner.sessionLock.RLock()
+		_, ok := owner.sessions[cli.kcp.conv]
+		owner.sessionLock.RUnlock()
+		if !ok {
+			t.Fatalf("session %d not held by its shard", cli.kcp.conv)
+		}
+		cli.Close()
+	}
+
+	// 一致性哈希：分片数增加时只有少量会话迁移
+	moved := 0
+	for conv := uint64(0); conv < 10000; conv++ {
+		if jumpHash(conv, shards) != jumpHash(conv, shards+1) {
+			moved++
+		}
+	}
+	if moved > 10000/(shards+1)*3/2 {
+		t.Fatalf("%d of 10000 keys moved", moved)
+	}
+}
+
+// TestDualStack 测试双栈监听器同时接受IPv4与IPv6客户端
+func TestDualStack(t *testing.T) {
+	l, err := ListenWithOptions("[::]:0", nil, 0, 0)
+	if err != nil {
+		t.Skip("IPv6 not available:", err)
+	}
+	defer l.Close()
+	if _, ok := newBatchConn(l.conn).(*ipv6.PacketConn); !ok {
+		t.Fatal("dual-stack listener not batched as IPv6")
+	}
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	for _, host := range []string{"127.0.0.1", "::ffff:127.0.0.1", "::1"} {
+		cli, err := DialWithOptions(net.JoinHostPort(host, port), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Write([]byte(host))
+		got := make([]byte, len(host))
+		cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(cli, got); err != nil {
+			if host == "::1" {
+				cli.Close()
+				continue // no IPv6 loopback
+			}
+			t.Fatal(host, err)
+		}
+		if string(got) != host {
+			t.Fatal("echo mismatch")
+		}
+
+		// v4-mapped 地址与IPv4地址是同一个键
+		l.sessionLock.RLock()
+		s := l.sessions[cli.kcp.conv]
+		l.sessionLock.RUnlock()
+		if s == nil {
+			t.Fatalf("no session of %s", host)
+		}
+		if key := addrKey(s.remoteAddr()); key.Addr().Is4In6() {
+			t.Fatalf("session of %s keyed by %v", host, key)
+		}
+		cli.Close()
+	}
+}
+
+// TestSessionTicket 测试会话票据在服务器重启后恢复状态，以及重放与篡改被拒绝
+func TestSessionTicket(t *testing.T) {
+	secret := make([]byte, 32)
+	issuer, _ := NewTicketKey(secret, time.Minute)
+	ticket, err := issuer.Seal([]byte("user=42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 用相同密钥启动的新服务器能打开之前签发的票据
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	key, _ := NewTicketKey(secret, time.Minute)
+	l.SetTicketKey(key)
+
+	resume := func(ticket []byte) (client, server TicketStatus, state []byte) {
+		cli, err := DialWithTicket(l.Addr().String(), ticket, nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if status, _ := cli.Resumption(); status != TicketPending {
+			t.Fatalf("client status %v before the verdict", status)
+		}
+		cli.Write([]byte("hello"))
+
+		l.SetReadDeadline(time.Now().Add(2 * time.Second))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		server, state = s.Resumption()
+
+		deadline := time.Now().Add(2 * time.Second)
+		for client, _ = cli.Resumption(); client == TicketPending && time.Now().Before(deadline); client, _ = cli.Resumption() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return client, server, state
+	}
+
+	client, server, state := resume(ticket)
+	if client != TicketAccepted || server != TicketAccepted || string(state) != "user=42" {
+		t.Fatalf("resumption failed: client %v, server %v, state %q", client, server, state)
+	}
+
+	// 同一票据只能使用一次
+	if client, server, _ := resume(ticket); client != TicketRejected || server != TicketRejected {
+		t.Fatalf("replayed ticket: client %v, server %v", client, server)
+	}
+
+	forged := append([]byte(nil), ticket...)
+	forged[len(forged)-1] ^= 1
+	if _, err := key.Open(forged); !errors.Is(err, ErrTicket) {
+		t.Fatal("forged ticket opened", err)
+	}
+
+	expiring, _ := NewTicketKey(secret, time.Nanosecond)
+	old, _ := expiring.Seal(nil)
+	time.Sleep(time.Second)
+	if _, err := expiring.Open(old); !errors.Is(err, ErrTicket) {
+		t.Fatal("expired ticket opened", err)
+	}
+}
+
+// scrambleProcessor 翻转KCP头之后的字节，并统计处理的包数
+type scrambleProcessor struct {
+	out, in atomic.Int64
+}
+
+func (p *scrambleProcessor) Outgoing(pkt []byte) ([]byte, error) {
+	p.out.Add(1)
+	for i := IKCP_OVERHEAD; i < len(pkt); i++ {
+		pkt[i] ^= 0xA5
+	}
+	return pkt, nil
+}
+
+func (p *scrambleProcessor) Incoming(pkt []byte) ([]byte, error) {
+	p.in.Add(1)
+	for i := IKCP_OVERHEAD; i < len(pkt); i++ {
+		pkt[i] ^= 0xA5
+	}
+	return pkt, nil
+}
+
+// TestVersionNegotiation 测试协议版本协商，以及没有共同版本时双方以 ErrVersion 快速失败
+func TestVersionNegotiation(t *testing.T) {
+	l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+	if err := cli.SetVersions(Version(9)); err == nil {
+		t.Fatal("unsupported version offered")
+	}
+	if err := cli.SetVersions(SupportedVersions()...); err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("hello"))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := s.Version(); v != Version1 {
+		t.Fatalf("server negotiated %v", v)
+	}
+	if s.SetVersions(Version1) == nil {
+		t.Fatal("versions offered by a server session")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cli.mu.Lock()
+		v, pending := cli.version, cli.versionOffer != nil
+		cli.mu.Unlock()
+		if !pending {
+			if v != Version1 {
+				t.Fatalf("client negotiated %v", v)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no answer to the version offer")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 服务器不支持的版本和格式错误的提议都以 ErrVersion 结束
+	for _, offer := range [][]byte{append([]byte(versionMagic), 9), []byte("KCP\x00\x01")} {
+		l, cli := newSimPair(t, newSimNetwork(0), nil, 0, 0)
+		cli.mu.Lock()
+		cli.kcp.version, cli.kcp.version_repeat, cli.versionOffer = offer, true, []Version{Version(offer[4])}
+		cli.mu.Unlock()
+		cli.Write([]byte("hello"))
+
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 16)
+		s.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := s.Read(buf); !errors.Is(err, ErrVersion) {
+			t.Fatalf("server read %v", err)
+		}
+		cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := cli.Read(buf); !errors.Is(err, ErrVersion) {
+			t.Fatalf("client read %v", err)
+		}
+		if _, err := cli.Write(buf); !errors.Is(err, ErrVersion) {
+			t.Fatalf("client write %v", err)
+		}
+	}
+}
+
+// TestPacketProcessor 测试会话的包处理链
+func TestPacketProcessor(t *testing.T) {
+	dataShards, parityShards := 0, 0
+	if fecEnabled {
+		dataShards, parityShards = 10, 3
+	}
+	l, cli := newSimPair(t, newSimNetwork(0.05), nil, dataShards, parityShards)
+	var server, client scrambleProcessor
+	l.SetPacketProcessors(func() []PacketProcessor { return []PacketProcessor{&server} })
+	cli.SetPacketProcessors(&client)
+
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	msg := bytes.Repeat([]byte("processor"), 4096)
+	go cli.Write(msg)
+	echo := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, echo) {
+		t.Fatal("echoed data mismatch")
+	}
+	if client.out.Load() == 0 || client.in.Load() == 0 || server.out.Load() == 0 || server.in.Load() == 0 {
+		t.Fatalf("processors not called: client %d/%d, server %d/%d",
+			client.out.Load(), client.in.Load(), server.out.Load(), server.in.Load())
+	}
+}
+
+// TestCompression 测试负载压缩的编解码和端到端传输
+func TestCompression(t *testing.T) {
+	c := NewCompressor()
+
+	packet := func(cmd byte, payload []byte) []byte {
+		pkt := make([]byte, IKCP_OVERHEAD, mtuLimit)
+		pkt[4] = cmd
+		return append(pkt, payload...)
+	}
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	cases := []struct {
+		name string
+		pkt  []byte
+		flag byte
+	}{
+		{"text", packet(IKCP_CMD_PUSH, bytes.Repeat([]byte(`{"key":"value"}`), 60)), compressSnappy},
+		{"random", packet(IKCP_CMD_PUSH, random), compressRaw},
+		{"small", packet(IKCP_CMD_PUSH, []byte("hello")), compressRaw},
+		{"probe", packet(IKCP_CMD_PROBE, make([]byte, 1000)), compressRaw},
+	}
+	for _, tc := range cases {
+		want := append([]byte(nil), tc.pkt...)
+		out, err := c.Outgoing(tc.pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if out[IKCP_OVERHEAD] != tc.flag {
+			t.Fatalf("%s: flag %d, want %d", tc.name, out[IKCP_OVERHEAD], tc.flag)
+		}
+		if tc.flag == compressSnappy && len(out) >= len(want) {
+			t.Fatalf("%s: %d bytes not compressed from %d", tc.name, len(out), len(want))
+		}
+		in, err := c.Incoming(out)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(in, want) {
+			t.Fatalf("%s: round trip mismatch", tc.name)
+		}
+	}
+
+	// 以版本协商开头的数据包原样通过，未压缩的一端也能读取
+	offer := packet(IKCP_CMD_VERSION, bytes.Repeat([]byte("SUDP"), 100))
+	if out, err := c.Outgoing(append([]byte(nil), offer...)); err != nil || !bytes.Equal(out, offer) {
+		t.Fatal("version offer changed", err)
+	}
+	if in, err := c.Incoming(append([]byte(nil), offer...)); err != nil || !bytes.Equal(in, offer) {
+		t.Fatal("version offer changed", err)
+	}
+
+	// 非法标志和损坏的压缩数据被丢弃
+	if _, err := c.Incoming(packet(IKCP_CMD_PUSH, []byte{7, 1, 2, 3})); err == nil {
+		t.Fatal("invalid flag accepted")
+	}
+	if _, err := c.Incoming(packet(IKCP_CMD_PUSH, []byte{compressSnappy, 0xff, 0xff, 0xff})); err == nil {
+		t.Fatal("corrupted data accepted")
+	}
+
+	// 端到端传输
+	l, cli := newSimPair(t, newSimNetwork(0.05), nil, 0, 0)
+	l.SetPacketProcessors(func() []PacketProcessor {
+		return []PacketProcessor{NewCompressor()}
+	})
+	mss := cli.MaxPayload()
+	cli.SetPacketProcessors(c)
+	if cli.MaxPayload() != mss-CompressHeaderSize {
+		t.Fatalf("max payload %d with compression, want %d", cli.MaxPayload(), mss-CompressHeaderSize)
+	}
+
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	msg := bytes.Repeat([]byte("compressible text "), 4096)
+	go cli.Write(msg)
+	echo := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, echo) {
+		t.Fatal("echoed data mismatch")
+	}
+}
+
+// TestCompressionMismatch 测试只有一端启用压缩时会话以 ErrVersion 失败而不是损坏数据
+func TestCompressionMismatch(t *testing.T) {
+	dial := func(server, client Config) (*Listener, *UDPSession) {
+		l, err := ListenWithConfig("127.0.0.1:0", &server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		cli, err := DialWithConfig(l.Addr().String(), &client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cli.Close() })
+		cli.Write(bytes.Repeat([]byte("compressible text "), 100))
+		return l, cli
+	}
+	buf := make([]byte, 4096)
+
+	// 双方都压缩时，无需显式设置 Versions 即协商成功
+	l, _ := dial(Config{Compression: true}, Config{Compression: true})
+	l.SetDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(s, buf[:1800]); err != nil {
+		t.Fatal(err)
+	}
+
+	// 客户端压缩而服务器不压缩，或反之，双方都以 ErrVersion 失败
+	for _, tc := range []struct {
+		name           string
+		server, client Config
+	}{
+		{"client", Config{}, Config{Compression: true}},
+		{"server", Config{Compression: true}, Config{Versions: SupportedVersions()}},
+	} {
+		l, cli := dial(tc.server, tc.client)
+		l.SetDeadline(time.Now().Add(2 * time.Second))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(tc.name, err)
+		}
+		s.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := s.Read(buf); !errors.Is(err, ErrVersion) {
+			t.Errorf("%s compressing: server read %v", tc.name, err)
+		}
+		cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := cli.Read(buf); !errors.Is(err, ErrVersion) {
+			t.Errorf("%s compressing: client read %v", tc.name, err)
+		}
+	}
+
+	// 不协商版本的客户端的数据包被压缩的监听器丢弃
+	l, _ = dial(Config{Compression: true}, Config{})
+	l.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	if s, err := l.AcceptKCP(); err == nil {
+		s.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if n, err := s.Read(buf); err == nil {
+			t.Errorf("%d bytes read from a client which did not negotiate", n)
+		}
+	}
+}
+
+// TestEndpoint 测试多个客户端会话共享一个本地套接字
+func TestEndpoint(t *testing.T) {
+	echo := func(l *Listener) {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}
+	block, _ := NewNoneBlockCrypt(nil)
+	var servers []*Listener
+	for i := 0; i < 2; i++ {
+		l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go echo(l)
+		servers = append(servers, l)
+	}
+
+	e, err := NewEndpoint("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	// 每个服务器一个会话，同一服务器不能有第二个会话
+	var sessions []*UDPSession
+	for _, l := range servers {
+		s, err := e.Dial(l.Addr().String(), block, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.SetNoDelay(1, 10, 2, 1)
+		if s.LocalAddr().String() != e.LocalAddr().String() {
+			t.Fatalf("session not on the shared socket: %v", s.LocalAddr())
+		}
+		sessions = append(sessions, s)
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		wg.Add(1)
+		go func(i int, s *UDPSession) {
+			defer wg.Done()
+			msg := bytes.Repeat([]byte{byte(i + 1)}, 32*1024)
+			go s.Write(msg)
+			got := make([]byte, len(msg))
+			s.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(s, got); err != nil {
+				t.Errorf("session %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("session %d received data of another session", i)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	if _, err := e.Dial(servers[0].Addr().String(), block, 0, 0); err == nil {
+		t.Fatal("second session to the same server accepted")
+	}
+
+	// 关闭会话只释放其路由
+	sessions[0].Close()
+	s, err := e.Dial(servers[0].Addr().String(), block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := sessions[1].Write([]byte("still open")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGRO 测试接收端合并的数据包被正确拆分
+func TestGRO(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !l.SetGRO(true) {
+		t.Skip("UDP_GRO not supported")
+	}
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if !cli.SetGRO(true) {
+		t.Fatal("GRO not enabled on the client session")
+	}
+	// 发送端使用 GSO，回环接口上接收端会收到合并后的缓冲区
+	cli.SetGSO(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetWindowSize(128, 128)
+
+	msg := make([]byte, 256*1024)
+	for i := range msg {
+		msg[i] = byte(i * 5)
+	}
+	go cli.Write(msg)
+
+	l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetWindowSize(128, 128)
+	if s.SetGRO(true) {
+		t.Fatal("GRO enabled on an accepted session")
+	}
+
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+
+	// 回显经过客户端的 GRO 读循环
+	s.Write(got[:64*1024])
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, got[:64*1024]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:64*1024], msg[:64*1024]) {
+		t.Fatal("echo mismatch")
+	}
+}
+
+// TestGarbageHandler 测试无法解析的数据包交给钩子处理并限速
+func TestGarbageHandler(t *testing.T) {
+	block, _ := NewNoneBlockCrypt(nil)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var mu sync.Mutex
+	var reports []GarbagePacket
+	l.SetGarbageHandler(func(p GarbagePacket) {
+		mu.Lock()
+		reports = append(reports, p)
+		mu.Unlock()
+	}, 3)
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 校验失败的包按原样上报，超过速率的包不上报
+	junk := bytes.Repeat([]byte{0xee}, 64)
+	for i := 0; i < 10; i++ {
+		conn.Write(junk)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 reports, got %d", len(reports))
+	}
+	for _, p := range reports {
+		if p.Reason != GarbageChecksum || !bytes.Equal(p.Data, junk) {
+			t.Fatalf("unexpected report %v %x", p.Reason, p.Data)
+		}
+		if p.Addr.String() != conn.LocalAddr().String() {
+			t.Fatalf("unexpected address %v", p.Addr)
+		}
+	}
+
+	// 过短的包上报为格式错误
+	reports = reports[:0]
+	l.SetGarbageHandler(func(p GarbagePacket) {
+		mu.Lock()
+		reports = append(reports, p)
+		mu.Unlock()
+	}, 3)
+	mu.Unlock()
+	conn.Write([]byte("short"))
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(reports) != 1 || reports[0].Reason != GarbageMalformed || reports[0].Reason.String() != "malformed" {
+		t.Fatalf("unexpected reports %v", reports)
+	}
 }
@@ -0,0 +1,102 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:31:26
+@Description: Cap on the sessions of a listener
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// EvictionPolicy selects what a listener at its session cap does with a new conversation
+type EvictionPolicy int
+
+const (
+	// EvictionReject drops the packets of new conversations until a session
+	// closes, the established sessions are kept. This is the default.
+	EvictionReject EvictionPolicy = iota
+
+	// EvictionLRU closes the session which has received nothing for the
+	// longest time to make room for the new one, so stale sessions do not
+	// lock out new clients, at the cost of a scan of the sessions.
+	EvictionLRU
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictionReject:
+		return "reject"
+	case EvictionLRU:
+		return "lru"
+	default:
+		return "invalid"
+	}
+}
+
+// MarshalText and UnmarshalText encode the policy by name in config files
+func (p EvictionPolicy) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *EvictionPolicy) UnmarshalText(text []byte) error {
+	return unmarshalName(p, text, "eviction policy", EvictionReject, EvictionLRU)
+}
+
+// valid reports whether 'p' is a known policy
+func (p EvictionPolicy) valid() bool {
+	return p == EvictionReject || p == EvictionLRU
+}
+
+// SetMaxSessions caps the concurrent sessions of the listener at 'n', 0 for
+// no cap, which is the default, and selects what becomes of new conversations
+// at the cap. Lowering the cap closes no session by itself. A sharded listener
+// applies the cap to each shard.
+func (l *Listener) SetMaxSessions(n int, policy EvictionPolicy) error {
+	if n < 0 {
+		return errors.New("session cap must not be negative")
+	}
+	if !policy.valid() {
+		return errors.Errorf("invalid eviction policy %d", policy)
+	}
+	l.maxSessions.Store(int64(n))
+	l.eviction.Store(int32(policy))
+	return nil
+}
+
+// admit makes room for a new session under the session cap, it reports
+// whether the session may be created
+func (l *Listener) admit() bool {
+	max := int(l.maxSessions.Load())
+	if max == 0 {
+		return true
+	}
+
+	l.sessionLock.RLock()
+	n := len(l.sessionAddrs)
+	var victim *UDPSession
+	if n >= max && EvictionPolicy(l.eviction.Load()) == EvictionLRU {
+		now := currentMs()
+		var idle int32 = -1
+		for _, s := range l.sessionAddrs {
+			if d := _itimediff(now, s.lastInput.Load()); d > idle {
+				victim, idle = s, d
+			}
+		}
+	}
+	l.sessionLock.RUnlock()
+
+	if n < max {
+		return true
+	}
+	if victim == nil {
+		atomic.AddUint64(&l.Snmp().SessionRejects, 1)
+		return false
+	}
+	victim.logEvent("evicted at the cap of %d sessions", max)
+	atomic.AddUint64(&l.Snmp().SessionEvictions, 1)
+	victim.Close()
+	return true
+}
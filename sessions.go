@@ -0,0 +1,83 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:31:26
+@Description: Enumeration of the sessions of a listener
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"time"
+)
+
+// SessionInfo describes a session of a listener for admin endpoints
+type SessionInfo struct {
+	Session    *UDPSession // the session itself, to inspect it further or Close it
+	Conv       uint32
+	RemoteAddr net.Addr
+	Uptime     time.Duration // since the first packet of the session
+	Idle       time.Duration // since the last packet from remote
+
+	SRTT, RTO int // smoothed round trip time and retransmission timeout in ms
+	Cwnd      int // congestion window in segments
+	WaitSnd   int // segments waiting to be sent or acknowledged
+	RcvQueue  int // segments received and not yet read
+}
+
+// info returns the description of the session
+func (s *UDPSession) info() SessionInfo {
+	now := time.Now()
+	idle := _itimediff(currentMs(), s.lastInput.Load())
+	if idle < 0 {
+		idle = 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SessionInfo{
+		Session:    s,
+		Conv:       s.kcp.conv,
+		RemoteAddr: s.remoteAddr(),
+		Uptime:     now.Sub(s.created),
+		Idle:       time.Duration(idle) * time.Millisecond,
+		SRTT:       int(s.kcp.rx_srtt),
+		RTO:        int(s.kcp.rx_rto),
+		Cwnd:       int(s.kcp.cwnd),
+		WaitSnd:    s.kcp.WaitSnd(),
+		RcvQueue:   s.kcp.rcv_queue.Len(),
+	}
+}
+
+// Sessions returns a snapshot of the open sessions of the listener, including
+// those waiting to be accepted, in no particular order.
+func (l *Listener) Sessions() []SessionInfo {
+	sessions := l.sessionList()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// RangeSessions calls 'f' with each open session of the listener until it
+// returns false. The sessions are collected first, so 'f' may close them.
+func (l *Listener) RangeSessions(f func(s *UDPSession) bool) {
+	for _, s := range l.sessionList() {
+		if !f(s) {
+			return
+		}
+	}
+}
+
+// sessionList returns the sessions of the listener
+func (l *Listener) sessionList() []*UDPSession {
+	l.sessionLock.RLock()
+	defer l.sessionLock.RUnlock()
+	sessions := make([]*UDPSession, 0, len(l.sessionAddrs))
+	for _, s := range l.sessionAddrs {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
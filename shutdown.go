@@ -0,0 +1,96 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-9 20:05:33
+@Description: Graceful shutdown of listeners
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"time"
+)
+
+// drainInterval is how often Shutdown checks whether the sessions have drained
+const drainInterval = 10 * time.Millisecond
+
+// Shutdown closes the listener gracefully: new conversations are ignored and
+// Accept fails with ErrClosed at once, sessions waiting in the backlog are
+// closed, and the accepted sessions keep running until the data queued on
+// them has been acknowledged by the remote, or until the context is done.
+// Then the sessions and the listener are closed.
+//
+// It returns ctx.Err() if the context was done before the sessions drained,
+// and the error of closing the listener otherwise.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.stopAccepting()
+	err := l.drain(ctx)
+	l.closeSessions()
+	if e := l.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// stopAccepting makes the listener ignore new conversations and fail Accept,
+// and closes the sessions never accepted
+func (l *Listener) stopAccepting() {
+	l.drainOnce.Do(func() { close(l.draining) })
+	for {
+		select {
+		case s := <-l.chAccepts:
+			s.Close()
+		default:
+			return
+		}
+	}
+}
+
+// isDraining reports whether the listener is shutting down
+func (l *Listener) isDraining() bool {
+	select {
+	case <-l.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain waits until the sessions have nothing left to send or the context is done
+func (l *Listener) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		if l.drained() {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.die:
+			return nil
+		}
+	}
+}
+
+// drained reports whether the data of all the sessions has been acknowledged
+func (l *Listener) drained() bool {
+	for _, s := range l.sessionList() {
+		s.mu.Lock()
+		waitsnd := s.kcp.WaitSnd()
+		s.mu.Unlock()
+		if waitsnd > 0 && !s.isClosed() {
+			return false
+		}
+	}
+	return true
+}
+
+// closeSessions closes the sessions of the listener
+func (l *Listener) closeSessions() {
+	for _, s := range l.sessionList() {
+		s.Close()
+	}
+}
@@ -0,0 +1,191 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 15:18:42
+@Description: SIP003 plugin executables as transport plugins
+@Language: Go 1.23.4
+*/
+
+// Package sip003 runs SIP003 plugin executables, as of Shadowsocks, as
+// transport plugins of safe-udp, see safeudp.Config.Plugin. It is apart from
+// safeudp so that programs without plugin processes do not carry os/exec.
+package sip003
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	safeudp "safe-udp"
+)
+
+// New returns a safeudp.Plugin running the SIP003 plugin executable 'path',
+// to register with safeudp.RegisterPlugin. A client session sends to the
+// process on a loopback port, started with the first datagram, which forwards
+// to the server. A listener hands its address over to a process listening on
+// it, which forwards to the listener on loopback. The process is started with
+// SS_REMOTE_HOST, SS_REMOTE_PORT, SS_LOCAL_HOST, SS_LOCAL_PORT and
+// Config.PluginOptions as SS_PLUGIN_OPTIONS, and stops when the session or
+// listener closes.
+func New(path string) safeudp.Plugin {
+	return plugin{path}
+}
+
+type plugin struct {
+	path string
+}
+
+func (p plugin) Wrap(conn net.PacketConn, options string, server bool) (net.PacketConn, error) {
+	if !server {
+		return &clientConn{PacketConn: conn, path: p.path, options: options}, nil
+	}
+
+	laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("sip003: the listener socket is not UDP")
+	}
+	// the process takes over the address of the listener
+	conn.Close()
+	loop, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := start(p.path, options, laddr.IP.String(), strconv.Itoa(laddr.Port), loop.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		loop.Close()
+		return nil, err
+	}
+	return &serverConn{UDPConn: loop, laddr: laddr, cmd: cmd}, nil
+}
+
+// start starts the plugin executable 'path' with the environment of SIP003: it
+// forwards the datagrams between the local address, where the process of a
+// client listens and a server process sends to, and the remote host and port,
+// which a client process sends to and a server process listens on.
+func start(path, options, remoteHost, remotePort string, local *net.UDPAddr) (*exec.Cmd, error) {
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST="+local.IP.String(),
+		"SS_LOCAL_PORT="+strconv.Itoa(local.Port),
+		"SS_PLUGIN_OPTIONS="+options,
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("sip003: plugin %s: %w", path, err)
+	}
+	return cmd, nil
+}
+
+// stop kills the plugin process and waits for it
+func stop(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+// freeLoopbackPort returns a loopback address with a UDP port free for a
+// plugin process to listen on
+func freeLoopbackPort() (*net.UDPAddr, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr), nil
+}
+
+// clientConn is the socket of a client session, which sends through a plugin
+// process started for the first remote address written to
+type clientConn struct {
+	net.PacketConn
+	path, options string
+
+	mu     sync.Mutex
+	remote net.Addr     // the server, as the session addresses it
+	local  *net.UDPAddr // the process
+	cmd    *exec.Cmd
+	closed bool
+}
+
+func (c *clientConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	local, err := c.start(addr)
+	if err != nil {
+		return 0, err
+	}
+	return c.PacketConn.WriteTo(b, local)
+}
+
+// start starts the process forwarding to 'remote' unless running, and returns
+// its address
+func (c *clientConn) start(remote net.Addr) (*net.UDPAddr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if c.cmd != nil {
+		return c.local, nil
+	}
+	host, port, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return nil, err
+	}
+	local, err := freeLoopbackPort()
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := start(c.path, c.options, host, port, local)
+	if err != nil {
+		return nil, err
+	}
+	c.remote, c.local, c.cmd = remote, local, cmd
+	return local, nil
+}
+
+// ReadFrom returns the datagrams of the process as from the server, and drops
+// any others
+func (c *clientConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		c.mu.Lock()
+		local, remote := c.local, c.remote
+		c.mu.Unlock()
+		if from, ok := addr.(*net.UDPAddr); ok && local != nil && from.AddrPort().Addr().Unmap() == local.AddrPort().Addr() && from.Port == local.Port {
+			return n, remote, nil
+		}
+	}
+}
+
+func (c *clientConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.PacketConn.Close()
+	if !c.closed && c.cmd != nil {
+		stop(c.cmd)
+	}
+	c.closed = true
+	return err
+}
+
+// serverConn is the loopback socket of a listener a plugin process forwards
+// to, reporting the address the process listens on
+type serverConn struct {
+	*net.UDPConn
+	laddr *net.UDPAddr
+	cmd   *exec.Cmd
+	once  sync.Once
+}
+
+func (c *serverConn) LocalAddr() net.Addr { return c.laddr }
+
+func (c *serverConn) Close() error {
+	err := c.UDPConn.Close()
+	c.once.Do(func() { stop(c.cmd) })
+	return err
+}
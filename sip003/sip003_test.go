@@ -0,0 +1,145 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 15:18:42
+@Description: SIP003 plugin executable tests
+@Language: Go 1.23.4
+*/
+
+package sip003
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+// TestPluginHelper 在SAFEUDP_PLUGIN_HELPER下作为SIP003插件转发数据报：客户端
+// 插件监听本地地址转发到远端，服务器插件监听远端地址转发到本地
+func TestPluginHelper(t *testing.T) {
+	if os.Getenv("SAFEUDP_PLUGIN_HELPER") != "1" {
+		t.Skip("run as a plugin process by TestNew")
+	}
+	listen := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	forward := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+	if os.Getenv("SS_PLUGIN_OPTIONS") == "server" {
+		listen, forward = forward, listen
+	}
+	laddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		os.Exit(1)
+	}
+	local, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		os.Exit(1)
+	}
+	remote, err := net.Dial("udp", forward)
+	if err != nil {
+		os.Exit(1)
+	}
+	var peer atomic.Pointer[net.Addr]
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				// 对端插件尚未监听
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					continue
+				}
+				os.Exit(0)
+			}
+			if addr := peer.Load(); addr != nil {
+				local.WriteTo(buf[:n], *addr)
+			}
+		}
+	}()
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := local.ReadFrom(buf)
+		if err != nil {
+			os.Exit(0)
+		}
+		peer.Store(&addr)
+		remote.Write(buf[:n])
+	}
+}
+
+// nextPlugin 使重复运行的测试各自注册插件
+var nextPlugin atomic.Int32
+
+// TestNew 测试经SIP003插件进程拨号与监听，会话关闭时插件进程退出
+func TestNew(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	pidfile := filepath.Join(dir, "pid")
+	script := filepath.Join(dir, "plugin.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho $$ > "+pidfile+".$SS_PLUGIN_OPTIONS\nSAFEUDP_PLUGIN_HELPER=1 exec "+exe+" -test.run='^TestPluginHelper$'\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	name := "sip003-test-" + strconv.Itoa(int(nextPlugin.Add(1)))
+	safeudp.RegisterPlugin(name, New(script))
+
+	// 服务器端插件占用监听地址，再转发到监听者的回环套接字
+	config := &safeudp.Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, Plugin: name, PluginOptions: "server"}
+	l, err := safeudp.ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *safeudp.UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		io.Copy(s, s)
+	}()
+
+	cc := *config
+	cc.PluginOptions = "client"
+	cli, err := safeudp.DialWithConfig(l.Addr().String(), &cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	msg := bytes.Repeat([]byte("through the plugin "), 500)
+	go cli.Write(msg)
+	got := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatal(err)
+	}
+	// 服务器看到的是插件的地址，而不是会话的套接字
+	s := <-accepted
+	if s.RemoteAddr().String() == cli.LocalAddr().String() {
+		t.Fatal("datagrams bypassed the plugin")
+	}
+
+	cli.Close()
+	l.Close()
+	for _, side := range []string{"client", "server"} {
+		b, err := os.ReadFile(pidfile + "." + side)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		if p, err := os.FindProcess(pid); err == nil && p.Signal(syscall.Signal(0)) == nil {
+			t.Fatal(side, "plugin process still running")
+		}
+	}
+}
@@ -1,6 +1,6 @@
 /*
 @Author: Lzww
-@LastEditTime: 2025-8-27 22:19:56
+@LastEditTime: 2025-10-17 10:26:45
 @Description: SNMP statistics collection for SafeUDP protocol
 @Language: Go 1.23.4
 */
@@ -25,10 +25,19 @@ type Snmp struct {
 	PassiveOpens uint64 // Number of connections accepted by this endpoint (server-side)
 	CurrEstab    uint64 // Current number of established connections
 
+	CookieChallenges uint64 // First packets of new sessions answered with a stateless cookie
+	CookieRejects    uint64 // Packets of new sessions with an invalid or expired cookie
+	SessionRejects   uint64 // New sessions refused at the session cap of a listener
+	SessionEvictions uint64 // Idle sessions closed to make room at the session cap
+
 	// Error statistics
 	InErrs          uint64 // Total input errors
 	InCsumErrors    uint64 // Input checksum errors
 	SafeUdpInErrors uint64 // SafeUDP specific input errors
+	InRateDrops     uint64 // Incoming packets dropped by receive rate limits
+	InSourceDrops   uint64 // Incoming packets dropped by the packet or source filters or limits of a listener
+	BacklogDrops    uint64 // Packets of new sessions refused while the accept backlog of a listener is full
+	StatelessResets uint64 // Resets sent for stale packets of conversations unknown to a listener
 
 	// Packet-level statistics
 	InPkts  uint64 // Total input packets
@@ -46,6 +55,10 @@ type Snmp struct {
 	EarlyRetransSegs uint64 // Early retransmitted segments (timeout triggered)
 	LostSegs         uint64 // Segments detected as lost
 	RepeatSegs       uint64 // Duplicate segments received
+	RACKRetransSegs  uint64 // Segments retransmitted as lost by time based detection
+	TLPSegs          uint64 // Tail loss probes sent
+	SpuriousRTOs     uint64 // Retransmission timeouts found spurious by F-RTO
+	SACKSegs         uint64 // Segments acknowledged by selective acknowledgement ranges only
 
 	// Forward Error Correction (FEC) statistics
 	FECFullShardSet uint64 // Complete FEC shard sets processed
@@ -54,11 +67,17 @@ type Snmp struct {
 	FECParityShards uint64 // Parity shards processed
 	FECShardSet     uint64 // Total FEC shard sets processed
 	FECShardMin     uint64 // Minimum shards required for recovery
+	FECSuspended    uint64 // Times FEC was suspended under memory pressure
 
 	// Ring buffer statistics for internal queues
 	RingBufferSndQueue  uint64 // Send queue ring buffer utilization
 	RingBufferRcvQueue  uint64 // Receive queue ring buffer utilization
 	RingBufferSndBuffer uint64 // Send buffer ring buffer utilization
+
+	// Batch transmission statistics
+	BatchTxFallbacks   uint64 // Batch sends failed and retried one by one
+	BatchTxUnsupported uint64 // Fallbacks because the socket or platform cannot send batches
+	BatchTxTransient   uint64 // Fallbacks because of a transient error, such as no buffer space
 }
 
 // NewSnmp creates and initializes a new SNMP statistics structure
@@ -97,9 +116,25 @@ func (s *Snmp) Header() []string {
 		"FECRecovered",
 		"FECShardSet",
 		"FECShardMin",
+		"FECSuspended",
+		"InRateDrops",
 		"RingBufferSndQueue",
 		"RingBufferRcvQueue",
 		"RingBufferSndBuffer",
+		"BatchTxFallbacks",
+		"BatchTxUnsupported",
+		"BatchTxTransient",
+		"RACKRetransSegs",
+		"TLPSegs",
+		"SpuriousRTOs",
+		"SACKSegs",
+		"CookieChallenges",
+		"CookieRejects",
+		"SessionRejects",
+		"SessionEvictions",
+		"InSourceDrops",
+		"BacklogDrops",
+		"StatelessResets",
 	}
 }
 
@@ -134,9 +169,25 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.FECRecovered),
 		fmt.Sprint(snmp.FECShardSet),
 		fmt.Sprint(snmp.FECShardMin),
+		fmt.Sprint(snmp.FECSuspended),
+		fmt.Sprint(snmp.InRateDrops),
 		fmt.Sprint(snmp.RingBufferSndQueue),
 		fmt.Sprint(snmp.RingBufferRcvQueue),
 		fmt.Sprint(snmp.RingBufferSndBuffer),
+		fmt.Sprint(snmp.BatchTxFallbacks),
+		fmt.Sprint(snmp.BatchTxUnsupported),
+		fmt.Sprint(snmp.BatchTxTransient),
+		fmt.Sprint(snmp.RACKRetransSegs),
+		fmt.Sprint(snmp.TLPSegs),
+		fmt.Sprint(snmp.SpuriousRTOs),
+		fmt.Sprint(snmp.SACKSegs),
+		fmt.Sprint(snmp.CookieChallenges),
+		fmt.Sprint(snmp.CookieRejects),
+		fmt.Sprint(snmp.SessionRejects),
+		fmt.Sprint(snmp.SessionEvictions),
+		fmt.Sprint(snmp.InSourceDrops),
+		fmt.Sprint(snmp.BacklogDrops),
+		fmt.Sprint(snmp.StatelessResets),
 	}
 }
 
@@ -171,9 +222,25 @@ func (s *Snmp) Copy() *Snmp {
 	d.FECRecovered = atomic.LoadUint64(&s.FECRecovered)
 	d.FECShardSet = atomic.LoadUint64(&s.FECShardSet)
 	d.FECShardMin = atomic.LoadUint64(&s.FECShardMin)
+	d.FECSuspended = atomic.LoadUint64(&s.FECSuspended)
+	d.InRateDrops = atomic.LoadUint64(&s.InRateDrops)
 	d.RingBufferSndQueue = atomic.LoadUint64(&s.RingBufferSndQueue)
 	d.RingBufferRcvQueue = atomic.LoadUint64(&s.RingBufferRcvQueue)
 	d.RingBufferSndBuffer = atomic.LoadUint64(&s.RingBufferSndBuffer)
+	d.BatchTxFallbacks = atomic.LoadUint64(&s.BatchTxFallbacks)
+	d.BatchTxUnsupported = atomic.LoadUint64(&s.BatchTxUnsupported)
+	d.BatchTxTransient = atomic.LoadUint64(&s.BatchTxTransient)
+	d.RACKRetransSegs = atomic.LoadUint64(&s.RACKRetransSegs)
+	d.TLPSegs = atomic.LoadUint64(&s.TLPSegs)
+	d.SpuriousRTOs = atomic.LoadUint64(&s.SpuriousRTOs)
+	d.SACKSegs = atomic.LoadUint64(&s.SACKSegs)
+	d.CookieChallenges = atomic.LoadUint64(&s.CookieChallenges)
+	d.CookieRejects = atomic.LoadUint64(&s.CookieRejects)
+	d.SessionRejects = atomic.LoadUint64(&s.SessionRejects)
+	d.SessionEvictions = atomic.LoadUint64(&s.SessionEvictions)
+	d.InSourceDrops = atomic.LoadUint64(&s.InSourceDrops)
+	d.BacklogDrops = atomic.LoadUint64(&s.BacklogDrops)
+	d.StatelessResets = atomic.LoadUint64(&s.StatelessResets)
 	return d
 }
 
@@ -207,11 +274,105 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.FECRecovered, 0)
 	atomic.StoreUint64(&s.FECShardSet, 0)
 	atomic.StoreUint64(&s.FECShardMin, 0)
+	atomic.StoreUint64(&s.FECSuspended, 0)
+	atomic.StoreUint64(&s.InRateDrops, 0)
 	atomic.StoreUint64(&s.RingBufferSndQueue, 0)
 	atomic.StoreUint64(&s.RingBufferRcvQueue, 0)
 	atomic.StoreUint64(&s.RingBufferSndBuffer, 0)
+	atomic.StoreUint64(&s.BatchTxFallbacks, 0)
+	atomic.StoreUint64(&s.BatchTxUnsupported, 0)
+	atomic.StoreUint64(&s.BatchTxTransient, 0)
+	atomic.StoreUint64(&s.RACKRetransSegs, 0)
+	atomic.StoreUint64(&s.TLPSegs, 0)
+	atomic.StoreUint64(&s.SpuriousRTOs, 0)
+	atomic.StoreUint64(&s.SACKSegs, 0)
+	atomic.StoreUint64(&s.CookieChallenges, 0)
+	atomic.StoreUint64(&s.CookieRejects, 0)
+	atomic.StoreUint64(&s.SessionRejects, 0)
+	atomic.StoreUint64(&s.SessionEvictions, 0)
+	atomic.StoreUint64(&s.InSourceDrops, 0)
+	atomic.StoreUint64(&s.BacklogDrops, 0)
+	atomic.StoreUint64(&s.StatelessResets, 0)
 }
 
+// established counts a new established connection and updates MaxConn
+func (s *Snmp) established() {
+	currestab := atomic.AddUint64(&s.CurrEstab, 1)
+	for maxconn := atomic.LoadUint64(&s.MaxConn); currestab > maxconn; maxconn = atomic.LoadUint64(&s.MaxConn) {
+		if atomic.CompareAndSwapUint64(&s.MaxConn, maxconn, currestab) {
+			break
+		}
+	}
+}
+
+// SetSnmp makes the listener and the sessions it creates afterwards count
+// into 'snmp' instead of DefaultSnmp, so that the listeners of a process are
+// monitored apart. nil restores DefaultSnmp.
+func (l *Listener) SetSnmp(snmp *Snmp) {
+	if snmp == nil {
+		snmp = DefaultSnmp
+	}
+	l.snmp.Store(snmp)
+}
+
+// Snmp returns the counters of the listener
+func (l *Listener) Snmp() *Snmp {
+	if snmp := l.snmp.Load(); snmp != nil {
+		return snmp
+	}
+	return DefaultSnmp
+}
+
+// SetSnmp makes all the shards count into 'snmp', see Listener.SetSnmp
+func (sl *ShardedListener) SetSnmp(snmp *Snmp) {
+	for _, l := range sl.group.shards {
+		l.SetSnmp(snmp)
+	}
+}
+
+// Snmp returns the counters of the shards
+func (sl *ShardedListener) Snmp() *Snmp { return sl.group.shards[0].Snmp() }
+
+// SetSnmp makes the session count into 'snmp' instead of the counters of its
+// listener, or DefaultSnmp for a client, nil restores DefaultSnmp. The session
+// moves its count in CurrEstab along, earlier counts stay where they were.
+func (s *UDPSession) SetSnmp(snmp *Snmp) {
+	if snmp == nil {
+		snmp = DefaultSnmp
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return
+	}
+	if old := s.Snmp(); old != snmp {
+		s.snmp.Store(snmp)
+		atomic.AddUint64(&old.CurrEstab, ^uint64(0))
+		snmp.established()
+	}
+	s.kcp.snmp = snmp
+	if s.fecDecoder != nil {
+		s.fecDecoder.setSnmp(snmp, &s.stats)
+	}
+}
+
+// Snmp returns the counters the session counts into, shared with the other
+// sessions of its listener or process unless set with SetSnmp, see Stats for
+// those of the session alone
+func (s *UDPSession) Snmp() *Snmp {
+	if snmp := s.snmp.Load(); snmp != nil {
+		return snmp
+	}
+	return DefaultSnmp
+}
+
+// Stats returns a copy of the counters of the session alone, which it adds to
+// along with its shared Snmp, to attribute traffic, retransmissions, FEC
+// recoveries and input errors to a peer. The counters of listeners, such as
+// CookieChallenges, and the gauges, such as CurrEstab and the ring buffers,
+// stay zero.
+func (s *UDPSession) Stats() *Snmp { return s.stats.Copy() }
+
 // DefaultSnmp is the global default SNMP statistics instance
 // This can be used for collecting system-wide SafeUDP statistics
 var DefaultSnmp *Snmp
@@ -0,0 +1,545 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 18:47:26
+@Description: SOCKS5 proxy over stream connections
+@Language: Go 1.23.4
+*/
+
+// Package socks5 runs a SOCKS5 proxy over safe-udp: a Client terminates
+// SOCKS5 on the client machine and carries each CONNECT and UDP ASSOCIATE
+// request as a stream over a few sessions to an exit Server, which connects
+// to the destinations.
+//
+// Only the "no authentication" method is offered, the Client should listen on
+// a trusted address. Anyone holding the key of the sessions can use the exit
+// Server as a proxy, so the Server refuses the sessions of an ephemeral key
+// agreed without authentication unless told otherwise, see
+// Server.AllowUnauthenticated.
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+const (
+	socksVersion = 5
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	repSucceeded           = 0x00
+	repGeneralFailure      = 0x01
+	repHostUnreachable     = 0x04
+	repConnectionRefused   = 0x05
+	repCommandNotSupported = 0x07
+	repAddrNotSupported    = 0x08
+
+	// handshakeTimeout bounds the negotiation of a request, and the
+	// connections to the destinations
+	handshakeTimeout = 10 * time.Second
+
+	// maxDatagram is the largest UDP payload relayed
+	maxDatagram = 65535
+)
+
+var (
+	errVersion = errors.New("not a SOCKS5 request")
+	errAddr    = errors.New("address type not supported")
+)
+
+// Client is the SOCKS5 server on the client machine, forwarding the requests
+// to an exit Server. Between them, each request is a stream led by the
+// command and the destination in the SOCKS5 format, answered with the reply
+// code; the datagrams of UDP ASSOCIATE follow as frames of a 2 byte length,
+// the address and the payload.
+type Client struct {
+	pool *safeudp.ClientPool
+}
+
+// NewClient dials 'sessions' sessions to the exit server at "raddr" with the
+// settings of 'config' until the context is done, the requests are spread
+// over them.
+func NewClient(ctx context.Context, raddr string, config *safeudp.Config, sessions int) (*Client, error) {
+	pool, err := safeudp.NewClientPool(ctx, raddr, config, sessions)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{pool: pool}, nil
+}
+
+// Serve answers the SOCKS5 clients accepted on 'l' until it fails, closing
+// the listener is the way to stop it. It returns the error of the listener.
+func (c *Client) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go c.handle(conn)
+	}
+}
+
+// Close closes the sessions to the exit server with the requests forwarded
+// over them
+func (c *Client) Close() error {
+	return c.pool.Close()
+}
+
+// handle negotiates a SOCKS5 request and forwards it
+func (c *Client) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	cmd, addr, err := readRequest(conn)
+	if err != nil {
+		if errors.Is(err, errAddr) {
+			writeReply(conn, repAddrNotSupported, nil)
+		}
+		conn.Close()
+		return
+	}
+
+	switch cmd {
+	case cmdConnect:
+		stream, rep := c.open(cmdConnect, addr)
+		writeReply(conn, rep, nil)
+		if rep != repSucceeded {
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		pipe(conn, stream)
+	case cmdUDPAssociate:
+		c.associate(conn, addr)
+	default:
+		writeReply(conn, repCommandNotSupported, nil)
+		conn.Close()
+	}
+}
+
+// open opens a stream for a request to the exit server and returns it with
+// the reply of the server
+func (c *Client) open(cmd byte, addr string) (*safeudp.Conn, byte) {
+	request, err := appendAddr([]byte{cmd}, addr)
+	if err != nil {
+		return nil, repAddrNotSupported
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	stream, err := c.pool.OpenStream(ctx)
+	if err != nil {
+		return nil, repGeneralFailure
+	}
+
+	stream.SetDeadline(time.Now().Add(handshakeTimeout))
+	rep := make([]byte, 1)
+	if _, err := stream.Write(request); err == nil {
+		_, err = io.ReadFull(stream, rep)
+	}
+	if err != nil {
+		stream.Close()
+		return nil, repGeneralFailure
+	}
+	if rep[0] != repSucceeded {
+		stream.Close()
+		return nil, rep[0]
+	}
+	stream.SetDeadline(time.Time{})
+	return stream, repSucceeded
+}
+
+// associate relays the datagrams of a UDP ASSOCIATE request, until the
+// control connection closes. Only datagrams from the IP address of the
+// control connection are taken, and from the port of the first.
+func (c *Client) associate(conn net.Conn, addr string) {
+	defer conn.Close()
+	local, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(local, "0"))
+	if err != nil {
+		writeReply(conn, repGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+	stream, rep := c.open(cmdUDPAssociate, addr)
+	if rep != repSucceeded {
+		writeReply(conn, rep, nil)
+		return
+	}
+	defer stream.Close()
+	if err := writeReply(conn, repSucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	clientIP := addrPort(conn.RemoteAddr()).Addr()
+
+	var app netip.AddrPort // the address the application sends from
+	var appMu sync.Mutex
+	go func() {
+		defer relay.Close()
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			src := addrPort(from)
+			appMu.Lock()
+			if !app.IsValid() && src.Addr() == clientIP {
+				app = src
+			}
+			ok := src == app
+			appMu.Unlock()
+			// RSV, FRAG, the destination, the payload; fragments are dropped
+			if !ok || n < 4 || buf[2] != 0 {
+				continue
+			}
+			if err := writeFrame(stream, buf[3:n]); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer conn.Close() // ends the association
+		defer relay.Close()
+		for {
+			frame, err := readFrame(stream)
+			if err != nil {
+				return
+			}
+			appMu.Lock()
+			to := app
+			appMu.Unlock()
+			if to.IsValid() {
+				relay.WriteTo(append([]byte{0, 0, 0}, frame...), net.UDPAddrFromAddrPort(to))
+			}
+		}
+	}()
+
+	// the association lives as long as the control connection
+	io.Copy(io.Discard, conn)
+}
+
+// Server is the exit of the requests of Clients, connecting to their
+// destinations
+type Server struct {
+	// AllowUnauthenticated serves the sessions encrypted with an ephemeral
+	// key agreed without authentication, see safeudp.Conn.Unauthenticated,
+	// which anyone reaching the listener can open, making the Server an open
+	// proxy. They are refused by default: give the listener a Key or a
+	// Config.Handshake backend. Plaintext sessions are not told apart and
+	// are served.
+	AllowUnauthenticated bool
+}
+
+// NewServer returns an exit server
+func NewServer() *Server {
+	return new(Server)
+}
+
+// Serve accepts the sessions of clients on 'l' and serves the requests of
+// their streams until the listener fails, closing it is the way to stop it.
+// Sessions failing their handshake, and unauthenticated sessions unless
+// allowed, are closed. It returns the error of the listener.
+func (s *Server) Serve(l *safeudp.StreamListener) error {
+	for {
+		conn, err := l.Accept()
+		if ne := net.Error(nil); errors.As(err, &ne) && ne.Temporary() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		first := conn.(*safeudp.Conn)
+		if first.Unauthenticated() && !s.AllowUnauthenticated {
+			first.CloseSession()
+			continue
+		}
+		go s.handle(first)
+		go func() {
+			for {
+				stream, err := first.AcceptStream()
+				if err != nil {
+					return
+				}
+				go s.handle(stream)
+			}
+		}()
+	}
+}
+
+// handle serves the request of a stream
+func (s *Server) handle(stream *safeudp.Conn) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(handshakeTimeout))
+	cmd := make([]byte, 1)
+	if _, err := io.ReadFull(stream, cmd); err != nil {
+		return
+	}
+	addr, err := readAddr(stream)
+	if err != nil {
+		return
+	}
+
+	switch cmd[0] {
+	case cmdConnect:
+		conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+		if err != nil {
+			stream.Write([]byte{dialReply(err)})
+			return
+		}
+		if _, err := stream.Write([]byte{repSucceeded}); err != nil {
+			conn.Close()
+			return
+		}
+		stream.SetDeadline(time.Time{})
+		pipe(stream, conn)
+	case cmdUDPAssociate:
+		relay, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			stream.Write([]byte{repGeneralFailure})
+			return
+		}
+		defer relay.Close()
+		if _, err := stream.Write([]byte{repSucceeded}); err != nil {
+			return
+		}
+		stream.SetDeadline(time.Time{})
+		s.relay(stream, relay)
+	default:
+		stream.Write([]byte{repCommandNotSupported})
+	}
+}
+
+// relay sends the datagrams of the frames of a stream to their destinations
+// and frames the datagrams received back, until the stream ends
+func (s *Server) relay(stream *safeudp.Conn, relay net.PacketConn) {
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			frame, err := appendAddr(nil, from.String())
+			if err != nil {
+				continue
+			}
+			if err := writeFrame(stream, append(frame, buf[:n]...)); err != nil {
+				relay.Close()
+				return
+			}
+		}
+	}()
+
+	resolved := make(map[string]*net.UDPAddr) // names resolved for the association
+	for {
+		frame, err := readFrame(stream)
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(frame)
+		addr, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		to, ok := resolved[addr]
+		if !ok {
+			if to, err = net.ResolveUDPAddr("udp", addr); err != nil {
+				continue
+			}
+			resolved[addr] = to
+		}
+		relay.WriteTo(frame[len(frame)-r.Len():], to)
+	}
+}
+
+// dialReply returns the reply code of a failure to connect
+func dialReply(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repConnectionRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return repHostUnreachable
+	default:
+		return repGeneralFailure
+	}
+}
+
+// readRequest negotiates the method with a SOCKS5 client and reads its
+// request
+func readRequest(conn net.Conn) (cmd byte, addr string, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socksVersion {
+		return 0, "", errVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, "", err
+	}
+	if bytes.IndexByte(methods, methodNoAuth) < 0 {
+		conn.Write([]byte{socksVersion, methodNoAcceptable})
+		return 0, "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, methodNoAuth}); err != nil {
+		return 0, "", err
+	}
+
+	request := make([]byte, 3) // VER, CMD, RSV
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return 0, "", err
+	}
+	if request[0] != socksVersion {
+		return 0, "", errVersion
+	}
+	addr, err = readAddr(conn)
+	return request[1], addr, err
+}
+
+// writeReply answers a request with 'rep' and the bound address, 0.0.0.0:0 if nil
+func writeReply(conn net.Conn, rep byte, bound net.Addr) error {
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	reply, err := appendAddr([]byte{socksVersion, rep, 0}, addr)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(reply)
+	return err
+}
+
+// readAddr reads an address in the SOCKS5 format, the type, the host and the
+// port
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case atypIPv4:
+		host = make([]byte, 4)
+	case atypIPv6:
+		host = make([]byte, 16)
+	case atypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		host = make([]byte, size[0])
+	default:
+		return "", errAddr
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	name := string(host)
+	if atyp[0] != atypDomain {
+		ip, _ := netip.AddrFromSlice(host)
+		name = ip.String()
+	}
+	return net.JoinHostPort(name, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendAddr appends "addr" in the SOCKS5 format to 'b'
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, service, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(service, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip = ip.Unmap(); ip.Is4() {
+			b = append(append(b, atypIPv4), ip.AsSlice()...)
+		} else {
+			b = append(append(b, atypIPv6), ip.WithZone("").AsSlice()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errAddr
+		}
+		b = append(append(b, atypDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// writeFrame writes a datagram of UDP ASSOCIATE to a stream
+func writeFrame(w io.Writer, frame []byte) error {
+	if len(frame) > maxDatagram {
+		return nil // cannot be framed, dropped like a datagram
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(frame))), frame...))
+	return err
+}
+
+// readFrame reads a datagram of UDP ASSOCIATE from a stream
+func readFrame(r io.Reader) ([]byte, error) {
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// addrPort returns the IP address and port of a UDP or TCP address
+func addrPort(addr net.Addr) netip.AddrPort {
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// pipe copies between two connections until either direction ends, then
+// closes both
+func pipe(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
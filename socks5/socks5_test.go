@@ -0,0 +1,217 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 18:47:26
+@Description: SOCKS5 proxy tests
+@Language: Go 1.23.4
+*/
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+// TestSOCKS5 测试经由出口服务器的CONNECT与UDP ASSOCIATE请求，以及不支持的命令
+func TestSOCKS5(t *testing.T) {
+	// 目标：TCP与UDP回显服务器
+	tcpEcho, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpEcho.Close()
+	go func() {
+		for {
+			conn, err := tcpEcho.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	udpEcho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buf[:n], from)
+		}
+	}()
+
+	config := &safeudp.Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, Key: make([]byte, 32)}
+	if config.Validate() != nil { // nocrypto
+		config.Key, config.Plaintext = nil, true
+	}
+	sl, err := safeudp.ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go NewServer().Serve(sl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := NewClient(ctx, sl.Addr().String(), config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go c.Serve(proxy)
+
+	// request sends a request to the proxy and returns the connection, the
+	// reply code and the bound address
+	request := func(cmd byte, addr string) (net.Conn, byte, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req, err := appendAddr([]byte{socksVersion, cmd, 0}, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append([]byte{socksVersion, 1, methodNoAuth}, req...))
+		method := make([]byte, 2)
+		reply := make([]byte, 3)
+		if _, err := io.ReadFull(conn, method); err != nil || method[1] != methodNoAuth {
+			t.Fatal("method not accepted", method, err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		bound, err := readAddr(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, reply[1], bound
+	}
+
+	// CONNECT
+	conn, rep, _ := request(cmdConnect, tcpEcho.Addr().String())
+	if rep != repSucceeded {
+		t.Fatalf("CONNECT reply %d", rep)
+	}
+	data := bytes.Repeat([]byte("socks"), 10000)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatal("CONNECT echo failed", err)
+	}
+	conn.Close()
+
+	// UDP ASSOCIATE
+	control, rep, bound := request(cmdUDPAssociate, "0.0.0.0:0")
+	if rep != repSucceeded {
+		t.Fatalf("UDP ASSOCIATE reply %d", rep)
+	}
+	defer control.Close()
+	app, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram, _ := appendAddr([]byte{0, 0, 0}, udpEcho.LocalAddr().String())
+	datagram = append(datagram, "ping"...)
+	app.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := app.WriteTo(datagram, relay); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := app.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buf[3:n])
+	from, err := readAddr(r)
+	if err != nil || from != udpEcho.LocalAddr().String() {
+		t.Fatalf("datagram from %s, want %v, %v", from, udpEcho.LocalAddr(), err)
+	}
+	if payload, _ := io.ReadAll(r); string(payload) != "ping" {
+		t.Fatalf("payload %q", payload)
+	}
+
+	// BIND
+	conn, rep, _ = request(0x02, "0.0.0.0:0")
+	conn.Close()
+	if rep != repCommandNotSupported {
+		t.Errorf("BIND reply %d, want %d", rep, repCommandNotSupported)
+	}
+}
+
+// TestUnauthenticated 测试出口服务器默认拒绝未经认证的临时密钥会话，显式允许时才服务
+func TestUnauthenticated(t *testing.T) {
+	config := &safeudp.Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	for _, allow := range []bool{false, true} {
+		sl, err := safeudp.ListenStream("127.0.0.1:0", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sl.Close()
+		go (&Server{AllowUnauthenticated: allow}).Serve(sl)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := safeudp.DialContext(ctx, sl.Addr().String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if !conn.Unauthenticated() {
+			t.Skip("no key agreement in this build")
+		}
+		// 不支持的命令得到应答，被拒绝的会话则被关闭
+		conn.Write([]byte{0x7f, atypIPv4, 127, 0, 0, 1, 0, 80})
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		reply := make([]byte, 1)
+		_, err = io.ReadFull(conn, reply)
+		if allow && (err != nil || reply[0] != repCommandNotSupported) {
+			t.Fatal("allowed session refused", err, reply)
+		}
+		if !allow && err == nil {
+			t.Fatal("unauthenticated session served")
+		}
+	}
+}
+
+// TestAddr 测试SOCKS5地址格式的编码与解码
+func TestAddr(t *testing.T) {
+	for _, addr := range []string{"192.0.2.1:80", "[2001:db8::1]:443", "example.com:53"} {
+		b, err := appendAddr(nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readAddr(bytes.NewReader(b))
+		if err != nil || got != addr {
+			t.Errorf("%s decoded as %s, %v", addr, got, err)
+		}
+	}
+	if _, err := appendAddr(nil, string(bytes.Repeat([]byte{'a'}, 256))+":80"); err == nil {
+		t.Error("name longer than 255 bytes encoded")
+	}
+}
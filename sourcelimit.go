@@ -0,0 +1,156 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 09:40:52
+@Description: Filter and rate limits per source address of a listener
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sourceTableLimit is the number of source addresses tracked by the rate
+// limits, idle sources are forgotten beyond it
+const sourceTableLimit = 1 << 16
+
+// SourceLimits are the rate limits a listener applies to each source IP
+// address, a limit of 0 is no limit. Bursts of one second's worth are allowed.
+type SourceLimits struct {
+	PacketsPerSec     int `json:"packets_per_sec,omitempty"`      // packets received from the address, checked before decryption
+	NewSessionsPerSec int `json:"new_sessions_per_sec,omitempty"` // sessions created for the address
+}
+
+// sourceTable holds the token buckets of the source addresses
+type sourceTable struct {
+	limits  SourceLimits
+	sources map[netip.Addr]*sourceBuckets
+	swept   time.Time // last sweep of idle sources, at most one per second
+	mu      sync.Mutex
+}
+
+// sourceBuckets are the token buckets of a source address, counting packets
+// and sessions instead of bytes
+type sourceBuckets struct {
+	packets, sessions tokenBucket
+}
+
+// newCountBucket returns a token bucket of 'perSec' events per second, full
+// at 'now', a rate of 0 is no limit
+func newCountBucket(perSec int, now time.Time) tokenBucket {
+	return tokenBucket{rate: float64(perSec), burst: float64(perSec), tokens: float64(perSec), last: now}
+}
+
+// SetSourceLimits limits the packets and new sessions of each source IP
+// address, packets over the limits are dropped and counted in InSourceDrops.
+// Zero limits disable the tracking of sources.
+//
+// The packet limit is checked before decryption, so floods from an address
+// cost little work. Up to 65536 addresses are tracked, idle ones are forgotten
+// beyond that, and packets of new addresses are dropped while all are busy.
+func (l *Listener) SetSourceLimits(limits SourceLimits) error {
+	if limits.PacketsPerSec < 0 || limits.NewSessionsPerSec < 0 {
+		return errors.New("source limits must not be negative")
+	}
+	if limits == (SourceLimits{}) {
+		l.sources.Store(nil)
+		return nil
+	}
+	l.sources.Store(&sourceTable{limits: limits, sources: make(map[netip.Addr]*sourceBuckets)})
+	return nil
+}
+
+// SetSourceFilter installs a callback consulted with the source address of
+// every packet before decryption, packets for which it returns false are
+// dropped and counted in InSourceDrops, so allow and deny lists cost no
+// cryptographic work. It runs on the read loop and must be fast. nil removes
+// the filter.
+func (l *Listener) SetSourceFilter(allow func(addr net.Addr) bool) {
+	if allow == nil {
+		l.sourceFilter.Store(nil)
+		return
+	}
+	l.sourceFilter.Store(&allow)
+}
+
+// admitPacket reports whether a packet from 'addr' passes the source filter
+// and the packet rate limit of its address
+func (l *Listener) admitPacket(addr net.Addr) bool {
+	if allow := l.sourceFilter.Load(); allow != nil && !(*allow)(addr) {
+		atomic.AddUint64(&l.Snmp().InSourceDrops, 1)
+		return false
+	}
+	if t := l.sources.Load(); t != nil && t.limits.PacketsPerSec > 0 {
+		if !t.allow(addrKey(addr).Addr(), false) {
+			atomic.AddUint64(&l.Snmp().InSourceDrops, 1)
+			return false
+		}
+	}
+	return true
+}
+
+// admitSession reports whether a session may be created for 'ip' under the
+// new session rate limit of its address
+func (l *Listener) admitSession(ip netip.Addr) bool {
+	if t := l.sources.Load(); t != nil && t.limits.NewSessionsPerSec > 0 {
+		if !t.allow(ip, true) {
+			atomic.AddUint64(&l.Snmp().InSourceDrops, 1)
+			return false
+		}
+	}
+	return true
+}
+
+// allow takes a token from the packet or session bucket of 'ip'
+func (t *sourceTable) allow(ip netip.Addr, session bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	b, ok := t.sources[ip]
+	if !ok {
+		if len(t.sources) >= sourceTableLimit && !t.sweep(now) {
+			return false
+		}
+		b = &sourceBuckets{packets: newCountBucket(t.limits.PacketsPerSec, now), sessions: newCountBucket(t.limits.NewSessionsPerSec, now)}
+		t.sources[ip] = b
+	}
+
+	bucket := &b.packets
+	if session {
+		bucket = &b.sessions
+	}
+	if bucket.rate == 0 {
+		return true
+	}
+	bucket.refill(now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweep forgets the sources which have been idle for a second, their buckets
+// are full again, and reports whether any was forgotten. The caller must hold
+// the lock.
+func (t *sourceTable) sweep(now time.Time) bool {
+	if now.Sub(t.swept) < time.Second {
+		return false
+	}
+	t.swept = now
+	n := len(t.sources)
+	for ip, b := range t.sources {
+		if now.Sub(b.packets.last) >= time.Second && now.Sub(b.sessions.last) >= time.Second {
+			delete(t.sources, ip)
+		}
+	}
+	return len(t.sources) < n
+}
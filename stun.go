@@ -0,0 +1,304 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-15 09:12:44
+@Description: Public address discovery with STUN binding requests
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	stunHeaderSize   = 20
+	stunMagicCookie  = 0x2112A442
+	stunBindingReq   = 0x0001
+	stunBindingResp  = 0x0101
+	stunMappedAddr   = 0x0001
+	stunXorMapped    = 0x0020
+	stunInitialRTO   = 500 * time.Millisecond // RFC 8489 section 6.2.1
+	stunMaxRequests  = 7                      // Rc of RFC 8489
+	stunFinalTimeout = 16                     // Rm, multiple of the initial RTO waited after the last request
+)
+
+type stunID [12]byte
+
+// stunTransactions matches the responses of STUN servers read by a session or
+// listener to the binding requests waiting for them
+type stunTransactions struct {
+	mu      sync.Mutex
+	pending map[stunID]chan netip.AddrPort
+}
+
+// input consumes 'raw' if it is the response to a pending binding request
+func (t *stunTransactions) input(raw []byte) bool {
+	if len(raw) < stunHeaderSize || raw[0]&0xc0 != 0 || binary.BigEndian.Uint32(raw[4:]) != stunMagicCookie {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return false
+	}
+	id, mapped, ok := parseSTUNResponse(raw)
+	if !ok {
+		return false
+	}
+	ch, ok := t.pending[id]
+	if !ok {
+		return false
+	}
+	delete(t.pending, id)
+	ch <- mapped
+	return true
+}
+
+// binding sends binding requests to 'server' with 'write' until 'input' reads
+// the response or the retransmissions are exhausted
+func (t *stunTransactions) binding(ctx context.Context, server net.Addr, write func(b []byte, addr net.Addr) error) (netip.AddrPort, error) {
+	req, id := newSTUNRequest()
+	ch := make(chan netip.AddrPort, 1)
+	t.mu.Lock()
+	if t.pending == nil {
+		t.pending = make(map[stunID]chan netip.AddrPort)
+	}
+	t.pending[id] = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for n, rto := 0, stunInitialRTO; ; n++ {
+		select {
+		case mapped := <-ch:
+			return mapped, nil
+		case <-ctx.Done():
+			return netip.AddrPort{}, errors.WithStack(ctx.Err())
+		case <-timer.C:
+		}
+		if n == stunMaxRequests {
+			return netip.AddrPort{}, errors.WithStack(ErrSTUN)
+		}
+		if err := write(req, server); err != nil {
+			return netip.AddrPort{}, errors.WithStack(err)
+		}
+		if n == stunMaxRequests-1 {
+			timer.Reset(stunFinalTimeout * stunInitialRTO)
+		} else {
+			timer.Reset(rto)
+			rto *= 2
+		}
+	}
+}
+
+// newSTUNRequest returns a binding request and its transaction ID
+func newSTUNRequest() ([]byte, stunID) {
+	var id stunID
+	rand.Read(id[:])
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req, stunBindingReq)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	copy(req[8:], id[:])
+	return req, id
+}
+
+// parseSTUNResponse returns the transaction ID and the mapped address of a
+// binding success response, preferring the XOR-MAPPED-ADDRESS attribute
+func parseSTUNResponse(raw []byte) (id stunID, mapped netip.AddrPort, ok bool) {
+	if len(raw) < stunHeaderSize || binary.BigEndian.Uint16(raw) != stunBindingResp ||
+		binary.BigEndian.Uint32(raw[4:]) != stunMagicCookie {
+		return id, mapped, false
+	}
+	length := int(binary.BigEndian.Uint16(raw[2:]))
+	if length%4 != 0 || stunHeaderSize+length > len(raw) {
+		return id, mapped, false
+	}
+	copy(id[:], raw[8:stunHeaderSize])
+	attrs := raw[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		typ, size := binary.BigEndian.Uint16(attrs), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+size]
+		switch typ {
+		case stunXorMapped:
+			if addr, valid := parseSTUNAddr(value, raw[4:stunHeaderSize]); valid {
+				return id, addr, true
+			}
+		case stunMappedAddr:
+			if addr, valid := parseSTUNAddr(value, nil); valid {
+				mapped = addr
+			}
+		}
+		attrs = attrs[4+(size+3)&^3:]
+	}
+	return id, mapped, mapped.IsValid()
+}
+
+// parseSTUNAddr decodes an address attribute, XORed with the magic cookie and
+// transaction ID in 'xor' if not nil
+func parseSTUNAddr(value, xor []byte) (netip.AddrPort, bool) {
+	if len(value) < 4 {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := value[4:]
+	switch {
+	case value[1] == 0x01 && len(ip) == 4:
+	case value[1] == 0x02 && len(ip) == 16:
+	default:
+		return netip.AddrPort{}, false
+	}
+	if xor != nil {
+		port ^= stunMagicCookie >> 16
+		ip = append([]byte(nil), ip...)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, port), true
+}
+
+// resolveFamily resolves 'raddr' to an address of the family of the socket
+// bound to 'local'
+func resolveFamily(ctx context.Context, raddr string, local net.Addr) (net.Addr, error) {
+	addrs, err := resolveUDPAddrs(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	v4only := false
+	if udpaddr, ok := local.(*net.UDPAddr); ok && udpaddr.IP.To4() != nil {
+		v4only = true
+	}
+	for _, addr := range addrs {
+		if !v4only || addr.IP.To4() != nil {
+			return addr, nil
+		}
+	}
+	return nil, errors.Errorf("no IPv4 address for %s", raddr)
+}
+
+// STUNBinding sends STUN binding requests to 'server', host:port, from 'conn'
+// and returns the public address the server saw them from, the address of the
+// socket behind the NATs on the path. The requests are retransmitted as in RFC
+// 8489 for about 40 seconds, or until the context is done.
+//
+// It reads from 'conn' and discards other packets, use it before passing the
+// socket to DialWithConn or ServeConn, and Listener.STUNBinding or
+// UDPSession.STUNBinding afterwards.
+func STUNBinding(ctx context.Context, conn net.PacketConn, server string) (netip.AddrPort, error) {
+	addr, err := resolveFamily(ctx, server, conn.LocalAddr())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var t stunTransactions
+	r := startReader(conn, func(b []byte, _ net.Addr) { t.input(b) })
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	mapped, err := t.binding(ctx, addr, func(b []byte, addr net.Addr) error {
+		_, err := conn.WriteTo(b, addr)
+		return err
+	})
+	if readErr := r.stop(); err != nil && readErr != nil {
+		return netip.AddrPort{}, readErr
+	}
+	return mapped, err
+}
+
+// packetReader reads the packets of a socket of the caller until stopped
+type packetReader struct {
+	conn net.PacketConn
+	done chan struct{} // closed when the reader returns
+	err  error         // failure of the read, valid after done
+}
+
+// startReader passes the packets read from 'conn' to 'input' on a goroutine
+// until the reader is stopped or a read fails, clearing the read deadline.
+// 'b' is reused after the call.
+func startReader(conn net.PacketConn, input func(b []byte, addr net.Addr)) *packetReader {
+	r := &packetReader{conn: conn, done: make(chan struct{})}
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(r.done)
+		buf := make([]byte, mtuLimit)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				r.err = err
+				return
+			}
+			input(buf[:n], addr)
+		}
+	}()
+	return r
+}
+
+// stop interrupts the read with a deadline, waits for the reader to return
+// and clears the deadline. It returns the failure which ended the reader
+// before, if any.
+func (r *packetReader) stop() error {
+	r.conn.SetReadDeadline(time.Now())
+	<-r.done
+	r.conn.SetReadDeadline(time.Time{})
+	if r.err != nil && !errors.Is(r.err, os.ErrDeadlineExceeded) {
+		return errors.WithStack(r.err)
+	}
+	return nil
+}
+
+// STUNBinding sends STUN binding requests to 'server', host:port, from the
+// socket of the listener and returns the public address the server saw them
+// from, to register with a rendezvous service or to advertise for NAT
+// traversal. The responses are taken from the packets read before the packet
+// filter, see SetPacketFilter, and the listener keeps serving its sessions.
+func (l *Listener) STUNBinding(ctx context.Context, server string) (netip.AddrPort, error) {
+	addr, err := resolveFamily(ctx, server, l.conn.LocalAddr())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return l.stun.binding(ctx, addr, func(b []byte, addr net.Addr) error {
+		_, err := l.conn.WriteTo(b, addr)
+		return err
+	})
+}
+
+// STUNBinding is Listener.STUNBinding from the socket of the session, for a
+// client session or an accepted one alike.
+func (s *UDPSession) STUNBinding(ctx context.Context, server string) (netip.AddrPort, error) {
+	if s.l != nil {
+		return s.l.STUNBinding(ctx, server)
+	}
+	addr, err := resolveFamily(ctx, server, s.conn.LocalAddr())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return s.stun.binding(ctx, addr, func(b []byte, addr net.Addr) error {
+		_, err := s.conn.WriteTo(b, addr)
+		return err
+	})
+}
@@ -0,0 +1,228 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-15 22:10:52
+@Description: Taps of the plaintext datagrams of sessions, and a pcap writer for them
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TapDirection tells whether a tapped datagram was sent or received
+type TapDirection int
+
+const (
+	TapOutgoing TapDirection = iota // to the remote, before encryption
+	TapIncoming                     // from the remote, after decryption
+)
+
+func (d TapDirection) String() string {
+	if d == TapOutgoing {
+		return "outgoing"
+	}
+	return "incoming"
+}
+
+// PacketTap receives the datagrams of sessions in plaintext, for wire-level
+// diagnostics such as pcap traces, see NewPcapWriter. An outgoing datagram is
+// tapped after FEC encoding and before encryption, parity shards included and
+// duplicates of SetDup not; an incoming one after decryption and before FEC
+// decoding. Both start with the FEC header, if any, followed by the KCP
+// segments.
+//
+// Tap is called on the paths of the packets, concurrently for the sessions
+// of a listener, and must not block. 'pkt' is only valid during the call.
+type PacketTap interface {
+	Tap(dir TapDirection, local, remote net.Addr, pkt []byte)
+}
+
+// packetTap holds the PacketTap of a session or listener
+type packetTap struct{ PacketTap }
+
+// SetPacketTap taps the datagrams of the sessions of the listener, a nil tap
+// removes it.
+func (l *Listener) SetPacketTap(tap PacketTap) {
+	if tap == nil {
+		l.tap.Store(nil)
+		return
+	}
+	l.tap.Store(&packetTap{tap})
+}
+
+// SetPacketTap taps the datagrams of the session, a nil tap removes it.
+// Sessions accepted from a Listener use the tap of the Listener.
+func (s *UDPSession) SetPacketTap(tap PacketTap) {
+	if tap == nil {
+		s.tap.Store(nil)
+		return
+	}
+	s.tap.Store(&packetTap{tap})
+}
+
+// packetTap returns the tap of the session, or of its listener, nil if none
+func (s *UDPSession) packetTap() PacketTap {
+	t := s.tap.Load()
+	if s.l != nil {
+		t = s.l.tap.Load()
+	}
+	if t == nil {
+		return nil
+	}
+	return t.PacketTap
+}
+
+// tapOutgoing taps a packet from the post processing and its parity shards,
+// before the crypto header is filled
+func (s *UDPSession) tapOutgoing(tap PacketTap, buf []byte, ecc [][]byte) {
+	offset := 0
+	if s.block != nil {
+		offset = cryptHeaderSize
+	}
+	local, remote := s.LocalAddr(), s.remoteAddr()
+	tap.Tap(TapOutgoing, local, remote, buf[offset:])
+	for k := range ecc {
+		tap.Tap(TapOutgoing, local, remote, ecc[k][offset:])
+	}
+}
+
+// pcap file format, with raw IP packets as the link type
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapLinkRaw  = 101
+	pcapSnapLen  = 65535
+	ipv4Header   = 20
+	ipv6Header   = 40
+	udpHeader    = 8
+	pcapRecord   = 16
+	pcapFileHead = 24
+)
+
+// PcapWriter is a PacketTap writing the datagrams to a pcap file, each
+// wrapped in IP and UDP headers with the addresses of the session, so that
+// tools like Wireshark or tcpdump read it. An unspecified local address, of
+// a socket bound to all interfaces, is written as such.
+type PcapWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+	err error // first write error, the writer stops at it
+}
+
+// NewPcapWriter writes the header of a pcap file to 'w' and returns a
+// PcapWriter adding the datagrams to it. 'w' should be buffered.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	head := make([]byte, pcapFileHead)
+	binary.LittleEndian.PutUint32(head[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(head[4:], 2)
+	binary.LittleEndian.PutUint16(head[6:], 4)
+	binary.LittleEndian.PutUint32(head[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(head[20:], pcapLinkRaw)
+	if _, err := w.Write(head); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// Err returns the first write error, after which datagrams are not written
+func (p *PcapWriter) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Tap implements PacketTap
+func (p *PcapWriter) Tap(dir TapDirection, local, remote net.Addr, pkt []byte) {
+	src, dst := addrKey(local), addrKey(remote)
+	if dir == TapIncoming {
+		src, dst = dst, src
+	}
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.buf = appendIPUDP(append(p.buf[:0], make([]byte, pcapRecord)...), src, dst, pkt)
+	size := len(p.buf) - pcapRecord
+	binary.LittleEndian.PutUint32(p.buf[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(p.buf[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(p.buf[8:], uint32(size))
+	binary.LittleEndian.PutUint32(p.buf[12:], uint32(size))
+	if _, err := p.w.Write(p.buf); err != nil {
+		p.err = errors.WithStack(err)
+	}
+}
+
+// appendIPUDP appends a UDP datagram of 'payload' from 'src' to 'dst' with
+// its IP header, IPv4 unless either address is IPv6
+func appendIPUDP(b []byte, src, dst netip.AddrPort, payload []byte) []byte {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	v4 := !srcIP.Is6() && !dstIP.Is6()
+	if v4 {
+		if !srcIP.IsValid() {
+			srcIP = netip.IPv4Unspecified()
+		}
+		if !dstIP.IsValid() {
+			dstIP = netip.IPv4Unspecified()
+		}
+	} else {
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	udpLen := udpHeader + len(payload)
+
+	start := len(b)
+	if v4 {
+		b = append(b, 0x45, 0, byte((ipv4Header+udpLen)>>8), byte(ipv4Header+udpLen), 0, 0, 0x40, 0, 64, 17, 0, 0)
+		b = append(b, srcIP.AsSlice()...)
+		b = append(b, dstIP.AsSlice()...)
+		binary.BigEndian.PutUint16(b[start+10:], ^onesSum(0, b[start:]))
+	} else {
+		b = append(b, 0x60, 0, 0, 0, byte(udpLen>>8), byte(udpLen), 17, 64)
+		b = append(b, srcIP.AsSlice()...)
+		b = append(b, dstIP.AsSlice()...)
+	}
+
+	udp := len(b)
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	b = binary.BigEndian.AppendUint16(b, dst.Port())
+	b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+	b = append(b, 0, 0)
+	b = append(b, payload...)
+
+	// checksum over the pseudo header and the datagram
+	sum := onesSum(0, srcIP.AsSlice())
+	sum = onesSum(sum, dstIP.AsSlice())
+	sum = onesSum(sum, []byte{0, 17, byte(udpLen >> 8), byte(udpLen)})
+	csum := ^onesSum(sum, b[udp:])
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[udp+6:], csum)
+	return b
+}
+
+// onesSum adds 'b' to the ones' complement sum 'sum' of the internet checksum
+func onesSum(sum uint16, b []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
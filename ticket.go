@@ -0,0 +1,228 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 10:02:35
+@Description: Session resumption with sealed tickets
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxTicketSize is the largest ticket a client can present, it is sent
+	// in front of the data of a packet
+	MaxTicketSize = 512
+
+	ticketIDSize       = 16
+	ticketHeaderSize   = 8 + ticketIDSize // issue time and id, sealed with the state
+	ticketReplayLimit  = 1 << 16          // tickets remembered as used by a TicketKey
+	ticketVerdictOK    = 1
+	ticketVerdictError = 2
+)
+
+// TicketStatus tells how far a session is in resuming with a ticket
+type TicketStatus int
+
+const (
+	TicketNone     TicketStatus = iota // no ticket was presented
+	TicketPending                      // the client waits for the verdict of the server
+	TicketAccepted                     // the server opened the ticket
+	TicketRejected                     // the ticket was invalid, expired or already used
+)
+
+func (t TicketStatus) String() string {
+	switch t {
+	case TicketNone:
+		return "none"
+	case TicketPending:
+		return "pending"
+	case TicketAccepted:
+		return "accepted"
+	case TicketRejected:
+		return "rejected"
+	default:
+		return "invalid"
+	}
+}
+
+// TicketKey seals application state into tickets held by clients, and opens
+// the tickets they present when reconnecting. The key is the static secret of
+// the server, a server restarted with the same key opens the tickets issued
+// before, so clients resume without repeating the application handshake.
+//
+// Each ticket is accepted once within its lifetime. The used tickets are
+// remembered in memory only, a restarted server accepts a ticket once more,
+// so keep the lifetime short.
+type TicketKey struct {
+	aead     cipher.AEAD
+	lifetime time.Duration
+
+	used map[[ticketIDSize]byte]time.Time // ids of accepted tickets and their expiry
+	mu   sync.Mutex
+}
+
+// NewTicketKey creates a TicketKey from a 16, 24 or 32 bytes secret, tickets
+// expire after 'lifetime'.
+func NewTicketKey(secret []byte, lifetime time.Duration) (*TicketKey, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if lifetime <= 0 {
+		return nil, errors.New("ticket lifetime must be positive")
+	}
+	return &TicketKey{aead: aead, lifetime: lifetime, used: make(map[[ticketIDSize]byte]time.Time)}, nil
+}
+
+// Seal returns a ticket carrying 'state', to be passed to the client by the
+// application. The state is encrypted and authenticated.
+func (k *TicketKey) Seal(state []byte) ([]byte, error) {
+	nonceSize := k.aead.NonceSize()
+	size := nonceSize + ticketHeaderSize + len(state) + k.aead.Overhead()
+	if size > MaxTicketSize {
+		return nil, errors.Errorf("ticket of %d bytes exceeds %d bytes", size, MaxTicketSize)
+	}
+
+	plain := make([]byte, ticketHeaderSize, ticketHeaderSize+len(state))
+	binary.LittleEndian.PutUint64(plain, uint64(time.Now().Unix()))
+	ticket := make([]byte, nonceSize, size)
+	if _, err := crand.Read(plain[8:ticketHeaderSize]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := crand.Read(ticket); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	plain = append(plain, state...)
+	return k.aead.Seal(ticket, ticket[:nonceSize], plain, nil), nil
+}
+
+// Open returns the state of a ticket, and marks it as used. It fails with
+// ErrTicket if the ticket is forged, expired or already used.
+func (k *TicketKey) Open(ticket []byte) ([]byte, error) {
+	nonceSize := k.aead.NonceSize()
+	if len(ticket) < nonceSize+ticketHeaderSize+k.aead.Overhead() {
+		return nil, errors.Wrap(ErrTicket, "malformed")
+	}
+	plain, err := k.aead.Open(nil, ticket[:nonceSize], ticket[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.Wrap(ErrTicket, "authentication failed")
+	}
+
+	now := time.Now()
+	issued := time.Unix(int64(binary.LittleEndian.Uint64(plain)), 0)
+	expiry := issued.Add(k.lifetime)
+	if now.After(expiry) || issued.After(now.Add(time.Minute)) {
+		return nil, errors.Wrap(ErrTicket, "expired")
+	}
+
+	var id [ticketIDSize]byte
+	copy(id[:], plain[8:ticketHeaderSize])
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.used[id]; ok {
+		return nil, errors.Wrap(ErrTicket, "replayed")
+	}
+	if len(k.used) >= ticketReplayLimit {
+		for used, exp := range k.used {
+			if now.After(exp) {
+				delete(k.used, used)
+			}
+		}
+		if len(k.used) >= ticketReplayLimit {
+			return nil, errors.Wrap(ErrTicket, "too many tickets in use")
+		}
+	}
+	k.used[id] = expiry
+	return plain[ticketHeaderSize:], nil
+}
+
+// SetTicketKey enables session resumption on the listener, the tickets which
+// clients present with DialWithTicket are opened with 'key', nil rejects them.
+// Sessions of Config.KCPCompat ignore tickets.
+func (l *Listener) SetTicketKey(key *TicketKey) {
+	l.ticketKey.Store(key)
+}
+
+// DialWithTicket connects to "raddr" like DialWithOptions, and presents a
+// ticket sealed by the server. The ticket is sent ahead of the data in every
+// packet until the server answers, see Resumption.
+func DialWithTicket(raddr string, ticket []byte, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	if len(ticket) == 0 || len(ticket) > MaxTicketSize {
+		return nil, errors.Errorf("ticket size must be between 1 and %d bytes", MaxTicketSize)
+	}
+
+	s, err := DialWithOptions(raddr, block, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.kcp.ticket = append([]byte(nil), ticket...)
+	s.kcp.ticket_repeat = true
+	s.ticketStatus = TicketPending
+	s.mu.Unlock()
+	return s, nil
+}
+
+// Resumption returns the status of the ticket presented for the session, and
+// on the server the state sealed in an accepted ticket. A server session has
+// its verdict once accepted, as the ticket comes with its first packet.
+func (s *UDPSession) Resumption() (TicketStatus, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ticketStatus, s.ticketState
+}
+
+// onTicket is invoked by KCP with the session lock held, with a ticket on the
+// server, or the verdict on it on the client
+func (s *UDPSession) onTicket(data []byte) {
+	if s.l == nil {
+		if s.ticketStatus != TicketPending || len(data) != 1 {
+			return
+		}
+		s.kcp.ticket, s.kcp.ticket_repeat = nil, false
+		if data[0] == ticketVerdictOK {
+			s.ticketStatus = TicketAccepted
+		} else {
+			s.ticketStatus = TicketRejected
+		}
+		s.traceEvent(TraceHandshake, "ticket %v", s.ticketStatus)
+		return
+	}
+
+	if s.refusedByKCPCompat("ticket") {
+		return // kcp-go does not understand the verdict
+	}
+
+	// answer a repeated ticket with the same verdict, it is used already
+	if s.ticketStatus == TicketNone {
+		s.ticketStatus = TicketRejected
+		if key := s.l.ticketKey.Load(); key != nil {
+			if state, err := key.Open(data); err == nil {
+				s.ticketStatus, s.ticketState = TicketAccepted, state
+			} else {
+				s.logEvent("ticket rejected: %v", err)
+			}
+		}
+	}
+
+	verdict := byte(ticketVerdictError)
+	if s.ticketStatus == TicketAccepted {
+		verdict = ticketVerdictOK
+	}
+	s.kcp.ticket = []byte{verdict}
+}
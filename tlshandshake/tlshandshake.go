@@ -0,0 +1,52 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 14:40:05
+@Description: TLS 1.3 handshake backend
+@Language: Go 1.23.4
+*/
+
+// Package tlshandshake secures the stream connections of safe-udp with TLS
+// 1.3 of crypto/tls, see safeudp.Config.Handshake. It is apart from safeudp so
+// that programs with a pre-shared key do not carry crypto/tls.
+package tlshandshake
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	safeudp "safe-udp"
+)
+
+// New returns a safeudp.HandshakeBackend running TLS 1.3 of crypto/tls with
+// 'config' over the sessions, its MinVersion raised to TLS 1.3. Servers set
+// Certificates and NextProtos for ALPN, clients ServerName, RootCAs and
+// ClientSessionCache to resume with session tickets. The connections are
+// *tls.Conn, see safeudp.Conn.Secured.
+func New(config *tls.Config) safeudp.HandshakeBackend {
+	config = config.Clone()
+	if config.MinVersion < tls.VersionTLS13 {
+		config.MinVersion = tls.VersionTLS13
+	}
+	return tlsHandshake{config}
+}
+
+type tlsHandshake struct {
+	config *tls.Config
+}
+
+func (h tlsHandshake) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	c := tls.Client(conn, h.config)
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (h tlsHandshake) Server(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	c := tls.Server(conn, h.config)
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
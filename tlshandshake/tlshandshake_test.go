@@ -0,0 +1,119 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 14:40:05
+@Description: TLS 1.3 handshake backend tests
+@Language: Go 1.23.4
+*/
+
+package tlshandshake
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+// TestNew 测试TLS 1.3握手后端：证书校验、ALPN、会话票据恢复以及失败的握手
+func TestNew(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"safe-udp.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	for _, noMux := range []bool{false, true} {
+		server := &safeudp.Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, NoMux: noMux,
+			Handshake: New(&tls.Config{
+				Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+				NextProtos:   []string{"echo"},
+			})}
+		if err := server.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		sl, err := safeudp.ListenStream("127.0.0.1:0", server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := sl.Accept()
+				if err != nil {
+					if errors.Is(err, safeudp.ErrHandshake) {
+						continue
+					}
+					return
+				}
+				go io.Copy(conn, conn)
+			}
+		}()
+
+		cache := tls.NewLRUClientSessionCache(4)
+		client := *server
+		client.Handshake = New(&tls.Config{ServerName: "safe-udp.test", RootCAs: roots, NextProtos: []string{"echo"}, ClientSessionCache: cache})
+		for i := 0; i < 2; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			conn, err := safeudp.DialContext(ctx, sl.Addr().String(), &client)
+			cancel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn.Unauthenticated() {
+				t.Fatal("handshake flagged unauthenticated")
+			}
+			tc, ok := conn.Secured().(*tls.Conn)
+			if !ok {
+				t.Fatal("no tls.Conn", conn.Secured())
+			}
+			state := tc.ConnectionState()
+			if state.Version != tls.VersionTLS13 || state.NegotiatedProtocol != "echo" {
+				t.Fatal("connection state", state.Version, state.NegotiatedProtocol)
+			}
+			// 第二次连接使用第一次的会话票据
+			if state.DidResume != (i == 1) {
+				t.Fatal("resumed", state.DidResume, "on dial", i, noMux)
+			}
+
+			msg := bytes.Repeat([]byte("certified "), 2000)
+			go conn.Write(msg)
+			got := make([]byte, len(msg))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+				t.Fatal(err, noMux)
+			}
+			conn.Close()
+		}
+
+		// 不信任服务器证书的客户端握手失败
+		client.Handshake = New(&tls.Config{ServerName: "safe-udp.test"})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = safeudp.DialContext(ctx, sl.Addr().String(), &client)
+		cancel()
+		if !errors.Is(err, safeudp.ErrHandshake) {
+			t.Fatal("untrusted certificate accepted:", err)
+		}
+		sl.Close()
+	}
+}
@@ -0,0 +1,65 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 09:12:40
+@Description: Tracing of the lifecycle of sessions
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// names of the events passed to SessionTracer.Event
+const (
+	TraceHandshake = "handshake" // protocol version, key agreement, ticket or cookie settled
+	TraceRTOStorm  = "rto_storm" // the retransmission timeout at least doubled in an update
+	TraceEvent     = "event"     // any other event of DebugState
+)
+
+// Tracer receives the lifecycle of sessions, for an adapter to a distributed
+// tracing system such as OpenTelemetry: a span per session from
+// StartSession to End, with the conv as an attribute and the events of the
+// session as span events, puts safe-udp hops into the traces of the calls
+// tunneled over them.
+type Tracer interface {
+	// StartSession is called when a session is dialed, or created for the
+	// first packet from a remote, before any of its events. 'ctx' is the
+	// context passed to DialContext, so that the span of the session is a
+	// child of the caller's, and context.Background() for accepted sessions
+	// and the dials without a context.
+	StartSession(ctx context.Context, conv uint32, local, remote net.Addr, client bool) SessionTracer
+}
+
+// SessionTracer receives the events of a session, from any goroutine. The
+// events are those of DebugState, named as TraceHandshake, TraceRTOStorm or
+// TraceEvent with their text as the detail.
+type SessionTracer interface {
+	Event(name, detail string)
+	End() // the session closed
+}
+
+// tracer holds the Tracer of SetTracer
+type tracer struct{ Tracer }
+
+var currentTracer atomic.Pointer[tracer]
+
+// SetTracer makes the sessions created afterwards report to 't', nil stops
+// tracing new sessions
+func SetTracer(t Tracer) {
+	if t == nil {
+		currentTracer.Store(nil)
+		return
+	}
+	currentTracer.Store(&tracer{t})
+}
+
+// startTrace starts the trace of a new session dialed with 'ctx', if a Tracer is set
+func (s *UDPSession) startTrace(ctx context.Context, conv uint32, remote net.Addr) {
+	if t := currentTracer.Load(); t != nil {
+		s.trace = t.StartSession(ctx, conv, s.LocalAddr(), remote, s.l == nil)
+	}
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 23:24:37
+@Description: TUN devices
+@Language: Go 1.23.4
+*/
+
+package tun
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Open creates the TUN interface "name", or attaches to it if it exists and
+// is persistent, without the packet information header. An empty name lets
+// the kernel choose one, such as tun0, see Device.Name. It needs the
+// CAP_NET_ADMIN capability.
+func Open(name string) (*Device, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "open /dev/net/tun")
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "create TUN device %q", name)
+	}
+	// non-blocking, so that the runtime poller lets Close interrupt a Read
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &Device{file: os.NewFile(uintptr(fd), "/dev/net/tun"), name: ifr.Name()}, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 23:24:37
+@Description: TUN devices, unsupported
+@Language: Go 1.23.4
+*/
+
+package tun
+
+import "github.com/pkg/errors"
+
+// Open creates a TUN device, which is supported on Linux only
+func Open(name string) (*Device, error) {
+	return nil, errors.New("TUN devices are supported on Linux only")
+}
@@ -0,0 +1,96 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-14 17:20:33
+@Description: IP packets of TUN devices over sessions
+@Language: Go 1.23.4
+*/
+
+// Package tun carries the IP packets of TUN devices over safe-udp sessions,
+// a minimal point to point VPN data plane: each packet is a message of the
+// session, encrypted and protected by FEC as the session is configured. The
+// addresses and routes of the devices are left to the system tools, such as
+// "ip addr add 10.0.0.1/30 dev tun0 && ip link set tun0 up".
+//
+// The messages are delivered reliably and in order, so a lost packet delays
+// the following ones like in TCP over TCP; a low latency profile, with a short
+// interval and fast resend, keeps this small.
+package tun
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	safeudp "safe-udp"
+)
+
+// maxPacket is the largest IP packet carried
+const maxPacket = 65535
+
+// Device is a TUN device, reading and writing one IP packet per call
+type Device struct {
+	file *os.File
+	name string
+}
+
+// Name returns the name of the interface
+func (d *Device) Name() string {
+	return d.name
+}
+
+func (d *Device) Read(b []byte) (int, error) {
+	return d.file.Read(b)
+}
+
+func (d *Device) Write(b []byte) (int, error) {
+	return d.file.Write(b)
+}
+
+// Close closes the device, the interface goes away with it
+func (d *Device) Close() error {
+	return d.file.Close()
+}
+
+// Forward carries the packets read from 'dev', a TUN device or anything
+// reading and writing one packet per call, to the session as messages, and
+// the messages of the session to 'dev'. It switches the session to
+// safeudp.WriteMessage, both ends must call it. Packets larger than the
+// MaxMessageSize of the session are dropped; the MTU of the device should be
+// below it.
+//
+// It returns the first error of either direction, once the device or the
+// session fails or is closed. The caller then closes both, which ends the
+// other direction.
+func Forward(dev io.ReadWriter, s *safeudp.UDPSession) error {
+	s.SetWritePolicy(safeudp.WriteMessage)
+	errs := make(chan error, 2)
+	go func() {
+		buf := make([]byte, maxPacket)
+		for {
+			n, err := dev.Read(buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := s.Write(buf[:n]); err != nil && !errors.Is(err, safeudp.ErrMsgTooLarge) {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxPacket)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := dev.Write(buf[:n]); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	return <-errs
+}
@@ -0,0 +1,117 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-14 17:20:33
+@Description: TUN forwarding tests
+@Language: Go 1.23.4
+*/
+
+package tun
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+// fakeDevice reads the packets sent to 'in' and writes packets to 'out', one
+// per call like a TUN device
+type fakeDevice struct {
+	in, out chan []byte
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{in: make(chan []byte, 16), out: make(chan []byte, 16)}
+}
+
+func (d *fakeDevice) Read(b []byte) (int, error) {
+	p, ok := <-d.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, p), nil
+}
+
+func (d *fakeDevice) Write(b []byte) (int, error) {
+	d.out <- bytes.Clone(b)
+	return len(b), nil
+}
+
+// TestForward 测试IP报文经由会话在两端设备之间逐个传递，保持报文边界
+func TestForward(t *testing.T) {
+	config := &safeudp.Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	l, err := safeudp.ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := safeudp.DialWithConfig(l.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	a, b := newFakeDevice(), newFakeDevice()
+	defer close(a.in)
+	defer close(b.in)
+	go Forward(a, client)
+
+	// 第一个报文使服务器接受会话
+	packets := [][]byte{bytes.Repeat([]byte{0x45}, 60), bytes.Repeat([]byte{0x46}, 1400), {0x60, 1, 2}}
+	a.in <- packets[0]
+	server, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go Forward(b, server)
+	for _, p := range packets[1:] {
+		a.in <- p
+	}
+	for _, want := range packets {
+		select {
+		case got := <-b.out:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("packet of %d bytes, want %d", len(got), len(want))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet not forwarded")
+		}
+	}
+
+	// 反方向
+	b.in <- packets[2]
+	select {
+	case got := <-a.out:
+		if !bytes.Equal(got, packets[2]) {
+			t.Fatal("reply corrupted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not forwarded")
+	}
+}
+
+// TestOpen 测试创建TUN设备，没有权限时跳过
+func TestOpen(t *testing.T) {
+	dev, err := Open("")
+	if err != nil {
+		t.Skip("no TUN device:", err)
+	}
+	defer dev.Close()
+	if dev.Name() == "" {
+		t.Error("device without a name")
+	}
+	done := make(chan struct{})
+	go func() {
+		dev.Read(make([]byte, maxPacket))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	dev.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Close did not interrupt Read")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-14 09:36:20
+@Description: TCP forwarding over stream connections
+@Language: Go 1.23.4
+*/
+
+// Package tunnel forwards TCP connections over safe-udp: a Client accepts
+// local TCP connections and carries each as a stream over a few sessions to
+// a Server, which connects it to a target address on the far end.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+// dialTimeout bounds the connections of the server to the target
+const dialTimeout = 10 * time.Second
+
+// Client forwards TCP connections to a Server
+type Client struct {
+	pool *safeudp.ClientPool
+}
+
+// NewClient dials 'sessions' sessions to the server at "raddr" with the
+// settings of 'config' until the context is done, the streams of the
+// forwarded connections are spread over them.
+func NewClient(ctx context.Context, raddr string, config *safeudp.Config, sessions int) (*Client, error) {
+	pool, err := safeudp.NewClientPool(ctx, raddr, config, sessions)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{pool: pool}, nil
+}
+
+// Serve forwards the connections accepted on 'l' until it fails, closing the
+// listener is the way to stop it. It returns the error of the listener.
+func (c *Client) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			stream, err := c.pool.OpenStream(ctx)
+			cancel()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			pipe(conn, stream)
+		}()
+	}
+}
+
+// Close closes the sessions to the server with the connections forwarded
+// over them
+func (c *Client) Close() error {
+	return c.pool.Close()
+}
+
+// Server forwards the streams of clients to a target address
+type Server struct {
+	target string
+}
+
+// NewServer returns a server connecting the streams to the TCP address
+// "target"
+func NewServer(target string) *Server {
+	return &Server{target: target}
+}
+
+// Serve accepts the sessions of clients on 'l' and forwards their streams
+// until the listener fails, closing it is the way to stop it. Sessions failing
+// their handshake are skipped. It returns the error of the listener.
+func (s *Server) Serve(l *safeudp.StreamListener) error {
+	for {
+		conn, err := l.Accept()
+		if ne := net.Error(nil); errors.As(err, &ne) && ne.Temporary() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		first := conn.(*safeudp.Conn)
+		go s.forward(first)
+		go func() {
+			for {
+				stream, err := first.AcceptStream()
+				if err != nil {
+					return
+				}
+				go s.forward(stream)
+			}
+		}()
+	}
+}
+
+// forward connects a stream to the target
+func (s *Server) forward(stream *safeudp.Conn) {
+	conn, err := net.DialTimeout("tcp", s.target, dialTimeout)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	pipe(stream, conn)
+}
+
+// pipe copies between two connections until either direction ends, then
+// closes both
+func pipe(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,94 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-14 09:36:20
+@Description: Tunnel tests
+@Language: Go 1.23.4
+*/
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	safeudp "safe-udp"
+)
+
+// TestTunnel 测试TCP连接经由客户端和服务器转发到目标
+func TestTunnel(t *testing.T) {
+	// 目标：TCP回显服务器
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	config := &safeudp.Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1}
+	sl, err := safeudp.ListenStream("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	go NewServer(target.Addr().String()).Serve(sl)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := NewClient(ctx, sl.Addr().String(), config, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go c.Serve(local)
+
+	// 多个并发连接各自回显
+	errs := make(chan error, 4)
+	for i := range cap(errs) {
+		go func() {
+			conn, err := net.Dial("tcp", local.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			data := bytes.Repeat([]byte{byte(i)}, 100<<10)
+			go conn.Write(data)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				errs <- io.ErrUnexpectedEOF
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for range cap(errs) {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 /*
 @Author: Lzww
-@LastEditTime: 2025-9-9 20:27:32
+@LastEditTime: 2025-10-17 09:12:31
 @Description: Crypt
 @Language: Go 1.23.4
 */
@@ -8,7 +8,10 @@
 package safeudp
 
 import (
+	"net"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/ipv4"
@@ -16,8 +19,32 @@ import (
 
 // tx sends packets using the appropriate transmission method
 func (s *UDPSession) tx(txqueue []ipv4.Message) {
-	// Check if we have batch connection capability
-	if s.xconn != nil {
+	// Let the kernel read the buffers directly if enabled
+	if s.zeroCopy.Load() || s.zc != nil {
+		sent := s.zeroCopyTx(txqueue)
+		if txqueue = txqueue[sent:]; len(txqueue) == 0 {
+			return
+		}
+	}
+
+	// Let the kernel segment bulk sends if enabled, the rest falls back below
+	if s.gso.Load() {
+		sent := s.gsoTx(txqueue)
+		if txqueue = txqueue[sent:]; len(txqueue) == 0 {
+			return
+		}
+	}
+
+	// Submit the rest through io_uring if enabled
+	if r := s.uring.Load(); r != nil {
+		sent := s.uringTx(r, txqueue)
+		if txqueue = txqueue[sent:]; len(txqueue) == 0 {
+			return
+		}
+	}
+
+	// Check if we have batch connection capability, and it is not backing off after a failure
+	if s.xconn != nil && (s.xconnWriteError == nil || !time.Now().Before(s.xconnRetry)) {
 		s.batchTx(txqueue)
 	} else {
 		s.defaultTx(txqueue)
@@ -28,7 +55,11 @@ func (s *UDPSession) defaultTx(txqueue []ipv4.Message) {
 	nbytes, npkts := 0, 0
 
 	for k := range txqueue {
-		if n, err := s.conn.WriteTo(txqueue[k].Buffers[0], txqueue[k].Addr); err == nil {
+		n, err := 0, faultWrite()
+		if err == nil {
+			n, err = s.writeMsg(&txqueue[k])
+		}
+		if err == nil {
 			nbytes += n
 			npkts++
 		} else {
@@ -37,23 +68,159 @@ func (s *UDPSession) defaultTx(txqueue []ipv4.Message) {
 		}
 	}
 
-	atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
-	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+	atomic.AddUint64(&s.Snmp().OutPkts, uint64(npkts))
+	atomic.AddUint64(&s.stats.OutPkts, uint64(npkts))
+	atomic.AddUint64(&s.Snmp().OutBytes, uint64(nbytes))
+	atomic.AddUint64(&s.stats.OutBytes, uint64(nbytes))
+}
+
+// writeMsg sends a packet with the control message pinning its source
+// address, if any
+func (s *UDPSession) writeMsg(msg *ipv4.Message) (int, error) {
+	if len(msg.OOB) > 0 {
+		if uc, ok := s.conn.(*net.UDPConn); ok {
+			if ua, ok := msg.Addr.(*net.UDPAddr); ok {
+				n, _, err := uc.WriteMsgUDP(msg.Buffers[0], msg.OOB, ua)
+				return n, err
+			}
+		}
+	}
+	return s.conn.WriteTo(msg.Buffers[0], msg.Addr)
 }
 
 func (s *UDPSession) batchTx(txqueue []ipv4.Message) {
 	nbytes, npkts := 0, 0
 
-	if _, err := s.xconn.WriteBatch(txqueue, 0); err == nil {
-		for k := range txqueue {
-			nbytes += len(txqueue[k].Buffers[0])
+	n, err := 0, faultWrite()
+	if err == nil {
+		n, err = s.xconn.WriteBatch(txqueue, 0)
+	}
+	for k := range txqueue[:max(n, 0)] {
+		nbytes += len(txqueue[k].Buffers[0])
+	}
+	npkts = max(n, 0)
+	atomic.AddUint64(&s.Snmp().OutPkts, uint64(npkts))
+	atomic.AddUint64(&s.stats.OutPkts, uint64(npkts))
+	atomic.AddUint64(&s.Snmp().OutBytes, uint64(nbytes))
+	atomic.AddUint64(&s.stats.OutBytes, uint64(nbytes))
+
+	if err == nil {
+		if s.xconnWriteError != nil {
+			s.logEvent("batch send restored")
+			s.xconnWriteError, s.xconnBackoff = nil, 0
 		}
-		npkts = len(txqueue)
-		atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
-		atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
-	} else {
-		// fall back to default transmission method
-		s.xconnWriteError = err
-		s.defaultTx(txqueue)
+		return
+	}
+
+	// fall back to default transmission method for the rest, and use it until
+	// the next probe
+	class := classifyBatchError(err)
+	atomic.AddUint64(&s.Snmp().BatchTxFallbacks, 1)
+	atomic.AddUint64(&s.stats.BatchTxFallbacks, 1)
+	switch class {
+	case batchErrUnsupported:
+		atomic.AddUint64(&s.Snmp().BatchTxUnsupported, 1)
+		atomic.AddUint64(&s.stats.BatchTxUnsupported, 1)
+	case batchErrTransient:
+		atomic.AddUint64(&s.Snmp().BatchTxTransient, 1)
+		atomic.AddUint64(&s.stats.BatchTxTransient, 1)
+	}
+
+	switch {
+	case class == batchErrTransient:
+		s.xconnBackoff = batchRetryMin
+	case s.xconnBackoff == 0:
+		s.xconnBackoff = batchRetryMin
+	default:
+		s.xconnBackoff = min(s.xconnBackoff*2, batchRetryMax)
 	}
+	if s.xconnWriteError == nil {
+		s.logEvent("batch send failed (%v): %v", class, err)
+	}
+	s.xconnWriteError = err
+	s.xconnRetry = time.Now().Add(s.xconnBackoff)
+	s.defaultTx(txqueue[max(n, 0):])
+}
+
+const (
+	batchRetryMin = 100 * time.Millisecond // first probe of batch sends after a failure
+	batchRetryMax = 30 * time.Second       // probe interval of batch sends failing repeatedly
+)
+
+// batchErrClass tells why a batch send failed
+type batchErrClass int
+
+const (
+	batchErrOther       batchErrClass = iota
+	batchErrUnsupported               // the socket or platform cannot send batches
+	batchErrTransient                 // out of buffers or would block, likely to pass
+)
+
+func (c batchErrClass) String() string {
+	switch c {
+	case batchErrUnsupported:
+		return "unsupported"
+	case batchErrTransient:
+		return "transient"
+	default:
+		return "other"
+	}
+}
+
+func classifyBatchError(err error) batchErrClass {
+	var ne net.Error
+	switch {
+	case errors.Is(err, syscall.ENOSYS), errors.Is(err, syscall.EOPNOTSUPP):
+		return batchErrUnsupported
+	case errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.ENOMEM),
+		errors.As(err, &ne) && ne.Timeout():
+		return batchErrTransient
+	default:
+		return batchErrOther
+	}
+}
+
+// SetGSO enables UDP generic segmentation offload on linux, consecutive packets
+// to the same address are passed to the kernel as one super packet, which cuts
+// the per-packet cost of bulk sends further than batching.
+//
+// It returns false if the socket or the kernel does not support it. GSO is
+// turned off for the session if a send fails, such as on a device without
+// checksum offload, and packets are sent one by one or in batches again.
+func (s *UDPSession) SetGSO(enable bool) bool {
+	if !enable {
+		s.gso.Store(false)
+		return true
+	}
+
+	conn, ok := s.conn.(*net.UDPConn)
+	if !ok || !gsoSupported(conn) {
+		return false
+	}
+	s.gso.Store(true)
+	return true
 }
+
+// GetGSO reports whether generic segmentation offload is in use
+func (s *UDPSession) GetGSO() bool { return s.gso.Load() }
+
+// SetZeroCopy enables MSG_ZEROCOPY transmission on linux, the kernel sends
+// packets from the buffers of the session instead of copying them, and the
+// buffers are held until it reports their completion. It pays off for large
+// packets on high-throughput links, for small packets the completions cost
+// more than the copy.
+//
+// It returns false if the socket or the kernel does not support it, or if the
+// session is accepted from a Listener, whose sessions share the error queue of
+// its socket and could not tell their completions apart. Zero copy is turned
+// off for the session if a send fails.
+func (s *UDPSession) SetZeroCopy(enable bool) bool {
+	if enable && (s.l != nil || !enableZeroCopy(s.conn)) {
+		return false
+	}
+	s.zeroCopy.Store(enable)
+	return true
+}
+
+// GetZeroCopy reports whether zero copy transmission is in use
+func (s *UDPSession) GetZeroCopy() bool { return s.zeroCopy.Load() }
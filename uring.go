@@ -0,0 +1,142 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 11:26:03
+@Description: Selection of the io_uring backend of sessions
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
+
+// errIORing is returned by the receives of a ring which is closed or failed,
+// the read loops receive with recvmmsg again
+var errIORing = errors.New("io_uring failed")
+
+// SetIOUring sends and receives the packets of the session through io_uring on
+// linux, a system call submits a batch of sends or receives and collects their
+// completions, where sendmmsg and recvmmsg would be used otherwise. The read
+// loop waits for packets in the netpoller of the Go runtime as with recvmmsg,
+// so read deadlines and Close interrupt it.
+// A client session sets up a ring of its own, an accepted session uses the
+// ring of its Listener, see Listener.SetIOUring.
+//
+// It returns false if the socket is not a UDP socket or io_uring cannot be
+// set up, such as on other platforms, old kernels or where it is disabled.
+// io_uring is turned off for the session if a send fails for a reason other
+// than full buffers, or if the ring fails to receive, and packets are sent and
+// received in batches again.
+func (s *UDPSession) SetIOUring(enable bool) bool {
+	if !enable {
+		if old := s.uring.Swap(nil); old != nil && s.l == nil {
+			old.close()
+		}
+		return true
+	}
+	if _, ok := s.conn.(*net.UDPConn); !ok {
+		return false
+	}
+	if s.l != nil {
+		r := s.l.uring.Load()
+		if r == nil {
+			return false
+		}
+		s.uring.Store(r)
+		return true
+	}
+	r, err := newIORing()
+	if err != nil {
+		return false
+	}
+	if old := s.uring.Swap(r); old != nil {
+		old.close()
+	}
+	return true
+}
+
+// GetIOUring reports whether the session sends and receives through io_uring
+func (s *UDPSession) GetIOUring() bool { return s.uring.Load() != nil }
+
+// SetIOUring sets up an io_uring shared by the sessions of the listener to
+// send their packets, and by the listener to receive them, see
+// UDPSession.SetIOUring, including the sessions accepted afterwards. It returns false if io_uring is unavailable, false
+// turns it off for all sessions.
+func (l *Listener) SetIOUring(enable bool) bool {
+	var r *ioRing
+	if enable {
+		if _, ok := l.conn.(*net.UDPConn); !ok {
+			return false
+		}
+		var err error
+		if r, err = newIORing(); err != nil {
+			return false
+		}
+	}
+	old := l.uring.Swap(r)
+	l.RangeSessions(func(s *UDPSession) bool {
+		s.uring.Store(r)
+		return true
+	})
+	if old != nil {
+		old.close()
+	}
+	return true
+}
+
+// releaseIORing closes the ring of a client session or a listener
+func releaseIORing(p *atomic.Pointer[ioRing]) {
+	if r := p.Swap(nil); r != nil {
+		r.close()
+	}
+}
+
+// uringTx sends packets through the ring, and returns the number sent
+func (s *UDPSession) uringTx(r *ioRing, txqueue []ipv4.Message) int {
+	n, err := 0, faultWrite()
+	if err == nil {
+		n, err = r.send(s.conn.(*net.UDPConn), txqueue)
+	}
+	nbytes := 0
+	for k := range txqueue[:n] {
+		nbytes += len(txqueue[k].Buffers[0])
+	}
+	atomic.AddUint64(&s.Snmp().OutPkts, uint64(n))
+	atomic.AddUint64(&s.stats.OutPkts, uint64(n))
+	atomic.AddUint64(&s.Snmp().OutBytes, uint64(nbytes))
+	atomic.AddUint64(&s.stats.OutBytes, uint64(nbytes))
+
+	if err != nil && classifyBatchError(err) != batchErrTransient {
+		s.turnOffIORing(r, err)
+	}
+	return n
+}
+
+// turnOffIORing stops using the ring 'r' of the session after it failed, the
+// ring of a listener stays with the listener
+func (s *UDPSession) turnOffIORing(r *ioRing, err error) {
+	if s.uring.CompareAndSwap(r, nil) {
+		s.logEvent("io_uring failed, turned off: %v", err)
+		if s.l == nil {
+			r.close()
+		}
+	}
+}
+
+// turnOffIORing stops using the ring 'r' of the listener and its sessions
+// after it failed to receive
+func (l *Listener) turnOffIORing(r *ioRing) {
+	if !l.uring.CompareAndSwap(r, nil) {
+		return
+	}
+	l.RangeSessions(func(s *UDPSession) bool {
+		s.uring.CompareAndSwap(r, nil)
+		return true
+	})
+	r.close()
+}
@@ -0,0 +1,354 @@
+//go:build linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 11:26:03
+@Description: io_uring backend of the sends and receives
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	uringEntries = 64 // submission queue entries, a batch is submitted in chunks of this
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringOpSendmsg    = 9
+	uringOpRecvmsg    = 10
+	uringSQELink      = 1 << 2 // IOSQE_IO_LINK, the next entry runs after this one succeeds
+	uringEnterGetEvts = 1 << 0 // IORING_ENTER_GETEVENTS
+	uringSQESize      = 64
+	uringCQESize      = 16
+)
+
+// uringParams is struct io_uring_params
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQOffsets
+	cqOff                                                                  uringCQOffsets
+}
+
+// uringSQOffsets is struct io_sqring_offsets
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// uringCQOffsets is struct io_cqring_offsets
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// ioRing is an io_uring instance sending and receiving the packets of
+// sessions, safe for concurrent use. Receives do not wait in the ring: the read
+// loops wait for the socket to be readable in the netpoller of the Go runtime,
+// where the deadlines and Close interrupt them as they do recvmmsg.
+type ioRing struct {
+	mu     sync.Mutex
+	fd     int
+	closed bool
+
+	sq, cq, sqes []byte // mappings of the rings and the submission entries
+	sqTail       *uint32
+	sqMask       uint32
+	sqArray      unsafe.Pointer
+	cqHead       *uint32
+	cqTail       *uint32
+	cqMask       uint32
+	cqes         unsafe.Pointer
+
+	// the messages of a chunk, kept in place until it completes
+	hdrs  [uringEntries]unix.Msghdr
+	iovs  [uringEntries]unix.Iovec
+	names [uringEntries]unix.RawSockaddrInet6
+	res   [uringEntries]int32 // results of the entries of a chunk
+}
+
+// newIORing sets up an io_uring, it fails on kernels without io_uring or
+// where it is disabled
+func newIORing() (*ioRing, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errors.WithStack(errno)
+	}
+	r := &ioRing{fd: int(fd)}
+
+	var err error
+	if r.sq, err = unix.Mmap(r.fd, uringOffSQRing, int(p.sqOff.array+p.sqEntries*4), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, errors.WithStack(err)
+	}
+	if r.cq, err = unix.Mmap(r.fd, uringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uringCQESize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, errors.WithStack(err)
+	}
+	if r.sqes, err = unix.Mmap(r.fd, uringOffSQEs, int(p.sqEntries*uringSQESize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		r.close()
+		return nil, errors.WithStack(err)
+	}
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sq[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sq[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Pointer(&r.sq[p.sqOff.array])
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cq[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cq[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cq[p.cqOff.ringMask]))
+	r.cqes = unsafe.Pointer(&r.cq[p.cqOff.cqes])
+	return r, nil
+}
+
+// close releases the ring, sends and receives fail afterwards
+func (r *ioRing) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	for _, m := range [][]byte{r.sq, r.cq, r.sqes} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	unix.Close(r.fd)
+}
+
+// send sends the packets on the UDP socket 'conn' in order, with a system
+// call per chunk of uringEntries. It returns the number of packets sent
+// before the first failure.
+func (r *ioRing) send(conn *net.UDPConn, msgs []ipv4.Message) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	v6 := true
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		v6 = false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, errors.WithStack(net.ErrClosed)
+	}
+	sent := 0
+	for sent < len(msgs) && err == nil {
+		chunk := msgs[sent:min(len(msgs), sent+uringEntries)]
+		var n int
+		if ctlErr := rc.Control(func(fd uintptr) { n, err = r.sendChunk(int(fd), chunk, v6) }); ctlErr != nil {
+			return sent, errors.WithStack(ctlErr)
+		}
+		sent += n
+	}
+	return sent, err
+}
+
+// sendChunk submits a chunk of linked sends on 'fd' and waits for their
+// completions, the caller holds the lock
+func (r *ioRing) sendChunk(fd int, msgs []ipv4.Message, v6 bool) (int, error) {
+	tail := atomic.LoadUint32(r.sqTail)
+	for i := range msgs {
+		hdr, iov := &r.hdrs[i], &r.iovs[i]
+		buf := msgs[i].Buffers[0]
+		iov.Base = unsafe.SliceData(buf)
+		iov.SetLen(len(buf))
+		*hdr = unix.Msghdr{Iov: iov, Iovlen: 1}
+		if namelen := r.putName(i, msgs[i].Addr, v6); namelen > 0 {
+			hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+			hdr.Namelen = namelen
+		}
+		if oob := msgs[i].OOB; len(oob) > 0 {
+			hdr.Control = unsafe.SliceData(oob)
+			hdr.SetControllen(len(oob))
+		}
+		r.prepare(tail, i, len(msgs), uringOpSendmsg, fd, hdr, 0)
+	}
+
+	sent, err := r.submit(tail, len(msgs))
+	runtime.KeepAlive(msgs)
+	return max(sent, 0), err
+}
+
+// recv receives up to uringEntries packets on the UDP socket 'conn' into
+// 'msgs' with a system call, and returns the number received. The receives
+// do not wait for packets, the goroutine waits for the socket to be readable
+// in the netpoller, so the read deadline and Close of 'conn' interrupt it. It
+// fails with errIORing if the ring is closed or fails, rather than the socket.
+func (r *ioRing) recv(conn *net.UDPConn, msgs []ipv4.Message) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	msgs = msgs[:min(len(msgs), uringEntries)]
+
+	var n int
+	var recvErr error
+	if err := rc.Read(func(fd uintptr) bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.closed {
+			n, recvErr = 0, errors.Wrap(errIORing, "closed")
+			return true
+		}
+		n, recvErr = r.recvChunk(int(fd), msgs)
+		return n > 0 || recvErr != nil // nothing to read, wait until readable
+	}); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return n, recvErr
+}
+
+// recvChunk submits a chunk of linked receives on 'fd' which find no packet
+// rather than wait for one, and collects their completions, the caller holds
+// the lock. A receive which finds no packet cancels those linked after it.
+func (r *ioRing) recvChunk(fd int, msgs []ipv4.Message) (int, error) {
+	tail := atomic.LoadUint32(r.sqTail)
+	for i := range msgs {
+		hdr, iov := &r.hdrs[i], &r.iovs[i]
+		buf := msgs[i].Buffers[0]
+		iov.Base = unsafe.SliceData(buf)
+		iov.SetLen(len(buf))
+		*hdr = unix.Msghdr{Iov: iov, Iovlen: 1, Name: (*byte)(unsafe.Pointer(&r.names[i])), Namelen: unix.SizeofSockaddrInet6}
+		if oob := msgs[i].OOB; len(oob) > 0 {
+			hdr.Control = unsafe.SliceData(oob)
+			hdr.SetControllen(len(oob))
+		}
+		r.prepare(tail, i, len(msgs), uringOpRecvmsg, fd, hdr, unix.MSG_DONTWAIT)
+	}
+
+	received, err := r.submit(tail, len(msgs))
+	runtime.KeepAlive(msgs)
+	if received < 0 {
+		return 0, errors.Wrap(errIORing, err.Error())
+	}
+	for i := range msgs[:received] {
+		msgs[i].N = int(r.res[i])
+		msgs[i].NN = int(r.hdrs[i].Controllen)
+		msgs[i].Flags = int(r.hdrs[i].Flags)
+		msgs[i].Addr = r.name(i)
+	}
+	if received > 0 || errors.Is(err, syscall.EAGAIN) {
+		return received, nil // a failure after the first packet surfaces with the next chunk
+	}
+	return 0, err
+}
+
+// prepare fills the submission entry 'i' of a chunk of 'count' entries from
+// 'tail', for the message 'hdr' on 'fd', linked to the next entry
+func (r *ioRing) prepare(tail uint32, i, count int, op byte, fd int, hdr *unix.Msghdr, msgFlags uint32) {
+	idx := (tail + uint32(i)) & r.sqMask
+	sqe := r.sqes[idx*uringSQESize : (idx+1)*uringSQESize]
+	clear(sqe)
+	sqe[0] = op
+	if i < count-1 {
+		sqe[1] = uringSQELink
+	}
+	*(*int32)(unsafe.Pointer(&sqe[4])) = int32(fd)
+	*(*uint64)(unsafe.Pointer(&sqe[16])) = uint64(uintptr(unsafe.Pointer(hdr)))
+	*(*uint32)(unsafe.Pointer(&sqe[24])) = 1
+	*(*uint32)(unsafe.Pointer(&sqe[28])) = msgFlags
+	*(*uint64)(unsafe.Pointer(&sqe[32])) = uint64(i)
+	*(*uint32)(unsafe.Add(r.sqArray, 4*idx)) = idx
+}
+
+// submit submits the 'count' entries prepared from 'tail', then waits until
+// every entry completed, with their results in r.res. It returns the index of
+// the first entry which failed and its error, 'count' if none did, or -1 if
+// the entries could not be submitted.
+func (r *ioRing) submit(tail uint32, count int) (int, error) {
+	atomic.StoreUint32(r.sqTail, tail+uint32(count))
+
+	toSubmit, done := count, 0
+	failed := count
+	var first error
+	for done < count {
+		submitted, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), 1, uringEnterGetEvts, 0, 0)
+		switch {
+		case errno == 0:
+			toSubmit -= int(submitted)
+		case toSubmit == count && errno != syscall.EINTR:
+			// nothing was submitted, take the entries back
+			atomic.StoreUint32(r.sqTail, tail)
+			return -1, errors.WithStack(errno)
+		default:
+			// entries are in flight and reference the messages, submit the
+			// rest again and wait for all of them
+		}
+		head := atomic.LoadUint32(r.cqHead)
+		for ; head != atomic.LoadUint32(r.cqTail); head++ {
+			cqe := unsafe.Add(r.cqes, uringCQESize*(head&r.cqMask))
+			i := int(*(*uint64)(cqe))
+			res := *(*int32)(unsafe.Add(cqe, 8))
+			r.res[i] = res
+			if res < 0 && i < failed {
+				failed, first = i, syscall.Errno(-res)
+			}
+			done++
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+	if first != nil {
+		return failed, errors.WithStack(first)
+	}
+	return failed, nil
+}
+
+// name returns the source address of the message 'i' received
+func (r *ioRing) name(i int) net.Addr {
+	sa := &r.names[i]
+	if sa.Family == unix.AF_INET {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		p := (*[2]byte)(unsafe.Pointer(&sa4.Port))
+		return &net.UDPAddr{IP: net.IPv4(sa4.Addr[0], sa4.Addr[1], sa4.Addr[2], sa4.Addr[3]), Port: int(p[0])<<8 | int(p[1])}
+	}
+	p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	addr := &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: int(p[0])<<8 | int(p[1])}
+	if sa.Scope_id != 0 {
+		if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+			addr.Zone = ifi.Name
+		}
+	}
+	return addr
+}
+
+// putName fills the address of message 'i' for a socket of the family, and
+// returns its length, 0 without an address
+func (r *ioRing) putName(i int, addr net.Addr, v6 bool) uint32 {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0
+	}
+	port := uint16(ua.Port)
+	if !v6 {
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&r.names[i]))
+		*sa = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		copy(sa.Addr[:], ua.IP.To4())
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		p[0], p[1] = byte(port>>8), byte(port)
+		return unix.SizeofSockaddrInet4
+	}
+	sa := &r.names[i]
+	*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	copy(sa.Addr[:], ua.IP.To16())
+	p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	p[0], p[1] = byte(port>>8), byte(port)
+	return unix.SizeofSockaddrInet6
+}
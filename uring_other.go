@@ -0,0 +1,35 @@
+//go:build !linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-18 11:26:03
+@Description: Sends and receives through io_uring, unsupported
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
+
+// ioRing is an io_uring instance, unused
+type ioRing struct{}
+
+// newIORing fails, io_uring is linux only
+func newIORing() (*ioRing, error) { return nil, errors.New("io_uring is only available on linux") }
+
+func (r *ioRing) close() {}
+
+// send never sends, a ring cannot be set up
+func (r *ioRing) send(conn *net.UDPConn, msgs []ipv4.Message) (int, error) {
+	return 0, errors.New("io_uring is only available on linux")
+}
+
+// recv never receives, a ring cannot be set up
+func (r *ioRing) recv(conn *net.UDPConn, msgs []ipv4.Message) (int, error) {
+	return 0, errors.Wrap(errIORing, "only available on linux")
+}
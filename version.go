@@ -0,0 +1,210 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 11:08:19
+@Description: Negotiation of the protocol version
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// versionMagic leads the data of IKCP_CMD_VERSION segments, followed by the
+// versions offered by the client, or the one chosen by the server, a byte each
+const versionMagic = "SUDP"
+
+// versionCompressed follows the versions of an offer or a choice if the peer
+// compresses with a Compressor, servers predating it skip it as an unknown
+// version
+const versionCompressed byte = 0xc0
+
+// Version is a version of the wire format
+type Version uint8
+
+const (
+	// Version1 is the kcp-go compatible format, spoken by peers which do not
+	// negotiate
+	Version1 Version = 1
+)
+
+// supportedVersions lists the versions of this implementation, newest last
+var supportedVersions = []Version{Version1}
+
+// SupportedVersions returns the protocol versions of this implementation,
+// newest last.
+func SupportedVersions() []Version {
+	return slices.Clone(supportedVersions)
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d", uint8(v))
+}
+
+// MarshalText and UnmarshalText encode the version as "v1" in config files
+func (v Version) MarshalText() ([]byte, error) { return []byte(v.String()), nil }
+
+func (v *Version) UnmarshalText(text []byte) error {
+	n, err := strconv.ParseUint(strings.TrimPrefix(string(text), "v"), 10, 8)
+	if err != nil || !bytes.HasPrefix(text, []byte("v")) {
+		return errors.Errorf("invalid protocol version %q", text)
+	}
+	*v = Version(n)
+	return nil
+}
+
+// checkVersions fails on versions this implementation does not support
+func checkVersions(versions []Version) error {
+	for _, v := range versions {
+		if !slices.Contains(supportedVersions, v) {
+			return errors.Errorf("unsupported protocol version %v", v)
+		}
+	}
+	return nil
+}
+
+// SetVersions makes a client session negotiate the protocol version with the
+// server, offering 'versions' in order of preference, before its first write.
+// The offer leads every packet until the server chooses, and reads and writes
+// fail with ErrVersion if the server supports none of them. No versions, the
+// default, skips the negotiation and speaks Version1, as servers released
+// before the negotiation drop the packets carrying an offer.
+//
+// A session with a Compressor, set before, offers compression along, and the
+// negotiation fails unless the server compresses too, as it does unless the
+// client offers it.
+//
+// Servers answer offers without any setting, see Listener.SetVersions.
+func (s *UDPSession) SetVersions(versions ...Version) error {
+	if s.l != nil {
+		return errors.New("versions are offered by the client")
+	}
+	if err := checkVersions(versions); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versionOffer, s.kcp.version, s.kcp.version_repeat = nil, nil, false
+	if len(versions) > 0 {
+		s.versionOffer = slices.Clone(versions)
+		offer := []byte(versionMagic)
+		for _, v := range versions {
+			offer = append(offer, byte(v))
+		}
+		if s.compression() != nil {
+			offer = append(offer, versionCompressed)
+		}
+		s.kcp.version, s.kcp.version_repeat = offer, true
+	}
+	return nil
+}
+
+// Version returns the protocol version of the session, Version1 until a
+// version has been negotiated or if none was.
+func (s *UDPSession) Version() Version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.version == 0 {
+		return Version1
+	}
+	return s.version
+}
+
+// SetVersions restricts the protocol versions the listener accepts in the
+// offers of clients, all the supported versions by default. Clients which do
+// not negotiate are accepted regardless.
+func (l *Listener) SetVersions(versions ...Version) error {
+	if err := checkVersions(versions); err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		l.versions.Store(nil)
+	} else {
+		versions = slices.Clone(versions)
+		l.versions.Store(&versions)
+	}
+	return nil
+}
+
+// onVersion is invoked by KCP with the session lock held, with the offer of
+// the client on the server, or the choice of the server on the client. It
+// returns false if the negotiation failed, and the packet must be dropped.
+func (s *UDPSession) onVersion(data []byte) bool {
+	valid := bytes.HasPrefix(data, []byte(versionMagic))
+	if s.l == nil {
+		if s.versionOffer == nil {
+			return true
+		}
+		offer := s.versionOffer
+		s.versionOffer = nil
+		s.kcp.version, s.kcp.version_repeat = nil, false
+		if !valid || len(data) < len(versionMagic)+1 || !slices.Contains(offer, Version(data[len(versionMagic)])) {
+			s.versionFailed(errors.Wrapf(ErrVersion, "server supports none of %v, or compresses otherwise", offer))
+			return false
+		}
+		compressed := bytes.Equal(data[len(versionMagic)+1:], []byte{versionCompressed})
+		if compressed != (s.compression() != nil) || len(data) > len(versionMagic)+2 {
+			s.versionFailed(errors.Wrap(ErrVersion, "compression differs from the server's"))
+			return false
+		}
+		s.version = Version(data[len(versionMagic)])
+		s.traceEvent(TraceHandshake, "protocol %v negotiated", s.version)
+		return true
+	}
+
+	// the first version of the offer the listener accepts, a repeated offer
+	// gets the same answer
+	accepted := supportedVersions
+	if versions := s.l.versions.Load(); versions != nil {
+		accepted = *versions
+	}
+	var choice Version
+	if valid {
+		for _, b := range data[len(versionMagic):] {
+			if slices.Contains(accepted, Version(b)) {
+				choice = Version(b)
+				break
+			}
+		}
+	}
+	compressed := s.compression() != nil
+	agreed := !valid || compressed == bytes.Contains(data[len(versionMagic):], []byte{versionCompressed})
+
+	reply := []byte(versionMagic)
+	if choice != 0 && agreed {
+		reply = append(reply, byte(choice))
+		if compressed {
+			reply = append(reply, versionCompressed)
+		}
+	}
+	s.kcp.version = reply
+	if choice == 0 {
+		s.versionFailed(errors.Wrapf(ErrVersion, "client offered none of %v", accepted))
+		return false
+	}
+	if !agreed {
+		s.versionFailed(errors.Wrap(ErrVersion, "compression differs from the client's"))
+		return false
+	}
+	if s.version == 0 {
+		s.version = choice
+		s.traceEvent(TraceHandshake, "protocol %v negotiated", choice)
+	}
+	return true
+}
+
+// versionFailed fails the reads and writes of the session after the version
+// negotiation failed
+func (s *UDPSession) versionFailed(err error) {
+	s.logEvent("%v", err)
+	s.notifyReadError(err)
+	s.notifyWriteError(err)
+}
@@ -0,0 +1,86 @@
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-22 09:41:16
+@Description: Policies for large writes
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+// WritePolicy selects how Write handles data larger than the free send window
+type WritePolicy int
+
+const (
+	// WriteChunk splits the data into segments and enqueues all of them once the
+	// send window has room for one segment, the send queue may grow beyond the
+	// window. Remote reads the data as a stream of segments. This is the default.
+	WriteChunk WritePolicy = iota
+
+	// WriteMessage sends each Write as a single message, a remote Read returns
+	// it as a whole. Writes larger than MaxMessageSize fail with ErrMsgTooLarge,
+	// and remote needs a receive window at least as large as the message.
+	WriteMessage
+
+	// WritePartial enqueues the part of the data which fits in the free send
+	// window, blocking until at least one segment fits, and returns the bytes
+	// written with io.ErrShortWrite if that is not all of it.
+	WritePartial
+)
+
+// maxMessageFragments is the largest number of fragments of a message, the frg field is a byte
+const maxMessageFragments = 255
+
+// SetWritePolicy sets how Write, WriteBuffers and WriteAsync handle data larger
+// than the free send window, the policy should not be changed while writing.
+//
+// WriteMessage requires message mode, it turns the deprecated stream mode off.
+func (s *UDPSession) SetWritePolicy(policy WritePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writePolicy = policy
+	if policy == WriteMessage {
+		s.kcp.stream = 0
+	}
+}
+
+// GetWritePolicy returns the write policy of the session
+func (s *UDPSession) GetWritePolicy() WritePolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writePolicy
+}
+
+// MaxMessageSize returns the largest Write accepted under WriteMessage, it
+// depends on the MTU and the send window.
+func (s *UDPSession) MaxMessageSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxMessageSegments(true) * int(s.kcp.mss)
+}
+
+// maxMessageSegments returns the largest number of segments written at once,
+// the caller must hold the session lock.
+func (s *UDPSession) maxMessageSegments(message bool) int {
+	if message {
+		return min(int(s.kcp.snd_wnd), maxMessageFragments)
+	}
+	return int(s.kcp.snd_wnd)
+}
+
+// splitSegments splits 'v' after the data of 'segments' segments, each buffer is
+// split into segments on its own, the caller must hold the session lock.
+func (s *UDPSession) splitSegments(v [][]byte, segments int) (head, tail [][]byte) {
+	mss := int(s.kcp.mss)
+	for i, b := range v {
+		count := (len(b) + mss - 1) / mss
+		if count <= segments {
+			segments -= count
+			continue
+		}
+
+		head = append(v[:i:i], b[:segments*mss])
+		tail = append([][]byte{b[segments*mss:]}, v[i+1:]...)
+		return head, tail
+	}
+	return v, nil
+}
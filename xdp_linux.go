@@ -0,0 +1,452 @@
+//go:build linux && safeudp_xdp
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-17 23:45:20
+@Description: Experimental AF_XDP receive path of listeners
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// xdpEnabled is true in builds with the safeudp_xdp tag on linux
+const xdpEnabled = true
+
+const (
+	xdpFrames    = 2048 // UMEM frames per queue, also the size of the fill and rx rings
+	xdpFrameSize = 2048 // bytes per frame, an MTU sized packet and the XDP headroom
+	xdpPollMs    = 100  // poll timeout, the receive loops notice a closed listener within it
+
+	xdpPass        = 2  // XDP_PASS
+	bpfRedirectMap = 51 // helper bpf_redirect_map
+	bpfPseudoMapFD = 1  // BPF_PSEUDO_MAP_FD
+)
+
+// xdpReceiver is the AF_XDP receive path of a listener
+type xdpReceiver struct {
+	prog, xskmap, link int            // the program, its map of sockets, and its attachment
+	queues             []*xdpSocket   // a socket per receive queue
+	wg                 sync.WaitGroup // the receive loops
+
+	ifindex uint32 // interface of the program
+	pktinfo bool   // destinations are passed on, for a listener on a wildcard address
+	v6      bool   // destinations are v4-mapped, for an IPv6 socket
+
+	received atomic.Uint64 // datagrams received through the sockets
+}
+
+// xdpSocket is an AF_XDP socket on a receive queue with its UMEM and rings
+type xdpSocket struct {
+	fd   int
+	umem []byte
+	rx   xdpRing // descriptors of received frames, produced by the kernel
+	fill xdpRing // frames handed to the kernel to receive into
+	maps [][]byte
+}
+
+// xdpRing is a ring shared with the kernel
+type xdpRing struct {
+	producer, consumer *uint32
+	desc               unsafe.Pointer
+	mask               uint32
+}
+
+// startXDP attaches an XDP program to the first 'queues' receive queues of
+// 'iface' which redirects the UDP packets to the port of the listener into
+// AF_XDP sockets, and starts a receive loop per queue. Other packets go on
+// to the kernel.
+func (l *Listener) startXDP(iface string, queues int) error {
+	udpaddr, ok := l.conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return errors.New("AF_XDP needs a UDP socket")
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	x := &xdpReceiver{prog: -1, xskmap: -1, link: -1, ifindex: uint32(ifi.Index)}
+	x.pktinfo, x.v6 = udpaddr.IP.IsUnspecified(), udpaddr.IP.To4() == nil
+	if err := x.setup(ifi.Index, queues, uint16(udpaddr.Port)); err != nil {
+		x.close()
+		return err
+	}
+	l.xdp = x
+
+	x.wg.Add(len(x.queues))
+	for _, q := range x.queues {
+		go l.xdpLoop(x, q, cloneBlock(l.block))
+	}
+	go func() {
+		// the loops return within a poll timeout, the rings are released after
+		x.wg.Wait()
+		x.close()
+	}()
+	return nil
+}
+
+// setup creates the sockets, the map and the program, and attaches it
+func (x *xdpReceiver) setup(ifindex, queues int, port uint16) error {
+	var err error
+	if x.xskmap, err = bpfMapCreate(unix.BPF_MAP_TYPE_XSKMAP, 4, 4, uint32(queues)); err != nil {
+		return errors.Wrap(err, "create XSKMAP")
+	}
+	for q := 0; q < queues; q++ {
+		s, err := newXDPSocket(ifindex, q)
+		if err != nil {
+			return errors.Wrapf(err, "AF_XDP socket on queue %d", q)
+		}
+		x.queues = append(x.queues, s)
+		if err := bpfMapUpdate(x.xskmap, uint32(q), uint32(s.fd)); err != nil {
+			return errors.Wrap(err, "update XSKMAP")
+		}
+	}
+	if x.prog, err = bpfProgLoad(xdpProgram(x.xskmap, port)); err != nil {
+		return errors.Wrap(err, "load XDP program")
+	}
+	if x.link, err = bpfLinkCreate(x.prog, ifindex); err != nil {
+		return errors.Wrap(err, "attach XDP program")
+	}
+	return nil
+}
+
+// close detaches the program and releases everything
+func (x *xdpReceiver) close() {
+	for _, fd := range []int{x.link, x.prog, x.xskmap} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+	for _, s := range x.queues {
+		s.close()
+	}
+}
+
+// xdpLoop receives the frames of a queue and passes their datagrams to the
+// listener until it closes
+func (l *Listener) xdpLoop(x *xdpReceiver, s *xdpSocket, block BlockCrypt) {
+	defer x.wg.Done()
+	fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-l.die:
+			return
+		default:
+		}
+		if _, err := unix.Poll(fds, xdpPollMs); err != nil && err != unix.EINTR {
+			l.notifyReadError(errors.WithStack(err))
+			return
+		}
+
+		cons, prod := *s.rx.consumer, atomic.LoadUint32(s.rx.producer)
+		fill := *s.fill.producer
+		for ; cons != prod; cons++ {
+			desc := (*unix.XDPDesc)(unsafe.Add(s.rx.desc, 16*uintptr(cons&s.rx.mask)))
+			frame := s.umem[desc.Addr : desc.Addr+uint64(desc.Len)]
+			if data, addr, dst, ok := parseXDPFrame(frame); ok {
+				x.received.Add(1)
+				switch {
+				case !x.pktinfo:
+					dst = pktinfo{}
+				case x.v6:
+					dst.addr = netip.AddrFrom16(dst.addr.As16())
+				}
+				dst.ifindex = x.ifindex
+				if !l.toWorkers(data, addr, dst) {
+					l.packetInput(block, data, addr, dst)
+				}
+			}
+			*(*uint64)(unsafe.Add(s.fill.desc, 8*uintptr(fill&s.fill.mask))) = desc.Addr
+			fill++
+		}
+		atomic.StoreUint32(s.rx.consumer, cons)
+		atomic.StoreUint32(s.fill.producer, fill)
+	}
+}
+
+// parseXDPFrame returns the UDP payload of an Ethernet frame with its source
+// and destination, as the XDP program matched it
+func parseXDPFrame(frame []byte) (data []byte, addr net.Addr, dst pktinfo, ok bool) {
+	if len(frame) < 14 {
+		return nil, nil, dst, false
+	}
+	var src netip.Addr
+	var udp []byte
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case 0x0800:
+		ip := frame[14:]
+		if len(ip) < 28 || ip[0]&0xf != 5 || ip[9] != 17 {
+			return nil, nil, dst, false
+		}
+		src = netip.AddrFrom4([4]byte(ip[12:16]))
+		dst.addr = netip.AddrFrom4([4]byte(ip[16:20]))
+		udp = ip[20:]
+	case 0x86dd:
+		ip := frame[14:]
+		if len(ip) < 48 || ip[6] != 17 {
+			return nil, nil, dst, false
+		}
+		src = netip.AddrFrom16([16]byte(ip[8:24]))
+		dst.addr = netip.AddrFrom16([16]byte(ip[24:40]))
+		udp = ip[40:]
+	default:
+		return nil, nil, dst, false
+	}
+	size := int(binary.BigEndian.Uint16(udp[4:]))
+	if size < 8 || size > len(udp) {
+		return nil, nil, dst, false
+	}
+	addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(udp)))
+	return udp[8:size], addr, dst, true
+}
+
+// newXDPSocket creates an AF_XDP socket bound to queue 'q' of the interface,
+// with all the frames of its UMEM in the fill ring
+func newXDPSocket(ifindex, q int) (*xdpSocket, error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &xdpSocket{fd: fd}
+	fail := func(err error) (*xdpSocket, error) {
+		s.close()
+		return nil, errors.WithStack(err)
+	}
+
+	if s.umem, err = unix.Mmap(-1, 0, xdpFrames*xdpFrameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE); err != nil {
+		return fail(err)
+	}
+	reg := unix.XDPUmemReg{Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))), Len: uint64(len(s.umem)), Size: xdpFrameSize}
+	if err := setsockopt(fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fail(err)
+	}
+	for _, opt := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_RX_RING} {
+		size := uint32(xdpFrames)
+		if err := setsockopt(fd, opt, unsafe.Pointer(&size), 4); err != nil {
+			return fail(err)
+		}
+	}
+
+	var off unix.XDPMmapOffsets
+	size := uint32(unsafe.Sizeof(off))
+	if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS,
+		uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return fail(errno)
+	}
+	if s.rx, err = s.mapRing(off.Rx, unix.XDP_PGOFF_RX_RING, 16); err != nil {
+		return fail(err)
+	}
+	if s.fill, err = s.mapRing(off.Fr, unix.XDP_UMEM_PGOFF_FILL_RING, 8); err != nil {
+		return fail(err)
+	}
+	// the completion ring is required with the UMEM, it stays empty without sends
+	if _, err = s.mapRing(off.Cr, unix.XDP_UMEM_PGOFF_COMPLETION_RING, 8); err != nil {
+		return fail(err)
+	}
+
+	for i := uint32(0); i < xdpFrames; i++ {
+		*(*uint64)(unsafe.Add(s.fill.desc, 8*uintptr(i))) = uint64(i) * xdpFrameSize
+	}
+	atomic.StoreUint32(s.fill.producer, xdpFrames)
+
+	if err := unix.Bind(fd, &unix.SockaddrXDP{Ifindex: uint32(ifindex), QueueID: uint32(q)}); err != nil {
+		return fail(err)
+	}
+	return s, nil
+}
+
+// mapRing maps a ring of xdpFrames entries of 'entry' bytes
+func (s *xdpSocket) mapRing(off unix.XDPRingOffset, pgoff int64, entry uint64) (xdpRing, error) {
+	m, err := unix.Mmap(s.fd, pgoff, int(off.Desc+xdpFrames*entry), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return xdpRing{}, err
+	}
+	s.maps = append(s.maps, m)
+	return xdpRing{
+		producer: (*uint32)(unsafe.Pointer(&m[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&m[off.Consumer])),
+		desc:     unsafe.Pointer(&m[off.Desc]),
+		mask:     xdpFrames - 1,
+	}, nil
+}
+
+func (s *xdpSocket) close() {
+	unix.Close(s.fd)
+	for _, m := range s.maps {
+		unix.Munmap(m)
+	}
+	if s.umem != nil {
+		unix.Munmap(s.umem)
+	}
+}
+
+// setsockopt sets an SOL_XDP option
+func setsockopt(fd, opt int, val unsafe.Pointer, size uintptr) error {
+	if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(val), size, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// bpfInsn is an eBPF instruction
+type bpfInsn struct {
+	code uint8
+	regs uint8 // destination and source registers
+	off  int16
+	imm  int32
+}
+
+// bpfOp builds an instruction, the register nibbles follow the byte order
+func bpfOp(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	regs := src<<4 | dst
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		regs = dst<<4 | src
+	}
+	return bpfInsn{code, regs, off, imm}
+}
+
+// native16 returns the network order bytes of 'v' as a load of the program sees them
+func native16(v uint16) int32 {
+	return int32(binary.NativeEndian.Uint16([]byte{byte(v >> 8), byte(v)}))
+}
+
+// xdpProgram returns the program redirecting the UDP packets to 'port' into
+// the socket of their receive queue in 'xskmap', or passing them on to the
+// kernel if the queue has none. IPv4 packets with options or fragmented go
+// to the kernel too.
+func xdpProgram(xskmap int, port uint16) []bpfInsn {
+	const (
+		ldxW, ldxH, ldxB = 0x61, 0x69, 0x71
+		movX, movK, addK = 0xbf, 0xb7, 0x07
+		andK, jgtX, jeqK = 0x57, 0x2d, 0x15
+		jneK, ja, call   = 0x55, 0x05, 0x85
+		exit, ldImm64    = 0x95, 0x18
+	)
+	p := native16(port)
+	// the jumps are relative to the next instruction, the targets are marked
+	const pass, ipv6, redirect = 36, 23, 30
+	at := func(pc, target int) int16 { return int16(target - pc - 1) }
+	return []bpfInsn{
+		bpfOp(movX, 6, 1, 0, 0),                             // 0: r6 = ctx
+		bpfOp(ldxW, 2, 6, 0, 0),                             // 1: r2 = data
+		bpfOp(ldxW, 3, 6, 4, 0),                             // 2: r3 = data_end
+		bpfOp(movX, 4, 2, 0, 0),                             // 3
+		bpfOp(addK, 4, 0, 0, 14),                            // 4
+		bpfOp(jgtX, 4, 3, at(5, pass), 0),                   // 5: no Ethernet header
+		bpfOp(ldxH, 5, 2, 12, 0),                            // 6: ethertype
+		bpfOp(jeqK, 5, 0, at(7, ipv6), native16(0x86dd)),    // 7
+		bpfOp(jneK, 5, 0, at(8, pass), native16(0x0800)),    // 8
+		bpfOp(movX, 4, 2, 0, 0),                             // 9
+		bpfOp(addK, 4, 0, 0, 42),                            // 10
+		bpfOp(jgtX, 4, 3, at(11, pass), 0),                  // 11: no IPv4 and UDP headers
+		bpfOp(ldxB, 5, 2, 14, 0),                            // 12
+		bpfOp(andK, 5, 0, 0, 0xf),                           // 13
+		bpfOp(jneK, 5, 0, at(14, pass), 5),                  // 14: options
+		bpfOp(ldxB, 5, 2, 23, 0),                            // 15
+		bpfOp(jneK, 5, 0, at(16, pass), 17),                 // 16: not UDP
+		bpfOp(ldxH, 5, 2, 20, 0),                            // 17
+		bpfOp(andK, 5, 0, 0, native16(0x3fff)),              // 18
+		bpfOp(jneK, 5, 0, at(19, pass), 0),                  // 19: fragment
+		bpfOp(ldxH, 5, 2, 36, 0),                            // 20
+		bpfOp(jneK, 5, 0, at(21, pass), p),                  // 21: other port
+		bpfOp(ja, 0, 0, at(22, redirect), 0),                // 22
+		bpfOp(movX, 4, 2, 0, 0),                             // 23: ipv6
+		bpfOp(addK, 4, 0, 0, 62),                            // 24
+		bpfOp(jgtX, 4, 3, at(25, pass), 0),                  // 25: no IPv6 and UDP headers
+		bpfOp(ldxB, 5, 2, 20, 0),                            // 26
+		bpfOp(jneK, 5, 0, at(27, pass), 17),                 // 27: not UDP, or extension headers
+		bpfOp(ldxH, 5, 2, 56, 0),                            // 28
+		bpfOp(jneK, 5, 0, at(29, pass), p),                  // 29: other port
+		bpfOp(ldxW, 2, 6, 16, 0),                            // 30: redirect, r2 = rx_queue_index
+		bpfOp(ldImm64, 1, bpfPseudoMapFD, 0, int32(xskmap)), // 31: r1 = xskmap
+		bpfOp(0, 0, 0, 0, 0),                                // 32
+		bpfOp(movK, 3, 0, 0, xdpPass),                       // 33: without a socket on the queue
+		bpfOp(call, 0, 0, 0, bpfRedirectMap),                // 34
+		bpfOp(exit, 0, 0, 0, 0),                             // 35
+		bpfOp(movK, 0, 0, 0, xdpPass),                       // 36: pass
+		bpfOp(exit, 0, 0, 0, 0),                             // 37
+	}
+}
+
+// bpf invokes the bpf system call
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+func bpfMapCreate(mapType, keySize, valueSize, entries uint32) (int, error) {
+	attr := struct{ mapType, keySize, valueSize, maxEntries, flags uint32 }{mapType, keySize, valueSize, entries, 0}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapUpdate(fd int, key, value uint32) error {
+	attr := struct {
+		fd, _      uint32
+		key, value uint64
+		flags      uint64
+	}{fd: uint32(fd), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// bpfProgLoad loads an XDP program, with the log of the verifier in the error
+func bpfProgLoad(insns []bpfInsn) (int, error) {
+	license := []byte("Dual MIT/GPL\x00")
+	attr := struct {
+		progType, insnCnt  uint32
+		insns, license     uint64
+		logLevel, logSize  uint32
+		logBuf             uint64
+		kernVersion, flags uint32
+	}{
+		progType: unix.BPF_PROG_TYPE_XDP,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil || err == unix.EPERM {
+		return fd, err
+	}
+	log := make([]byte, 64<<10)
+	attr.logLevel, attr.logSize, attr.logBuf = 1, uint32(len(log)), uint64(uintptr(unsafe.Pointer(&log[0])))
+	if fd, err = bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err == nil {
+		return fd, nil
+	}
+	if n := bytesIndexZero(log); n > 0 {
+		return -1, errors.Errorf("%v: %s", err, log[:n])
+	}
+	return -1, err
+}
+
+// bytesIndexZero returns the length of a NUL terminated string
+func bytesIndexZero(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// bpfLinkCreate attaches an XDP program to an interface, in driver mode if
+// the driver supports it and generic mode otherwise, until the link is closed
+func bpfLinkCreate(prog, ifindex int) (int, error) {
+	attr := struct{ progFD, ifindex, attachType, flags uint32 }{uint32(prog), uint32(ifindex), unix.BPF_XDP, 0}
+	return bpf(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
@@ -0,0 +1,22 @@
+//go:build !linux || !safeudp_xdp
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-16 13:52:40
+@Description: AF_XDP stubs for regular builds
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import "github.com/pkg/errors"
+
+// xdpEnabled is true in builds with the safeudp_xdp tag on linux
+const xdpEnabled = false
+
+// xdpReceiver is the AF_XDP receive path of a listener, never set here
+type xdpReceiver struct{}
+
+func (l *Listener) startXDP(iface string, queues int) error {
+	return errors.WithStack(errXDPDisabled)
+}
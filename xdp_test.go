@@ -0,0 +1,72 @@
+//go:build linux && safeudp_xdp
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-16 13:52:40
+@Description: AF_XDP receive path tests
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestXDP 测试监听器经AF_XDP在回环接口上收包
+func TestXDP(t *testing.T) {
+	config := &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1, XDPInterface: "lo"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenWithConfig("127.0.0.1:0", config)
+	if err != nil {
+		t.Skip("AF_XDP not available:", err)
+	}
+	defer l.Close()
+	cli, err := DialWithConfig(l.Addr().String(), &Config{NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	msg := make([]byte, 256*1024)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	go cli.Write(msg)
+	got := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo mismatch")
+	}
+	if l.xdp.received.Load() == 0 {
+		t.Fatal("no datagrams received through AF_XDP")
+	}
+
+	// 关闭后程序卸载，数据包回到套接字
+	l.Close()
+	x := l.xdp
+	x.wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+	l2, err := ListenWithConfig(l.Addr().String(), config)
+	if err != nil {
+		t.Fatal("program still attached:", err)
+	}
+	l2.Close()
+}
@@ -0,0 +1,227 @@
+//go:build linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-10-16 19:14:50
+@Description: MSG_ZEROCOPY transmission
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// zeroCopyMaxPending is the number of buffers held for the kernel, packets are
+// copied as usual beyond it until completions arrive
+const zeroCopyMaxPending = 4096
+
+// zeroCopyBuffer is a buffer the kernel may still read from
+type zeroCopyBuffer struct {
+	id  uint32 // sequence number of the send
+	buf []byte
+}
+
+// zeroCopy sends packets with MSG_ZEROCOPY, and holds their buffers until the
+// kernel reports the completion on the error queue. It is only used by tx.
+type zeroCopy struct {
+	rc    syscall.RawConn
+	inet6 bool
+
+	pending []zeroCopyBuffer // in order of sending
+	next    uint32           // sequence number of the next zero copy send
+	oob     []byte
+}
+
+// enableZeroCopy sets SO_ZEROCOPY on 'conn', and reports whether it is supported
+func enableZeroCopy(conn net.PacketConn) bool {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return false
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1)
+	}); err != nil {
+		return false
+	}
+	return sockErr == nil
+}
+
+func newZeroCopy(conn net.PacketConn) *zeroCopy {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	z := &zeroCopy{rc: rc, oob: make([]byte, 128)}
+	if addr, ok := uc.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		z.inet6 = true
+	}
+	return z
+}
+
+// sockaddr converts the destination for the socket family
+func (z *zeroCopy) sockaddr(addr net.Addr) unix.Sockaddr {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	if !z.inet6 {
+		if ip4 := ua.IP.To4(); ip4 != nil {
+			sa := &unix.SockaddrInet4{Port: ua.Port}
+			copy(sa.Addr[:], ip4)
+			return sa
+		}
+		return nil
+	}
+	sa := &unix.SockaddrInet6{Port: ua.Port}
+	copy(sa.Addr[:], ua.IP.To16())
+	if ua.Zone != "" {
+		if ifi, err := net.InterfaceByName(ua.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return sa
+}
+
+// send transmits the packets, and takes the buffers of the packets sent without
+// a copy by setting them to nil. It returns the number of packets sent.
+func (z *zeroCopy) send(txqueue []ipv4.Message) (sent int, nbytes int, err error) {
+	z.reap()
+	for k := range txqueue {
+		buf := txqueue[k].Buffers[0]
+		sa := z.sockaddr(txqueue[k].Addr)
+		if sa == nil {
+			return sent, nbytes, unix.EAFNOSUPPORT
+		}
+
+		flags := unix.MSG_ZEROCOPY
+		if len(z.pending) >= zeroCopyMaxPending {
+			flags = 0
+		}
+
+		var sendErr error
+		if err := z.rc.Write(func(fd uintptr) bool {
+			sendErr = unix.Sendmsg(int(fd), buf, txqueue[k].OOB, sa, flags)
+			if sendErr == unix.ENOBUFS && flags != 0 {
+				// out of locked memory for pinned pages, copy this one
+				flags = 0
+				sendErr = unix.Sendmsg(int(fd), buf, txqueue[k].OOB, sa, flags)
+			}
+			return sendErr != unix.EAGAIN
+		}); err != nil {
+			return sent, nbytes, err
+		}
+		if sendErr != nil {
+			return sent, nbytes, sendErr
+		}
+
+		if flags != 0 {
+			z.pending = append(z.pending, zeroCopyBuffer{z.next, buf})
+			z.next++
+			txqueue[k].Buffers[0] = nil
+		}
+		sent++
+		nbytes += len(buf)
+	}
+	return sent, nbytes, nil
+}
+
+// reap reads the completions from the error queue and recycles the buffers
+func (z *zeroCopy) reap() {
+	for len(z.pending) > 0 {
+		var n int
+		var recvErr error
+		if err := z.rc.Control(func(fd uintptr) {
+			_, n, _, _, recvErr = unix.Recvmsg(int(fd), nil, z.oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		}); err != nil || recvErr != nil {
+			break
+		}
+
+		msgs, err := unix.ParseSocketControlMessage(z.oob[:n])
+		if err != nil {
+			break
+		}
+		for _, m := range msgs {
+			if !(m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) &&
+				!(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR) {
+				continue
+			}
+			if len(m.Data) < int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+				continue
+			}
+			ee := (*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if ee.Origin != unix.SO_EE_ORIGIN_ZEROCOPY {
+				continue
+			}
+			// SO_EE_CODE_ZEROCOPY_COPIED in ee.Code tells the kernel copied
+			// anyway, such as on loopback, the buffers are released the same
+			z.release(ee.Info, ee.Data)
+		}
+	}
+}
+
+// release recycles the buffers of the sends in the range [lo, hi]
+func (z *zeroCopy) release(lo, hi uint32) {
+	n := 0
+	for _, p := range z.pending {
+		if _itimediff(p.id, lo) >= 0 && _itimediff(p.id, hi) <= 0 {
+			xmitBuf.Put(p.buf)
+			continue
+		}
+		z.pending[n] = p
+		n++
+	}
+	clear(z.pending[n:])
+	z.pending = z.pending[:n]
+}
+
+// zeroCopyTx sends the packets without copying if enabled, it returns the
+// number of packets sent, the rest is sent by the other methods.
+func (s *UDPSession) zeroCopyTx(txqueue []ipv4.Message) int {
+	z := s.zc
+	if !s.zeroCopy.Load() {
+		if z != nil {
+			// keep reaping until the kernel has released all the buffers
+			if z.reap(); len(z.pending) == 0 {
+				s.zc = nil
+			}
+		}
+		return 0
+	}
+
+	if z == nil {
+		if z = newZeroCopy(s.conn); z == nil {
+			s.zeroCopy.Store(false)
+			return 0
+		}
+		s.zc = z
+	}
+
+	sent, nbytes, err := z.send(txqueue)
+	if err != nil {
+		s.zeroCopy.Store(false)
+	}
+	atomic.AddUint64(&s.Snmp().OutPkts, uint64(sent))
+	atomic.AddUint64(&s.stats.OutPkts, uint64(sent))
+	atomic.AddUint64(&s.Snmp().OutBytes, uint64(nbytes))
+	atomic.AddUint64(&s.stats.OutBytes, uint64(nbytes))
+	return sent
+}
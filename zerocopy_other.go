@@ -0,0 +1,25 @@
+//go:build !linux
+
+/*
+@Author: Lzww
+@LastEditTime: 2025-9-27 22:15:36
+@Description: MSG_ZEROCOPY transmission, unsupported
+@Language: Go 1.23.4
+*/
+
+package safeudp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// zeroCopy is the state of zero copy transmission, unused
+type zeroCopy struct{}
+
+// enableZeroCopy reports false, MSG_ZEROCOPY is linux only
+func enableZeroCopy(conn net.PacketConn) bool { return false }
+
+// zeroCopyTx never sends, zero copy cannot be enabled
+func (s *UDPSession) zeroCopyTx(txqueue []ipv4.Message) int { return 0 }